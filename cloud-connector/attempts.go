@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	cloud_task_registry "github.com/wndrws/cloud-optimization-suite/cloud-task-registry"
+)
+
+// executorInstance tells the attempts of different connector instances apart, serverless containers have
+// a unique host name per instance
+func executorInstance() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return hostname
+}
+
+// finishAttempt records the outcome of the attempt of the stage when the handler returns. The request context
+// may be already expired, which is likely the very reason of the error.
+func finishAttempt(
+	ctx context.Context,
+	stage *cloud_task_registry.Stage,
+	attempt cloud_task_registry.StageAttempt,
+	appErr *AppError,
+) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), errorReportingTimeout)
+	defer cancel()
+	status := stage.Status
+	if appErr != nil {
+		status = cloud_task_registry.StageStatus_Error
+		attempt.Error = fmt.Sprintf("%s (%v)", appErr.Message, appErr.Error)
+	}
+	if err := taskRegistry.FinishStageAttempt(ctx, stage, attempt, status); err != nil {
+		log.Println("Couldn't record attempt", attempt.N, "of the stage (non-critical error):", err)
+	}
+}
+
+// markLastAttemptLost finishes the attempt of the connector whose stage has been taken over
+func markLastAttemptLost(ctx context.Context, stage *cloud_task_registry.Stage) {
+	if len(stage.Attempts) == 0 {
+		return
+	}
+	last := stage.Attempts[len(stage.Attempts)-1]
+	if last.Status != cloud_task_registry.StageStatus_InProgress {
+		return
+	}
+	last.Error = "the lease expired, the executor is presumed dead"
+	if err := taskRegistry.FinishStageAttempt(ctx, stage, last, cloud_task_registry.StageStatus_Error); err != nil {
+		log.Println("Couldn't record the lost attempt", last.N, "of the stage (non-critical error):", err)
+	}
+}
+
+// giveUpStage fails the stage for good once it has been attempted max_attempts times, and reports the task run
+// as finished, so that the runner stops waiting for it and sees the failed stage
+func giveUpStage(
+	ctx context.Context,
+	stage *cloud_task_registry.Stage,
+	taskRun *cloud_task_registry.TaskRun,
+	received *cloud_task_registry.TaskMessage,
+) *AppError {
+	log.Println("Stage", stage.Name, "of task run", taskRun.UUID, "has been attempted", len(stage.Attempts),
+		"times out of", stage.MaxAttempts, "- giving up")
+	if stage.Status == cloud_task_registry.StageStatus_InProgress {
+		// The executor of the last attempt is presumably dead (see IsStageLeaseExpired)
+		markLastAttemptLost(ctx, stage)
+		err := taskRegistry.UpdateStageStatus(ctx, stage, cloud_task_registry.StageStatus_Error)
+		if errors.Is(err, cloud_task_registry.ErrTransitionConflict) {
+			log.Println("Cannot give up the stage, another delivery has changed it:", err)
+			return nil
+		}
+		if err != nil {
+			msg := fmt.Sprintf("Unable to update status for stage %s for task %s", stage.Name, stage.TaskRunUUID)
+			return &AppError{err, msg, http.StatusInternalServerError, stage}
+		}
+	}
+	comment := fmt.Sprintf("Gave up after %d attempts (max_attempts is %d)", len(stage.Attempts), stage.MaxAttempts)
+	if err := taskRegistry.UpdateStageComment(ctx, stage, comment); err != nil {
+		log.Println("Couldn't update the stage comment (non-critical error):", err)
+	}
+	message := received.PassOn(taskRun, stage.Name)
+	if err := taskRegistry.FinishTaskRun(ctx, message); err != nil {
+		msg := fmt.Sprintf("error finishing the task run %s", taskRun.UUID)
+		// The stage has failed already, there is no point in setting the error status again
+		return &AppError{err, msg, http.StatusInternalServerError, nil}
+	}
+	return nil
+}
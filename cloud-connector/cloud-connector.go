@@ -1,13 +1,16 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"maps"
 	"net/http"
 	"os"
 	"os/exec"
+	"slices"
 	"strings"
 	"time"
 
@@ -23,28 +26,46 @@ type AppError struct {
 
 var taskRegistry *cloud_task_registry.CloudTaskRegistry
 
+// errorReportingTimeout bounds setting the error status to the stage after the request has failed
+const errorReportingTimeout = 10 * time.Second
+
 func main() {
 	if os.Getenv("SHOW_CPU_INFO") != "" {
 		logCpuInformation()
 	}
-	port := os.Getenv("PORT")
-	if port == "" {
-		log.Fatal("PORT environment variable not set")
-	}
-
 	pipelineStage := flag.String("pipeline-stage", "", "Stage of the pipeline")
 	configFilePath := flag.String("config-file-path", "/tmp/config", "Path to the config file (internal)")
 	inputFilePath := flag.String("input-file-path", "/tmp/input", "Path to the input file (internal)")
 	outputFilePath := flag.String("output-file-path", "/tmp/output", "Path to the output file (internal)")
+	resultsFilePath := flag.String("results-file-path", "", "Path to the file with k=v results that a non-final stage publishes, if it exists (internal)")
 	commandFilePath := flag.String("command-file-path", "/tmp/run-command.sh", "Path to the command file (internal)")
 	dynamoDocApiEndpoint := flag.String("dynamo-docapi-endpoint", "", "DynamoDB Document API endpoint URL for task registry")
+	artifactStoreURL := flag.String("artifact-store", "", "Artifact storage, e.g. 'file:///mnt/shared/artifacts' (S3 by default)")
+	registryURL := flag.String("registry", "", "Task registry backend, e.g. 'sqlite:///path/to/registry.db' (DynamoDB, S3 and SQS by default)")
+	migrateOnly := flag.Bool("migrate-only", false, "Apply task registry schema migrations and exit")
+	skipMigrate := flag.Bool("skip-migrate", false, "Don't check the task registry schema on startup (use after --migrate-only)")
 	extraArtifacts := flag.String("extra-artifacts", "", "Comma-delimited paths to extra artifacts (files and/or folders) to upload to S3")
+	inputs := flag.String("inputs", "", "Comma-delimited name=path of the named outputs of the previous stages to download, e.g. 'summary=/tmp/summary.csv,cfd.mesh=/tmp/mesh/' (a trailing '/' extracts the archive into the folder)")
+	outputs := flag.String("outputs", "", "Comma-delimited name=path of the named outputs (files and/or folders) to upload to S3, e.g. 'summary=/tmp/summary.csv,fields=/tmp/fields'")
 	maxTimeForExtrasArchiving := flag.Int("max-archiving-time", 90, "Max time that is expected to be spent on archiving extra artifacts")
+	flag.DurationVar(&stageLease, "stage-lease", cloud_task_registry.DefaultStageLease, "How long the stage is deemed alive after a heartbeat, a redelivered task run takes over a stage whose lease has expired")
 	timeout := flag.Int("timeout", 600, "Request processing timeout (in seconds) that is imposed by the cloud execution environment")
 	// If there is less than [maxTimeForExtrasArchiving] seconds before [timout], extra artifacts will not be compressed and uploaded to S3
+	registryConfigFlags := cloud_task_registry.RegisterConfigFlags(flag.CommandLine)
 
 	flag.Parse()
 
+	if *migrateOnly {
+		connectToRegistry(*dynamoDocApiEndpoint, *registryURL, *artifactStoreURL, registryConfigFlags, false)
+		log.Println("Task registry schema is up to date")
+		os.Exit(0)
+	}
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		log.Fatal("PORT environment variable not set")
+	}
+
 	// Check for required flags
 	if *pipelineStage == "" {
 		log.Fatal("--pipeline-stage arg is mandatory, this must be the name of this stage")
@@ -52,31 +73,36 @@ func main() {
 	if *commandFilePath == "" {
 		log.Fatal("--command-file-path arg is mandatory, this must be the path to the command to execute")
 	}
-	if *dynamoDocApiEndpoint == "" {
-		log.Fatal("--dynamo-docapi-endpoint arg is mandatory, this must be DynamoDB Document API endpoint URL for task registry")
-	}
-
-	if registry, err := cloud_task_registry.New(*dynamoDocApiEndpoint); err != nil {
-		log.Fatalf("Could not connect to the Cloud Task Registry: %s\n", err.Error())
-	} else {
-		log.Println("Connected to the Cloud Task Registry", *dynamoDocApiEndpoint)
-		taskRegistry = registry
-	}
+	taskRegistry = connectToRegistry(*dynamoDocApiEndpoint, *registryURL, *artifactStoreURL, registryConfigFlags, *skipMigrate)
 
 	extraArtifactsPaths := strings.Split(*extraArtifacts, ",")
+	namedInputs, err := parseNamedPaths(*inputs)
+	if err != nil {
+		log.Fatalf("Invalid --inputs: %s\n", err.Error())
+	}
+	namedOutputs, err := parseNamedPaths(*outputs)
+	if err != nil {
+		log.Fatalf("Invalid --outputs: %s\n", err.Error())
+	}
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		// The cloud execution environment stops the request after --timeout, so there is no point in waiting longer
+		ctx, cancel := context.WithTimeout(r.Context(), time.Duration(*timeout)*time.Second)
+		defer cancel()
 		timeoutRisk := false
 		timer := time.AfterFunc(time.Duration(*timeout-*maxTimeForExtrasArchiving)*time.Second, func() { timeoutRisk = true })
-		appErr := handler(w, r, *pipelineStage, *configFilePath, *inputFilePath, *outputFilePath, *commandFilePath, extraArtifactsPaths, &timeoutRisk)
+		appErr := handler(ctx, w, r, *pipelineStage, *configFilePath, *inputFilePath, *outputFilePath, *resultsFilePath, *commandFilePath, extraArtifactsPaths, namedInputs, namedOutputs, &timeoutRisk)
 		if appErr != nil {
 			log.Printf("Error: %s (%v)", appErr.Message, appErr.Error)
 			http.Error(w, appErr.Message, appErr.Code)
 			if appErr.Stage != nil {
 				log.Println("Setting stage status to", cloud_task_registry.StageStatus_Error)
-				if err := taskRegistry.UpdateStageStatus(appErr.Stage, cloud_task_registry.StageStatus_Error); err != nil {
+				// The request context may be already expired, which is likely the very reason of the error
+				errCtx, cancelErrCtx := context.WithTimeout(context.WithoutCancel(ctx), errorReportingTimeout)
+				if err := taskRegistry.UpdateStageStatus(errCtx, appErr.Stage, cloud_task_registry.StageStatus_Error); err != nil {
 					log.Printf("Error updating stage status: %v", err)
 				}
+				cancelErrCtx()
 			}
 		}
 		timer.Stop()
@@ -88,109 +114,200 @@ func main() {
 	}
 }
 
+func connectToRegistry(
+	dynamoDocApiEndpoint, registryURL, artifactStoreURL string,
+	registryConfigFlags *cloud_task_registry.ConfigFlags,
+	skipMigrate bool,
+) *cloud_task_registry.CloudTaskRegistry {
+	registryOptions, err := cloud_task_registry.OptionsFromURL(registryURL)
+	if err != nil {
+		log.Fatalf("Could not configure the Cloud Task Registry: %s\n", err.Error())
+	}
+	artifactOptions, err := cloud_task_registry.ArtifactOptionsFromURL(artifactStoreURL)
+	if err != nil {
+		log.Fatalf("Could not configure the Cloud Task Registry artifact store: %s\n", err.Error())
+	}
+	registryOptions = append(registryOptions, artifactOptions...)
+	registryConfig, err := registryConfigFlags.Load()
+	if err != nil {
+		log.Fatalf("Could not load the Cloud Task Registry configuration: %s\n", err.Error())
+	}
+	registryOptions = append(registryOptions, cloud_task_registry.WithConfig(registryConfig))
+	if skipMigrate {
+		registryOptions = append(registryOptions, cloud_task_registry.WithoutMigrations())
+	}
+	registry, err := cloud_task_registry.New(dynamoDocApiEndpoint, registryOptions...)
+	if err != nil {
+		log.Fatalf("Could not connect to the Cloud Task Registry: %s\n", err.Error())
+	}
+	log.Println("Connected to the Cloud Task Registry", dynamoDocApiEndpoint, registryURL, registryConfig)
+	return registry
+}
+
 func handler(
+	ctx context.Context,
 	w http.ResponseWriter,
 	r *http.Request,
-	pipelineStage, configPath, inputFilePath, outputFilePath, commandFilePath string,
+	pipelineStage, configPath, inputFilePath, outputFilePath, resultsFilePath, commandFilePath string,
 	extraArtifactsPaths []string,
+	namedInputs, namedOutputs map[string]string,
 	timeoutRisk *bool,
-) *AppError {
-	taskId, appErr := extractSQSMessageBodyFromYandexCloudTriggerRequest(r)
+) (handlerErr *AppError) {
+	received, appErr := extractTaskMessageFromYandexCloudTriggerRequest(r)
 	if appErr != nil {
 		return appErr
 	}
+	taskId := received.TaskRunUUID
 
 	if taskId == "" {
 		msg := fmt.Sprintf("Expected task run UUID in SQS message body but it was empty! %v", r)
 		return &AppError{errors.New(msg), msg, http.StatusBadRequest, nil}
 	}
 
-	stage, errGetStage := taskRegistry.GetStageByName(taskId, pipelineStage)
+	if received.TargetStage != "" && received.TargetStage != pipelineStage {
+		log.Println("The message is addressed to stage", received.TargetStage, "but this is stage", pipelineStage,
+			"- check the trigger of the queue. Processing anyway.")
+	}
+	if wait := received.QueueWaitTime(time.Now()); wait > 0 {
+		log.Println("Task run", taskId, "has waited in the queue for", wait.Round(time.Millisecond),
+			"(trace ID", received.TraceID+")")
+	}
+
+	stage, errGetStage := taskRegistry.GetStageByName(ctx, taskId, pipelineStage)
+	if errors.Is(errGetStage, cloud_task_registry.ErrNotFound) && taskRunDeleted(ctx, taskId) {
+		log.Println("Task run", taskId, "has been deleted from the registry. Cloud Connector will do nothing.")
+		return nil
+	}
 	if errGetStage != nil {
 		msg := fmt.Sprintf("Unable to get stage %s for task %s", pipelineStage, taskId)
 		return &AppError{errGetStage, msg, http.StatusInternalServerError, stage}
 	}
 
-	taskRun, errGetTask := taskRegistry.GetTaskRun(stage.TaskRunUUID)
+	taskRun, errGetTask := taskRegistry.GetTaskRun(ctx, stage.TaskRunUUID)
 	if errGetTask != nil {
 		msg := fmt.Sprintf("couldn't get task run %s from the task registry", stage.TaskRunUUID)
 		return &AppError{errGetTask, msg, http.StatusInternalServerError, stage}
 	}
 
-	if stage.Status == cloud_task_registry.StageStatus_Success {
-		log.Println("This stage has already finished with successful status! It means that task run "+
-			"duplication occurred in SQS - this should not happen in normal circumstances! "+
-			"Task run ID was", taskRun.UUID, "for task", taskRun.TaskID,
-			". Cloud Connector will do nothing.")
+	taskWasCancelled, err := taskRegistry.IsCancelled(ctx, taskRun.UUID)
+	if taskWasCancelled {
+		markAsCancelled(ctx, stage)
 		return nil
 	}
+	if err != nil {
+		log.Println("Couldn't check if task run is cancelled. Assuming it is not... The error was", err)
+	}
 
-	if stage.Status == cloud_task_registry.StageStatus_InProgress {
-		log.Println("This stage is already in progress! It means that task run "+
+	if cloud_task_registry.AttemptsExhausted(stage) && (stage.Status == cloud_task_registry.StageStatus_Error ||
+		cloud_task_registry.IsStageLeaseExpired(stage, time.Now())) {
+		return giveUpStage(ctx, stage, taskRun, received)
+	}
+
+	if started, err := startStage(ctx, stage); err != nil {
+		return err
+	} else if !started {
+		log.Println("This stage is already in progress or finished! It means that task run "+
 			"duplication occurred in SQS - this should not happen in normal circumstances! "+
 			"Task run ID was", taskRun.UUID, "for task", taskRun.TaskID,
 			". Cloud Connector will do nothing.")
 		return nil
 	}
 
-	taskWasCancelled, err := taskRegistry.IsCancelled(taskRun.UUID)
-	if taskWasCancelled {
-		markAsCancelled(stage)
-		return nil
-	}
+	ctx, heartbeat := startStageHeartbeat(ctx, stage)
+	defer heartbeat.stop()
+	defer func() {
+		// Whatever has failed, the stage must be left to the connector that has taken it over
+		if handlerErr != nil && heartbeat.lost() {
+			handlerErr = leaseLostError(stage)
+		}
+	}()
+
+	// Recorded once the extra artifacts are uploaded, i.e. after the deferred upload below
+	var artifacts []string
+	attempt, err := taskRegistry.StartStageAttempt(ctx, stage, executorInstance())
 	if err != nil {
-		log.Println("Couldn't check if task run is cancelled. Assuming it is not... The error was", err)
+		log.Println("Couldn't record the attempt of the stage (non-critical error):", err)
+	} else {
+		defer func() {
+			attempt.Artifacts = artifacts
+			finishAttempt(ctx, stage, attempt, handlerErr)
+		}()
 	}
 
-	if err := startStage(stage); err != nil {
+	if err := checkNamedArtifacts(stage, namedInputs, namedOutputs); err != nil {
 		return err
 	}
 
 	if len(extraArtifactsPaths) > 0 && extraArtifactsPaths[0] != "" {
 		defer func() {
 			if !*timeoutRisk {
-				uploadExtraArtifactsAndUpdateStageComment(extraArtifactsPaths, taskRun, stage)
+				uploaded := uploadExtraArtifactsAndUpdateStageComment(ctx, extraArtifactsPaths, taskRun, stage)
+				artifacts = append(artifacts, uploaded...)
 			} else {
 				log.Println("Extra artifacts will not be uploaded due to timeout risk!")
 			}
 		}()
 	}
 
-	if err := downloadConfigFileIfSpecified(stage, configPath); err != nil {
+	if err := downloadConfigFileIfSpecified(ctx, stage, configPath); err != nil {
+		return err
+	}
+
+	if err := downloadInputFileIfSpecified(ctx, stage, inputFilePath); err != nil {
 		return err
 	}
 
-	if err := downloadInputFileIfSpecified(stage, inputFilePath); err != nil {
+	if err := downloadNamedInputs(ctx, stage, namedInputs); err != nil {
 		return err
 	}
 
 	command, errReadCommandFile := readCommandFile(commandFilePath, stage)
-	if err != nil {
+	if errReadCommandFile != nil {
 		return errReadCommandFile
 	}
 
-	if err := startCommandAndWait(command, stage, taskRun.Parameters); err != nil {
-		return err
+	attempt.ExitCode, appErr = startCommandAndWait(ctx, command, stage, taskRun.Parameters)
+	if appErr != nil {
+		return appErr
+	}
+	if heartbeat.lost() {
+		return leaseLostError(stage)
 	}
 
-	if taskWasCancelled, _ := taskRegistry.IsCancelled(taskRun.UUID); taskWasCancelled {
+	if taskWasCancelled, _ := taskRegistry.IsCancelled(ctx, taskRun.UUID); taskWasCancelled {
 		log.Println("Setting cancellation status to the stage", stage.Name, "for task run", stage.TaskRunUUID)
-		err := taskRegistry.UpdateStageStatus(stage, cloud_task_registry.StageStatus_Cancelled)
+		heartbeat.release()
+		err := taskRegistry.UpdateStageStatus(ctx, stage, cloud_task_registry.StageStatus_Cancelled)
 		if err != nil {
 			log.Println("Unable to update status for stage", stage.Name, "for task run",
 				stage.TaskRunUUID, "(non-critical error)", err)
 		}
 	} else {
-		s3PathForOutput, appErr := uploadOutputFile(outputFilePath, taskRun, stage)
+		s3PathForOutput, appErr := uploadOutputFile(ctx, outputFilePath, taskRun, stage)
 		if appErr != nil {
 			return appErr
 		}
+		if s3PathForOutput != "" {
+			artifacts = append(artifacts, s3PathForOutput)
+		}
 
-		if err := handoverTask(stage, taskRun, s3PathForOutput, outputFilePath); err != nil {
+		if err := uploadNamedOutputs(ctx, namedOutputs, taskRun, stage); err != nil {
 			return err
 		}
+		for _, name := range slices.Sorted(maps.Keys(namedOutputs)) {
+			artifacts = append(artifacts, stage.Outputs[name])
+		}
 
-		if err := finishStage(stage, taskRun); err != nil {
+		if err := publishResultsIfPresent(ctx, resultsFilePath, taskRun, stage); err != nil {
+			return err
+		}
+
+		if err := handoverTask(ctx, stage, taskRun, received, s3PathForOutput, outputFilePath); err != nil {
+			return err
+		}
+
+		heartbeat.release()
+		if err := finishStage(ctx, stage, taskRun); err != nil {
 			return err
 		}
 	}
@@ -200,34 +317,59 @@ func handler(
 	return nil
 }
 
-func markAsCancelled(stage *cloud_task_registry.Stage) {
+func markAsCancelled(ctx context.Context, stage *cloud_task_registry.Stage) {
 	log.Println("Setting cancelled status to the stage", stage.Name, "for task run", stage.TaskRunUUID)
-	err := taskRegistry.UpdateStageStatus(stage, cloud_task_registry.StageStatus_Cancelled)
+	err := taskRegistry.UpdateStageStatus(ctx, stage, cloud_task_registry.StageStatus_Cancelled)
 	if err != nil {
 		log.Println("Unable to update status for stage", stage.Name, "for task run",
 			stage.TaskRunUUID, "(non-critical error)", err)
 	}
 }
 
-func startStage(stage *cloud_task_registry.Stage) *AppError {
-	if err := taskRegistry.UpdateStageStatus(stage, cloud_task_registry.StageStatus_InProgress); err != nil {
+// taskRunDeleted tells whether the task run is gone, so that the pending messages about it can be dropped
+// (see DeleteTaskRun). A stage missing from an existing run is a misconfiguration and is reported as an error.
+func taskRunDeleted(ctx context.Context, taskRunUUID string) bool {
+	_, err := taskRegistry.GetTaskRun(ctx, taskRunUUID)
+	return errors.Is(err, cloud_task_registry.ErrNotFound)
+}
+
+// startStage moves the stage to InProgress and takes its lease. It returns false if another delivery of the same
+// task run has already taken the stage (or the stage has finished), so that this one must be dropped.
+// A stage whose lease has expired is taken over, as its connector is presumably dead.
+func startStage(ctx context.Context, stage *cloud_task_registry.Stage) (bool, *AppError) {
+	var err error
+	if cloud_task_registry.IsStageLeaseExpired(stage, time.Now()) {
+		log.Println("The lease of the stage expired at", stage.TLeaseExpiryUTC.Format(time.DateTime),
+			"(last heartbeat at", stage.THeartbeatUTC.Format(time.DateTime)+"), taking the stage over")
+		if err = taskRegistry.TakeOverStage(ctx, stage, stageLease); err == nil {
+			markLastAttemptLost(ctx, stage)
+		}
+	} else {
+		err = taskRegistry.StartStageWithLease(ctx, stage, stageLease)
+	}
+	// A failed condition means that another delivery has changed the stage or its lease since it was read
+	if errors.Is(err, cloud_task_registry.ErrTransitionConflict) || errors.Is(err, cloud_task_registry.ErrConditionFailed) {
+		log.Println("Cannot start the stage:", err)
+		return false, nil
+	}
+	if err != nil {
 		msg := fmt.Sprintf("Unable to update status for stage %s for task %s", stage.Name, stage.TaskRunUUID)
-		return &AppError{err, msg, http.StatusInternalServerError, stage}
+		return false, &AppError{err, msg, http.StatusInternalServerError, stage}
 	}
-	if err := taskRegistry.UpdateStageStartTime(stage, time.Now().UTC()); err != nil {
+	if err := taskRegistry.UpdateStageStartTime(ctx, stage, time.Now().UTC()); err != nil {
 		msg := fmt.Sprintf("Unable to update start time for stage %s for task %s", stage.Name, stage.TaskRunUUID)
-		return &AppError{err, msg, http.StatusInternalServerError, stage}
+		return true, &AppError{err, msg, http.StatusInternalServerError, stage}
 	}
-	return nil
+	return true, nil
 }
 
-func finishStage(stage *cloud_task_registry.Stage, task *cloud_task_registry.TaskRun) *AppError {
-	if err := taskRegistry.UpdateStageStatus(stage, cloud_task_registry.StageStatus_Success); err != nil {
+func finishStage(ctx context.Context, stage *cloud_task_registry.Stage, task *cloud_task_registry.TaskRun) *AppError {
+	if err := taskRegistry.UpdateStageStatus(ctx, stage, cloud_task_registry.StageStatus_Success); err != nil {
 		msg := fmt.Sprintf("error setting successful status to this stage, task %s", task.UUID)
 		return &AppError{err, msg, http.StatusInternalServerError, stage}
 	}
 
-	if err := taskRegistry.UpdateStageFinishTime(stage, time.Now().UTC()); err != nil {
+	if err := taskRegistry.UpdateStageFinishTime(ctx, stage, time.Now().UTC()); err != nil {
 		msg := fmt.Sprintf("Unable to update finish time for stage %s for task %s", stage.Name, stage.TaskRunUUID)
 		return &AppError{err, msg, http.StatusInternalServerError, stage}
 	}
@@ -235,14 +377,18 @@ func finishStage(stage *cloud_task_registry.Stage, task *cloud_task_registry.Tas
 }
 
 func handoverTask(
+	ctx context.Context,
 	stage *cloud_task_registry.Stage,
 	taskRun *cloud_task_registry.TaskRun,
+	received *cloud_task_registry.TaskMessage,
 	s3PathForOutput string,
 	outputFilePath string,
 ) *AppError {
+	// The trace and the reply queue of the runner are passed on along the pipeline
+	message := received.PassOn(taskRun, stage.Name)
 	if len(stage.Next) > 0 {
 		for _, nextStageName := range stage.Next {
-			nextStage, errGetNextStage := taskRegistry.GetStageByName(stage.TaskRunUUID, nextStageName)
+			nextStage, errGetNextStage := taskRegistry.GetStageByName(ctx, stage.TaskRunUUID, nextStageName)
 			if errGetNextStage != nil {
 				msg := "error getting next stage"
 				return &AppError{errGetNextStage, msg, http.StatusInternalServerError, stage}
@@ -254,14 +400,14 @@ func handoverTask(
 					"pass it further. Task run ID was", taskRun.UUID, "for task", taskRun.TaskID)
 			}
 			if s3PathForOutput != "" {
-				if err := taskRegistry.UpdateStageInput(nextStage, s3PathForOutput); err != nil {
+				if err := taskRegistry.UpdateStageInput(ctx, nextStage, s3PathForOutput, stage.OutputSHA256); err != nil {
 					msg := fmt.Sprintf("error setting input for the next stage %v", nextStage)
 					return &AppError{err, msg, http.StatusInternalServerError, stage}
 				}
 			} else {
 				log.Println("No output file was uploaded to S3, so input for the next stage will be absent!")
 			}
-			if err := taskRegistry.PassTaskToStage(nextStage); err != nil {
+			if err := taskRegistry.PassTaskToStage(ctx, nextStage, message); err != nil {
 				msg := fmt.Sprintf("error passing task to the next stage %v", nextStage)
 				return &AppError{err, msg, http.StatusInternalServerError, stage}
 			}
@@ -269,18 +415,19 @@ func handoverTask(
 	} else {
 		log.Println("This stage is final in the task pipeline. Reading results...")
 		// output file is required to be in format "k=v" per line where k is an objective name
-		resultsMap, errReadResults := readKeyValueFile(outputFilePath)
+		resultsMap, errReadResults := readResultsFile(outputFilePath)
 		if errReadResults != nil {
 			msg := "error reading output files to get results"
 			return &AppError{errReadResults, msg, http.StatusInternalServerError, stage}
 		} else {
 			log.Printf("Read results: %v\n", resultsMap)
 		}
-		if err := taskRegistry.PutTaskRunResults(taskRun, resultsMap); err != nil {
+		// The results are merged, so that they don't override the ones published by previous stages
+		if err := taskRegistry.MergeTaskRunResults(ctx, taskRun, stage.Name, resultsMap); err != nil {
 			msg := fmt.Sprintf("error setting results for the task run %s", taskRun.UUID)
 			return &AppError{err, msg, http.StatusInternalServerError, stage}
 		}
-		if err := taskRegistry.FinishTaskRun(taskRun.UUID); err != nil {
+		if err := taskRegistry.FinishTaskRun(ctx, message); err != nil {
 			msg := fmt.Sprintf("error finishing the task run %s", taskRun.UUID)
 			return &AppError{err, msg, http.StatusInternalServerError, stage}
 		}
@@ -288,6 +435,82 @@ func handoverTask(
 	return nil
 }
 
+// publishResultsIfPresent lets a non-final stage contribute to the task run results, e.g. a mass estimation stage
+// may publish the mass objective while the final CFD stage publishes aerodynamic ones
+func publishResultsIfPresent(
+	ctx context.Context,
+	resultsFilePath string,
+	taskRun *cloud_task_registry.TaskRun,
+	stage *cloud_task_registry.Stage,
+) *AppError {
+	if resultsFilePath == "" || len(stage.Next) == 0 {
+		return nil
+	}
+	if _, err := os.Stat(resultsFilePath); errors.Is(err, os.ErrNotExist) {
+		log.Println("No results file", resultsFilePath, "was produced by this stage")
+		return nil
+	}
+	// The file must not be published again on behalf of the next task run that this instance serves
+	defer os.Remove(resultsFilePath)
+	resultsMap, err := readResultsFile(resultsFilePath)
+	if err != nil {
+		msg := "error reading the results file"
+		return &AppError{err, msg, http.StatusInternalServerError, stage}
+	}
+	log.Printf("Read results: %v\n", resultsMap)
+	if err := taskRegistry.MergeTaskRunResults(ctx, taskRun, stage.Name, resultsMap); err != nil {
+		msg := fmt.Sprintf("error publishing results for the task run %s", taskRun.UUID)
+		return &AppError{err, msg, http.StatusInternalServerError, stage}
+	}
+	return nil
+}
+
+// parseNamedPaths parses "name=path,name=path" of --inputs and --outputs
+func parseNamedPaths(flagValue string) (map[string]string, error) {
+	namedPaths := make(map[string]string)
+	if flagValue == "" {
+		return namedPaths, nil
+	}
+	for _, namedPath := range strings.Split(flagValue, ",") {
+		name, filePath, ok := strings.Cut(namedPath, "=")
+		name, filePath = strings.TrimSpace(name), strings.TrimSpace(filePath)
+		if !ok || name == "" || filePath == "" {
+			return nil, fmt.Errorf("expected name=path, got %q", namedPath)
+		}
+		if _, ok := namedPaths[name]; ok {
+			return nil, fmt.Errorf("name %q is given more than once", name)
+		}
+		namedPaths[name] = filePath
+	}
+	return namedPaths, nil
+}
+
+// checkNamedArtifacts fails fast if the stage declares named inputs or outputs in stages.yaml
+// that don't match the ones given by --inputs and --outputs, i.e. before the command has been run for nothing
+func checkNamedArtifacts(stage *cloud_task_registry.Stage, namedInputs, namedOutputs map[string]string) *AppError {
+	check := func(kind string, declared []string, given map[string]string) *AppError {
+		if len(declared) == 0 {
+			return nil
+		}
+		givenNames := slices.Sorted(maps.Keys(given))
+		declared = slices.Sorted(slices.Values(declared))
+		if !slices.Equal(declared, givenNames) {
+			msg := fmt.Sprintf("stage %s declares %s %v, but cloud-connector is given %v", stage.Name, kind, declared, givenNames)
+			return &AppError{errors.New(msg), msg, http.StatusInternalServerError, stage}
+		}
+		return nil
+	}
+	for name := range namedOutputs {
+		if err := cloud_task_registry.CheckOutputName(name); err != nil {
+			return &AppError{err, err.Error(), http.StatusInternalServerError, stage}
+		}
+	}
+	if err := check("inputs", stage.InputNames, namedInputs); err != nil {
+		return err
+	}
+	return check("outputs", stage.OutputNames, namedOutputs)
+}
+
 func logCpuInformation() {
 	cmd := exec.Command("lscpu")
 	cmd.Stdout = os.Stdout
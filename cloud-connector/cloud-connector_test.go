@@ -0,0 +1,479 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	cloud_task_registry "github.com/wndrws/cloud-optimization-suite/cloud-task-registry"
+)
+
+// runUUID is delivered as the bare message body sent by older versions, unless a test sends a task message
+const runUUID = "0190d0e4-7c1f-7b2a-9a53-3f0e7f2c1a11"
+
+func TestHandler_MustRunPipelineEndToEndWithInMemoryRegistry(t *testing.T) {
+	// given
+	ctx := context.Background()
+	taskRegistry = cloud_task_registry.NewInMemory()
+	tmpDir := t.TempDir()
+	taskRun := cloud_task_registry.TaskRun{
+		TaskID:     "task",
+		UUID:       runUUID,
+		Parameters: map[string]string{"CONNECTOR_TEST_X": "42"},
+		Status:     cloud_task_registry.TaskRunStatus_Submitted,
+	}
+	mustNotFail(t, taskRegistry.InsertTaskRun(ctx, taskRun))
+	mustNotFail(t, taskRegistry.InsertStage(ctx, cloud_task_registry.Stage{
+		TaskRunUUID: taskRun.UUID, NOrd: 1, Name: "generate", Status: cloud_task_registry.StageInitialStatus,
+		S3Bucket: "bucket", Next: []string{"evaluate"},
+	}))
+	mustNotFail(t, taskRegistry.InsertStage(ctx, cloud_task_registry.Stage{
+		TaskRunUUID: taskRun.UUID, NOrd: 2, Name: "evaluate", Status: cloud_task_registry.StageInitialStatus,
+		S3Bucket: "bucket",
+	}))
+
+	// when
+	runStage(t, tmpDir, taskRun.UUID, "generate", `echo "mass=$CONNECTOR_TEST_X" > "$OUT"`)
+	runStage(t, tmpDir, taskRun.UUID, "evaluate", `cp "$IN" "$OUT"`)
+
+	// then
+	finishedTaskRun, err := taskRegistry.GetTaskRun(ctx, taskRun.UUID)
+	mustNotFail(t, err)
+	if finishedTaskRun.Results["mass"].String() != "42" {
+		t.Errorf("expected result mass=42, got %v", finishedTaskRun.Results)
+	}
+	stages, err := taskRegistry.GetAllStages(ctx, taskRun.UUID)
+	mustNotFail(t, err)
+	for _, stage := range stages {
+		if stage.Status != cloud_task_registry.StageStatus_Success {
+			t.Errorf("expected stage %s to be successful, got %s", stage.Name, stage.Status)
+		}
+	}
+	finishedTaskRunUUID, err := taskRegistry.WaitForPipelineFinish(ctx, taskRun.TaskID, taskRun.UUID)
+	mustNotFail(t, err)
+	if finishedTaskRunUUID != taskRun.UUID {
+		t.Errorf("expected %s to be reported as finished, got %s", taskRun.UUID, finishedTaskRunUUID)
+	}
+}
+
+func TestHandler_MustDropDuplicateDeliveryOfFinishedStage(t *testing.T) {
+	// given
+	ctx := context.Background()
+	taskRegistry = cloud_task_registry.NewInMemory()
+	tmpDir := t.TempDir()
+	taskRun := cloud_task_registry.TaskRun{TaskID: "task", UUID: runUUID, Status: cloud_task_registry.TaskRunStatus_Submitted}
+	mustNotFail(t, taskRegistry.InsertTaskRun(ctx, taskRun))
+	mustNotFail(t, taskRegistry.InsertStage(ctx, cloud_task_registry.Stage{
+		TaskRunUUID: taskRun.UUID, NOrd: 1, Name: "generate", Status: cloud_task_registry.StageInitialStatus,
+		S3Bucket: "bucket",
+	}))
+	counterPath := filepath.Join(tmpDir, "runs")
+	runStage(t, tmpDir, taskRun.UUID, "generate", `echo run >> "`+counterPath+`"; echo "mass=1" > "$OUT"`)
+
+	// when
+	runStage(t, tmpDir, taskRun.UUID, "generate", `echo run >> "`+counterPath+`"; echo "mass=2" > "$OUT"`)
+
+	// then
+	runs, err := os.ReadFile(counterPath)
+	mustNotFail(t, err)
+	if string(runs) != "run\n" {
+		t.Errorf("expected the command to run once, got %q", runs)
+	}
+	finishedTaskRun, err := taskRegistry.GetTaskRun(ctx, taskRun.UUID)
+	mustNotFail(t, err)
+	if finishedTaskRun.Results["mass"].String() != "1" {
+		t.Errorf("expected results of the first delivery, got %v", finishedTaskRun.Results)
+	}
+}
+
+func TestHandler_MustDropMessageAboutDeletedTaskRun(t *testing.T) {
+	// given
+	ctx := context.Background()
+	taskRegistry = cloud_task_registry.NewInMemory()
+	tmpDir := t.TempDir()
+	taskRun := cloud_task_registry.TaskRun{TaskID: "task", UUID: runUUID, Status: cloud_task_registry.TaskRunStatus_Submitted}
+	mustNotFail(t, taskRegistry.InsertTaskRun(ctx, taskRun))
+	mustNotFail(t, taskRegistry.InsertStage(ctx, cloud_task_registry.Stage{
+		TaskRunUUID: taskRun.UUID, NOrd: 1, Name: "generate", Status: cloud_task_registry.StageInitialStatus,
+		S3Bucket: "bucket",
+	}))
+	_, err := taskRegistry.DeleteTaskRun(ctx, taskRun.UUID, false)
+	mustNotFail(t, err)
+	counterPath := filepath.Join(tmpDir, "runs")
+
+	// when
+	appErr := deliverToStage(t, tmpDir, taskRun.UUID, "generate", `echo run >> "`+counterPath+`"`, nil, nil)
+
+	// then
+	if appErr != nil {
+		t.Errorf("expected the message to be dropped, got %s (%v)", appErr.Message, appErr.Error)
+	}
+	if _, err := os.Stat(counterPath); !os.IsNotExist(err) {
+		t.Errorf("expected the command not to run, got %v", err)
+	}
+}
+
+func TestHandler_MustTakeOverStageWithExpiredLease(t *testing.T) {
+	// given
+	ctx := context.Background()
+	taskRegistry = cloud_task_registry.NewInMemory()
+	tmpDir := t.TempDir()
+	taskRun := cloud_task_registry.TaskRun{TaskID: "task", UUID: runUUID, Status: cloud_task_registry.TaskRunStatus_Submitted}
+	mustNotFail(t, taskRegistry.InsertTaskRun(ctx, taskRun))
+	mustNotFail(t, taskRegistry.InsertStage(ctx, cloud_task_registry.Stage{
+		TaskRunUUID: taskRun.UUID, NOrd: 1, Name: "generate", Status: cloud_task_registry.StageInitialStatus,
+		S3Bucket: "bucket",
+	}))
+	// The executor of the first delivery has been killed, its last heartbeat was long ago
+	dead, err := taskRegistry.GetStage(ctx, taskRun.UUID, 1)
+	mustNotFail(t, err)
+	mustNotFail(t, taskRegistry.UpdateStageStatus(ctx, dead, cloud_task_registry.StageStatus_InProgress))
+	mustNotFail(t, taskRegistry.RenewStageLease(ctx, dead, -time.Minute))
+
+	// when
+	runStage(t, tmpDir, taskRun.UUID, "generate", `echo "mass=1" > "$OUT"`)
+
+	// then
+	stage, err := taskRegistry.GetStage(ctx, taskRun.UUID, 1)
+	mustNotFail(t, err)
+	if stage.Status != cloud_task_registry.StageStatus_Success {
+		t.Errorf("expected the stage to be taken over and finished, got %s", stage.Status)
+	}
+	if stage.TLeaseExpiryUTC != nil {
+		t.Errorf("expected the lease to be released with the finished stage, got %v", stage.TLeaseExpiryUTC)
+	}
+	events, err := taskRegistry.GetRunEvents(ctx, taskRun.UUID)
+	mustNotFail(t, err)
+	takenOver := false
+	for _, event := range events {
+		takenOver = takenOver || strings.HasPrefix(event.Details, "taken over")
+	}
+	if !takenOver {
+		t.Errorf("expected the take-over to be recorded, got %+v", events)
+	}
+}
+
+func TestStartStage_MustLetOnlyOneOfInterleavedConnectorsRetryStage(t *testing.T) {
+	// given
+	ctx := context.Background()
+	taskRegistry = cloud_task_registry.NewInMemory()
+	mustNotFail(t, taskRegistry.InsertStage(ctx, cloud_task_registry.Stage{
+		TaskRunUUID: runUUID, NOrd: 1, Name: "cfd", Status: cloud_task_registry.StageInitialStatus, S3Bucket: "bucket",
+	}))
+	// The first attempt has failed after its lease expired
+	failed, err := taskRegistry.GetStage(ctx, runUUID, 1)
+	mustNotFail(t, err)
+	mustNotFail(t, taskRegistry.StartStageWithLease(ctx, failed, -time.Minute))
+	mustNotFail(t, taskRegistry.UpdateStageStatus(ctx, failed, cloud_task_registry.StageStatus_Error))
+	first, err := taskRegistry.GetStage(ctx, runUUID, 1)
+	mustNotFail(t, err)
+	second, err := taskRegistry.GetStage(ctx, runUUID, 1)
+	mustNotFail(t, err)
+
+	// when
+	startedFirst, errFirst := startStage(ctx, first)
+	late, err := taskRegistry.GetStage(ctx, runUUID, 1)
+	mustNotFail(t, err)
+	startedLate, errLate := startStage(ctx, late)
+	startedSecond, errSecond := startStage(ctx, second)
+
+	// then
+	if !startedFirst || errFirst != nil {
+		t.Fatalf("expected the first connector to start the stage, got %v (%v)", startedFirst, errFirst)
+	}
+	if startedLate || errLate != nil {
+		t.Errorf("expected the connector reading the started stage to drop it, got %v (%v)", startedLate, errLate)
+	}
+	if startedSecond || errSecond != nil {
+		t.Errorf("expected the connector reading the failed stage to drop it, got %v (%v)", startedSecond, errSecond)
+	}
+	mustNotFail(t, taskRegistry.RenewStageLease(ctx, first, stageLease))
+	stage, err := taskRegistry.GetStage(ctx, runUUID, 1)
+	mustNotFail(t, err)
+	if stage.Status != cloud_task_registry.StageStatus_InProgress {
+		t.Errorf("expected the stage to stay in progress, got %s", stage.Status)
+	}
+}
+
+func TestStageHeartbeat_MustNotMistakeFinishedStageForTakenOver(t *testing.T) {
+	// given
+	ctx := context.Background()
+	taskRegistry = cloud_task_registry.NewInMemory()
+	defer func(lease time.Duration) { stageLease = lease }(stageLease)
+	stageLease = 30 * time.Millisecond
+	mustNotFail(t, taskRegistry.InsertStage(ctx, cloud_task_registry.Stage{
+		TaskRunUUID: runUUID, NOrd: 1, Name: "cfd", Status: cloud_task_registry.StageInitialStatus, S3Bucket: "bucket",
+	}))
+	stage, err := taskRegistry.GetStage(ctx, runUUID, 1)
+	mustNotFail(t, err)
+	mustNotFail(t, taskRegistry.StartStageWithLease(ctx, stage, stageLease))
+	heartbeatCtx, heartbeat := startStageHeartbeat(ctx, stage)
+	defer heartbeat.stop()
+
+	// when
+	mustNotFail(t, taskRegistry.UpdateStageStatus(ctx, stage, cloud_task_registry.StageStatus_Success))
+	time.Sleep(3 * stageLease)
+
+	// then
+	if heartbeat.lost() {
+		t.Errorf("expected the lease of the finished stage to be released, not lost")
+	}
+	if heartbeatCtx.Err() != nil {
+		t.Errorf("expected the context to stay alive for the uploads after the stage, got %v", context.Cause(heartbeatCtx))
+	}
+}
+
+func TestHandler_MustRecordAttemptsAndGiveUpAfterMaxAttempts(t *testing.T) {
+	// given
+	ctx := context.Background()
+	taskRegistry = cloud_task_registry.NewInMemory()
+	tmpDir := t.TempDir()
+	taskRun := cloud_task_registry.TaskRun{TaskID: "task", UUID: runUUID, Status: cloud_task_registry.TaskRunStatus_Submitted}
+	mustNotFail(t, taskRegistry.InsertTaskRun(ctx, taskRun))
+	mustNotFail(t, taskRegistry.InsertStage(ctx, cloud_task_registry.Stage{
+		TaskRunUUID: taskRun.UUID, NOrd: 1, Name: "cfd", Status: cloud_task_registry.StageInitialStatus,
+		S3Bucket: "bucket", MaxAttempts: 2,
+	}))
+	counterPath := filepath.Join(tmpDir, "runs")
+	command := `echo run >> "` + counterPath + `"; exit 3`
+
+	// when
+	errFirst := deliverToStage(t, tmpDir, taskRun.UUID, "cfd", command, nil, nil)
+	errSecond := deliverToStage(t, tmpDir, taskRun.UUID, "cfd", command, nil, nil)
+	errThird := deliverToStage(t, tmpDir, taskRun.UUID, "cfd", command, nil, nil)
+
+	// then
+	if errFirst == nil || errSecond == nil {
+		t.Errorf("expected the first two attempts to fail")
+	}
+	if errThird != nil {
+		t.Errorf("expected the third delivery to give up quietly, got %s (%v)", errThird.Message, errThird.Error)
+	}
+	runs, err := os.ReadFile(counterPath)
+	mustNotFail(t, err)
+	if string(runs) != "run\nrun\n" {
+		t.Errorf("expected the command to run twice, got %q", runs)
+	}
+	stage, err := taskRegistry.GetStage(ctx, taskRun.UUID, 1)
+	mustNotFail(t, err)
+	if len(stage.Attempts) != 2 {
+		t.Fatalf("expected 2 attempts, got %v", stage.Attempts)
+	}
+	for _, attempt := range stage.Attempts {
+		if attempt.Status != cloud_task_registry.StageStatus_Error || attempt.ExitCode == nil || *attempt.ExitCode != 3 {
+			t.Errorf("expected failed attempt with exit code 3, got %+v", attempt)
+		}
+	}
+	if !strings.HasPrefix(stage.Comments, "Gave up after 2 attempts") {
+		t.Errorf("expected the stage comment to tell that the connector gave up, got %q", stage.Comments)
+	}
+	finishedTaskRunUUID, err := taskRegistry.WaitForPipelineFinish(ctx, taskRun.TaskID, taskRun.UUID)
+	mustNotFail(t, err)
+	if finishedTaskRunUUID != taskRun.UUID {
+		t.Errorf("expected %s to be reported as finished, got %s", taskRun.UUID, finishedTaskRunUUID)
+	}
+}
+
+func TestHandler_MustMergeResultsPublishedByDifferentStages(t *testing.T) {
+	// given
+	ctx := context.Background()
+	taskRegistry = cloud_task_registry.NewInMemory()
+	tmpDir := t.TempDir()
+	taskRun := cloud_task_registry.TaskRun{TaskID: "task", UUID: runUUID, Status: cloud_task_registry.TaskRunStatus_Submitted}
+	mustNotFail(t, taskRegistry.InsertTaskRun(ctx, taskRun))
+	mustNotFail(t, taskRegistry.InsertStage(ctx, cloud_task_registry.Stage{
+		TaskRunUUID: taskRun.UUID, NOrd: 1, Name: "mass-estimation", Status: cloud_task_registry.StageInitialStatus,
+		S3Bucket: "bucket", Next: []string{"cfd"},
+	}))
+	mustNotFail(t, taskRegistry.InsertStage(ctx, cloud_task_registry.Stage{
+		TaskRunUUID: taskRun.UUID, NOrd: 2, Name: "cfd", Status: cloud_task_registry.StageInitialStatus,
+		S3Bucket: "bucket",
+	}))
+
+	// when
+	runStage(t, tmpDir, taskRun.UUID, "mass-estimation", `echo "mass=42" > "$RES"; echo geometry > "$OUT"`)
+	runStage(t, tmpDir, taskRun.UUID, "cfd", `echo "lift_to_drag=7.7" > "$OUT"`)
+
+	// then
+	finishedTaskRun, err := taskRegistry.GetTaskRun(ctx, taskRun.UUID)
+	mustNotFail(t, err)
+	if finishedTaskRun.Results["mass"].String() != "42" || finishedTaskRun.Results["lift_to_drag"].String() != "7.7" {
+		t.Errorf("expected results of both stages, got %v", finishedTaskRun.Results)
+	}
+	if finishedTaskRun.Results["mass"].Stage != "mass-estimation" {
+		t.Errorf("expected mass to be published by mass-estimation, got %v", finishedTaskRun.Results["mass"].Stage)
+	}
+}
+
+func TestHandler_MustPassNamedOutputsToNamedInputsOfNextStage(t *testing.T) {
+	// given
+	ctx := context.Background()
+	taskRegistry = cloud_task_registry.NewInMemory()
+	tmpDir := t.TempDir()
+	taskRun := cloud_task_registry.TaskRun{TaskID: "task", UUID: runUUID, Status: cloud_task_registry.TaskRunStatus_Submitted}
+	mustNotFail(t, taskRegistry.InsertTaskRun(ctx, taskRun))
+	mustNotFail(t, taskRegistry.InsertStage(ctx, cloud_task_registry.Stage{
+		TaskRunUUID: taskRun.UUID, NOrd: 1, Name: "cfd", Status: cloud_task_registry.StageInitialStatus,
+		S3Bucket: "bucket", Next: []string{"post"}, OutputNames: []string{"summary", "log"},
+	}))
+	mustNotFail(t, taskRegistry.InsertStage(ctx, cloud_task_registry.Stage{
+		TaskRunUUID: taskRun.UUID, NOrd: 2, Name: "post", Status: cloud_task_registry.StageInitialStatus,
+		S3Bucket: "bucket", InputNames: []string{"cfd.summary"},
+	}))
+	summaryPath, logPath := filepath.Join(tmpDir, "summary"), filepath.Join(tmpDir, "log")
+	downloadedPath := filepath.Join(tmpDir, "downloaded-summary")
+
+	// when
+	runStageWithNamedArtifacts(t, tmpDir, taskRun.UUID, "cfd",
+		`echo "lift_to_drag=7.7" > "`+summaryPath+`"; echo converged > "`+logPath+`"; echo done > "$OUT"`,
+		nil, map[string]string{"summary": summaryPath, "log": logPath})
+	runStageWithNamedArtifacts(t, tmpDir, taskRun.UUID, "post", `cp "`+downloadedPath+`" "$OUT"`,
+		map[string]string{"cfd.summary": downloadedPath}, nil)
+
+	// then
+	finishedTaskRun, err := taskRegistry.GetTaskRun(ctx, taskRun.UUID)
+	mustNotFail(t, err)
+	if finishedTaskRun.Results["lift_to_drag"].String() != "7.7" {
+		t.Errorf("expected result lift_to_drag=7.7 from the named output, got %v", finishedTaskRun.Results)
+	}
+	cfd, err := taskRegistry.GetStageByName(ctx, taskRun.UUID, "cfd")
+	mustNotFail(t, err)
+	if len(cfd.Outputs) != 2 || len(cfd.OutputsSHA256) != 2 {
+		t.Errorf("expected 2 named outputs with checksums, got %v and %v", cfd.Outputs, cfd.OutputsSHA256)
+	}
+}
+
+func TestCheckNamedArtifacts_MustRejectOutputsNotDeclaredByStage(t *testing.T) {
+	// given
+	stage := &cloud_task_registry.Stage{Name: "cfd", OutputNames: []string{"summary"}}
+	// when
+	appErr := checkNamedArtifacts(stage, nil, map[string]string{"summary": "/tmp/s", "log": "/tmp/l"})
+	// then
+	if appErr == nil {
+		t.Errorf("expected an error for the undeclared output")
+	}
+}
+
+func TestHandler_MustKeepTraceAndReplyQueueOfReceivedMessageWhenPassingTaskOn(t *testing.T) {
+	// given
+	ctx := context.Background()
+	queues := cloud_task_registry.NewMemoryMessageQueue()
+	registry, err := cloud_task_registry.New("",
+		cloud_task_registry.WithTaskStore(cloud_task_registry.NewMemoryTaskStore()),
+		cloud_task_registry.WithArtifactStore(cloud_task_registry.NewMemoryArtifactStore()),
+		cloud_task_registry.WithMessageQueue(queues))
+	mustNotFail(t, err)
+	taskRegistry = registry
+	tmpDir := t.TempDir()
+	taskRun := cloud_task_registry.TaskRun{TaskID: "task", UUID: runUUID, Status: cloud_task_registry.TaskRunStatus_Submitted}
+	mustNotFail(t, taskRegistry.InsertTaskRun(ctx, taskRun))
+	mustNotFail(t, taskRegistry.InsertStage(ctx, cloud_task_registry.Stage{
+		TaskRunUUID: taskRun.UUID, NOrd: 1, Name: "generate", Status: cloud_task_registry.StageInitialStatus,
+		S3Bucket: "bucket", Next: []string{"evaluate"},
+	}))
+	mustNotFail(t, taskRegistry.InsertStage(ctx, cloud_task_registry.Stage{
+		TaskRunUUID: taskRun.UUID, NOrd: 2, Name: "evaluate", Status: cloud_task_registry.StageInitialStatus,
+		S3Bucket: "bucket",
+	}))
+	first, err := taskRegistry.GetStage(ctx, taskRun.UUID, 1)
+	mustNotFail(t, err)
+	submittedMessage := cloud_task_registry.NewTaskMessage(&taskRun, "", "trace-1")
+	submittedMessage.ReplyTo = cloud_task_registry.ReplyQueueName(taskRun.UUID)
+	mustNotFail(t, taskRegistry.PassTaskToStage(ctx, first, submittedMessage))
+	submitted := receiveTaskMessage(t, queues, "generate")
+
+	// when
+	if appErr := deliverToStage(t, tmpDir, submitted.Body, "generate", `echo "mass=1" > "$OUT"`, nil, nil); appErr != nil {
+		t.Fatalf("stage generate failed: %s (%v)", appErr.Message, appErr.Error)
+	}
+	passed := receiveTaskMessage(t, queues, "evaluate")
+	if appErr := deliverToStage(t, tmpDir, passed.Body, "evaluate", `cp "$IN" "$OUT"`, nil, nil); appErr != nil {
+		t.Fatalf("stage evaluate failed: %s (%v)", appErr.Message, appErr.Error)
+	}
+	finished := receiveTaskMessage(t, queues, submittedMessage.ReplyTo)
+
+	// then
+	for _, received := range []*cloud_task_registry.QueueMessage{passed, finished} {
+		message, err := cloud_task_registry.ParseTaskMessage(received.Body)
+		mustNotFail(t, err)
+		if message.TraceID != "trace-1" || message.ReplyTo != submittedMessage.ReplyTo || message.EnqueuedUTC == nil {
+			t.Errorf("expected the message to keep trace-1 and the reply queue, got %+v", message)
+		}
+	}
+	message, err := cloud_task_registry.ParseTaskMessage(passed.Body)
+	mustNotFail(t, err)
+	if message.SourceStage != "generate" || message.TargetStage != "evaluate" || message.Attempt != 1 {
+		t.Errorf("expected the message from generate to evaluate, got %+v", message)
+	}
+}
+
+func receiveTaskMessage(
+	t *testing.T,
+	queues cloud_task_registry.MessageQueue,
+	queueName string,
+) *cloud_task_registry.QueueMessage {
+	t.Helper()
+	message, err := queues.ReceiveMessage(context.Background(), queueName, 0)
+	mustNotFail(t, err)
+	if message == nil {
+		t.Fatalf("expected a message in queue %s", queueName)
+	}
+	mustNotFail(t, queues.DeleteMessage(context.Background(), queueName, message.ReceiptHandle))
+	return message
+}
+
+func runStage(t *testing.T, tmpDir, taskRunUUID, stageName, command string) {
+	t.Helper()
+	runStageWithNamedArtifacts(t, tmpDir, taskRunUUID, stageName, command, nil, nil)
+}
+
+func runStageWithNamedArtifacts(
+	t *testing.T,
+	tmpDir, taskRunUUID, stageName, command string,
+	namedInputs, namedOutputs map[string]string,
+) {
+	t.Helper()
+	if appErr := deliverToStage(t, tmpDir, taskRunUUID, stageName, command, namedInputs, namedOutputs); appErr != nil {
+		t.Fatalf("stage %s failed: %s (%v)", stageName, appErr.Message, appErr.Error)
+	}
+}
+
+// deliverToStage handles a delivery of the task run to the stage like main does, including the error status.
+// The message body is either a task message or the bare task run UUID sent by older versions.
+func deliverToStage(
+	t *testing.T,
+	tmpDir, messageBody, stageName, command string,
+	namedInputs, namedOutputs map[string]string,
+) *AppError {
+	t.Helper()
+	inputPath := filepath.Join(tmpDir, stageName+"-input")
+	outputPath := filepath.Join(tmpDir, stageName+"-output")
+	resultsPath := filepath.Join(tmpDir, stageName+"-results")
+	commandPath := filepath.Join(tmpDir, stageName+".sh")
+	command = strings.NewReplacer("$IN", inputPath, "$OUT", outputPath, "$RES", resultsPath).Replace(command)
+	mustNotFail(t, os.WriteFile(commandPath, []byte(command), 0o644))
+
+	body := fmt.Sprintf(`{"messages":[{"details":{"message":{"body":%q}}}]}`, messageBody)
+	request := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	recorder := httptest.NewRecorder()
+	timeoutRisk := false
+	appErr := handler(request.Context(), recorder, request, stageName, "", inputPath, outputPath, resultsPath, commandPath, nil,
+		namedInputs, namedOutputs, &timeoutRisk)
+	if appErr != nil && appErr.Stage != nil {
+		mustNotFail(t, taskRegistry.UpdateStageStatus(request.Context(), appErr.Stage, cloud_task_registry.StageStatus_Error))
+	}
+	return appErr
+}
+
+func mustNotFail(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
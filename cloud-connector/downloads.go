@@ -1,54 +1,96 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"net/http"
 	"os"
 	"path"
+	"slices"
 	"strings"
 
 	cloud_task_registry "github.com/wndrws/cloud-optimization-suite/cloud-task-registry"
 )
 
-func downloadConfigFileIfSpecified(stage *cloud_task_registry.Stage, configPath string) *AppError {
+func downloadConfigFileIfSpecified(ctx context.Context, stage *cloud_task_registry.Stage, configPath string) *AppError {
 	if stage.Config != "" {
 		if configPath == "" {
 			msg := "config file path is not specified in cloud-connector args"
 			return &AppError{errors.New(msg), msg, http.StatusInternalServerError, stage}
 		}
-		if err := taskRegistry.DownloadConfigFile(stage, configPath); err != nil {
+		if err := taskRegistry.DownloadConfigFile(ctx, stage, configPath); err != nil {
 			msg := fmt.Sprintf("couldn't download config file %q from S3 bucket %q", configPath, stage.S3Bucket)
-			return &AppError{err, msg, http.StatusInternalServerError, stage}
+			return &AppError{err, checksumMessage(msg, err), http.StatusInternalServerError, stage}
 		}
 	}
 	return nil
 }
 
-func downloadInputFileIfSpecified(stage *cloud_task_registry.Stage, inputFilePath string) *AppError {
+func downloadInputFileIfSpecified(ctx context.Context, stage *cloud_task_registry.Stage, inputFilePath string) *AppError {
 	if stage.Input != "" {
 		if inputFilePath == "" {
 			msg := "input file path is not specified in cloud-connector args"
 			return &AppError{errors.New(msg), msg, http.StatusInternalServerError, stage}
 		}
 		if strings.HasSuffix(inputFilePath, "/") {
-			if err := downloadInputToFolder(stage, inputFilePath); err != nil {
+			if err := downloadInputToFolder(stage, inputFilePath, func(destination string) error {
+				return taskRegistry.DownloadInputFile(ctx, stage, destination)
+			}); err != nil {
 				msg := fmt.Sprintf("couldn't download input artifacts from S3 bucket %q and place them into folder %q",
 					inputFilePath, stage.S3Bucket)
-				return &AppError{err, msg, http.StatusInternalServerError, stage}
+				return &AppError{err, checksumMessage(msg, err), http.StatusInternalServerError, stage}
 			}
 		} else {
-			if err := taskRegistry.DownloadInputFile(stage, inputFilePath); err != nil {
+			if err := taskRegistry.DownloadInputFile(ctx, stage, inputFilePath); err != nil {
 				msg := fmt.Sprintf("couldn't download input file %q from S3 bucket %q", inputFilePath, stage.S3Bucket)
-				return &AppError{err, msg, http.StatusInternalServerError, stage}
+				return &AppError{err, checksumMessage(msg, err), http.StatusInternalServerError, stage}
 			}
 		}
 	}
 	return nil
 }
 
-func downloadInputToFolder(stage *cloud_task_registry.Stage, inputFilePath string) error {
+// checksumMessage points out that the downloaded artifact is corrupted, so that it isn't mistaken for
+// a connectivity problem
+func checksumMessage(msg string, err error) string {
+	if errors.Is(err, cloud_task_registry.ErrChecksumMismatch) {
+		return msg + ": the file is corrupted, its SHA-256 checksum doesn't match the uploaded one"
+	}
+	return msg
+}
+
+// downloadNamedInputs downloads the named outputs of the previous stages (--inputs), a path with a trailing "/" is
+// a folder to extract the archived output into
+func downloadNamedInputs(ctx context.Context, stage *cloud_task_registry.Stage, namedInputs map[string]string) *AppError {
+	for _, name := range slices.Sorted(maps.Keys(namedInputs)) {
+		inputPath := namedInputs[name]
+		download := func(destination string) error {
+			return taskRegistry.DownloadNamedInput(ctx, stage, name, destination)
+		}
+		var err error
+		if strings.HasSuffix(inputPath, "/") {
+			err = downloadInputToFolder(stage, inputPath, download)
+		} else {
+			err = download(inputPath)
+		}
+		if err != nil {
+			msg := fmt.Sprintf("couldn't download input %q to %q", name, inputPath)
+			return &AppError{err, checksumMessage(msg, err), http.StatusInternalServerError, stage}
+		}
+	}
+	return nil
+}
+
+// downloadInputToFolder downloads the input with the download function and extracts it into the folder if it is
+// an archive, or moves it there otherwise
+func downloadInputToFolder(
+	stage *cloud_task_registry.Stage,
+	inputFilePath string,
+	download func(destination string) error,
+) error {
 	tempfile, err := os.CreateTemp("", stage.Name+"-input")
 	if err != nil {
 		return fmt.Errorf("couldn't create temp file for downloading the input artifact(s)")
@@ -61,9 +103,9 @@ func downloadInputToFolder(stage *cloud_task_registry.Stage, inputFilePath strin
 		}
 	}()
 
-	if err := taskRegistry.DownloadInputFile(stage, tempfile.Name()); err != nil {
-		return fmt.Errorf("couldn't download input file %q from S3 bucket %q to temporary file %q",
-			inputFilePath, stage.S3Bucket, tempfile.Name())
+	if err := download(tempfile.Name()); err != nil {
+		return fmt.Errorf("couldn't download input file %q from S3 bucket %q to temporary file %q, %w",
+			inputFilePath, stage.S3Bucket, tempfile.Name(), err)
 	}
 
 	isArchive, err := Is7z(tempfile.Name())
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	cloud_task_registry "github.com/wndrws/cloud-optimization-suite/cloud-task-registry"
+)
+
+// stageLease is how long the stage is deemed alive after a heartbeat (--stage-lease)
+var stageLease = cloud_task_registry.DefaultStageLease
+
+var errLeaseLost = errors.New("the stage lease is lost")
+
+// stageHeartbeat renews the lease of the stage in the background, so that a redelivery of the task run doesn't take
+// the stage over while it is running (see startStage)
+type stageHeartbeat struct {
+	cancel   context.CancelCauseFunc
+	quit     chan struct{}
+	quitOnce sync.Once
+	done     chan struct{}
+	isLost   atomic.Bool
+}
+
+// startStageHeartbeat renews the lease every third of its duration until released. If the lease is lost, i.e. another
+// connector has taken the stage over, the returned context is cancelled, which stops the command of the stage.
+// A stage that is not InProgress anymore has been released, its lease is not renewed then, but nothing is cancelled.
+func startStageHeartbeat(ctx context.Context, stage *cloud_task_registry.Stage) (context.Context, *stageHeartbeat) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	heartbeat := &stageHeartbeat{cancel: cancel, quit: make(chan struct{}), done: make(chan struct{})}
+	// The handler keeps updating the stage, the heartbeat needs the lease fields only
+	leased := *stage
+	go func() {
+		defer close(heartbeat.done)
+		ticker := time.NewTicker(stageLease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-heartbeat.quit:
+				return
+			case <-ticker.C:
+				err := taskRegistry.RenewStageLease(ctx, &leased, stageLease)
+				if errors.Is(err, cloud_task_registry.ErrConditionFailed) && stageReleased(ctx, &leased) {
+					log.Println("Stage", leased.Name, "of task run", leased.TaskRunUUID,
+						"is not in progress anymore, its lease is not renewed")
+					return
+				}
+				if errors.Is(err, cloud_task_registry.ErrConditionFailed) {
+					log.Println("Lost the lease of stage", leased.Name, "of task run", leased.TaskRunUUID,
+						"- another connector has taken it over, stopping")
+					heartbeat.isLost.Store(true)
+					cancel(errLeaseLost)
+					return
+				}
+				if err != nil {
+					log.Println("Couldn't renew the stage lease (will retry):", err)
+				}
+			}
+		}
+	}()
+	return ctx, heartbeat
+}
+
+// release stops renewing the lease, the context stays alive. It must be called before the handler moves the stage out
+// of InProgress, so that the heartbeat doesn't mistake the finished stage for the one taken over.
+func (heartbeat *stageHeartbeat) release() {
+	heartbeat.quitOnce.Do(func() { close(heartbeat.quit) })
+	<-heartbeat.done
+}
+
+func (heartbeat *stageHeartbeat) stop() {
+	heartbeat.release()
+	heartbeat.cancel(nil)
+}
+
+func (heartbeat *stageHeartbeat) lost() bool {
+	return heartbeat.isLost.Load()
+}
+
+// stageReleased tells whether the stage whose lease couldn't be renewed has left InProgress, e.g. it has been
+// cancelled, rather than been taken over by another connector
+func stageReleased(ctx context.Context, stage *cloud_task_registry.Stage) bool {
+	current, err := taskRegistry.GetStageByName(ctx, stage.TaskRunUUID, stage.Name)
+	return err == nil && current.Status != cloud_task_registry.StageStatus_InProgress
+}
+
+// leaseLostError makes the handler give up the stage without touching it, it belongs to another connector now
+func leaseLostError(stage *cloud_task_registry.Stage) *AppError {
+	msg := fmt.Sprintf("stage %s of task run %s has been taken over by another connector", stage.Name, stage.TaskRunUUID)
+	return &AppError{errLeaseLost, msg, http.StatusConflict, nil}
+}
@@ -3,8 +3,11 @@ package main
 import (
 	"bufio"
 	"fmt"
+	"log"
 	"os"
 	"strings"
+
+	cloud_task_registry "github.com/wndrws/cloud-optimization-suite/cloud-task-registry"
 )
 
 func readKeyValueFile(filePath string) (map[string]string, error) {
@@ -34,3 +37,17 @@ func readKeyValueFile(filePath string) (map[string]string, error) {
 
 	return kvMap, nil
 }
+
+// readResultsFile reads results in "k=v" format, where v is like "42", "42 kg", "failed" or "penalty 1e6",
+// see cloud_task_registry.ParseResultValue. Malformed values are kept as failed results.
+func readResultsFile(filePath string) (map[string]cloud_task_registry.ResultValue, error) {
+	values, err := readKeyValueFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	results, err := cloud_task_registry.ParseResults(values)
+	if err != nil {
+		log.Printf("Some results are malformed and will be marked as failed: %v", err)
+	}
+	return results, nil
+}
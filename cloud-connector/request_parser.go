@@ -5,6 +5,8 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+
+	cloud_task_registry "github.com/wndrws/cloud-optimization-suite/cloud-task-registry"
 )
 
 type RequestBody struct {
@@ -73,3 +75,21 @@ func extractSQSMessageBodyFromYandexCloudTriggerRequest(r *http.Request) (string
 	messageBody := reqBody.Messages[0].Details.Message.Body
 	return messageBody, nil
 }
+
+// extractTaskMessageFromYandexCloudTriggerRequest reads the task message from the SQS message body, which is either
+// the JSON envelope or the bare task run UUID sent by older versions
+func extractTaskMessageFromYandexCloudTriggerRequest(r *http.Request) (*cloud_task_registry.TaskMessage, *AppError) {
+	messageBody, appErr := extractSQSMessageBodyFromYandexCloudTriggerRequest(r)
+	if appErr != nil {
+		return nil, appErr
+	}
+	message, err := cloud_task_registry.ParseTaskMessage(messageBody)
+	if err != nil {
+		return nil, &AppError{
+			Error:   err,
+			Message: "Unable to parse SQS message body",
+			Code:    http.StatusBadRequest,
+		}
+	}
+	return message, nil
+}
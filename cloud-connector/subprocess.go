@@ -14,12 +14,14 @@ import (
 	"github.com/wndrws/cloud-optimization-suite/cloud-task-registry"
 )
 
+// startCommandAndWait runs the command of the stage and returns its exit code, or nil if it hasn't run
 func startCommandAndWait(
+	ctx context.Context,
 	command string,
 	stage *cloud_task_registry.Stage,
 	envVars map[string]string,
-) *AppError {
-	ctx, cancel := context.WithCancel(context.Background())
+) (*int, *AppError) {
+	listenerCtx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
 	// Create environment variables from the Parameters map
@@ -28,35 +30,37 @@ func startCommandAndWait(
 		//env = append(env, fmt.Sprintf("%s=%s", key, value))
 		if err := os.Setenv(key, value); err != nil {
 			msg := fmt.Sprintf("couldn't set env var %s=%s", key, value)
-			return &AppError{err, msg, http.StatusInternalServerError, stage}
+			return nil, &AppError{err, msg, http.StatusInternalServerError, stage}
 		}
 	}
 
-	cmd := exec.CommandContext(context.Background(), "/bin/sh", "-c", command)
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
 	cmd.Env = nil // append(cmd.Env, env...) // TODO Does this work?
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	go launchTaskCancellationListener(ctx, cmd, stage)
+	go launchTaskCancellationListener(listenerCtx, cmd, stage)
 	if err := cmd.Start(); err != nil {
 		msg := fmt.Sprintf("unable to start shell subprocess %q", command)
-		return &AppError{err, msg, http.StatusInternalServerError, stage}
+		return nil, &AppError{err, msg, http.StatusInternalServerError, stage}
 	}
 	log.Println("Started subprocess", command)
 
 	go monitorSubprocess(cmd)
 
-	if err := cmd.Wait(); err != nil || cmd.ProcessState.ExitCode() != 0 {
-		if taskWasCancelled, _ := taskRegistry.IsCancelled(stage.TaskRunUUID); taskWasCancelled {
-			log.Println("Subprocess was interrupted and finished with exit-code", cmd.ProcessState.ExitCode())
+	err := cmd.Wait()
+	exitCode := cmd.ProcessState.ExitCode()
+	if err != nil || exitCode != 0 {
+		if taskWasCancelled, _ := taskRegistry.IsCancelled(ctx, stage.TaskRunUUID); taskWasCancelled {
+			log.Println("Subprocess was interrupted and finished with exit-code", exitCode)
 		} else {
 			if err == nil {
 				err = errors.New("non-zero exit code from subprocess")
 			}
-			msg := fmt.Sprintf("subprocess failed with error, exit-code %d", cmd.ProcessState.ExitCode())
-			return &AppError{err, msg, http.StatusInternalServerError, stage}
+			msg := fmt.Sprintf("subprocess failed with error, exit-code %d", exitCode)
+			return &exitCode, &AppError{err, msg, http.StatusInternalServerError, stage}
 		}
 	}
-	return nil
+	return &exitCode, nil
 }
 
 func monitorSubprocess(cmd *exec.Cmd) {
@@ -76,7 +80,7 @@ func launchTaskCancellationListener(ctx context.Context, cmd *exec.Cmd, stage *c
 		case <-ctx.Done():
 			return
 		default:
-			taskCancelled, err := taskRegistry.IsCancelled(stage.TaskRunUUID)
+			taskCancelled, err := taskRegistry.IsCancelled(ctx, stage.TaskRunUUID)
 			if err != nil {
 				log.Println("Couldn't check the task run cancellation (will retry in 5s):", err)
 			}
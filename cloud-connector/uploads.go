@@ -1,56 +1,38 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"maps"
 	"net/http"
 	"os"
 	"os/exec"
 	"path"
+	"slices"
 
 	cloud_task_registry "github.com/wndrws/cloud-optimization-suite/cloud-task-registry"
 )
 
 func uploadOutputFile(
+	ctx context.Context,
 	outputFilePath string,
 	task *cloud_task_registry.TaskRun,
 	stage *cloud_task_registry.Stage,
 ) (string, *AppError) {
 	if outputFilePath != "" {
-		fileToUpload := outputFilePath
-		fileInfo, err := os.Stat(outputFilePath)
+		fileToUpload, cleanup, err := archiveIfDirectory(outputFilePath, stage.Name+"-output.7z")
 		if err != nil {
-			msg := fmt.Sprintf("unable to stat path %q, %v", outputFilePath, err)
-			return "", &AppError{err, msg, http.StatusInternalServerError, stage}
-		}
-		if fileInfo.IsDir() {
-			archivePath := path.Join(os.TempDir(), stage.Name+"-output.7z")
-			defer func() {
-				if err := os.Remove(archivePath); err != nil {
-					fmt.Println("Couldn't remove the temporary file", archivePath, err)
-				} else {
-					fmt.Println("Cleaned up the archive:", archivePath)
-				}
-			}()
-			log.Printf("output artifact path %s points at a directory, archiving...", outputFilePath)
-			archiveCmd := exec.Command("7zz", "a", archivePath, outputFilePath)
-			archiveCmd.Stdout = os.Stdout
-			archiveCmd.Stderr = os.Stderr
-			errRun := archiveCmd.Run()
-			if errRun != nil {
-				err := fmt.Errorf("failed to compress directory %q, %w", outputFilePath, errRun)
-				return "", &AppError{err, err.Error(), http.StatusInternalServerError, stage}
-			}
-			fileToUpload = archivePath
-			log.Println("Successfully created archive:", archivePath)
+			return "", &AppError{err, err.Error(), http.StatusInternalServerError, stage}
 		}
-		s3PathForOutput, err := taskRegistry.UploadFileForStage(
-			fileToUpload, stage.S3Bucket, task, stage.Name, stage.NOrd)
+		defer cleanup()
+		s3PathForOutput, digest, err := taskRegistry.UploadFileForStage(
+			ctx, fileToUpload, stage.S3Bucket, task, stage.Name, stage.NOrd)
 		if err != nil {
 			msg := fmt.Sprintf("error uploading file %q to S3 bucket %q", fileToUpload, stage.S3Bucket)
 			return "", &AppError{err, msg, http.StatusInternalServerError, stage}
 		}
-		if err := taskRegistry.UpdateStageOutput(stage, s3PathForOutput); err != nil {
+		if err := taskRegistry.UpdateStageOutput(ctx, stage, s3PathForOutput, digest); err != nil {
 			msg := "error setting output for stage"
 			return "", &AppError{err, msg, http.StatusInternalServerError, stage}
 		}
@@ -61,30 +43,96 @@ func uploadOutputFile(
 	}
 }
 
+// uploadNamedOutputs uploads the named outputs of the stage (--outputs) and sets them to the stage all at once
+func uploadNamedOutputs(
+	ctx context.Context,
+	namedOutputs map[string]string,
+	task *cloud_task_registry.TaskRun,
+	stage *cloud_task_registry.Stage,
+) *AppError {
+	if len(namedOutputs) == 0 {
+		return nil
+	}
+	outputs := make(map[string]string, len(namedOutputs))
+	sha256s := make(map[string]string, len(namedOutputs))
+	for _, name := range slices.Sorted(maps.Keys(namedOutputs)) {
+		fileToUpload, cleanup, err := archiveIfDirectory(namedOutputs[name], stage.Name+"-"+name+".7z")
+		if err != nil {
+			return &AppError{err, err.Error(), http.StatusInternalServerError, stage}
+		}
+		outputs[name], sha256s[name], err = taskRegistry.UploadNamedOutput(
+			ctx, fileToUpload, stage.S3Bucket, task, stage.Name, stage.NOrd, name)
+		cleanup()
+		if err != nil {
+			msg := fmt.Sprintf("error uploading output %q (file %q) to S3 bucket %q", name, fileToUpload, stage.S3Bucket)
+			return &AppError{err, msg, http.StatusInternalServerError, stage}
+		}
+	}
+	if err := taskRegistry.UpdateStageOutputs(ctx, stage, outputs, sha256s); err != nil {
+		msg := "error setting named outputs for stage"
+		return &AppError{err, msg, http.StatusInternalServerError, stage}
+	}
+	return nil
+}
+
+// archiveIfDirectory returns the file to upload for the output path: the path itself if it is a file, or the 7z archive
+// with the given name in the temp folder if it is a directory. The returned function removes the archive.
+func archiveIfDirectory(outputPath string, archiveName string) (string, func(), error) {
+	fileInfo, err := os.Stat(outputPath)
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to stat path %q, %w", outputPath, err)
+	}
+	if !fileInfo.IsDir() {
+		return outputPath, func() {}, nil
+	}
+	archivePath := path.Join(os.TempDir(), archiveName)
+	cleanup := func() {
+		if err := os.Remove(archivePath); err != nil {
+			fmt.Println("Couldn't remove the temporary file", archivePath, err)
+		} else {
+			fmt.Println("Cleaned up the archive:", archivePath)
+		}
+	}
+	log.Printf("output artifact path %s points at a directory, archiving...", outputPath)
+	archiveCmd := exec.Command("7zz", "a", archivePath, outputPath)
+	archiveCmd.Stdout = os.Stdout
+	archiveCmd.Stderr = os.Stderr
+	if err := archiveCmd.Run(); err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("failed to compress directory %q, %w", outputPath, err)
+	}
+	log.Println("Successfully created archive:", archivePath)
+	return archivePath, cleanup, nil
+}
+
 func uploadExtraArtifactsAndUpdateStageComment(
+	ctx context.Context,
 	extraArtifactsPaths []string,
 	task *cloud_task_registry.TaskRun,
 	stage *cloud_task_registry.Stage,
-) {
-	if uploaded, appErr := uploadExtraArtifacts(extraArtifactsPaths, task, stage); appErr != nil {
+) []string {
+	uploaded, appErr := uploadExtraArtifacts(ctx, extraArtifactsPaths, task, stage)
+	if appErr != nil {
 		comment := fmt.Sprintf("Extra artifacts upload failed! Uploaded %d (%v) out of %d (%v) files, %v",
 			len(uploaded), uploaded, len(extraArtifactsPaths), extraArtifactsPaths, appErr.Error)
 		log.Println(comment)
-		if err := taskRegistry.UpdateStageComment(stage, comment); err != nil {
+		if err := taskRegistry.UpdateStageComment(ctx, stage, comment); err != nil {
 			msg := fmt.Sprintf("error updating comment for stage %s of task %s", stage.Name, stage.TaskRunUUID)
 			log.Println(msg)
 		}
 	} else {
 		comment := fmt.Sprintf("Uploaded %d extra artifacts: %v", len(uploaded), uploaded)
 		log.Println(comment)
-		if err := taskRegistry.UpdateStageComment(stage, comment); err != nil {
+		if err := taskRegistry.UpdateStageComment(ctx, stage, comment); err != nil {
 			msg := fmt.Sprintf("error updating comment for stage %s of task %s", stage.Name, stage.TaskRunUUID)
 			log.Println(msg)
 		}
 	}
+	return uploaded
 }
 
 func uploadExtraArtifacts(
+	ctx context.Context,
 	extraArtifactsPaths []string,
 	task *cloud_task_registry.TaskRun,
 	stage *cloud_task_registry.Stage,
@@ -119,8 +167,8 @@ func uploadExtraArtifacts(
 				}
 			}(archivePath) // Clean up the ZIP file after upload
 		}
-		s3Path, err := taskRegistry.UploadExtraFileForStage(
-			fileToUpload, stage.S3Bucket, task, stage.Name, stage.NOrd)
+		s3Path, _, err := taskRegistry.UploadExtraFileForStage(
+			ctx, fileToUpload, stage.S3Bucket, task, stage.Name, stage.NOrd)
 		if err != nil {
 			msg := fmt.Sprintf("error uploading file %q (extra artifact) to S3 bucket %q", fileToUpload, stage.S3Bucket)
 			return uploaded, &AppError{err, msg, http.StatusInternalServerError, stage}
@@ -0,0 +1,153 @@
+package cloud_task_registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// blobsFolder keeps the content-addressed files shared by all tasks and runs: task-registry/blobs/<sha256>.
+// It's not a task ID, see CreateTask.
+const blobsFolder = "blobs"
+
+// blobRefreshAge is how old an existing blob may be to skip its upload. Older blobs are uploaded again,
+// which makes them young enough for CollectBlobs to keep them until the new stages that refer to them are created.
+const blobRefreshAge = 24 * time.Hour
+
+// MinBlobAge is the least age of the blobs that CollectBlobs deletes, so that it never deletes a blob whose upload
+// has just been skipped
+const MinBlobAge = 2 * blobRefreshAge
+
+// BlobPath is the S3 path of the file with the SHA-256 digest in the blob area
+func BlobPath(digest string) string {
+	return strings.Join([]string{s3CommonPrefix, blobsFolder, digest}, "/")
+}
+
+// IsBlobPath tells if the S3 path is in the blob area, i.e. the object may be shared and must not be deleted
+// with a task or a task run
+func IsBlobPath(s3Path string) bool {
+	return strings.HasPrefix(s3Path, s3CommonPrefix+"/"+blobsFolder+"/")
+}
+
+// UploadBlob uploads the file to the blob area unless it's already there and returns its S3 path and SHA-256 digest.
+// Files that are the same for many runs (task definitions, stage configs) are kept only once this way.
+func (registry *CloudTaskRegistry) UploadBlob(ctx context.Context, filePath, s3Bucket string) (string, string, error) {
+	digest, err := FileSHA256(filePath)
+	if err != nil {
+		return "", "", err
+	}
+	s3Path := BlobPath(digest)
+
+	object, err := registry.artifacts.HeadObject(ctx, s3Bucket, s3Path)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return "", "", fmt.Errorf("failed to check %q in S3 bucket %q, %w", s3Path, s3Bucket, err)
+	}
+	// An object without the digest in the metadata may be left by an interrupted upload
+	if err == nil && object.Metadata[MetadataSHA256] == digest && time.Since(object.LastModified) < blobRefreshAge {
+		log.Printf("File is already in S3, upload skipped: %s", s3Path)
+		return s3Path, digest, nil
+	}
+
+	// The key has no file name, so the name is kept to download the blob under it
+	metadata := digestMetadata(digest)
+	metadata[MetadataFileName] = url.PathEscape(filepath.Base(filePath))
+	if err := registry.putFile(ctx, s3Bucket, s3Path, filePath, metadata, StorageClass_Standard); err != nil {
+		return "", "", err
+	}
+	log.Printf("File uploaded to S3: %s", s3Path)
+	return s3Path, digest, nil
+}
+
+// CollectBlobs deletes the blobs that no task, task run or stage refers to and that are older than minAge
+// (at least MinBlobAge). On a dry run it only reports what would be deleted.
+func (registry *CloudTaskRegistry) CollectBlobs(
+	ctx context.Context,
+	minAge time.Duration,
+	dryRun bool,
+) (*DeletionReport, error) {
+	if minAge < MinBlobAge {
+		return nil, fmt.Errorf("blobs younger than %v may be in use by runs being created, got %v", MinBlobAge, minAge)
+	}
+	// The references are collected before the blobs are listed, so that the blobs uploaded meanwhile are too young
+	// to be deleted
+	referenced, buckets, err := registry.blobReferences(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &DeletionReport{}
+	prefix := s3CommonPrefix + "/" + blobsFolder + "/"
+	createdBefore := time.Now().Add(-minAge)
+	for _, bucket := range buckets {
+		objects, err := registry.artifacts.ListObjects(ctx, bucket, prefix)
+		if err != nil {
+			return report, fmt.Errorf("failed to list %q in S3 bucket %q, %w", prefix, bucket, err)
+		}
+		for _, object := range objects {
+			if referenced[object.Key] || !object.LastModified.Before(createdBefore) {
+				continue
+			}
+			if !dryRun {
+				if err := registry.artifacts.DeleteObject(ctx, bucket, object.Key); err != nil {
+					return report, fmt.Errorf("failed to delete %q from S3 bucket %q, %w", object.Key, bucket, err)
+				}
+			}
+			report.Objects++
+			report.Bytes += object.Size
+		}
+	}
+	if !dryRun {
+		log.Printf("Deleted %d unreferenced blobs, %d bytes", report.Objects, report.Bytes)
+	}
+	return report, nil
+}
+
+// blobReferences returns the blob paths referred to by the tasks, the task runs and their stages, and the buckets
+// these may be in. A path refers to the blob in any bucket, which errs on the side of keeping blobs.
+func (registry *CloudTaskRegistry) blobReferences(ctx context.Context) (map[string]bool, []string, error) {
+	referenced := make(map[string]bool)
+	var buckets []string
+	addBucket := func(bucket string) {
+		if bucket != "" && !slices.Contains(buckets, bucket) {
+			buckets = append(buckets, bucket)
+		}
+	}
+	refer := func(paths ...string) {
+		for _, path := range paths {
+			if IsBlobPath(path) {
+				referenced[path] = true
+			}
+		}
+	}
+
+	tasks, err := registry.tasks.ListTasks(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list tasks, %w", err)
+	}
+	for _, task := range tasks {
+		addBucket(task.S3Bucket)
+		refer(task.Definition)
+	}
+	taskRuns, err := registry.ListAllTaskRuns(ctx, TaskRunFilter{Limit: deletionPageSize})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list task runs, %w", err)
+	}
+	for _, taskRun := range taskRuns {
+		refer(taskRun.TaskDefinition)
+		stages, err := registry.tasks.GetAllStages(ctx, taskRun.UUID)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to get stages of task run %s, %w", taskRun.UUID, err)
+		}
+		for _, stage := range stages {
+			addBucket(stage.S3Bucket)
+			refer(stage.Config, stage.Input, stage.Output)
+		}
+	}
+	return referenced, buckets, nil
+}
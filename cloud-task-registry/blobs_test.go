@@ -0,0 +1,96 @@
+package cloud_task_registry
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUploadBlob_MustSkipUploadOfSameContent(t *testing.T) {
+	// given
+	ctx := context.Background()
+	artifacts := &countingArtifactStore{ArtifactStore: NewMemoryArtifactStore()}
+	registry, err := New("", WithArtifactStore(artifacts),
+		WithTaskStore(NewMemoryTaskStore()), WithMessageQueue(NewMemoryMessageQueue()))
+	require.NoError(t, err)
+	tmpDir := t.TempDir()
+	first, second := filepath.Join(tmpDir, "optimization.in"), filepath.Join(tmpDir, "copy.in")
+	require.NoError(t, os.WriteFile(first, []byte("mesh=coarse"), 0o644))
+	require.NoError(t, os.WriteFile(second, []byte("mesh=coarse"), 0o644))
+	// when
+	firstPath, firstDigest, errFirst := registry.UploadBlob(ctx, first, "bucket")
+	secondPath, secondDigest, errSecond := registry.UploadBlob(ctx, second, "bucket")
+	// then
+	require.NoError(t, errFirst)
+	require.NoError(t, errSecond)
+	assert.Equal(t, BlobPath(firstDigest), firstPath)
+	assert.Equal(t, firstPath, secondPath)
+	assert.Equal(t, firstDigest, secondDigest)
+	assert.Equal(t, 1, artifacts.puts)
+}
+
+func TestCollectBlobs_MustDeleteOnlyOldUnreferencedBlobs(t *testing.T) {
+	// given
+	ctx := context.Background()
+	root := t.TempDir()
+	store, err := NewFileArtifactStore(root, "")
+	require.NoError(t, err)
+	registry, err := New("", WithArtifactStore(store),
+		WithTaskStore(NewMemoryTaskStore()), WithMessageQueue(NewMemoryMessageQueue()))
+	require.NoError(t, err)
+	upload := func(content string) string {
+		filePath := filepath.Join(t.TempDir(), "file")
+		require.NoError(t, os.WriteFile(filePath, []byte(content), 0o644))
+		s3Path, _, err := registry.UploadBlob(ctx, filePath, "bucket")
+		require.NoError(t, err)
+		return s3Path
+	}
+	definition, config, orphan, youngOrphan := upload("definition"), upload("config"), upload("orphan"), upload("young")
+	old := time.Now().Add(-MinBlobAge - time.Hour)
+	for _, s3Path := range []string{definition, config, orphan} {
+		require.NoError(t, os.Chtimes(filepath.Join(root, "bucket", s3Path), old, old))
+	}
+	require.NoError(t, registry.CreateTask(ctx, Task{ID: "task", S3Bucket: "bucket", Definition: definition}))
+	taskRun := TaskRun{TaskID: "task", UUID: "run-1", Status: TaskRunStatus_Finished, TaskDefinition: definition}
+	stage := Stage{TaskRunUUID: "run-1", NOrd: 1, Name: "cfd", Config: config, S3Bucket: "bucket"}
+	require.NoError(t, registry.CreateTaskRunWithStages(ctx, taskRun, []Stage{stage}))
+	// when
+	_, errDeleteRun := registry.DeleteTaskRun(ctx, "run-1", false)
+	_, errTooYoung := registry.CollectBlobs(ctx, time.Hour, false)
+	report, errCollect := registry.CollectBlobs(ctx, MinBlobAge, false)
+	// then
+	require.NoError(t, errDeleteRun)
+	assert.Error(t, errTooYoung)
+	require.NoError(t, errCollect)
+	assert.Equal(t, 2, report.Objects)
+	objects, err := store.ListObjects(ctx, "bucket", s3CommonPrefix+"/"+blobsFolder+"/")
+	require.NoError(t, err)
+	var remaining []string
+	for _, object := range objects {
+		remaining = append(remaining, object.Key)
+	}
+	assert.ElementsMatch(t, []string{definition, youngOrphan}, remaining)
+}
+
+// countingArtifactStore counts the objects put into the artifact store
+type countingArtifactStore struct {
+	ArtifactStore
+	puts int
+}
+
+func (store *countingArtifactStore) PutObject(
+	ctx context.Context,
+	bucket, key string,
+	body io.Reader,
+	storageClass StorageClass,
+	metadata map[string]string,
+) error {
+	store.puts++
+	return store.ArtifactStore.PutObject(ctx, bucket, key, body, storageClass, metadata)
+}
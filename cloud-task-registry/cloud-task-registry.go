@@ -3,96 +3,212 @@ package cloud_task_registry
 import (
 	"context"
 	"fmt"
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"net/url"
+	"strings"
+	"time"
 )
 
 const s3CommonPrefix = "task-registry"
 
+// migrationTimeout bounds waiting for the tables and indexes created by migrations to become active
+const migrationTimeout = 10 * time.Minute
+
+// cleanupTimeout bounds the cleanup after a failed operation, which runs even if the operation was cancelled
+const cleanupTimeout = 30 * time.Second
+
 type CloudTaskRegistry struct {
-	dynamodbClient *dynamodb.Client
-	s3Client       *s3.Client
-	sqsClient      *sqs.Client
+	tasks      TaskStore
+	artifacts  ArtifactStore
+	queues     MessageQueue
+	eventActor string
+	dlqName    string
+}
+
+type Option func(*options)
+
+type options struct {
+	config        *Config
+	skipMigrate   bool
+	taskStore     TaskStore
+	artifactStore ArtifactStore
+	messageQueue  MessageQueue
+	eventActor    string
+	dlqName       string
 }
 
-func New(dynamoDocApiEndpoint string) (*CloudTaskRegistry, error) {
-	configForDynamoDB, err := getAwsConfigForDynamoDB(dynamoDocApiEndpoint)
-	if err != nil {
-		return nil, fmt.Errorf("unable to load SDK config for DynamoDB, %w", err)
+// WithConfig sets cloud endpoints, regions and credentials profiles for the default DynamoDB, S3 and SQS backends
+// (Yandex Cloud defaults are used otherwise)
+func WithConfig(config Config) Option {
+	return func(o *options) {
+		o.config = &config
 	}
+}
 
-	configForS3, err := getAwsConfigForS3()
-	if err != nil {
-		return nil, fmt.Errorf("unable to load SDK config for S3, %w", err)
+// WithoutMigrations makes New skip schema migrations, e.g. when they are applied separately with --migrate-only,
+// so that a serverless container doesn't check the tables on every cold start
+func WithoutMigrations() Option {
+	return func(o *options) {
+		o.skipMigrate = true
 	}
+}
 
-	configForSQS, err := getAwsConfigForSQS()
-	if err != nil {
-		return nil, fmt.Errorf("unable to load SDK config for S3, %w", err)
+// WithTaskStore replaces the default DynamoDB task store (dynamoDocApiEndpoint is ignored then)
+func WithTaskStore(taskStore TaskStore) Option {
+	return func(o *options) {
+		o.taskStore = taskStore
 	}
+}
 
-	svc := dynamodb.NewFromConfig(configForDynamoDB)
-	if err = migrate(svc); err != nil {
-		return nil, err
+// WithArtifactStore replaces the default S3 artifact store
+func WithArtifactStore(artifactStore ArtifactStore) Option {
+	return func(o *options) {
+		o.artifactStore = artifactStore
 	}
+}
 
-	return &CloudTaskRegistry{
-		dynamodbClient: svc,
-		s3Client:       s3.NewFromConfig(configForS3),
-		sqsClient:      sqs.NewFromConfig(configForSQS),
-	}, nil
+// WithMessageQueue replaces the default SQS message queue
+func WithMessageQueue(messageQueue MessageQueue) Option {
+	return func(o *options) {
+		o.messageQueue = messageQueue
+	}
 }
 
-func getAwsConfigForDynamoDB(dynamoDocApiEndpoint string) (aws.Config, error) {
-	customResolver := aws.EndpointResolverWithOptionsFunc(
-		func(service, region string, options ...interface{}) (aws.Endpoint, error) {
-			return aws.Endpoint{URL: dynamoDocApiEndpoint, SigningRegion: "ru-central1"}, nil
-		},
-	)
-
-	cfg, err := config.LoadDefaultConfig(
-		context.Background(),
-		config.WithEndpointResolverWithOptions(customResolver),
-	)
-	return cfg, err
+// WithEventActor sets the actor of the events recorded by the registry (program@hostname by default),
+// see GetRunEvents
+func WithEventActor(actor string) Option {
+	return func(o *options) {
+		o.eventActor = actor
+	}
 }
 
-func getAwsConfigForS3() (aws.Config, error) {
-	// See https://yandex.cloud/ru/docs/storage/tools/aws-sdk-go
-	customResolver := aws.EndpointResolverWithOptionsFunc(
-		func(service, region string, options ...interface{}) (aws.Endpoint, error) {
-			if service == s3.ServiceID && region == "ru-central1" {
-				return aws.Endpoint{
-					PartitionID:   "yc",
-					URL:           "https://storage.yandexcloud.net",
-					SigningRegion: "ru-central1",
-				}, nil
-			}
-			return aws.Endpoint{}, fmt.Errorf("unknown endpoint requested")
-		})
-
-	cfg, err := config.LoadDefaultConfig(
-		context.Background(),
-		config.WithEndpointResolverWithOptions(customResolver),
-	)
-	return cfg, err
+// WithDeadLetterQueue sets the dead-letter queue of the stage queues ("DLQ" by default), which the deletion of task
+// runs purges of their pending messages
+func WithDeadLetterQueue(dlqName string) Option {
+	return func(o *options) {
+		o.dlqName = dlqName
+	}
+}
+
+// OptionsFromURL translates the --registry flag value into options for New:
+//   - "" or "dynamodb://" - DynamoDB, S3 and SQS (default)
+//   - "sqlite:///path/to/registry.db" - task runs, stages and queues in a local SQLite file
+//   - "memory://" - everything in process memory
+func OptionsFromURL(registryURL string) ([]Option, error) {
+	switch {
+	case registryURL == "" || registryURL == "dynamodb://":
+		return nil, nil
+	case strings.HasPrefix(registryURL, "sqlite://"):
+		store, err := NewSQLiteStore(strings.TrimPrefix(registryURL, "sqlite://"))
+		if err != nil {
+			return nil, err
+		}
+		return []Option{WithTaskStore(store), WithMessageQueue(store)}, nil
+	case registryURL == "memory://":
+		return []Option{
+			WithTaskStore(NewMemoryTaskStore()),
+			WithArtifactStore(NewMemoryArtifactStore()),
+			WithMessageQueue(NewMemoryMessageQueue()),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported task registry URL %q", registryURL)
+	}
+}
+
+// ArtifactOptionsFromURL translates the --artifact-store flag value into options for New:
+//   - "" or "s3://" - S3 (default)
+//   - "file:///mnt/shared/artifacts" - local or NFS directory (bucket becomes a subdirectory);
+//     add "?cold=/mnt/cold/artifacts" to keep extra artifacts (cold storage class) in another directory
+func ArtifactOptionsFromURL(artifactStoreURL string) ([]Option, error) {
+	switch {
+	case artifactStoreURL == "" || artifactStoreURL == "s3://":
+		return nil, nil
+	case strings.HasPrefix(artifactStoreURL, "file://"):
+		u, err := url.Parse(artifactStoreURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid artifact store URL %q: %w", artifactStoreURL, err)
+		}
+		store, err := NewFileArtifactStore(u.Path, u.Query().Get("cold"))
+		if err != nil {
+			return nil, err
+		}
+		return []Option{WithArtifactStore(store)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported artifact store URL %q", artifactStoreURL)
+	}
 }
 
-func getAwsConfigForSQS() (aws.Config, error) {
-	customResolver := aws.EndpointResolverWithOptionsFunc(
-		func(service, region string, options ...interface{}) (aws.Endpoint, error) {
-			return aws.Endpoint{
-				URL:           "https://message-queue.api.cloud.yandex.net",
-				SigningRegion: "ru-central1",
-			}, nil
-		})
-
-	cfg, err := config.LoadDefaultConfig(
-		context.Background(),
-		config.WithEndpointResolverWithOptions(customResolver),
-	)
-	return cfg, err
+func New(dynamoDocApiEndpoint string, opts ...Option) (*CloudTaskRegistry, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	var cfg Config
+	if o.config != nil {
+		cfg = *o.config
+	} else {
+		defaultConfig, err := DefaultConfig(Provider_Yandex)
+		if err != nil {
+			return nil, err
+		}
+		cfg = defaultConfig
+	}
+	if dynamoDocApiEndpoint != "" {
+		cfg.DynamoDB.Endpoint = dynamoDocApiEndpoint
+	}
+
+	if o.taskStore == nil {
+		if cfg.DynamoDB.Endpoint == "" && cfg.Provider != Provider_AWS {
+			return nil, fmt.Errorf("DynamoDB Document API endpoint is required for the %s cloud "+
+				"(use --dynamo-docapi-endpoint or %s)", cfg.Provider, dynamoDBEndpointEnv)
+		}
+		taskStore, err := NewDynamoDBTaskStore(cfg.DynamoDB)
+		if err != nil {
+			return nil, err
+		}
+		o.taskStore = taskStore
+	}
+
+	if o.artifactStore == nil {
+		artifactStore, err := NewS3ArtifactStore(cfg.S3)
+		if err != nil {
+			return nil, err
+		}
+		o.artifactStore = artifactStore
+	}
+
+	if o.messageQueue == nil {
+		messageQueue, err := NewSQSMessageQueue(cfg.SQS)
+		if err != nil {
+			return nil, err
+		}
+		o.messageQueue = messageQueue
+	}
+
+	if !o.skipMigrate {
+		ctx, cancel := context.WithTimeout(context.Background(), migrationTimeout)
+		defer cancel()
+		for _, store := range []any{o.taskStore, o.artifactStore, o.messageQueue} {
+			if migrator, ok := store.(Migrator); ok {
+				if err := migrator.Migrate(ctx); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	if o.eventActor == "" {
+		o.eventActor = defaultEventActor()
+	}
+
+	if o.dlqName == "" {
+		o.dlqName = defaultDeadLetterQueue
+	}
+	return &CloudTaskRegistry{
+		tasks:      o.taskStore,
+		artifacts:  o.artifactStore,
+		queues:     o.messageQueue,
+		eventActor: o.eventActor,
+		dlqName:    o.dlqName,
+	}, nil
 }
@@ -7,137 +7,123 @@ import (
 	"math/rand"
 	"strings"
 	"time"
-
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/sqs"
 )
 
 const finishedTasksQ = "finished-tasks"
 
 const longPollingInterval = 20 // seconds
 
-func (registry *CloudTaskRegistry) FinishTaskRun(taskRunUUID string) error {
-	err := sendMessageToSQS(finishedTasksQ, taskRunUUID, registry.sqsClient)
-	if err != nil {
-		return fmt.Errorf("error sending message to SQS queue %q, %w", finishedTasksQ, err)
+// FinishTaskRun reports the task run as finished to the reply queue of the runner waiting for it (see WaitForReply),
+// or to the shared finished-tasks queue if the message has no reply queue (see WaitForPipelineFinish)
+func (registry *CloudTaskRegistry) FinishTaskRun(ctx context.Context, message TaskMessage) error {
+	message.TargetStage, message.Attempt = "", 0
+	queueName := finishedTasksQ
+	if message.ReplyTo != "" {
+		queueName = message.ReplyTo
+	}
+	if err := registry.sendTaskMessage(ctx, queueName, &message); err != nil {
+		return err
 	}
-	log.Println("Task run", taskRunUUID, "is marked as finished")
+	registry.recordEvent(ctx, message.TaskRunUUID, "", EventType_Handover, "to "+queueName)
+	log.Println("Task run", message.TaskRunUUID, "is marked as finished")
 	return nil
 }
 
-func (registry *CloudTaskRegistry) PassTaskToStage(stage *Stage) error {
-	err := sendMessageToSQS(stage.Name, stage.TaskRunUUID, registry.sqsClient)
-	if err != nil {
-		return fmt.Errorf("error sending message to SQS queue %q, %w", stage.Name, err)
+// PassTaskToStage sends the message to the queue of the stage, the message is addressed to the next attempt
+// of the stage
+func (registry *CloudTaskRegistry) PassTaskToStage(ctx context.Context, stage *Stage, message TaskMessage) error {
+	message.TargetStage, message.Attempt = stage.Name, len(stage.Attempts)+1
+	if err := registry.sendTaskMessage(ctx, stage.Name, &message); err != nil {
+		return err
 	}
+	registry.recordEvent(ctx, stage.TaskRunUUID, stage.Name, EventType_Handover, "to "+stage.Name)
 	log.Println("Passed task to stage", stage.Name)
 	return nil
 }
 
-func sendMessageToSQS(queueName, messageBody string, svc *sqs.Client) error {
-	queueUrl, err := getQueueUrl(queueName, svc)
+func (registry *CloudTaskRegistry) sendTaskMessage(ctx context.Context, queueName string, message *TaskMessage) error {
+	now := time.Now().UTC()
+	message.Version, message.EnqueuedUTC = TaskMessageVersion, &now
+	body, err := message.encode()
 	if err != nil {
-		return fmt.Errorf("error getting SQS queue URL for name %q, %w", queueName, err)
+		return err
 	}
-	_, err = svc.SendMessage(context.TODO(), &sqs.SendMessageInput{
-		QueueUrl:    aws.String(queueUrl),
-		MessageBody: aws.String(messageBody),
-	})
-	return err
-}
-
-func getQueueUrl(queueName string, svc *sqs.Client) (string, error) {
-	result, err := svc.GetQueueUrl(context.TODO(), &sqs.GetQueueUrlInput{
-		QueueName: aws.String(queueName),
-	})
-	if err != nil {
-		return "", err
+	if err := registry.queues.SendMessage(ctx, queueName, body); err != nil {
+		return fmt.Errorf("error sending message to SQS queue %q, %w", queueName, err)
 	}
-	return *result.QueueUrl, nil
+	return nil
 }
 
+// WaitForPipelineFinish blocks until the expected task run is reported as finished to the shared finished-tasks queue
+// or ctx is done, in which case ctx.Err() is returned. The runners waiting on the shared queue pass each other's
+// messages back and forth, WaitForReply doesn't.
 func (registry *CloudTaskRegistry) WaitForPipelineFinish(
+	ctx context.Context,
 	taskId string,
 	expectedTaskRunUUID string,
-	wasCancelled chan bool,
 ) (string, error) {
-	ctx, cancel := context.WithCancel(context.Background())
-	go func() {
-		<-wasCancelled
-		cancel()
-	}()
-	defer func() {
-		wasCancelled <- false
-	}()
-
-	queueURL, err := getQueueUrl(finishedTasksQ, registry.sqsClient)
-	if err != nil {
-		return "", fmt.Errorf("error getting SQS queue URL for name %q, %w", finishedTasksQ, err)
-	}
 	log.Println("Waiting for the pipeline to finish...")
 	for {
 		// Receive messages with long polling
-		output, err := registry.sqsClient.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
-			QueueUrl:            aws.String(queueURL),
-			MaxNumberOfMessages: 1,
-			WaitTimeSeconds:     longPollingInterval,
-		})
+		message, err := registry.queues.ReceiveMessage(ctx, finishedTasksQ, longPollingInterval*time.Second)
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
 		if err != nil {
 			return "", fmt.Errorf("failed to receive messages, %w", err)
 		}
 
-		if len(output.Messages) == 0 {
-			registry.printStatusReport(taskId, expectedTaskRunUUID)
+		if message == nil {
+			registry.printStatusReport(ctx, taskId, expectedTaskRunUUID)
 			continue
 		}
 
 		log.Printf("Received a message from %s queue\n", finishedTasksQ)
-		if len(output.Messages) > 1 {
-			log.Println("Received message count is more than 1! Only the first will be taken.")
-		}
 
-		finishedTaskRunUUID := output.Messages[0].Body
-		if *finishedTaskRunUUID != expectedTaskRunUUID {
+		finished, err := ParseTaskMessage(message.Body)
+		if err != nil {
+			log.Printf("Failed to parse the message (it may be sent by a newer version), %v\n", err)
+			finished = &TaskMessage{}
+		}
+		finishedTaskRunUUID := finished.TaskRunUUID
+		if finishedTaskRunUUID != expectedTaskRunUUID {
 			log.Printf("Pipeline returned %s as finished task but expected %s, keep waiting...\n",
-				*finishedTaskRunUUID, expectedTaskRunUUID)
-			err := makeMessageMaximallyVisible(finishedTasksQ, *output.Messages[0].ReceiptHandle, registry.sqsClient)
+				finishedTaskRunUUID, expectedTaskRunUUID)
+			err := registry.makeMessageMaximallyVisible(ctx, finishedTasksQ, message.ReceiptHandle)
 			if err != nil {
 				log.Printf("Failed to set message visibility timeout to 0 due to an error: %v\n", err)
 				log.Println("You can try sending SIGSTOP and SIGCONT to one of the task runners " +
 					"to break the tie between them if this is the case.")
 			}
-			registry.printStatusReport(taskId, expectedTaskRunUUID)
+			registry.printStatusReport(ctx, taskId, expectedTaskRunUUID)
 			interrupted := SleepInterruptibly(ctx, time.Duration(rand.Intn(3000))*time.Millisecond)
 			if interrupted {
-				return expectedTaskRunUUID, nil
+				return "", ctx.Err()
 			} else {
 				continue
 			}
 		} else {
-			log.Println("TaskRun", *finishedTaskRunUUID, "finished!")
-			_, err = registry.sqsClient.DeleteMessage(context.TODO(), &sqs.DeleteMessageInput{
-				QueueUrl:      aws.String(queueURL),
-				ReceiptHandle: output.Messages[0].ReceiptHandle,
-			})
+			log.Println("TaskRun", finishedTaskRunUUID, "finished!", describeTaskMessage(finished))
+			err = registry.queues.DeleteMessage(ctx, finishedTasksQ, message.ReceiptHandle)
 			if err != nil {
-				fmt.Printf("failed to remove message from the queue (non-critical error), %w", err)
+				log.Printf("failed to remove message from the queue (non-critical error), %v", err)
 			}
 		}
 
-		return *finishedTaskRunUUID, nil
+		return finishedTaskRunUUID, nil
 	}
 }
 
-func (registry *CloudTaskRegistry) printStatusReport(taskId string, expectedTaskRunUUID string) {
-	stagesStatusReport, err := registry.getStagesStatusReport(expectedTaskRunUUID)
+func (registry *CloudTaskRegistry) printStatusReport(ctx context.Context, taskId string, expectedTaskRunUUID string) {
+	stagesStatusReport, err := registry.getStagesStatusReport(ctx, expectedTaskRunUUID)
 	if err != nil {
 		log.Printf("failed to get stages status report (non-critical error), %v", err)
 	}
 	log.Printf("%s (run %s): %s\n", taskId, expectedTaskRunUUID, stagesStatusReport)
 }
 
-func (registry *CloudTaskRegistry) getStagesStatusReport(taskRunUUID string) (string, error) {
-	stages, err := registry.GetAllStages(taskRunUUID)
+func (registry *CloudTaskRegistry) getStagesStatusReport(ctx context.Context, taskRunUUID string) (string, error) {
+	stages, err := registry.GetAllStages(ctx, taskRunUUID)
 	if err != nil {
 		return "", fmt.Errorf("failed getting stages information from DB: %w", err)
 	}
@@ -159,69 +145,45 @@ func SleepInterruptibly(ctx context.Context, d time.Duration) bool {
 	return false
 }
 
-func makeMessageMaximallyVisible(queueName, receiptHandle string, svc *sqs.Client) error {
-	queueUrl, err := getQueueUrl(queueName, svc)
-	if err != nil {
-		return fmt.Errorf("error getting SQS queue URL for name %q, %w", queueName, err)
-	}
-
-	input := &sqs.ChangeMessageVisibilityInput{
-		QueueUrl:          aws.String(queueUrl),
-		ReceiptHandle:     aws.String(receiptHandle),
-		VisibilityTimeout: 0,
-	}
-
-	_, err = svc.ChangeMessageVisibility(context.TODO(), input)
-	if err != nil {
-		return fmt.Errorf("failed to change message visibility: %w", err)
-	}
-	return nil
+func (registry *CloudTaskRegistry) makeMessageMaximallyVisible(ctx context.Context, queueName, receiptHandle string) error {
+	return registry.queues.ChangeMessageVisibility(ctx, queueName, receiptHandle, 0)
 }
 
+// WaitForDLQ blocks until the expected task run lands in the dead-letter queue or ctx is done,
+// in which case ctx.Err() is returned. It's the counterpart of WaitForPipelineFinish, see DispatchDeadLetters
+// for the counterpart of WaitForReply.
 func (registry *CloudTaskRegistry) WaitForDLQ(
+	ctx context.Context,
 	dlqName string,
 	expectedTaskRunUUID string,
-	wasCancelled chan bool,
 ) (string, error) {
-	ctx, cancel := context.WithCancel(context.Background())
-	go func() {
-		<-wasCancelled
-		cancel()
-	}()
-	defer func() {
-		wasCancelled <- false
-	}()
-
-	queueURL, err := getQueueUrl(dlqName, registry.sqsClient)
-	if err != nil {
-		return "", fmt.Errorf("error getting SQS queue URL for name %q, %w", finishedTasksQ, err)
-	}
 	log.Println("Waiting for the dead-letter queue...")
 	for {
 		// Receive messages with long polling
-		output, err := registry.sqsClient.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
-			QueueUrl:            aws.String(queueURL),
-			MaxNumberOfMessages: 1,
-			WaitTimeSeconds:     longPollingInterval,
-		})
+		message, err := registry.queues.ReceiveMessage(ctx, dlqName, longPollingInterval*time.Second)
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
 		if err != nil {
 			return "", fmt.Errorf("failed to receive messages, %w", err)
 		}
 
-		if len(output.Messages) == 0 {
+		if message == nil {
 			continue
 		}
 
 		log.Printf("Received a message from the dead-letter queue %s\n", dlqName)
-		if len(output.Messages) > 1 {
-			log.Println("Received message count is more than 1! Only the first will be taken.")
-		}
 
-		failedTaskRunUUID := output.Messages[0].Body
-		if *failedTaskRunUUID != expectedTaskRunUUID {
+		failed, err := ParseTaskMessage(message.Body)
+		if err != nil {
+			log.Printf("Failed to parse the message (it may be sent by a newer version), %v\n", err)
+			failed = &TaskMessage{}
+		}
+		failedTaskRunUUID := failed.TaskRunUUID
+		if failedTaskRunUUID != expectedTaskRunUUID {
 			log.Printf("DLQ returned %s as a failed task but expected %s, keep waiting...\n",
-				*failedTaskRunUUID, expectedTaskRunUUID)
-			err := makeMessageMaximallyVisible(dlqName, *output.Messages[0].ReceiptHandle, registry.sqsClient)
+				failedTaskRunUUID, expectedTaskRunUUID)
+			err := registry.makeMessageMaximallyVisible(ctx, dlqName, message.ReceiptHandle)
 			if err != nil {
 				log.Printf("Failed to set message visibility timeout to 0 due to an error: %v\n", err)
 				log.Println("You can try sending SIGSTOP and SIGCONT to one of the task runners " +
@@ -229,21 +191,40 @@ func (registry *CloudTaskRegistry) WaitForDLQ(
 			}
 			interrupted := SleepInterruptibly(ctx, time.Duration(rand.Intn(3000))*time.Millisecond)
 			if interrupted {
-				return expectedTaskRunUUID, nil
+				return "", ctx.Err()
 			} else {
 				continue
 			}
 		} else {
-			log.Println("TaskRun", *failedTaskRunUUID, "failed!")
-			_, err = registry.sqsClient.DeleteMessage(context.TODO(), &sqs.DeleteMessageInput{
-				QueueUrl:      aws.String(queueURL),
-				ReceiptHandle: output.Messages[0].ReceiptHandle,
-			})
+			log.Println("TaskRun", failedTaskRunUUID, "failed!", describeTaskMessage(failed))
+			registry.recordEvent(ctx, failedTaskRunUUID, failed.TargetStage, EventType_DLQ, "landed in "+dlqName)
+			err = registry.queues.DeleteMessage(ctx, dlqName, message.ReceiptHandle)
 			if err != nil {
-				fmt.Printf("failed to remove message from the queue (non-critical error), %w", err)
+				log.Printf("failed to remove message from the queue (non-critical error), %v", err)
 			}
 		}
 
-		return *failedTaskRunUUID, nil
+		return failedTaskRunUUID, nil
+	}
+}
+
+// describeTaskMessage tells where the message was going and how long it has been queued, if the message says so
+func describeTaskMessage(message *TaskMessage) string {
+	var parts []string
+	if message.TargetStage != "" {
+		parts = append(parts, fmt.Sprintf("stage %s (attempt %d)", message.TargetStage, message.Attempt))
+	}
+	if message.SourceStage != "" {
+		parts = append(parts, "passed by stage "+message.SourceStage)
+	}
+	if message.EnqueuedUTC != nil {
+		parts = append(parts, fmt.Sprintf("queued for %s", message.QueueWaitTime(time.Now()).Round(time.Millisecond)))
+	}
+	if message.TraceID != "" {
+		parts = append(parts, "trace "+message.TraceID)
+	}
+	if len(parts) == 0 {
+		return ""
 	}
+	return "[" + strings.Join(parts, ", ") + "]"
 }
@@ -0,0 +1,167 @@
+package cloud_task_registry
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWaitForPipelineFinish_MustReturnContextErrorWhenCancelled(t *testing.T) {
+	// given
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	registry := NewInMemory()
+	require.NoError(t, registry.FinishTaskRun(ctx, NewTaskMessage(&TaskRun{TaskID: "task", UUID: "run-other"}, "cfd", "")))
+	// when
+	started := time.Now()
+	finishedTaskRunUUID, err := registry.WaitForPipelineFinish(ctx, "task", "run-1")
+	// then
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Empty(t, finishedTaskRunUUID)
+	assert.Less(t, time.Since(started), 5*time.Second)
+}
+
+func TestWaitForDLQ_MustAcceptEnvelopeAndLegacyBodies(t *testing.T) {
+	// given
+	ctx := context.Background()
+	registry := NewInMemory()
+	taskRun := TaskRun{TaskID: "task", UUID: "run-1"}
+	message := NewTaskMessage(&taskRun, "mesh", "")
+	require.NoError(t, registry.PassTaskToStage(ctx, &Stage{TaskRunUUID: "run-1", Name: "DLQ"}, message))
+	legacyUUID := "0190d0e4-7c1f-7b2a-9a53-3f0e7f2c1a11"
+	require.NoError(t, registry.queues.SendMessage(ctx, "DLQ", legacyUUID))
+	// when
+	first, errFirst := registry.WaitForDLQ(ctx, "DLQ", "run-1")
+	second, errSecond := registry.WaitForDLQ(ctx, "DLQ", legacyUUID)
+	// then
+	require.NoError(t, errFirst)
+	require.NoError(t, errSecond)
+	assert.Equal(t, "run-1", first)
+	assert.Equal(t, legacyUUID, second)
+	events, err := registry.GetRunEvents(ctx, "run-1")
+	require.NoError(t, err)
+	require.NotEmpty(t, events)
+	assert.Equal(t, EventType_DLQ, events[len(events)-1].Type)
+	assert.Equal(t, "DLQ", events[len(events)-1].Stage)
+}
+
+func TestWaitForReply_MustReceiveOnlyOwnRunsIncludingDeadLetters(t *testing.T) {
+	// given
+	ctx := context.Background()
+	queues := NewMemoryMessageQueue()
+	registry, err := New("", WithTaskStore(NewMemoryTaskStore()), WithMessageQueue(queues),
+		WithArtifactStore(NewMemoryArtifactStore()))
+	require.NoError(t, err)
+	runs := []TaskRun{{TaskID: "task", UUID: "run-1"}, {TaskID: "task", UUID: "run-2"}}
+	replyQueues := make([]string, len(runs))
+	for i, taskRun := range runs {
+		replyQueues[i], err = registry.OpenReplyQueue(ctx, taskRun.UUID)
+		require.NoError(t, err)
+		message := NewTaskMessage(&taskRun, "", "")
+		message.ReplyTo = replyQueues[i]
+		require.NoError(t, registry.PassTaskToStage(ctx, &Stage{TaskRunUUID: taskRun.UUID, Name: "cfd"}, message))
+	}
+	// run-1 is finished by the last stage, run-2 exhausts the retries of the cfd queue
+	finishing, err := queues.ReceiveMessage(ctx, "cfd", 0)
+	require.NoError(t, err)
+	received, err := ParseTaskMessage(finishing.Body)
+	require.NoError(t, err)
+	require.NoError(t, registry.FinishTaskRun(ctx, received.PassOn(&runs[0], "cfd")))
+	dead, err := queues.ReceiveMessage(ctx, "cfd", 0)
+	require.NoError(t, err)
+	require.NoError(t, queues.SendMessage(ctx, "DLQ", dead.Body))
+	dispatchCtx, stopDispatching := context.WithCancel(ctx)
+	dispatched := make(chan error, 1)
+	go func() { dispatched <- registry.DispatchDeadLetters(dispatchCtx, "DLQ") }()
+	// when
+	finished, errFinished := registry.WaitForReply(ctx, replyQueues[0], "task", "run-1")
+	failed, errFailed := registry.WaitForReply(ctx, replyQueues[1], "task", "run-2")
+	stopDispatching()
+	// then
+	require.NoError(t, errFinished)
+	require.NoError(t, errFailed)
+	assert.Equal(t, "run-1", finished.TaskRunUUID)
+	assert.False(t, finished.DeadLettered)
+	assert.Equal(t, "cfd", finished.SourceStage)
+	assert.Equal(t, "run-2", failed.TaskRunUUID)
+	assert.True(t, failed.DeadLettered)
+	assert.Equal(t, "cfd", failed.TargetStage)
+	assert.ErrorIs(t, <-dispatched, context.Canceled)
+	shared, err := queues.ReceiveMessage(ctx, finishedTasksQ, 0)
+	require.NoError(t, err)
+	assert.Nil(t, shared, "the shared queue must not be used when there is a reply queue")
+	require.NoError(t, registry.CloseReplyQueue(ctx, "run-1"))
+	require.NoError(t, registry.CloseReplyQueue(ctx, "run-1"))
+}
+
+func TestDispatchDeadLetters_MustDropDeadLetterWhoseReplyQueueIsGone(t *testing.T) {
+	// given
+	ctx := context.Background()
+	queues := NewMemoryMessageQueue()
+	registry, err := New("", WithTaskStore(NewMemoryTaskStore()), WithMessageQueue(queues),
+		WithArtifactStore(NewMemoryArtifactStore()))
+	require.NoError(t, err)
+	taskRun := TaskRun{TaskID: "task", UUID: "run-1", Status: TaskRunStatus_Submitted}
+	require.NoError(t, registry.InsertTaskRun(ctx, taskRun))
+	message := NewTaskMessage(&taskRun, "", "")
+	message.ReplyTo, err = registry.OpenReplyQueue(ctx, taskRun.UUID)
+	require.NoError(t, err)
+	message.TargetStage = "cfd"
+	body, err := message.encode()
+	require.NoError(t, err)
+	require.NoError(t, queues.SendMessage(ctx, "DLQ", body))
+	// The runner has been killed and its reply queue deleted by gc
+	require.NoError(t, registry.CloseReplyQueue(ctx, taskRun.UUID))
+	dispatchCtx, stopDispatching := context.WithCancel(ctx)
+	dispatched := make(chan error, 1)
+	// when
+	go func() { dispatched <- registry.DispatchDeadLetters(dispatchCtx, "DLQ") }()
+	// then
+	assert.Eventually(t, func() bool {
+		events, err := registry.GetRunEvents(ctx, taskRun.UUID)
+		return err == nil && len(events) > 0 && events[len(events)-1].Type == EventType_DLQ
+	}, 5*time.Second, 10*time.Millisecond)
+	stopDispatching()
+	assert.ErrorIs(t, <-dispatched, context.Canceled)
+	assert.Empty(t, queues.queues["DLQ"], "the dead letter must be dropped rather than retried")
+	events, err := registry.GetRunEvents(ctx, taskRun.UUID)
+	require.NoError(t, err)
+	assert.Contains(t, events[len(events)-1].Details, "dropped")
+}
+
+func TestDispatchDeadLetters_MustParkGarbageAndDropLegacyLettersNobodyWaitsFor(t *testing.T) {
+	// given
+	ctx := context.Background()
+	queues := NewMemoryMessageQueue()
+	registry, err := New("", WithTaskStore(NewMemoryTaskStore()), WithMessageQueue(queues),
+		WithArtifactStore(NewMemoryArtifactStore()))
+	require.NoError(t, err)
+	awaited, failed := "0190d0e4-7c1f-7b2a-9a53-3f0e7f2c1a11", "0190d0e4-7c1f-7b2a-9a53-3f0e7f2c1a12"
+	require.NoError(t, registry.InsertTaskRun(ctx, TaskRun{TaskID: "task", UUID: awaited, Status: TaskRunStatus_Submitted}))
+	require.NoError(t, registry.InsertTaskRun(ctx, TaskRun{TaskID: "task", UUID: failed, Status: TaskRunStatus_Failed}))
+	for _, body := range []string{"garbage", failed, awaited} {
+		require.NoError(t, queues.SendMessage(ctx, "DLQ", body))
+	}
+	dispatchCtx, stopDispatching := context.WithCancel(ctx)
+	dispatched := make(chan error, 1)
+	// when
+	go func() { dispatched <- registry.DispatchDeadLetters(dispatchCtx, "DLQ") }()
+	// then
+	parked := func() bool {
+		queues.mu.Lock()
+		defer queues.mu.Unlock()
+		letters := queues.queues["DLQ"]
+		return len(letters) == 2 && letters[0].invisibleUntil.After(time.Now().Add(time.Hour))
+	}
+	assert.Eventually(t, parked, 5*time.Second, 10*time.Millisecond)
+	stopDispatching()
+	assert.ErrorIs(t, <-dispatched, context.Canceled)
+	var bodies []string
+	for _, letter := range queues.queues["DLQ"] {
+		bodies = append(bodies, letter.body)
+	}
+	assert.Equal(t, []string{"garbage", awaited}, bodies, "the runner of the awaited run is waiting with WaitForDLQ")
+}
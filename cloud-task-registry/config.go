@@ -0,0 +1,290 @@
+package cloud_task_registry
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	Provider_Yandex = "yandex"
+	Provider_AWS    = "aws"
+)
+
+// Config describes how to reach the cloud services behind the registry. The defaults depend on the provider:
+// for Yandex Cloud they point at Object Storage and Message Queue in ru-central1, for AWS they are left empty,
+// so that the SDK resolves them as usual. Set the endpoints to use MinIO, LocalStack, ElasticMQ and the like.
+type Config struct {
+	Provider string        `yaml:"provider"`
+	DynamoDB ServiceConfig `yaml:"dynamodb"`
+	S3       ServiceConfig `yaml:"s3"`
+	SQS      ServiceConfig `yaml:"sqs"`
+}
+
+type ServiceConfig struct {
+	Endpoint  string `yaml:"endpoint"`
+	Region    string `yaml:"region"`
+	Profile   string `yaml:"profile"`    // profile from the shared AWS credentials/config files
+	PathStyle bool   `yaml:"path_style"` // S3 only: address buckets as <endpoint>/<bucket> instead of <bucket>.<endpoint>
+	// S3 only: files larger than a part are uploaded and downloaded in parts
+	Transfer TransferConfig `yaml:"transfer"`
+}
+
+// TransferConfig tunes transfers of large files, zero fields take the defaults
+type TransferConfig struct {
+	PartSizeMB  int `yaml:"part_size_mb"` // 64 by default, at least 5
+	Concurrency int `yaml:"concurrency"`  // parts transferred in parallel, 4 by default
+	PartRetries int `yaml:"part_retries"` // retries of a failed part on top of the SDK ones, 3 by default
+}
+
+func DefaultConfig(provider string) (Config, error) {
+	switch provider {
+	case "", Provider_Yandex:
+		// See https://yandex.cloud/ru/docs/storage/tools/aws-sdk-go
+		// DynamoDB endpoint is specific to a YDB database, so it has no default
+		return Config{
+			Provider: Provider_Yandex,
+			DynamoDB: ServiceConfig{Region: "ru-central1"},
+			S3:       ServiceConfig{Endpoint: "https://storage.yandexcloud.net", Region: "ru-central1"},
+			SQS:      ServiceConfig{Endpoint: "https://message-queue.api.cloud.yandex.net", Region: "ru-central1"},
+		}, nil
+	case Provider_AWS:
+		return Config{Provider: Provider_AWS}, nil
+	default:
+		return Config{}, fmt.Errorf("unsupported cloud provider %q", provider)
+	}
+}
+
+// LoadConfigFile reads a YAML profile on top of the defaults for the provider declared in it
+func LoadConfigFile(path string) (Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, fmt.Errorf("failed to read registry config %q: %w", path, err)
+	}
+	return parseConfig(data, "")
+}
+
+func parseConfig(data []byte, providerOverride string) (Config, error) {
+	var declared struct {
+		Provider string `yaml:"provider"`
+	}
+	if err := yaml.Unmarshal(data, &declared); err != nil {
+		return Config{}, fmt.Errorf("failed to unmarshal registry config: %w", err)
+	}
+	provider := declared.Provider
+	if providerOverride != "" {
+		provider = providerOverride
+	}
+
+	cfg, err := DefaultConfig(provider)
+	if err != nil {
+		return Config{}, err
+	}
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return Config{}, fmt.Errorf("failed to unmarshal registry config: %w", err)
+	}
+	cfg.Provider = provider
+	if cfg.Provider == "" {
+		cfg.Provider = Provider_Yandex
+	}
+	return cfg, nil
+}
+
+// configSetting is a single Config field that can be set from an environment variable or a command-line flag
+type configSetting struct {
+	flag  string
+	env   string
+	usage string
+	set   func(cfg *Config, value string) error
+}
+
+var configSettings = []configSetting{
+	stringSetting("dynamodb-region", "TASK_REGISTRY_DYNAMODB_REGION", "DynamoDB region",
+		func(cfg *Config) *string { return &cfg.DynamoDB.Region }),
+	stringSetting("dynamodb-profile", "TASK_REGISTRY_DYNAMODB_PROFILE", "AWS credentials profile for DynamoDB",
+		func(cfg *Config) *string { return &cfg.DynamoDB.Profile }),
+	stringSetting("s3-endpoint", "TASK_REGISTRY_S3_ENDPOINT", "S3 endpoint URL",
+		func(cfg *Config) *string { return &cfg.S3.Endpoint }),
+	stringSetting("s3-region", "TASK_REGISTRY_S3_REGION", "S3 region",
+		func(cfg *Config) *string { return &cfg.S3.Region }),
+	stringSetting("s3-profile", "TASK_REGISTRY_S3_PROFILE", "AWS credentials profile for S3",
+		func(cfg *Config) *string { return &cfg.S3.Profile }),
+	{
+		flag:  "s3-path-style",
+		env:   "TASK_REGISTRY_S3_PATH_STYLE",
+		usage: "Use path-style S3 addressing (true/false), needed for MinIO and LocalStack",
+		set: func(cfg *Config, value string) error {
+			pathStyle, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("invalid S3 path style setting %q: %w", value, err)
+			}
+			cfg.S3.PathStyle = pathStyle
+			return nil
+		},
+	},
+	intSetting("s3-part-size-mb", "TASK_REGISTRY_S3_PART_SIZE_MB",
+		"Size of the parts large files are uploaded and downloaded in, MiB",
+		func(cfg *Config) *int { return &cfg.S3.Transfer.PartSizeMB }),
+	intSetting("s3-concurrency", "TASK_REGISTRY_S3_CONCURRENCY", "Number of parts transferred in parallel",
+		func(cfg *Config) *int { return &cfg.S3.Transfer.Concurrency }),
+	intSetting("s3-part-retries", "TASK_REGISTRY_S3_PART_RETRIES", "Number of retries of a failed part",
+		func(cfg *Config) *int { return &cfg.S3.Transfer.PartRetries }),
+	stringSetting("sqs-endpoint", "TASK_REGISTRY_SQS_ENDPOINT", "SQS endpoint URL",
+		func(cfg *Config) *string { return &cfg.SQS.Endpoint }),
+	stringSetting("sqs-region", "TASK_REGISTRY_SQS_REGION", "SQS region",
+		func(cfg *Config) *string { return &cfg.SQS.Region }),
+	stringSetting("sqs-profile", "TASK_REGISTRY_SQS_PROFILE", "AWS credentials profile for SQS",
+		func(cfg *Config) *string { return &cfg.SQS.Profile }),
+}
+
+// dynamoDBEndpointEnv has no flag here since all the binaries already have --dynamo-docapi-endpoint
+const dynamoDBEndpointEnv = "TASK_REGISTRY_DYNAMODB_ENDPOINT"
+
+func stringSetting(flagName, env, usage string, field func(cfg *Config) *string) configSetting {
+	return configSetting{
+		flag:  flagName,
+		env:   env,
+		usage: usage,
+		set: func(cfg *Config, value string) error {
+			*field(cfg) = value
+			return nil
+		},
+	}
+}
+
+func intSetting(flagName, env, usage string, field func(cfg *Config) *int) configSetting {
+	return configSetting{
+		flag:  flagName,
+		env:   env,
+		usage: usage,
+		set: func(cfg *Config, value string) error {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return fmt.Errorf("invalid setting %q, expected a non-negative integer", value)
+			}
+			*field(cfg) = n
+			return nil
+		},
+	}
+}
+
+// ConfigFlags holds the registry config flags registered in a flag set
+type ConfigFlags struct {
+	flagSet    *flag.FlagSet
+	configFile *string
+	provider   *string
+	values     map[string]*string
+}
+
+// RegisterConfigFlags adds --registry-config, --cloud-provider and per-service endpoint/region/profile flags.
+// Call ConfigFlags.Load after parsing the flags.
+func RegisterConfigFlags(flagSet *flag.FlagSet) *ConfigFlags {
+	flags := &ConfigFlags{
+		flagSet: flagSet,
+		configFile: flagSet.String("registry-config", "",
+			"YAML profile with cloud endpoints, regions and credentials profiles (env TASK_REGISTRY_CONFIG)"),
+		provider: flagSet.String("cloud-provider", "",
+			"Cloud provider to take default endpoints from: yandex or aws (env TASK_REGISTRY_PROVIDER)"),
+		values: make(map[string]*string),
+	}
+	for _, setting := range configSettings {
+		flags.values[setting.flag] = flagSet.String(setting.flag, "", fmt.Sprintf("%s (env %s)", setting.usage, setting.env))
+	}
+	return flags
+}
+
+// Load builds the config from (in the order of increasing priority) provider defaults, YAML profile,
+// environment variables and explicitly set flags
+func (flags *ConfigFlags) Load() (Config, error) {
+	setFlags := make(map[string]bool)
+	flags.flagSet.Visit(func(f *flag.Flag) { setFlags[f.Name] = true })
+
+	provider := os.Getenv("TASK_REGISTRY_PROVIDER")
+	if setFlags["cloud-provider"] {
+		provider = *flags.provider
+	}
+	configFile := os.Getenv("TASK_REGISTRY_CONFIG")
+	if setFlags["registry-config"] {
+		configFile = *flags.configFile
+	}
+
+	var cfg Config
+	var err error
+	if configFile != "" {
+		var data []byte
+		if data, err = os.ReadFile(configFile); err != nil {
+			return Config{}, fmt.Errorf("failed to read registry config %q: %w", configFile, err)
+		}
+		cfg, err = parseConfig(data, provider)
+	} else {
+		cfg, err = DefaultConfig(provider)
+	}
+	if err != nil {
+		return Config{}, err
+	}
+
+	if endpoint, ok := os.LookupEnv(dynamoDBEndpointEnv); ok {
+		cfg.DynamoDB.Endpoint = endpoint
+	}
+	for _, setting := range configSettings {
+		if value, ok := os.LookupEnv(setting.env); ok {
+			if err := setting.set(&cfg, value); err != nil {
+				return Config{}, fmt.Errorf("%s: %w", setting.env, err)
+			}
+		}
+	}
+	for _, setting := range configSettings {
+		if setFlags[setting.flag] {
+			if err := setting.set(&cfg, *flags.values[setting.flag]); err != nil {
+				return Config{}, fmt.Errorf("--%s: %w", setting.flag, err)
+			}
+		}
+	}
+	return cfg, nil
+}
+
+func loadAwsConfig(service ServiceConfig) (aws.Config, error) {
+	var loadOptions []func(*config.LoadOptions) error
+	if service.Region != "" {
+		loadOptions = append(loadOptions, config.WithRegion(service.Region))
+	}
+	if service.Profile != "" {
+		loadOptions = append(loadOptions, config.WithSharedConfigProfile(service.Profile))
+	}
+	if service.Endpoint != "" {
+		customResolver := aws.EndpointResolverWithOptionsFunc(
+			func(_, region string, options ...interface{}) (aws.Endpoint, error) {
+				return aws.Endpoint{
+					URL:               service.Endpoint,
+					SigningRegion:     region,
+					HostnameImmutable: service.PathStyle,
+				}, nil
+			})
+		loadOptions = append(loadOptions, config.WithEndpointResolverWithOptions(customResolver))
+	}
+	return config.LoadDefaultConfig(context.Background(), loadOptions...)
+}
+
+func (cfg Config) String() string {
+	services := []string{
+		fmt.Sprintf("dynamodb=%s", cfg.DynamoDB.describe()),
+		fmt.Sprintf("s3=%s", cfg.S3.describe()),
+		fmt.Sprintf("sqs=%s", cfg.SQS.describe()),
+	}
+	return fmt.Sprintf("%s (%s)", cfg.Provider, strings.Join(services, ", "))
+}
+
+func (service ServiceConfig) describe() string {
+	endpoint := service.Endpoint
+	if endpoint == "" {
+		endpoint = "<sdk default>"
+	}
+	return fmt.Sprintf("%s@%s", endpoint, service.Region)
+}
@@ -0,0 +1,58 @@
+package cloud_task_registry
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigFlagsLoad_MustLayerProviderDefaultsProfileEnvAndFlags(t *testing.T) {
+	// given
+	profile := filepath.Join(t.TempDir(), "minio.yaml")
+	require.NoError(t, os.WriteFile(profile, []byte(`
+provider: aws
+s3:
+  endpoint: http://localhost:9000
+  region: us-east-1
+  path_style: true
+sqs:
+  endpoint: http://localhost:9324
+  region: elasticmq
+`), 0o644))
+	t.Setenv("TASK_REGISTRY_CONFIG", profile)
+	t.Setenv("TASK_REGISTRY_DYNAMODB_ENDPOINT", "http://localhost:8000")
+	t.Setenv("TASK_REGISTRY_SQS_REGION", "from-env")
+	t.Setenv("TASK_REGISTRY_S3_REGION", "from-env")
+	flagSet := flag.NewFlagSet("test", flag.ContinueOnError)
+	configFlags := RegisterConfigFlags(flagSet)
+	require.NoError(t, flagSet.Parse([]string{"--s3-region=from-flag", "--sqs-profile=local"}))
+	// when
+	cfg, err := configFlags.Load()
+	// then
+	require.NoError(t, err)
+	assert.Equal(t, Config{
+		Provider: Provider_AWS,
+		DynamoDB: ServiceConfig{Endpoint: "http://localhost:8000"},
+		S3:       ServiceConfig{Endpoint: "http://localhost:9000", Region: "from-flag", PathStyle: true},
+		SQS:      ServiceConfig{Endpoint: "http://localhost:9324", Region: "from-env", Profile: "local"},
+	}, cfg)
+}
+
+func TestConfigFlagsLoad_MustDefaultToYandexCloud(t *testing.T) {
+	// given
+	flagSet := flag.NewFlagSet("test", flag.ContinueOnError)
+	configFlags := RegisterConfigFlags(flagSet)
+	require.NoError(t, flagSet.Parse(nil))
+	// when
+	cfg, err := configFlags.Load()
+	// then
+	require.NoError(t, err)
+	assert.Equal(t, Provider_Yandex, cfg.Provider)
+	assert.Equal(t, "https://storage.yandexcloud.net", cfg.S3.Endpoint)
+	assert.Equal(t, "https://message-queue.api.cloud.yandex.net", cfg.SQS.Endpoint)
+	assert.Equal(t, "ru-central1", cfg.DynamoDB.Region)
+}
@@ -2,36 +2,120 @@ package cloud_task_registry
 
 import "time"
 
+// Task is an optimization task, i.e. what all its runs have in common
+type Task struct {
+	ID               string          `dynamodbav:"task_id"`    // PK
+	Definition       string          `dynamodbav:"definition"` // S3 path of the task definition file
+	DefinitionSHA256 string          `dynamodbav:"definition_sha256"`
+	S3Bucket         string          `dynamodbav:"s3_bucket"`
+	Objectives       []string        `dynamodbav:"objectives"`
+	Parameters       []ParameterSpec `dynamodbav:"parameters,omitempty"`
+	Pipeline         []PipelineStage `dynamodbav:"pipeline,omitempty"`
+	CreationTime     *time.Time      `dynamodbav:"creation_time,omitempty"`
+}
+
+// ParameterSpec declares an optimization parameter, bounds are optional
+type ParameterSpec struct {
+	Name  string   `dynamodbav:"name" json:"name"`
+	Lower *float64 `dynamodbav:"lower,omitempty" json:"lower,omitempty"`
+	Upper *float64 `dynamodbav:"upper,omitempty" json:"upper,omitempty"`
+}
+
+// PipelineStage is a stage of the pipeline that the task runs go through
+type PipelineStage struct {
+	Name     string   `dynamodbav:"name" json:"name"`
+	Executor string   `dynamodbav:"executor,omitempty" json:"executor,omitempty"`
+	Next     []string `dynamodbav:"next,omitempty" json:"next,omitempty"`
+}
+
 type TaskRun struct {
-	TaskID         string            `dynamodbav:"task_id"`  // PK
-	UUID           string            `dynamodbav:"run_uuid"` // SK, SGI PK
-	Parameters     map[string]string `dynamodbav:"parameters"`
-	Results        map[string]string `dynamodbav:"results,omitempty"`
-	TaskDefinition string            `dynamodbav:"task_definition"`
-	CreationTime   *time.Time        `dynamodbav:"creation_time,omitempty"`
-	Status         TaskRunStatus     `dynamodbav:"status"`
+	TaskID         string                 `dynamodbav:"task_id"`  // PK
+	UUID           string                 `dynamodbav:"run_uuid"` // SK, SGI PK
+	Parameters     map[string]string      `dynamodbav:"parameters"`
+	Results        map[string]ResultValue `dynamodbav:"results,omitempty"`
+	TaskDefinition string                 `dynamodbav:"task_definition"`
+	CreationTime   *time.Time             `dynamodbav:"creation_time,omitempty"`
+	Status         TaskRunStatus          `dynamodbav:"status"`
 }
 
 type Stage struct {
-	TaskRunUUID string     `dynamodbav:"run_uuid"` // PK
-	NOrd        int        `dynamodbav:"n_ord"`    // SK
-	Name        string     `dynamodbav:"name"`     // SGI SK
-	Status      string     `dynamodbav:"status"`
-	Config      string     `dynamodbav:"config,omitempty"`
-	Input       string     `dynamodbav:"input,omitempty"`
-	Output      string     `dynamodbav:"output,omitempty"`
-	TStartUTC   *time.Time `dynamodbav:"t_start_utc,omitempty"`
-	TFinishUTC  *time.Time `dynamodbav:"t_finish_utc,omitempty"`
-	Executor    string     `dynamodbav:"executor,omitempty"`
-	S3Bucket    string     `dynamodbav:"s3_bucket"`
-	Comments    string     `dynamodbav:"comments,omitempty"`
-	Next        []string   `dynamodbav:"next,omitempty"` // name(s) of stage(s) to execute next
+	TaskRunUUID string `dynamodbav:"run_uuid"` // PK
+	NOrd        int    `dynamodbav:"n_ord"`    // SK
+	Name        string `dynamodbav:"name"`     // SGI SK
+	Status      string `dynamodbav:"status"`
+	Config      string `dynamodbav:"config,omitempty"`
+	Input       string `dynamodbav:"input,omitempty"`
+	Output      string `dynamodbav:"output,omitempty"`
+	// SHA-256 digests of the config, input and output files, verified on download
+	ConfigSHA256 string     `dynamodbav:"config_sha256,omitempty"`
+	InputSHA256  string     `dynamodbav:"input_sha256,omitempty"`
+	OutputSHA256 string     `dynamodbav:"output_sha256,omitempty"`
+	TStartUTC    *time.Time `dynamodbav:"t_start_utc,omitempty"`
+	TFinishUTC   *time.Time `dynamodbav:"t_finish_utc,omitempty"`
+	Executor     string     `dynamodbav:"executor,omitempty"`
+	S3Bucket     string     `dynamodbav:"s3_bucket"`
+	Comments     string     `dynamodbav:"comments,omitempty"`
+	Next         []string   `dynamodbav:"next,omitempty"` // name(s) of stage(s) to execute next
+	// Named outputs (name -> S3 path, name -> SHA-256 digest) besides Output. The next stages download them by name,
+	// see DownloadNamedInput.
+	Outputs       map[string]string `dynamodbav:"outputs,omitempty"`
+	OutputsSHA256 map[string]string `dynamodbav:"outputs_sha256,omitempty"`
+	// Names of the outputs declared in stages.yaml, and of the outputs of the previous stages the stage requests
+	// ("name", or "stage.name" if several previous stages have it)
+	OutputNames []string `dynamodbav:"output_names,omitempty"`
+	InputNames  []string `dynamodbav:"input_names,omitempty"`
+	// The connector renews the lease with heartbeats while the stage is InProgress. Once the lease has expired,
+	// the executor is presumed dead and a redelivery of the task run may take over the stage (see TakeOverStage).
+	THeartbeatUTC   *time.Time `dynamodbav:"t_heartbeat_utc,omitempty"`
+	TLeaseExpiryUTC *time.Time `dynamodbav:"t_lease_expiry_utc,omitempty"`
+	// History of the runs of the stage, a new attempt starts on each redelivery of the task run by SQS.
+	// MaxAttempts is declared in stages.yaml, 0 means no limit (see AttemptsExhausted).
+	Attempts    []StageAttempt `dynamodbav:"attempts,omitempty"`
+	MaxAttempts int            `dynamodbav:"max_attempts,omitempty"`
+}
+
+// StageAttempt is a single run of the stage by a connector
+type StageAttempt struct {
+	N          int        `dynamodbav:"n" json:"n"` // 1-based
+	Status     string     `dynamodbav:"status" json:"status"`
+	TStartUTC  *time.Time `dynamodbav:"t_start_utc,omitempty" json:"t_start_utc,omitempty"`
+	TFinishUTC *time.Time `dynamodbav:"t_finish_utc,omitempty" json:"t_finish_utc,omitempty"`
+	Executor   string     `dynamodbav:"executor,omitempty" json:"executor,omitempty"`   // instance of the connector
+	ExitCode   *int       `dynamodbav:"exit_code,omitempty" json:"exit_code,omitempty"` // if the command has run
+	Error      string     `dynamodbav:"error,omitempty" json:"error,omitempty"`
+	Artifacts  []string   `dynamodbav:"artifacts,omitempty" json:"artifacts,omitempty"` // S3 paths of the uploaded files
+}
+
+// TaskEvent is an entry of the append-only log of a task run, see GetRunEvents
+type TaskEvent struct {
+	TaskRunUUID string    `dynamodbav:"run_uuid"` // PK
+	ID          string    `dynamodbav:"event_id"` // SK, the time of the event with a random suffix, see newEventID
+	TimeUTC     time.Time `dynamodbav:"time_utc"`
+	Stage       string    `dynamodbav:"stage,omitempty"` // empty for the events of the task run itself
+	Type        string    `dynamodbav:"type"`
+	Actor       string    `dynamodbav:"actor,omitempty"` // the program and host that caused the event, see WithEventActor
+	Details     string    `dynamodbav:"details,omitempty"`
 }
 
+// TasksTable keeps task runs (the name predates the Task entity, see RegisteredTasksTable)
 const TasksTable = "task_runs"
 
+const RegisteredTasksTable = "tasks"
+
 const StagesTable = "task_stages"
 
+const EventsTable = "task_events"
+
+// Types of TaskEvent
+const (
+	EventType_StageStatus   = "stage_status"
+	EventType_TaskRunStatus = "task_run_status"
+	EventType_Handover      = "handover"
+	EventType_Upload        = "upload"
+	EventType_Cancellation  = "cancellation"
+	EventType_DLQ           = "dlq"
+)
+
 const (
 	StageStatus_Pending    = "Pending"
 	StageStatus_InProgress = "InProgress"
@@ -50,3 +134,10 @@ const (
 	TaskRunStatus_Failed    TaskRunStatus = "Failed"
 	TaskRunStatus_Cancelled TaskRunStatus = "Cancelled"
 )
+
+// TaskRunStatuses are all the statuses of a task run
+var TaskRunStatuses = []TaskRunStatus{
+	TaskRunStatus_Submitted, TaskRunStatus_Finished, TaskRunStatus_Failed, TaskRunStatus_Cancelled,
+}
+
+var finalTaskRunStatuses = []TaskRunStatus{TaskRunStatus_Finished, TaskRunStatus_Failed, TaskRunStatus_Cancelled}
@@ -2,6 +2,9 @@ package cloud_task_registry
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -9,129 +12,87 @@ import (
 	"path/filepath"
 	"strings"
 	"time"
-
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
-	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
-func (registry *CloudTaskRegistry) InsertTaskRun(task TaskRun) error {
-	av, err := attributevalue.MarshalMap(task)
-	if err != nil {
-		return err
-	}
-
-	input := &dynamodb.PutItemInput{
-		TableName: aws.String(TasksTable),
-		Item:      av,
-	}
+func (registry *CloudTaskRegistry) InsertTaskRun(ctx context.Context, task TaskRun) error {
+	return registry.tasks.InsertTaskRun(ctx, task)
+}
 
-	_, err = registry.dynamodbClient.PutItem(context.TODO(), input)
-	return err
+func (registry *CloudTaskRegistry) InsertStage(ctx context.Context, stage Stage) error {
+	return registry.tasks.InsertStage(ctx, stage)
 }
 
-func (registry *CloudTaskRegistry) InsertStage(stage Stage) error {
-	av, err := attributevalue.MarshalMap(stage)
+// CreateTaskRunWithStages inserts the task run together with all its stages, so that a failure never leaves
+// a task run without some of its stages. If the insertion fails, the stage config files already uploaded
+// to S3 are deleted as well, see DeleteStageConfigs.
+func (registry *CloudTaskRegistry) CreateTaskRunWithStages(ctx context.Context, taskRun TaskRun, stages []Stage) error {
+	err := registry.tasks.InsertTaskRunWithStages(ctx, taskRun, stages)
 	if err != nil {
+		if cleanupErr := registry.DeleteStageConfigs(ctx, stages); cleanupErr != nil {
+			log.Printf("Failed to clean up config files of task run %s: %v", taskRun.UUID, cleanupErr)
+		}
 		return err
 	}
+	return nil
+}
 
-	input := &dynamodb.PutItemInput{
-		TableName: aws.String(StagesTable),
-		Item:      av,
+// DeleteStageConfigs deletes the config files of the stages from S3, except for the blobs that may be shared
+// with other runs. A blob uploaded for these stages alone is left to CollectBlobs, which deletes it once it is older
+// than MinBlobAge, as no stage refers to it. It goes on even if ctx is cancelled, since it is meant for cleaning up
+// after failures.
+func (registry *CloudTaskRegistry) DeleteStageConfigs(ctx context.Context, stages []Stage) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cleanupTimeout)
+	defer cancel()
+
+	var errs []error
+	for _, stage := range stages {
+		if stage.Config == "" || IsBlobPath(stage.Config) {
+			continue
+		}
+		if err := registry.artifacts.DeleteObject(ctx, stage.S3Bucket, stage.Config); err != nil {
+			errs = append(errs, fmt.Errorf("failed to delete %q from S3 bucket %q, %w", stage.Config, stage.S3Bucket, err))
+			continue
+		}
+		log.Printf("File deleted from S3: %s", stage.Config)
 	}
-
-	_, err = registry.dynamodbClient.PutItem(context.TODO(), input)
-	return err
+	return errors.Join(errs...)
 }
 
 // UpdateTaskRunStatus NB: The status will be updated unless the task run is already cancelled
-func (registry *CloudTaskRegistry) UpdateTaskRunStatus(taskRun *TaskRun, newStatus TaskRunStatus) error {
-	input := &dynamodb.UpdateItemInput{
-		TableName: aws.String(TasksTable),
-		Key: map[string]types.AttributeValue{
-			"task_id":  &types.AttributeValueMemberS{Value: taskRun.TaskID},
-			"run_uuid": &types.AttributeValueMemberS{Value: taskRun.UUID},
-		},
-		UpdateExpression:    aws.String("SET #status = :newStatus"),
-		ConditionExpression: aws.String("attribute_exists(run_uuid) AND #status <> :cancelled"),
-		ExpressionAttributeNames: map[string]string{
-			"#status": "status",
-		},
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":newStatus": &types.AttributeValueMemberS{Value: string(newStatus)},
-			":cancelled": &types.AttributeValueMemberS{Value: string(TaskRunStatus_Cancelled)},
-		},
-		ReturnValues: types.ReturnValueUpdatedNew,
-	}
-
-	_, err := registry.dynamodbClient.UpdateItem(context.TODO(), input)
-	if err != nil {
-		return fmt.Errorf("failed to update task run status: %w", err)
+func (registry *CloudTaskRegistry) UpdateTaskRunStatus(ctx context.Context, taskRun *TaskRun, newStatus TaskRunStatus) error {
+	if err := registry.tasks.UpdateTaskRunStatus(ctx, taskRun, newStatus); err != nil {
+		return err
+	}
+	if newStatus == TaskRunStatus_Cancelled {
+		registry.recordEvent(ctx, taskRun.UUID, "", EventType_Cancellation, "")
+	} else {
+		registry.recordEvent(ctx, taskRun.UUID, "", EventType_TaskRunStatus, string(newStatus))
 	}
-
 	return nil
 }
 
-// TODO make this work, as well
-//func (registry *CloudTaskRegistry) GetTask(taskId string) (*TaskRun, error) {
-//	input := &dynamodb.GetItemInput{
-//		TableName: aws.String(TasksTable),
-//		Key: map[string]types.AttributeValue{
-//			"task_id": &types.AttributeValueMemberS{Value: taskId},
-//		},
-//	}
-//
-//	result, err := registry.dynamodbClient.GetItem(context.TODO(), input)
-//	if err != nil {
-//		return nil, err
-//	}
-//
-//	var task TaskRun
-//	err = attributevalue.UnmarshalMap(result.Item, &task)
-//	if err != nil {
-//		return nil, err
-//	}
-//
-//	return &task, nil
-//}
-
-func (registry *CloudTaskRegistry) GetTaskRun(taskRunUUID string) (*TaskRun, error) {
-	input := &dynamodb.QueryInput{
-		TableName:              aws.String(TasksTable),
-		IndexName:              aws.String("TaskRunUUIDIndex"),
-		KeyConditionExpression: aws.String("run_uuid = :run_uuid"),
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":run_uuid": &types.AttributeValueMemberS{Value: taskRunUUID},
-		},
-	}
-
-	result, err := registry.dynamodbClient.Query(context.TODO(), input)
-	if err != nil {
-		return nil, err
+// CreateTask registers the task, it fails with ErrConditionFailed if there is a task with the same ID already
+func (registry *CloudTaskRegistry) CreateTask(ctx context.Context, task Task) error {
+	if task.ID == blobsFolder {
+		return fmt.Errorf("task ID %q is reserved for the blob area", task.ID)
 	}
+	return registry.tasks.InsertTask(ctx, task)
+}
 
-	if len(result.Items) == 0 {
-		return nil, fmt.Errorf("task run '%s' not found", taskRunUUID)
-	}
-	if len(result.Items) > 1 {
-		return nil, fmt.Errorf("task run '%s' is not unique", taskRunUUID)
-	}
+func (registry *CloudTaskRegistry) GetTask(ctx context.Context, taskID string) (*Task, error) {
+	return registry.tasks.GetTask(ctx, taskID)
+}
 
-	var task TaskRun
-	err = attributevalue.UnmarshalMap(result.Items[0], &task)
-	if err != nil {
-		return nil, err
-	}
+func (registry *CloudTaskRegistry) ListTasks(ctx context.Context) ([]Task, error) {
+	return registry.tasks.ListTasks(ctx)
+}
 
-	return &task, nil
+func (registry *CloudTaskRegistry) GetTaskRun(ctx context.Context, taskRunUUID string) (*TaskRun, error) {
+	return registry.tasks.GetTaskRun(ctx, taskRunUUID)
 }
 
-func (registry *CloudTaskRegistry) IsCancelled(taskRunUUID string) (bool, error) {
-	taskRun, err := registry.GetTaskRun(taskRunUUID)
+func (registry *CloudTaskRegistry) IsCancelled(ctx context.Context, taskRunUUID string) (bool, error) {
+	taskRun, err := registry.GetTaskRun(ctx, taskRunUUID)
 	if err != nil {
 		return false, err
 	}
@@ -141,346 +102,246 @@ func (registry *CloudTaskRegistry) IsCancelled(taskRunUUID string) (bool, error)
 	return false, nil
 }
 
-// PutTaskRunResults TODO support append?
-func (registry *CloudTaskRegistry) PutTaskRunResults(taskRun *TaskRun, results map[string]string) error {
-	av, err := attributevalue.MarshalMap(results)
-	if err != nil {
-		return err
-	}
-
-	input := &dynamodb.UpdateItemInput{
-		TableName: aws.String(TasksTable),
-		Key: map[string]types.AttributeValue{
-			"task_id":  &types.AttributeValueMemberS{Value: taskRun.TaskID},
-			"run_uuid": &types.AttributeValueMemberS{Value: taskRun.UUID},
-		},
-		UpdateExpression:    aws.String("SET #results = :results"),
-		ConditionExpression: aws.String("attribute_exists(run_uuid)"),
-		ExpressionAttributeNames: map[string]string{
-			"#results": "results",
-		},
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":results": &types.AttributeValueMemberM{Value: av},
-		},
-		ReturnValues: types.ReturnValueUpdatedNew,
-	}
-
-	_, err = registry.dynamodbClient.UpdateItem(context.TODO(), input)
-	if err != nil {
-		return fmt.Errorf("failed to update task run results: %w", err)
-	}
-
-	return nil
+// PutTaskRunResults replaces all results of the task run, see MergeTaskRunResults for publishing results
+// from several stages
+func (registry *CloudTaskRegistry) PutTaskRunResults(
+	ctx context.Context,
+	taskRun *TaskRun,
+	results map[string]ResultValue,
+) error {
+	return registry.tasks.PutTaskRunResults(ctx, taskRun, results)
 }
 
-func (registry *CloudTaskRegistry) GetStage(taskRunUUID string, nOrd int) (*Stage, error) {
-	input := &dynamodb.GetItemInput{
-		TableName: aws.String(StagesTable),
-		Key: map[string]types.AttributeValue{
-			"run_uuid": &types.AttributeValueMemberS{Value: taskRunUUID},
-			"n_ord":    &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", nOrd)},
-		},
-	}
-
-	result, err := registry.dynamodbClient.GetItem(context.TODO(), input)
-	if err != nil {
-		return nil, err
-	}
-
-	if len(result.Item) == 0 {
-		return nil, nil
+// MergeTaskRunResults adds the results published by the stage to the results of the task run. A stage may
+// overwrite its own results (e.g. when it's run again after an error), but not the ones of other stages,
+// see ResultConflictError.
+func (registry *CloudTaskRegistry) MergeTaskRunResults(
+	ctx context.Context,
+	taskRun *TaskRun,
+	stageName string,
+	results map[string]ResultValue,
+) error {
+	if len(results) == 0 {
+		return nil
 	}
-
-	var stage Stage
-	err = attributevalue.UnmarshalMap(result.Item, &stage)
-	if err != nil {
-		return nil, err
+	published := make(map[string]ResultValue, len(results))
+	for key, result := range results {
+		result.Stage = stageName
+		published[key] = result
 	}
-
-	return &stage, nil
+	return registry.tasks.MergeTaskRunResults(ctx, taskRun, stageName, published)
 }
 
-func (registry *CloudTaskRegistry) GetStageByName(taskRunUUID, stageName string) (*Stage, error) {
-	input := &dynamodb.QueryInput{
-		TableName:              aws.String(StagesTable),
-		IndexName:              aws.String("StageNameIndex"),
-		KeyConditionExpression: aws.String("run_uuid = :run_uuid and name = :name"),
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":run_uuid": &types.AttributeValueMemberS{Value: taskRunUUID},
-			":name":     &types.AttributeValueMemberS{Value: stageName},
-		},
-	}
-
-	result, err := registry.dynamodbClient.Query(context.TODO(), input)
-	if err != nil {
-		return nil, err
-	}
-	if len(result.Items) == 0 {
-		return nil, fmt.Errorf("stage '%s' not found in task %s", stageName, taskRunUUID)
-	}
-	if len(result.Items) > 1 {
-		return nil, fmt.Errorf("stage '%s' is not unique in task %s", stageName, taskRunUUID)
-	}
-
-	var stage Stage
-	err = attributevalue.UnmarshalMap(result.Items[0], &stage)
-	if err != nil {
-		return nil, err
-	}
-
-	return &stage, nil
+func (registry *CloudTaskRegistry) GetStage(ctx context.Context, taskRunUUID string, nOrd int) (*Stage, error) {
+	return registry.tasks.GetStage(ctx, taskRunUUID, nOrd)
 }
 
-func (registry *CloudTaskRegistry) GetAllStages(taskRunUUID string) ([]Stage, error) {
-	result, err := registry.dynamodbClient.Query(context.TODO(), &dynamodb.QueryInput{
-		TableName:              aws.String(StagesTable),
-		KeyConditionExpression: aws.String("run_uuid = :run_uuid"),
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":run_uuid": &types.AttributeValueMemberS{Value: taskRunUUID},
-		},
-	})
-	if err != nil {
-		return nil, fmt.Errorf("failed to query stages: %w", err)
-	}
-
-	var stages []Stage
-	err = attributevalue.UnmarshalListOfMaps(result.Items, &stages)
-	if err != nil {
-		return nil, fmt.Errorf("failed to unmarshal stages: %w", err)
-	}
+func (registry *CloudTaskRegistry) GetStageByName(ctx context.Context, taskRunUUID, stageName string) (*Stage, error) {
+	return registry.tasks.GetStageByName(ctx, taskRunUUID, stageName)
+}
 
-	return stages, nil
+func (registry *CloudTaskRegistry) GetAllStages(ctx context.Context, taskRunUUID string) ([]Stage, error) {
+	return registry.tasks.GetAllStages(ctx, taskRunUUID)
 }
 
-func (registry *CloudTaskRegistry) UpdateStageStatus(stage *Stage, newStatus string) error {
-	input := &dynamodb.UpdateItemInput{
-		TableName: aws.String(StagesTable),
-		Key: map[string]types.AttributeValue{
-			"run_uuid": &types.AttributeValueMemberS{Value: stage.TaskRunUUID},
-			"n_ord":    &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", stage.NOrd)},
-		},
-		UpdateExpression:    aws.String("SET #status = :newStatus"),
-		ConditionExpression: aws.String("attribute_exists(n_ord)"),
-		ExpressionAttributeNames: map[string]string{
-			"#status": "status",
-		},
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":newStatus": &types.AttributeValueMemberS{Value: newStatus},
-		},
-		ReturnValues: types.ReturnValueUpdatedNew,
+// UpdateStageStatus moves the stage from stage.Status to newStatus if the stage state machine allows it
+// and nobody has changed the stage status in the meantime, see StageTransitionError.
+// On success, stage.Status is set to newStatus and the lease of the stage is cleared.
+func (registry *CloudTaskRegistry) UpdateStageStatus(ctx context.Context, stage *Stage, newStatus string) error {
+	if !CanTransitionStage(stage.Status, newStatus) {
+		return newStageTransitionError(stage, newStatus, "")
 	}
-
-	_, err := registry.dynamodbClient.UpdateItem(context.TODO(), input)
-	if err != nil {
-		return fmt.Errorf("failed to update stage status: %w", err)
+	if err := registry.tasks.UpdateStageStatus(ctx, stage, newStatus); err != nil {
+		return err
 	}
-
+	registry.recordEvent(ctx, stage.TaskRunUUID, stage.Name, EventType_StageStatus, stage.Status+" -> "+newStatus)
+	stage.Status = newStatus
+	stage.THeartbeatUTC, stage.TLeaseExpiryUTC = nil, nil
 	return nil
 }
 
-func (registry *CloudTaskRegistry) UpdateStageOutput(stage *Stage, path string) error {
-	updateItem := &dynamodb.UpdateItemInput{
-		TableName: aws.String(StagesTable),
-		Key: map[string]types.AttributeValue{
-			"run_uuid": &types.AttributeValueMemberS{Value: stage.TaskRunUUID},
-			"n_ord":    &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", stage.NOrd)},
-		},
-		UpdateExpression:    aws.String("SET #output = :path"),
-		ConditionExpression: aws.String("attribute_exists(n_ord)"),
-		ExpressionAttributeNames: map[string]string{
-			"#output": "output",
-		},
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":path": &types.AttributeValueMemberS{Value: path},
-		},
-		ReturnValues: types.ReturnValueUpdatedNew,
-	}
-
-	_, err := registry.dynamodbClient.UpdateItem(context.TODO(), updateItem)
-	if err != nil {
-		return fmt.Errorf("failed to update stage output: %w", err)
+// UpdateStageOutput sets the output file of the stage with its SHA-256 digest, and sets them to stage on success
+func (registry *CloudTaskRegistry) UpdateStageOutput(ctx context.Context, stage *Stage, path, sha256 string) error {
+	if err := registry.tasks.UpdateStageOutput(ctx, stage, path, sha256); err != nil {
+		return err
 	}
-
+	stage.Output, stage.OutputSHA256 = path, sha256
 	return nil
 }
 
-func (registry *CloudTaskRegistry) UpdateStageInput(stage *Stage, path string) error {
-	updateItem := &dynamodb.UpdateItemInput{
-		TableName: aws.String(StagesTable),
-		Key: map[string]types.AttributeValue{
-			"run_uuid": &types.AttributeValueMemberS{Value: stage.TaskRunUUID},
-			"n_ord":    &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", stage.NOrd)},
-		},
-		UpdateExpression:    aws.String("SET #input = :path"),
-		ConditionExpression: aws.String("attribute_exists(n_ord)"),
-		ExpressionAttributeNames: map[string]string{
-			"#input": "input",
-		},
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":path": &types.AttributeValueMemberS{Value: path},
-		},
-		ReturnValues: types.ReturnValueUpdatedNew,
-	}
-
-	_, err := registry.dynamodbClient.UpdateItem(context.TODO(), updateItem)
-	if err != nil {
-		return fmt.Errorf("failed to update stage input: %w", err)
-	} // TODO check if update was done?
-
+// UpdateStageInput sets the input file of the stage with its SHA-256 digest, and sets them to stage on success
+func (registry *CloudTaskRegistry) UpdateStageInput(ctx context.Context, stage *Stage, path, sha256 string) error {
+	if err := registry.tasks.UpdateStageInput(ctx, stage, path, sha256); err != nil {
+		return err
+	}
+	stage.Input, stage.InputSHA256 = path, sha256
 	return nil
 }
 
-func (registry *CloudTaskRegistry) UpdateStageComment(stage *Stage, comment string) error {
-	updateItem := &dynamodb.UpdateItemInput{
-		TableName: aws.String(StagesTable),
-		Key: map[string]types.AttributeValue{
-			"run_uuid": &types.AttributeValueMemberS{Value: stage.TaskRunUUID},
-			"n_ord":    &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", stage.NOrd)},
-		},
-		UpdateExpression:    aws.String("SET #comment = :comment"),
-		ConditionExpression: aws.String("attribute_exists(n_ord)"),
-		ExpressionAttributeNames: map[string]string{
-			"#comment": "comment",
-		},
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":comment": &types.AttributeValueMemberS{Value: comment},
-		},
-		ReturnValues: types.ReturnValueUpdatedNew,
-	}
-
-	_, err := registry.dynamodbClient.UpdateItem(context.TODO(), updateItem)
-	if err != nil {
-		return fmt.Errorf("failed to update stage comment: %w", err)
-	} // TODO check if update was done?
-
+// UpdateStageOutputs replaces the named outputs of the stage with their SHA-256 digests, and sets them to stage
+// on success
+func (registry *CloudTaskRegistry) UpdateStageOutputs(
+	ctx context.Context,
+	stage *Stage,
+	outputs, sha256s map[string]string,
+) error {
+	if err := registry.tasks.UpdateStageOutputs(ctx, stage, outputs, sha256s); err != nil {
+		return err
+	}
+	stage.Outputs, stage.OutputsSHA256 = outputs, sha256s
 	return nil
 }
 
-func (registry *CloudTaskRegistry) UpdateStageStartTime(stage *Stage, tStartUTC time.Time) error {
-	input := &dynamodb.UpdateItemInput{
-		TableName: aws.String(StagesTable),
-		Key: map[string]types.AttributeValue{
-			"run_uuid": &types.AttributeValueMemberS{Value: stage.TaskRunUUID},
-			"n_ord":    &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", stage.NOrd)},
-		},
-		UpdateExpression:    aws.String("SET t_start_utc = :t"),
-		ConditionExpression: aws.String("attribute_exists(n_ord)"),
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":t": &types.AttributeValueMemberS{Value: tStartUTC.Format(time.RFC3339)},
-		},
-		ReturnValues: types.ReturnValueUpdatedNew,
-	}
-
-	_, err := registry.dynamodbClient.UpdateItem(context.TODO(), input)
-	if err != nil {
-		return fmt.Errorf("failed to update t_start_utc for stage %v: %w", stage, err)
-	}
+func (registry *CloudTaskRegistry) UpdateStageComment(ctx context.Context, stage *Stage, comment string) error {
+	return registry.tasks.UpdateStageComment(ctx, stage, comment)
+}
 
-	return nil
+func (registry *CloudTaskRegistry) UpdateStageStartTime(ctx context.Context, stage *Stage, tStartUTC time.Time) error {
+	return registry.tasks.UpdateStageStartTime(ctx, stage, tStartUTC)
 }
 
-func (registry *CloudTaskRegistry) UpdateStageFinishTime(stage *Stage, tFinishUTC time.Time) error {
-	input := &dynamodb.UpdateItemInput{
-		TableName: aws.String(StagesTable),
-		Key: map[string]types.AttributeValue{
-			"run_uuid": &types.AttributeValueMemberS{Value: stage.TaskRunUUID},
-			"n_ord":    &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", stage.NOrd)},
-		},
-		UpdateExpression:    aws.String("SET t_finish_utc = :t"),
-		ConditionExpression: aws.String("attribute_exists(n_ord)"),
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":t": &types.AttributeValueMemberS{Value: tFinishUTC.Format(time.RFC3339)},
-		},
-		ReturnValues: types.ReturnValueUpdatedNew,
-	}
+func (registry *CloudTaskRegistry) UpdateStageFinishTime(ctx context.Context, stage *Stage, tFinishUTC time.Time) error {
+	return registry.tasks.UpdateStageFinishTime(ctx, stage, tFinishUTC)
+}
 
-	_, err := registry.dynamodbClient.UpdateItem(context.TODO(), input)
+// UploadTaskDefinition uploads the task definition file to the blob area (see UploadBlob) and returns its S3 path
+// and SHA-256 digest to put into Task
+func (registry *CloudTaskRegistry) UploadTaskDefinition(
+	ctx context.Context,
+	filePath, s3Bucket, taskId string,
+) (string, string, error) {
+	s3Path, digest, err := registry.UploadBlob(ctx, filePath, s3Bucket)
 	if err != nil {
-		return fmt.Errorf("failed to update t_finish_utc for stage %v: %w", stage, err)
+		return "", "", fmt.Errorf("failed to upload definition of task %s, %w", taskId, err)
 	}
-
-	return nil
+	return s3Path, digest, nil
 }
 
-func (registry *CloudTaskRegistry) UploadFileForTask(filePath, s3Bucket, taskId, taskRunId string) (string, error) {
+// FileSHA256 returns the hex-encoded SHA-256 digest of the file content
+func FileSHA256(filePath string) (string, error) {
 	file, err := os.Open(filePath)
 	if err != nil {
 		return "", err
 	}
 	defer file.Close()
 
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", fmt.Errorf("failed to read %q, %w", filePath, err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// UploadFileForTask uploads the file for the task run and returns its S3 path and SHA-256 digest
+//
+// Deprecated: use UploadBlob, which keeps the file once for all runs of all tasks. The file uploaded under
+// the run prefix is still deleted along with the task run, unlike a blob.
+func (registry *CloudTaskRegistry) UploadFileForTask(
+	ctx context.Context,
+	filePath, s3Bucket, taskId, taskRunId string,
+) (string, string, error) {
 	s3Path := strings.Join([]string{s3CommonPrefix, taskId, taskRunId, filepath.Base(filePath)}, "/")
-	_, err = registry.s3Client.PutObject(context.TODO(), &s3.PutObjectInput{
-		Bucket: aws.String(s3Bucket),
-		Key:    aws.String(s3Path),
-		Body:   file,
-	})
+	digest, err := registry.uploadFile(ctx, s3Bucket, s3Path, filePath, StorageClass_Standard)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
-
-	log.Printf("File uploaded to S3: %s", s3Path)
-	return s3Path, nil
+	return s3Path, digest, nil
 }
 
+// UploadFileForStage uploads the file for the stage and returns its S3 path and SHA-256 digest
+// to put into Stage (e.g. Output and OutputSHA256)
 func (registry *CloudTaskRegistry) UploadFileForStage(
+	ctx context.Context,
 	filePath string,
 	s3Bucket string,
 	taskRun *TaskRun,
 	stageName string,
 	stageNOrd int,
-) (string, error) {
+) (string, string, error) {
 	// By default, we use Standard storage class
 	return registry.uploadFileForStage(
-		filePath, s3Bucket, taskRun, stageName, stageNOrd, s3types.StorageClassStandard)
+		ctx, filePath, s3Bucket, taskRun, stageName, stageNOrd, "", StorageClass_Standard)
 }
 
 func (registry *CloudTaskRegistry) UploadExtraFileForStage(
+	ctx context.Context,
 	filePath string,
 	s3Bucket string,
 	taskRun *TaskRun,
 	stageName string,
 	stageNOrd int,
-) (string, error) {
+) (string, string, error) {
 	// Cold storage is 2x cheaper, so let's use it for extra artifacts that stages may have
 	return registry.uploadFileForStage(
-		filePath, s3Bucket, taskRun, stageName, stageNOrd, s3types.StorageClassStandardIa)
+		ctx, filePath, s3Bucket, taskRun, stageName, stageNOrd, "", StorageClass_Cold)
 }
 
 func (registry *CloudTaskRegistry) uploadFileForStage(
+	ctx context.Context,
 	filePath string,
 	s3Bucket string,
 	taskRun *TaskRun,
 	stageName string,
 	stageNOrd int,
-	storageClass s3types.StorageClass,
+	outputName string,
+	storageClass StorageClass,
+) (string, string, error) {
+	stageFolder := fmt.Sprintf("%d_%s", stageNOrd, stageName)
+	folders := []string{s3CommonPrefix, taskRun.TaskID, taskRun.UUID, stageFolder}
+	// Files of different named outputs may have the same name
+	if outputName != "" {
+		folders = append(folders, outputName)
+	}
+	s3Path := strings.Join(append(folders, filepath.Base(filePath)), "/")
+	digest, err := registry.uploadFile(ctx, s3Bucket, s3Path, filePath, storageClass)
+	if err != nil {
+		return "", "", err
+	}
+	registry.recordEvent(ctx, taskRun.UUID, stageName, EventType_Upload, s3Path)
+	return s3Path, digest, nil
+}
+
+// uploadFile uploads the file with its SHA-256 digest in the object metadata and returns the digest
+func (registry *CloudTaskRegistry) uploadFile(
+	ctx context.Context,
+	s3Bucket, s3Path, filePath string,
+	storageClass StorageClass,
 ) (string, error) {
-	file, err := os.Open(filePath)
+	digest, err := FileSHA256(filePath)
 	if err != nil {
 		return "", err
 	}
-	defer file.Close()
+	if err := registry.putFile(ctx, s3Bucket, s3Path, filePath, digestMetadata(digest), storageClass); err != nil {
+		return "", err
+	}
+	log.Printf("File uploaded to S3: %s (sha256 %s)", s3Path, digest)
+	return digest, nil
+}
 
-	stageFolder := fmt.Sprintf("%d_%s", stageNOrd, stageName)
-	s3Path := strings.Join(
-		[]string{s3CommonPrefix, taskRun.TaskID, taskRun.UUID, stageFolder, filepath.Base(filePath)},
-		"/")
-	_, err = registry.s3Client.PutObject(context.TODO(), &s3.PutObjectInput{
-		Bucket:       aws.String(s3Bucket),
-		Key:          aws.String(s3Path),
-		Body:         file,
-		StorageClass: storageClass,
-	})
+// putFile uploads the file with FileTransferrer if the artifact store implements it
+func (registry *CloudTaskRegistry) putFile(
+	ctx context.Context,
+	s3Bucket, s3Path, filePath string,
+	metadata map[string]string,
+	storageClass StorageClass,
+) error {
+	if transferrer, ok := registry.artifacts.(FileTransferrer); ok {
+		return transferrer.UploadFile(ctx, s3Bucket, s3Path, filePath, storageClass, metadata)
+	}
+	file, err := os.Open(filePath)
 	if err != nil {
-		return "", err
+		return err
 	}
+	defer file.Close()
+	return registry.artifacts.PutObject(ctx, s3Bucket, s3Path, file, storageClass, metadata)
+}
 
-	log.Printf("File uploaded to S3: %s", s3Path)
-	return s3Path, nil
+func digestMetadata(digest string) map[string]string {
+	return map[string]string{MetadataSHA256: digest}
 }
 
-func (registry *CloudTaskRegistry) DownloadConfigFile(stage *Stage, destination string) error {
-	err := registry.DownloadFileFromS3(stage.S3Bucket, stage.Config, destination)
+func (registry *CloudTaskRegistry) DownloadConfigFile(ctx context.Context, stage *Stage, destination string) error {
+	err := registry.downloadFile(ctx, stage.S3Bucket, stage.Config, destination, stage.ConfigSHA256)
 	if err != nil {
 		return fmt.Errorf("failed to download config file %q from s3 bucket %q for stage %q of task %s, %w",
 			stage.Config, stage.S3Bucket, stage.Name, stage.TaskRunUUID, err)
@@ -488,8 +349,8 @@ func (registry *CloudTaskRegistry) DownloadConfigFile(stage *Stage, destination
 	return nil
 }
 
-func (registry *CloudTaskRegistry) DownloadInputFile(stage *Stage, destination string) error {
-	err := registry.DownloadFileFromS3(stage.S3Bucket, stage.Input, destination)
+func (registry *CloudTaskRegistry) DownloadInputFile(ctx context.Context, stage *Stage, destination string) error {
+	err := registry.downloadFile(ctx, stage.S3Bucket, stage.Input, destination, stage.InputSHA256)
 	if err != nil {
 		return fmt.Errorf("failed to download input file %q from s3 bucket %q for stage %q of task %s, %w",
 			stage.Input, stage.S3Bucket, stage.Name, stage.TaskRunUUID, err)
@@ -497,110 +358,97 @@ func (registry *CloudTaskRegistry) DownloadInputFile(stage *Stage, destination s
 	return nil
 }
 
-func (registry *CloudTaskRegistry) DownloadFileFromS3(s3Bucket, s3Path, destination string) error {
-	object, err := registry.s3Client.GetObject(context.TODO(), &s3.GetObjectInput{
-		Bucket: aws.String(s3Bucket),
-		Key:    aws.String(s3Path),
-	})
-	if err != nil {
-		return fmt.Errorf("couldn't download file %q from S3 bucket %q, %w", s3Path, s3Bucket, err)
-	}
-	defer object.Body.Close()
+// DownloadFileFromS3 verifies the downloaded file against the SHA-256 digest in the object metadata, if any
+func (registry *CloudTaskRegistry) DownloadFileFromS3(ctx context.Context, s3Bucket, s3Path, destination string) error {
+	return registry.downloadFile(ctx, s3Bucket, s3Path, destination, "")
+}
 
-	destFile, err := os.Create(destination)
-	if err != nil {
-		return fmt.Errorf("failed to create/overwrite destination file %q, %w", destination, err)
+// downloadFile downloads the file and verifies its SHA-256 digest. If expectedSHA256 is empty (e.g. the stage
+// was created before the digests were kept), the digest in the object metadata is used instead, and the file is not
+// verified if there is none either. On a mismatch, the downloaded file is removed and ErrChecksumMismatch is returned.
+func (registry *CloudTaskRegistry) downloadFile(
+	ctx context.Context,
+	s3Bucket, s3Path, destination, expectedSHA256 string,
+) error {
+	if err := registry.fetchFile(ctx, s3Bucket, s3Path, destination); err != nil {
+		return err
 	}
-	defer destFile.Close()
 
-	_, err = io.Copy(destFile, object.Body)
-	if err != nil {
-		return fmt.Errorf("failed to copy file content from S3 to local file, %w", err)
+	if expectedSHA256 == "" {
+		object, err := registry.artifacts.HeadObject(ctx, s3Bucket, s3Path)
+		if err != nil {
+			return fmt.Errorf("couldn't get metadata of %q in S3 bucket %q, %w", s3Path, s3Bucket, err)
+		}
+		expectedSHA256 = object.Metadata[MetadataSHA256]
 	}
-
 	absPath, _ := filepath.Abs(destination)
-	log.Printf("Successfully downloaded %q from S3 bucket %q to %q", s3Path, s3Bucket, absPath)
+	if expectedSHA256 == "" {
+		log.Printf("Successfully downloaded %q from S3 bucket %q to %q (no checksum to verify)", s3Path, s3Bucket, absPath)
+		return nil
+	}
+	digest, err := FileSHA256(destination)
+	if err != nil {
+		return err
+	}
+	if digest != expectedSHA256 {
+		if err := os.Remove(destination); err != nil {
+			log.Printf("Couldn't remove corrupted file %q: %v", destination, err)
+		}
+		return fmt.Errorf("file %q downloaded from S3 bucket %q has sha256 %s instead of %s, %w",
+			s3Path, s3Bucket, digest, expectedSHA256, ErrChecksumMismatch)
+	}
+	log.Printf("Successfully downloaded %q from S3 bucket %q to %q (sha256 verified)", s3Path, s3Bucket, absPath)
 	return nil
 }
 
-// ListTaskRuns queries by TaskID (partition key). Optional status filter.
-// If taskID == "", it falls back to a full table Scan (paginated).
-func (r *CloudTaskRegistry) ListTaskRuns(taskID string, statuses []TaskRunStatus) ([]TaskRun, error) {
-	var items []map[string]types.AttributeValue
-	var err error
-
-	if strings.TrimSpace(taskID) != "" {
-		items, err = r.queryTaskRunsByTaskID(context.TODO(), taskID)
-	} else {
-		items, err = r.scanAllTaskRuns(context.TODO())
+// fetchFile downloads the file with FileTransferrer if the artifact store implements it
+func (registry *CloudTaskRegistry) fetchFile(ctx context.Context, s3Bucket, s3Path, destination string) error {
+	if transferrer, ok := registry.artifacts.(FileTransferrer); ok {
+		if err := transferrer.DownloadFile(ctx, s3Bucket, s3Path, destination); err != nil {
+			return fmt.Errorf("couldn't download file %q from S3 bucket %q, %w", s3Path, s3Bucket, err)
+		}
+		return nil
 	}
+
+	object, err := registry.artifacts.GetObject(ctx, s3Bucket, s3Path)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("couldn't download file %q from S3 bucket %q, %w", s3Path, s3Bucket, err)
 	}
+	defer object.Close()
 
-	var res []TaskRun
-	if err := attributevalue.UnmarshalListOfMaps(items, &res); err != nil {
-		return nil, fmt.Errorf("unmarshal task runs: %w", err)
+	destFile, err := os.Create(destination)
+	if err != nil {
+		return fmt.Errorf("failed to create/overwrite destination file %q, %w", destination, err)
 	}
+	defer destFile.Close()
 
-	if len(statuses) == 0 {
-		return res, nil
-	}
-	allowed := map[TaskRunStatus]struct{}{}
-	for _, s := range statuses {
-		allowed[s] = struct{}{}
-	}
-	out := res[:0]
-	for _, tr := range res {
-		if _, ok := allowed[tr.Status]; ok {
-			out = append(out, tr)
-		}
+	_, err = io.Copy(destFile, object)
+	if err != nil {
+		return fmt.Errorf("failed to copy file content from S3 to local file, %w", err)
 	}
-	return out, nil
+	return destFile.Close()
 }
 
-func (r *CloudTaskRegistry) queryTaskRunsByTaskID(ctx context.Context, taskID string) ([]map[string]types.AttributeValue, error) {
-	var last map[string]types.AttributeValue
-	var items []map[string]types.AttributeValue
-
-	for {
-		resp, err := r.dynamodbClient.Query(ctx, &dynamodb.QueryInput{
-			TableName:              aws.String(TasksTable),
-			KeyConditionExpression: aws.String("task_id = :tid"),
-			ExpressionAttributeValues: map[string]types.AttributeValue{
-				":tid": &types.AttributeValueMemberS{Value: taskID},
-			},
-			ExclusiveStartKey: last,
-		})
-		if err != nil {
-			return nil, fmt.Errorf("query task_runs by task_id: %w", err)
-		}
-		items = append(items, resp.Items...)
-		if len(resp.LastEvaluatedKey) == 0 {
-			break
-		}
-		last = resp.LastEvaluatedKey
-	}
-	return items, nil
+// ListTaskRuns returns a page of the task runs matching the filter. To get the next page, pass the cursor
+// of the page in the filter.
+func (registry *CloudTaskRegistry) ListTaskRuns(ctx context.Context, filter TaskRunFilter) (*TaskRunPage, error) {
+	filter.TaskID = strings.TrimSpace(filter.TaskID)
+	return registry.tasks.ListTaskRuns(ctx, filter)
 }
 
-func (r *CloudTaskRegistry) scanAllTaskRuns(ctx context.Context) ([]map[string]types.AttributeValue, error) {
-	var last map[string]types.AttributeValue
-	var items []map[string]types.AttributeValue
-
+// ListAllTaskRuns follows the pages of ListTaskRuns starting from filter.Cursor, fetching filter.Limit
+// task runs at a time
+func (registry *CloudTaskRegistry) ListAllTaskRuns(ctx context.Context, filter TaskRunFilter) ([]TaskRun, error) {
+	var taskRuns []TaskRun
 	for {
-		resp, err := r.dynamodbClient.Scan(ctx, &dynamodb.ScanInput{
-			TableName:         aws.String(TasksTable),
-			ExclusiveStartKey: last,
-		})
+		page, err := registry.ListTaskRuns(ctx, filter)
 		if err != nil {
-			return nil, fmt.Errorf("scan task_runs: %w", err)
+			return nil, err
 		}
-		items = append(items, resp.Items...)
-		if len(resp.LastEvaluatedKey) == 0 {
-			break
+		taskRuns = append(taskRuns, page.TaskRuns...)
+		if page.Cursor == "" {
+			return taskRuns, nil
 		}
-		last = resp.LastEvaluatedKey
+		filter.Cursor = page.Cursor
 	}
-	return items, nil
 }
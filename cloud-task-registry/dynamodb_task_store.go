@@ -0,0 +1,1074 @@
+package cloud_task_registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// DynamoDBTaskStore keeps task runs and stages in DynamoDB (or Yandex Database via Document API)
+type DynamoDBTaskStore struct {
+	client *dynamodb.Client
+}
+
+func NewDynamoDBTaskStore(serviceConfig ServiceConfig) (*DynamoDBTaskStore, error) {
+	configForDynamoDB, err := loadAwsConfig(serviceConfig)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load SDK config for DynamoDB, %w", err)
+	}
+
+	return &DynamoDBTaskStore{client: dynamodb.NewFromConfig(configForDynamoDB)}, nil
+}
+
+func (store *DynamoDBTaskStore) InsertTask(ctx context.Context, task Task) error {
+	av, err := attributevalue.MarshalMap(task)
+	if err != nil {
+		return err
+	}
+
+	input := &dynamodb.PutItemInput{
+		TableName:           aws.String(RegisteredTasksTable),
+		Item:                av,
+		ConditionExpression: aws.String("attribute_not_exists(task_id)"),
+	}
+
+	_, err = store.client.PutItem(ctx, input)
+	if err != nil {
+		return fmt.Errorf("failed to insert task '%s': %w", task.ID, conditionFailed(err))
+	}
+	return nil
+}
+
+func (store *DynamoDBTaskStore) GetTask(ctx context.Context, taskID string) (*Task, error) {
+	input := &dynamodb.GetItemInput{
+		TableName: aws.String(RegisteredTasksTable),
+		Key: map[string]types.AttributeValue{
+			"task_id": &types.AttributeValueMemberS{Value: taskID},
+		},
+	}
+
+	result, err := store.client.GetItem(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(result.Item) == 0 {
+		return nil, fmt.Errorf("task '%s' %w", taskID, ErrNotFound)
+	}
+
+	var task Task
+	err = attributevalue.UnmarshalMap(result.Item, &task)
+	if err != nil {
+		return nil, err
+	}
+
+	return &task, nil
+}
+
+func (store *DynamoDBTaskStore) ListTasks(ctx context.Context) ([]Task, error) {
+	var last map[string]types.AttributeValue
+	var items []map[string]types.AttributeValue
+
+	for {
+		resp, err := store.client.Scan(ctx, &dynamodb.ScanInput{
+			TableName:         aws.String(RegisteredTasksTable),
+			ExclusiveStartKey: last,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("scan tasks: %w", err)
+		}
+		items = append(items, resp.Items...)
+		if len(resp.LastEvaluatedKey) == 0 {
+			break
+		}
+		last = resp.LastEvaluatedKey
+	}
+
+	var res []Task
+	if err := attributevalue.UnmarshalListOfMaps(items, &res); err != nil {
+		return nil, fmt.Errorf("unmarshal tasks: %w", err)
+	}
+	return res, nil
+}
+
+func (store *DynamoDBTaskStore) DeleteTask(ctx context.Context, taskID string) error {
+	_, err := store.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(RegisteredTasksTable),
+		Key: map[string]types.AttributeValue{
+			"task_id": &types.AttributeValueMemberS{Value: taskID},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete task '%s': %w", taskID, err)
+	}
+	return nil
+}
+
+func (store *DynamoDBTaskStore) InsertTaskRun(ctx context.Context, task TaskRun) error {
+	av, err := attributevalue.MarshalMap(task)
+	if err != nil {
+		return err
+	}
+
+	input := &dynamodb.PutItemInput{
+		TableName: aws.String(TasksTable),
+		Item:      av,
+	}
+
+	_, err = store.client.PutItem(ctx, input)
+	return err
+}
+
+func (store *DynamoDBTaskStore) InsertStage(ctx context.Context, stage Stage) error {
+	av, err := attributevalue.MarshalMap(stage)
+	if err != nil {
+		return err
+	}
+
+	input := &dynamodb.PutItemInput{
+		TableName: aws.String(StagesTable),
+		Item:      av,
+	}
+
+	_, err = store.client.PutItem(ctx, input)
+	return err
+}
+
+// dynamoDBTransactionMaxItems is the limit of items in a single TransactWriteItems call
+const dynamoDBTransactionMaxItems = 25
+
+// InsertTaskRunWithStages writes everything in one transaction when it fits into dynamoDBTransactionMaxItems.
+// Otherwise, stages are written in several transactions and the task run goes last, with the stages
+// of the successful transactions deleted if a later one fails.
+func (store *DynamoDBTaskStore) InsertTaskRunWithStages(ctx context.Context, taskRun TaskRun, stages []Stage) error {
+	items := make([]types.TransactWriteItem, 0, len(stages)+1)
+	for _, stage := range stages {
+		av, err := attributevalue.MarshalMap(stage)
+		if err != nil {
+			return err
+		}
+		items = append(items, types.TransactWriteItem{Put: &types.Put{
+			TableName:           aws.String(StagesTable),
+			Item:                av,
+			ConditionExpression: aws.String("attribute_not_exists(n_ord)"),
+		}})
+	}
+	av, err := attributevalue.MarshalMap(taskRun)
+	if err != nil {
+		return err
+	}
+	items = append(items, types.TransactWriteItem{Put: &types.Put{
+		TableName:           aws.String(TasksTable),
+		Item:                av,
+		ConditionExpression: aws.String("attribute_not_exists(run_uuid)"),
+	}})
+
+	for written := 0; written < len(items); written += dynamoDBTransactionMaxItems {
+		chunk := items[written:min(written+dynamoDBTransactionMaxItems, len(items))]
+		_, err := store.client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: chunk})
+		if err != nil {
+			err = fmt.Errorf("failed to insert task run '%s' with stages: %w", taskRun.UUID, transactionConditionFailed(err))
+			if written > 0 {
+				// Only stages could have been written before, the task run is in the last chunk
+				rollbackCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cleanupTimeout)
+				defer cancel()
+				if rollbackErr := store.deleteStages(rollbackCtx, stages[:written]); rollbackErr != nil {
+					return errors.Join(err, fmt.Errorf("failed to roll back inserted stages: %w", rollbackErr))
+				}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (store *DynamoDBTaskStore) deleteStages(ctx context.Context, stages []Stage) error {
+	var errs []error
+	for _, stage := range stages {
+		_, err := store.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+			TableName: aws.String(StagesTable),
+			Key: map[string]types.AttributeValue{
+				"run_uuid": &types.AttributeValueMemberS{Value: stage.TaskRunUUID},
+				"n_ord":    &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", stage.NOrd)},
+			},
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("stage %d of task run '%s': %w", stage.NOrd, stage.TaskRunUUID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (store *DynamoDBTaskStore) UpdateTaskRunStatus(ctx context.Context, taskRun *TaskRun, newStatus TaskRunStatus) error {
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(TasksTable),
+		Key: map[string]types.AttributeValue{
+			"task_id":  &types.AttributeValueMemberS{Value: taskRun.TaskID},
+			"run_uuid": &types.AttributeValueMemberS{Value: taskRun.UUID},
+		},
+		UpdateExpression:    aws.String("SET #status = :newStatus"),
+		ConditionExpression: aws.String("attribute_exists(run_uuid) AND #status <> :cancelled"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":newStatus": &types.AttributeValueMemberS{Value: string(newStatus)},
+			":cancelled": &types.AttributeValueMemberS{Value: string(TaskRunStatus_Cancelled)},
+		},
+		ReturnValues: types.ReturnValueUpdatedNew,
+	}
+
+	_, err := store.client.UpdateItem(ctx, input)
+	if err != nil {
+		return fmt.Errorf("failed to update task run status: %w", conditionFailed(err))
+	}
+
+	return nil
+}
+
+func (store *DynamoDBTaskStore) GetTaskRun(ctx context.Context, taskRunUUID string) (*TaskRun, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(TasksTable),
+		IndexName:              aws.String("TaskRunUUIDIndex"),
+		KeyConditionExpression: aws.String("run_uuid = :run_uuid"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":run_uuid": &types.AttributeValueMemberS{Value: taskRunUUID},
+		},
+	}
+
+	result, err := store.client.Query(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(result.Items) == 0 {
+		return nil, fmt.Errorf("task run '%s' %w", taskRunUUID, ErrNotFound)
+	}
+	if len(result.Items) > 1 {
+		return nil, fmt.Errorf("task run '%s' is %w", taskRunUUID, ErrNotUnique)
+	}
+
+	var task TaskRun
+	err = attributevalue.UnmarshalMap(result.Items[0], &task)
+	if err != nil {
+		return nil, err
+	}
+
+	return &task, nil
+}
+
+func (store *DynamoDBTaskStore) PutTaskRunResults(
+	ctx context.Context,
+	taskRun *TaskRun,
+	results map[string]ResultValue,
+) error {
+	av, err := attributevalue.MarshalMap(results)
+	if err != nil {
+		return err
+	}
+
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(TasksTable),
+		Key: map[string]types.AttributeValue{
+			"task_id":  &types.AttributeValueMemberS{Value: taskRun.TaskID},
+			"run_uuid": &types.AttributeValueMemberS{Value: taskRun.UUID},
+		},
+		UpdateExpression:    aws.String("SET #results = :results"),
+		ConditionExpression: aws.String("attribute_exists(run_uuid)"),
+		ExpressionAttributeNames: map[string]string{
+			"#results": "results",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":results": &types.AttributeValueMemberM{Value: av},
+		},
+		ReturnValues: types.ReturnValueUpdatedNew,
+	}
+
+	_, err = store.client.UpdateItem(ctx, input)
+	if err != nil {
+		return fmt.Errorf("failed to update task run results: %w", conditionFailed(err))
+	}
+
+	return nil
+}
+
+// MergeTaskRunResults sets results.<key> attributes one by one, on condition that each result is either absent
+// or published by the same stage before
+func (store *DynamoDBTaskStore) MergeTaskRunResults(
+	ctx context.Context,
+	taskRun *TaskRun,
+	stageName string,
+	results map[string]ResultValue,
+) error {
+	key := map[string]types.AttributeValue{
+		"task_id":  &types.AttributeValueMemberS{Value: taskRun.TaskID},
+		"run_uuid": &types.AttributeValueMemberS{Value: taskRun.UUID},
+	}
+
+	// Nested attributes can be set only inside an existing map, and a map can't be created and updated
+	// in the same expression, so the map is created first
+	_, err := store.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(TasksTable),
+		Key:                 key,
+		UpdateExpression:    aws.String("SET #results = if_not_exists(#results, :empty)"),
+		ConditionExpression: aws.String("attribute_exists(run_uuid)"),
+		ExpressionAttributeNames: map[string]string{
+			"#results": "results",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":empty": &types.AttributeValueMemberM{Value: map[string]types.AttributeValue{}},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to merge task run results: %w", conditionFailed(err))
+	}
+
+	names := map[string]string{
+		"#results": "results",
+		"#stage":   "stage",
+	}
+	values := map[string]types.AttributeValue{
+		":stage": &types.AttributeValueMemberS{Value: stageName},
+	}
+	updates := make([]string, 0, len(results))
+	conditions := []string{"attribute_exists(run_uuid)"}
+	i := 0
+	for resultKey, result := range results {
+		name, valueName := fmt.Sprintf("#k%d", i), fmt.Sprintf(":v%d", i)
+		names[name] = resultKey
+		av, err := attributevalue.Marshal(result)
+		if err != nil {
+			return err
+		}
+		values[valueName] = av
+		updates = append(updates, fmt.Sprintf("#results.%s = %s", name, valueName))
+		// Results stored as bare strings before they got typed have no stage, so they are never overwritten
+		conditions = append(conditions,
+			fmt.Sprintf("(attribute_not_exists(#results.%s) OR #results.%s.#stage = :stage)", name, name))
+		i++
+	}
+
+	_, err = store.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(TasksTable),
+		Key:                       key,
+		UpdateExpression:          aws.String("SET " + strings.Join(updates, ", ")),
+		ConditionExpression:       aws.String(strings.Join(conditions, " AND ")),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	})
+	if err == nil {
+		return nil
+	}
+	err = conditionFailed(err)
+	if !errors.Is(err, ErrConditionFailed) {
+		return fmt.Errorf("failed to merge task run results: %w", err)
+	}
+	stored, errGet := store.GetTaskRun(ctx, taskRun.UUID)
+	if errGet != nil {
+		return fmt.Errorf("failed to merge task run results: %w", err)
+	}
+	if conflicts := findResultConflicts(stored, stageName, results); len(conflicts) > 0 {
+		return &ResultConflictError{TaskRunUUID: taskRun.UUID, Stage: stageName, Conflicts: conflicts}
+	}
+	return fmt.Errorf("failed to merge task run results: %w", err)
+}
+
+func (store *DynamoDBTaskStore) GetStage(ctx context.Context, taskRunUUID string, nOrd int) (*Stage, error) {
+	input := &dynamodb.GetItemInput{
+		TableName: aws.String(StagesTable),
+		Key: map[string]types.AttributeValue{
+			"run_uuid": &types.AttributeValueMemberS{Value: taskRunUUID},
+			"n_ord":    &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", nOrd)},
+		},
+	}
+
+	result, err := store.client.GetItem(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(result.Item) == 0 {
+		return nil, nil
+	}
+
+	var stage Stage
+	err = attributevalue.UnmarshalMap(result.Item, &stage)
+	if err != nil {
+		return nil, err
+	}
+
+	return &stage, nil
+}
+
+func (store *DynamoDBTaskStore) GetStageByName(ctx context.Context, taskRunUUID, stageName string) (*Stage, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(StagesTable),
+		IndexName:              aws.String("StageNameIndex"),
+		KeyConditionExpression: aws.String("run_uuid = :run_uuid and name = :name"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":run_uuid": &types.AttributeValueMemberS{Value: taskRunUUID},
+			":name":     &types.AttributeValueMemberS{Value: stageName},
+		},
+	}
+
+	result, err := store.client.Query(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Items) == 0 {
+		return nil, fmt.Errorf("stage '%s' %w in task %s", stageName, ErrNotFound, taskRunUUID)
+	}
+	if len(result.Items) > 1 {
+		return nil, fmt.Errorf("stage '%s' is %w in task %s", stageName, ErrNotUnique, taskRunUUID)
+	}
+
+	var stage Stage
+	err = attributevalue.UnmarshalMap(result.Items[0], &stage)
+	if err != nil {
+		return nil, err
+	}
+
+	return &stage, nil
+}
+
+func (store *DynamoDBTaskStore) GetAllStages(ctx context.Context, taskRunUUID string) ([]Stage, error) {
+	result, err := store.client.Query(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(StagesTable),
+		KeyConditionExpression: aws.String("run_uuid = :run_uuid"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":run_uuid": &types.AttributeValueMemberS{Value: taskRunUUID},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query stages: %w", err)
+	}
+
+	var stages []Stage
+	err = attributevalue.UnmarshalListOfMaps(result.Items, &stages)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal stages: %w", err)
+	}
+
+	return stages, nil
+}
+
+func (store *DynamoDBTaskStore) DeleteTaskRun(ctx context.Context, taskRun *TaskRun) error {
+	stages, err := store.GetAllStages(ctx, taskRun.UUID)
+	if err != nil {
+		return err
+	}
+	if err := store.deleteStages(ctx, stages); err != nil {
+		return fmt.Errorf("failed to delete stages of task run '%s': %w", taskRun.UUID, err)
+	}
+	events, err := store.GetRunEvents(ctx, taskRun.UUID)
+	if err != nil {
+		return err
+	}
+	if err := store.deleteEvents(ctx, events); err != nil {
+		return fmt.Errorf("failed to delete events of task run '%s': %w", taskRun.UUID, err)
+	}
+	_, err = store.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(TasksTable),
+		Key: map[string]types.AttributeValue{
+			"task_id":  &types.AttributeValueMemberS{Value: taskRun.TaskID},
+			"run_uuid": &types.AttributeValueMemberS{Value: taskRun.UUID},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete task run '%s': %w", taskRun.UUID, err)
+	}
+	return nil
+}
+
+func (store *DynamoDBTaskStore) UpdateStageStatus(ctx context.Context, stage *Stage, newStatus string) error {
+	return store.updateStageStatus(ctx, stage, newStatus,
+		"SET #status = :newStatus REMOVE t_heartbeat_utc, t_lease_expiry_utc",
+		map[string]types.AttributeValue{})
+}
+
+func (store *DynamoDBTaskStore) UpdateStageStatusWithLease(
+	ctx context.Context,
+	stage *Stage,
+	newStatus string,
+	tHeartbeatUTC, tLeaseExpiryUTC time.Time,
+) error {
+	return store.updateStageStatus(ctx, stage, newStatus,
+		"SET #status = :newStatus, t_heartbeat_utc = :heartbeat, t_lease_expiry_utc = :leaseExpiry",
+		map[string]types.AttributeValue{
+			":heartbeat":   &types.AttributeValueMemberS{Value: tHeartbeatUTC.Format(time.RFC3339)},
+			":leaseExpiry": &types.AttributeValueMemberS{Value: tLeaseExpiryUTC.Format(time.RFC3339)},
+		})
+}
+
+// updateStageStatus sets the status with the update expression, which may refer to extra values
+func (store *DynamoDBTaskStore) updateStageStatus(
+	ctx context.Context,
+	stage *Stage,
+	newStatus, updateExpression string,
+	values map[string]types.AttributeValue,
+) error {
+	values[":newStatus"] = &types.AttributeValueMemberS{Value: newStatus}
+	values[":expectedStatus"] = &types.AttributeValueMemberS{Value: stage.Status}
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(StagesTable),
+		Key: map[string]types.AttributeValue{
+			"run_uuid": &types.AttributeValueMemberS{Value: stage.TaskRunUUID},
+			"n_ord":    &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", stage.NOrd)},
+		},
+		UpdateExpression:    aws.String(updateExpression),
+		ConditionExpression: aws.String("attribute_exists(n_ord) AND #status = :expectedStatus"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+		},
+		ExpressionAttributeValues: values,
+		ReturnValues:              types.ReturnValueUpdatedNew,
+	}
+
+	_, err := store.client.UpdateItem(ctx, input)
+	if err = conditionFailed(err); errors.Is(err, ErrConditionFailed) {
+		// Tell a lost race from an absent stage
+		stored, errGet := store.GetStage(ctx, stage.TaskRunUUID, stage.NOrd)
+		if errGet == nil && stored != nil {
+			return newStageTransitionError(stage, newStatus, stored.Status)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update stage status: %w", err)
+	}
+
+	return nil
+}
+
+func (store *DynamoDBTaskStore) UpdateStageOutput(ctx context.Context, stage *Stage, path, sha256 string) error {
+	updateItem := &dynamodb.UpdateItemInput{
+		TableName: aws.String(StagesTable),
+		Key: map[string]types.AttributeValue{
+			"run_uuid": &types.AttributeValueMemberS{Value: stage.TaskRunUUID},
+			"n_ord":    &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", stage.NOrd)},
+		},
+		UpdateExpression:    aws.String("SET #output = :path, #sha256 = :sha256"),
+		ConditionExpression: aws.String("attribute_exists(n_ord)"),
+		ExpressionAttributeNames: map[string]string{
+			"#output": "output",
+			"#sha256": "output_sha256",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":path":   &types.AttributeValueMemberS{Value: path},
+			":sha256": &types.AttributeValueMemberS{Value: sha256},
+		},
+		ReturnValues: types.ReturnValueUpdatedNew,
+	}
+
+	_, err := store.client.UpdateItem(ctx, updateItem)
+	if err != nil {
+		return fmt.Errorf("failed to update stage output: %w", conditionFailed(err))
+	}
+
+	return nil
+}
+
+func (store *DynamoDBTaskStore) UpdateStageInput(ctx context.Context, stage *Stage, path, sha256 string) error {
+	updateItem := &dynamodb.UpdateItemInput{
+		TableName: aws.String(StagesTable),
+		Key: map[string]types.AttributeValue{
+			"run_uuid": &types.AttributeValueMemberS{Value: stage.TaskRunUUID},
+			"n_ord":    &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", stage.NOrd)},
+		},
+		UpdateExpression:    aws.String("SET #input = :path, #sha256 = :sha256"),
+		ConditionExpression: aws.String("attribute_exists(n_ord)"),
+		ExpressionAttributeNames: map[string]string{
+			"#input":  "input",
+			"#sha256": "input_sha256",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":path":   &types.AttributeValueMemberS{Value: path},
+			":sha256": &types.AttributeValueMemberS{Value: sha256},
+		},
+		ReturnValues: types.ReturnValueUpdatedNew,
+	}
+
+	_, err := store.client.UpdateItem(ctx, updateItem)
+	if err != nil {
+		return fmt.Errorf("failed to update stage input: %w", conditionFailed(err))
+	} // TODO check if update was done?
+
+	return nil
+}
+
+func (store *DynamoDBTaskStore) UpdateStageOutputs(
+	ctx context.Context,
+	stage *Stage,
+	outputs, sha256s map[string]string,
+) error {
+	outputsValue, err := attributevalue.Marshal(outputs)
+	if err != nil {
+		return err
+	}
+	sha256sValue, err := attributevalue.Marshal(sha256s)
+	if err != nil {
+		return err
+	}
+	updateItem := &dynamodb.UpdateItemInput{
+		TableName: aws.String(StagesTable),
+		Key: map[string]types.AttributeValue{
+			"run_uuid": &types.AttributeValueMemberS{Value: stage.TaskRunUUID},
+			"n_ord":    &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", stage.NOrd)},
+		},
+		UpdateExpression:    aws.String("SET #outputs = :outputs, #sha256s = :sha256s"),
+		ConditionExpression: aws.String("attribute_exists(n_ord)"),
+		ExpressionAttributeNames: map[string]string{
+			"#outputs": "outputs",
+			"#sha256s": "outputs_sha256",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":outputs": outputsValue,
+			":sha256s": sha256sValue,
+		},
+	}
+
+	if _, err := store.client.UpdateItem(ctx, updateItem); err != nil {
+		return fmt.Errorf("failed to update stage outputs: %w", conditionFailed(err))
+	}
+	return nil
+}
+
+func (store *DynamoDBTaskStore) UpdateStageComment(ctx context.Context, stage *Stage, comment string) error {
+	updateItem := &dynamodb.UpdateItemInput{
+		TableName: aws.String(StagesTable),
+		Key: map[string]types.AttributeValue{
+			"run_uuid": &types.AttributeValueMemberS{Value: stage.TaskRunUUID},
+			"n_ord":    &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", stage.NOrd)},
+		},
+		UpdateExpression:    aws.String("SET #comments = :comment"),
+		ConditionExpression: aws.String("attribute_exists(n_ord)"),
+		ExpressionAttributeNames: map[string]string{
+			"#comments": "comments",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":comment": &types.AttributeValueMemberS{Value: comment},
+		},
+		ReturnValues: types.ReturnValueUpdatedNew,
+	}
+
+	_, err := store.client.UpdateItem(ctx, updateItem)
+	if err != nil {
+		return fmt.Errorf("failed to update stage comment: %w", conditionFailed(err))
+	} // TODO check if update was done?
+
+	return nil
+}
+
+func (store *DynamoDBTaskStore) UpdateStageStartTime(ctx context.Context, stage *Stage, tStartUTC time.Time) error {
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(StagesTable),
+		Key: map[string]types.AttributeValue{
+			"run_uuid": &types.AttributeValueMemberS{Value: stage.TaskRunUUID},
+			"n_ord":    &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", stage.NOrd)},
+		},
+		UpdateExpression:    aws.String("SET t_start_utc = :t"),
+		ConditionExpression: aws.String("attribute_exists(n_ord)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":t": &types.AttributeValueMemberS{Value: tStartUTC.Format(time.RFC3339)},
+		},
+		ReturnValues: types.ReturnValueUpdatedNew,
+	}
+
+	_, err := store.client.UpdateItem(ctx, input)
+	if err != nil {
+		return fmt.Errorf("failed to update t_start_utc for stage %v: %w", stage, conditionFailed(err))
+	}
+
+	return nil
+}
+
+func (store *DynamoDBTaskStore) UpdateStageFinishTime(ctx context.Context, stage *Stage, tFinishUTC time.Time) error {
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(StagesTable),
+		Key: map[string]types.AttributeValue{
+			"run_uuid": &types.AttributeValueMemberS{Value: stage.TaskRunUUID},
+			"n_ord":    &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", stage.NOrd)},
+		},
+		UpdateExpression:    aws.String("SET t_finish_utc = :t"),
+		ConditionExpression: aws.String("attribute_exists(n_ord)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":t": &types.AttributeValueMemberS{Value: tFinishUTC.Format(time.RFC3339)},
+		},
+		ReturnValues: types.ReturnValueUpdatedNew,
+	}
+
+	_, err := store.client.UpdateItem(ctx, input)
+	if err != nil {
+		return fmt.Errorf("failed to update t_finish_utc for stage %v: %w", stage, conditionFailed(err))
+	}
+
+	return nil
+}
+
+func (store *DynamoDBTaskStore) UpdateStageLease(
+	ctx context.Context,
+	stage *Stage,
+	tHeartbeatUTC, tLeaseExpiryUTC time.Time,
+) error {
+	condition := "attribute_exists(n_ord) AND #status = :inProgress AND attribute_not_exists(t_lease_expiry_utc)"
+	values := map[string]types.AttributeValue{
+		":heartbeat":   &types.AttributeValueMemberS{Value: tHeartbeatUTC.Format(time.RFC3339)},
+		":leaseExpiry": &types.AttributeValueMemberS{Value: tLeaseExpiryUTC.Format(time.RFC3339)},
+		":inProgress":  &types.AttributeValueMemberS{Value: StageStatus_InProgress},
+	}
+	if stage.TLeaseExpiryUTC != nil {
+		condition = "attribute_exists(n_ord) AND #status = :inProgress AND t_lease_expiry_utc = :expectedLeaseExpiry"
+		values[":expectedLeaseExpiry"] = &types.AttributeValueMemberS{Value: stage.TLeaseExpiryUTC.Format(time.RFC3339)}
+	}
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(StagesTable),
+		Key: map[string]types.AttributeValue{
+			"run_uuid": &types.AttributeValueMemberS{Value: stage.TaskRunUUID},
+			"n_ord":    &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", stage.NOrd)},
+		},
+		UpdateExpression:    aws.String("SET t_heartbeat_utc = :heartbeat, t_lease_expiry_utc = :leaseExpiry"),
+		ConditionExpression: aws.String(condition),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+		},
+		ExpressionAttributeValues: values,
+	}
+
+	_, err := store.client.UpdateItem(ctx, input)
+	if err != nil {
+		return fmt.Errorf("failed to update lease for stage %v: %w", stage, conditionFailed(err))
+	}
+
+	return nil
+}
+
+func (store *DynamoDBTaskStore) AppendStageAttempt(ctx context.Context, stage *Stage, attempt StageAttempt) error {
+	attemptValue, err := attributevalue.Marshal(attempt)
+	if err != nil {
+		return err
+	}
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(StagesTable),
+		Key: map[string]types.AttributeValue{
+			"run_uuid": &types.AttributeValueMemberS{Value: stage.TaskRunUUID},
+			"n_ord":    &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", stage.NOrd)},
+		},
+		UpdateExpression:    aws.String("SET attempts = list_append(if_not_exists(attempts, :empty), :attempts)"),
+		ConditionExpression: aws.String("attribute_exists(n_ord)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":empty":    &types.AttributeValueMemberL{Value: []types.AttributeValue{}},
+			":attempts": &types.AttributeValueMemberL{Value: []types.AttributeValue{attemptValue}},
+		},
+	}
+
+	_, err = store.client.UpdateItem(ctx, input)
+	if err != nil {
+		return fmt.Errorf("failed to append attempt of stage %v: %w", stage, conditionFailed(err))
+	}
+
+	return nil
+}
+
+func (store *DynamoDBTaskStore) UpdateStageAttempt(ctx context.Context, stage *Stage, attempt StageAttempt) error {
+	attemptValue, err := attributevalue.Marshal(attempt)
+	if err != nil {
+		return err
+	}
+	// attempts[i] must exist, otherwise SET would append the attempt instead of failing
+	element := fmt.Sprintf("attempts[%d]", attempt.N-1)
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(StagesTable),
+		Key: map[string]types.AttributeValue{
+			"run_uuid": &types.AttributeValueMemberS{Value: stage.TaskRunUUID},
+			"n_ord":    &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", stage.NOrd)},
+		},
+		UpdateExpression:    aws.String("SET " + element + " = :attempt"),
+		ConditionExpression: aws.String("attribute_exists(" + element + ")"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":attempt": attemptValue,
+		},
+	}
+
+	_, err = store.client.UpdateItem(ctx, input)
+	if err != nil {
+		return fmt.Errorf("failed to update attempt %d of stage %v: %w", attempt.N, stage, conditionFailed(err))
+	}
+
+	return nil
+}
+
+func (store *DynamoDBTaskStore) AppendEvent(ctx context.Context, event TaskEvent) error {
+	item, err := attributevalue.MarshalMap(event)
+	if err != nil {
+		return err
+	}
+
+	_, err = store.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(EventsTable),
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to append event of task run %s: %w", event.TaskRunUUID, err)
+	}
+
+	return nil
+}
+
+func (store *DynamoDBTaskStore) GetRunEvents(ctx context.Context, taskRunUUID string) ([]TaskEvent, error) {
+	paginator := dynamodb.NewQueryPaginator(store.client, &dynamodb.QueryInput{
+		TableName:              aws.String(EventsTable),
+		KeyConditionExpression: aws.String("run_uuid = :run_uuid"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":run_uuid": &types.AttributeValueMemberS{Value: taskRunUUID},
+		},
+	})
+
+	var events []TaskEvent
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query events: %w", err)
+		}
+		var pageEvents []TaskEvent
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &pageEvents); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal events: %w", err)
+		}
+		events = append(events, pageEvents...)
+	}
+
+	return events, nil
+}
+
+func (store *DynamoDBTaskStore) deleteEvents(ctx context.Context, events []TaskEvent) error {
+	var errs []error
+	for _, event := range events {
+		_, err := store.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+			TableName: aws.String(EventsTable),
+			Key: map[string]types.AttributeValue{
+				"run_uuid": &types.AttributeValueMemberS{Value: event.TaskRunUUID},
+				"event_id": &types.AttributeValueMemberS{Value: event.ID},
+			},
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("event %s of task run '%s': %w", event.ID, event.TaskRunUUID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// dynamoDBTaskRunCursor is the position in the queries planned by planTaskRunQueries
+type dynamoDBTaskRunCursor struct {
+	Query   int               `json:"query"`
+	LastKey map[string]string `json:"last_key,omitempty"` // all the key attributes of task runs and their indexes are strings
+}
+
+// taskRunQuery reads a page of task runs starting after startKey, limit is nil when there is no limit
+type taskRunQuery func(
+	ctx context.Context,
+	startKey map[string]types.AttributeValue,
+	limit *int32,
+) ([]map[string]types.AttributeValue, map[string]types.AttributeValue, error)
+
+// ListTaskRuns queries task runs of the task by the table key, or by TaskCreationTimeIndex if there is a time range.
+// Without the task ID, it queries StatusCreationTimeIndex for each of the statuses (all of them by default),
+// or falls back to a full table Scan if there are neither statuses nor time range.
+func (store *DynamoDBTaskStore) ListTaskRuns(ctx context.Context, filter TaskRunFilter) (*TaskRunPage, error) {
+	var cursor dynamoDBTaskRunCursor
+	if filter.Cursor != "" {
+		if err := decodeCursor(filter.Cursor, &cursor); err != nil {
+			return nil, err
+		}
+	}
+	queries := store.planTaskRunQueries(filter)
+
+	page := &TaskRunPage{}
+	for cursor.Query < len(queries) {
+		var limit *int32
+		if filter.Limit > 0 {
+			remaining := filter.Limit - len(page.TaskRuns)
+			if remaining <= 0 {
+				var err error
+				if page.Cursor, err = encodeCursor(cursor); err != nil {
+					return nil, err
+				}
+				return page, nil
+			}
+			limit = aws.Int32(int32(remaining))
+		}
+
+		startKey := make(map[string]types.AttributeValue, len(cursor.LastKey))
+		for name, value := range cursor.LastKey {
+			startKey[name] = &types.AttributeValueMemberS{Value: value}
+		}
+		if len(startKey) == 0 {
+			startKey = nil
+		}
+		items, lastKey, err := queries[cursor.Query](ctx, startKey, limit)
+		if err != nil {
+			return nil, err
+		}
+
+		var taskRuns []TaskRun
+		if err := attributevalue.UnmarshalListOfMaps(items, &taskRuns); err != nil {
+			return nil, fmt.Errorf("unmarshal task runs: %w", err)
+		}
+		for _, taskRun := range taskRuns {
+			// The key conditions compare creation times as strings, so the time range is checked precisely here
+			if filter.matches(&taskRun) {
+				page.TaskRuns = append(page.TaskRuns, taskRun)
+			}
+		}
+
+		if len(lastKey) == 0 {
+			cursor = dynamoDBTaskRunCursor{Query: cursor.Query + 1}
+			continue
+		}
+		cursor.LastKey = make(map[string]string, len(lastKey))
+		for name, value := range lastKey {
+			s, ok := value.(*types.AttributeValueMemberS)
+			if !ok {
+				return nil, fmt.Errorf("unexpected type %T of key attribute %q of task runs", value, name)
+			}
+			cursor.LastKey[name] = s.Value
+		}
+	}
+	return page, nil
+}
+
+func (store *DynamoDBTaskStore) planTaskRunQueries(filter TaskRunFilter) []taskRunQuery {
+	names := map[string]string{}
+	values := map[string]types.AttributeValue{}
+	var timeCondition string
+	if filter.hasTimeRange() {
+		names["#creationTime"] = "creation_time"
+		// Times are stored as RFC3339Nano strings in UTC
+		if filter.CreatedAfter != nil {
+			values[":after"] = &types.AttributeValueMemberS{Value: filter.CreatedAfter.UTC().Format(time.RFC3339Nano)}
+		}
+		if filter.CreatedBefore != nil {
+			values[":before"] = &types.AttributeValueMemberS{Value: filter.CreatedBefore.UTC().Format(time.RFC3339Nano)}
+		}
+		switch {
+		case filter.CreatedAfter != nil && filter.CreatedBefore != nil:
+			// A key condition can't have two comparisons, the exclusive bound is checked after the query
+			timeCondition = " AND #creationTime BETWEEN :after AND :before"
+		case filter.CreatedAfter != nil:
+			timeCondition = " AND #creationTime >= :after"
+		default:
+			timeCondition = " AND #creationTime < :before"
+		}
+	}
+
+	if filter.TaskID != "" {
+		input := &dynamodb.QueryInput{
+			TableName:              aws.String(TasksTable),
+			KeyConditionExpression: aws.String("task_id = :tid" + timeCondition),
+		}
+		values[":tid"] = &types.AttributeValueMemberS{Value: filter.TaskID}
+		if filter.hasTimeRange() {
+			input.IndexName = aws.String("TaskCreationTimeIndex")
+		}
+		if len(filter.Statuses) > 0 {
+			names["#status"] = "status"
+			placeholders := make([]string, len(filter.Statuses))
+			for i, status := range filter.Statuses {
+				placeholders[i] = fmt.Sprintf(":status%d", i)
+				values[placeholders[i]] = &types.AttributeValueMemberS{Value: string(status)}
+			}
+			input.FilterExpression = aws.String("#status IN (" + strings.Join(placeholders, ", ") + ")")
+		}
+		if len(names) > 0 {
+			input.ExpressionAttributeNames = names
+		}
+		input.ExpressionAttributeValues = values
+		return []taskRunQuery{store.queryTaskRuns(input)}
+	}
+
+	if len(filter.Statuses) == 0 && !filter.hasTimeRange() {
+		return []taskRunQuery{store.scanTaskRuns()}
+	}
+
+	statuses := filter.Statuses
+	if len(statuses) == 0 {
+		statuses = allTaskRunStatuses
+	}
+	queries := make([]taskRunQuery, len(statuses))
+	for i, status := range statuses {
+		statusNames := maps.Clone(names)
+		statusNames["#status"] = "status"
+		statusValues := maps.Clone(values)
+		statusValues[":status"] = &types.AttributeValueMemberS{Value: string(status)}
+		queries[i] = store.queryTaskRuns(&dynamodb.QueryInput{
+			TableName:                 aws.String(TasksTable),
+			IndexName:                 aws.String("StatusCreationTimeIndex"),
+			KeyConditionExpression:    aws.String("#status = :status" + timeCondition),
+			ExpressionAttributeNames:  statusNames,
+			ExpressionAttributeValues: statusValues,
+		})
+	}
+	return queries
+}
+
+func (store *DynamoDBTaskStore) queryTaskRuns(input *dynamodb.QueryInput) taskRunQuery {
+	return func(
+		ctx context.Context,
+		startKey map[string]types.AttributeValue,
+		limit *int32,
+	) ([]map[string]types.AttributeValue, map[string]types.AttributeValue, error) {
+		page := *input
+		page.ExclusiveStartKey = startKey
+		page.Limit = limit
+		resp, err := store.client.Query(ctx, &page)
+		if err != nil {
+			return nil, nil, fmt.Errorf("query task_runs: %w", err)
+		}
+		return resp.Items, resp.LastEvaluatedKey, nil
+	}
+}
+
+func (store *DynamoDBTaskStore) scanTaskRuns() taskRunQuery {
+	return func(
+		ctx context.Context,
+		startKey map[string]types.AttributeValue,
+		limit *int32,
+	) ([]map[string]types.AttributeValue, map[string]types.AttributeValue, error) {
+		resp, err := store.client.Scan(ctx, &dynamodb.ScanInput{
+			TableName:         aws.String(TasksTable),
+			ExclusiveStartKey: startKey,
+			Limit:             limit,
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("scan task_runs: %w", err)
+		}
+		return resp.Items, resp.LastEvaluatedKey, nil
+	}
+}
+
+// transactionConditionFailed wraps a transaction cancelled by a failed condition into ErrConditionFailed
+func transactionConditionFailed(err error) error {
+	var cancelled *types.TransactionCanceledException
+	if errors.As(err, &cancelled) {
+		for _, reason := range cancelled.CancellationReasons {
+			if aws.ToString(reason.Code) == "ConditionalCheckFailed" {
+				return fmt.Errorf("%w: %v", ErrConditionFailed, err)
+			}
+		}
+	}
+	return err
+}
+
+// conditionFailed wraps ConditionalCheckFailedException into ErrConditionFailed
+func conditionFailed(err error) error {
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		return fmt.Errorf("%w: %v", ErrConditionFailed, err)
+	}
+	return err
+}
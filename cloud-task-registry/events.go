@@ -0,0 +1,52 @@
+package cloud_task_registry
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// eventTimeLayout has a fixed width, so that event IDs sort by time as strings
+const eventTimeLayout = "20060102T150405.000000000Z"
+
+// defaultEventActor names the program and the host that record the events, e.g. "cloud-connector@c8a1e5f2"
+func defaultEventActor() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return filepath.Base(os.Args[0]) + "@" + hostname
+}
+
+// newEventID orders the events of a task run by time, the random suffix tells apart the events
+// recorded at the same time by different actors
+func newEventID(t time.Time) string {
+	return fmt.Sprintf("%s-%08x", t.UTC().Format(eventTimeLayout), rand.Uint32())
+}
+
+// GetRunEvents returns the event log of the task run in the order of the events
+func (registry *CloudTaskRegistry) GetRunEvents(ctx context.Context, taskRunUUID string) ([]TaskEvent, error) {
+	return registry.tasks.GetRunEvents(ctx, taskRunUUID)
+}
+
+// recordEvent appends an event to the log of the task run. The log is informational, so a failure to record
+// the event doesn't fail the operation that has already happened.
+func (registry *CloudTaskRegistry) recordEvent(ctx context.Context, taskRunUUID, stage, eventType, details string) {
+	now := time.Now().UTC()
+	event := TaskEvent{
+		TaskRunUUID: taskRunUUID,
+		ID:          newEventID(now),
+		TimeUTC:     now,
+		Stage:       stage,
+		Type:        eventType,
+		Actor:       registry.eventActor,
+		Details:     details,
+	}
+	if err := registry.tasks.AppendEvent(ctx, event); err != nil {
+		log.Printf("failed to record %s event of task run %s (non-critical error), %v", eventType, taskRunUUID, err)
+	}
+}
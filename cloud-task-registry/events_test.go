@@ -0,0 +1,63 @@
+package cloud_task_registry
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunEvents_MustLogStatusChangesHandoversAndUploadsInOrder(t *testing.T) {
+	sqliteStore, err := NewSQLiteStore(filepath.Join(t.TempDir(), "registry.db"))
+	require.NoError(t, err)
+	defer sqliteStore.Close()
+	stores := map[string]TaskStore{"memory": NewMemoryTaskStore(), "sqlite": sqliteStore}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			// given
+			ctx := context.Background()
+			registry, err := New("", WithTaskStore(store), WithMessageQueue(NewMemoryMessageQueue()),
+				WithArtifactStore(NewMemoryArtifactStore()), WithEventActor("connector@host-1"))
+			require.NoError(t, err)
+			taskRun := TaskRun{TaskID: "task", UUID: "run-1", Status: TaskRunStatus_Submitted}
+			require.NoError(t, store.InsertTaskRun(ctx, taskRun))
+			require.NoError(t, registry.InsertStage(ctx,
+				Stage{TaskRunUUID: "run-1", NOrd: 1, Name: "cfd", Status: StageInitialStatus, S3Bucket: "bucket"}))
+			stage, err := registry.GetStage(ctx, "run-1", 1)
+			require.NoError(t, err)
+			output := filepath.Join(t.TempDir(), "out.txt")
+			require.NoError(t, os.WriteFile(output, []byte("result"), 0644))
+			// when
+			require.NoError(t, registry.PassTaskToStage(ctx, stage, NewTaskMessage(&taskRun, "", "")))
+			require.NoError(t, registry.UpdateStageStatus(ctx, stage, StageStatus_InProgress))
+			_, _, errUpload := registry.UploadFileForStage(ctx, output, "bucket", &taskRun, stage.Name, stage.NOrd)
+			require.NoError(t, registry.UpdateStageStatus(ctx, stage, StageStatus_Success))
+			require.NoError(t, registry.FinishTaskRun(ctx, NewTaskMessage(&taskRun, "cfd", "")))
+			require.NoError(t, registry.UpdateTaskRunStatus(ctx, &taskRun, TaskRunStatus_Cancelled))
+			events, err := registry.GetRunEvents(ctx, "run-1")
+			// then
+			require.NoError(t, errUpload)
+			require.NoError(t, err)
+			types := make([]string, len(events))
+			for i, event := range events {
+				types[i] = event.Type
+				assert.Equal(t, "run-1", event.TaskRunUUID)
+				assert.Equal(t, "connector@host-1", event.Actor)
+				assert.False(t, event.TimeUTC.IsZero())
+			}
+			assert.Equal(t, []string{EventType_Handover, EventType_StageStatus, EventType_Upload,
+				EventType_StageStatus, EventType_Handover, EventType_Cancellation}, types)
+			assert.Equal(t, "cfd", events[1].Stage)
+			assert.Equal(t, StageInitialStatus+" -> "+StageStatus_InProgress, events[1].Details)
+			assert.Equal(t, "task-registry/task/run-1/1_cfd/out.txt", events[2].Details)
+			assert.Empty(t, events[5].Stage)
+			require.NoError(t, store.DeleteTaskRun(ctx, &taskRun))
+			events, err = registry.GetRunEvents(ctx, "run-1")
+			require.NoError(t, err)
+			assert.Empty(t, events)
+		})
+	}
+}
@@ -0,0 +1,238 @@
+package cloud_task_registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FileArtifactStore keeps artifacts in a local (or NFS-mounted) directory using the same layout as S3:
+// <root>/<bucket>/task-registry/<task>/<run>/<n>_<stage>/<file>.
+// Artifacts of StorageClass_Cold go under coldRoot instead, which may point to cheaper storage.
+// Object metadata is kept next to the object in a hidden .metadata-<file>.json file.
+type FileArtifactStore struct {
+	root     string
+	coldRoot string
+}
+
+// NewFileArtifactStore NB: if coldRoot is empty, cold artifacts are kept under root as well
+func NewFileArtifactStore(root, coldRoot string) (*FileArtifactStore, error) {
+	if coldRoot == "" {
+		coldRoot = root
+	}
+	for _, dir := range []string{root, coldRoot} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("couldn't create artifacts directory %q: %w", dir, err)
+		}
+	}
+	return &FileArtifactStore{root: root, coldRoot: coldRoot}, nil
+}
+
+func (store *FileArtifactStore) PutObject(
+	_ context.Context,
+	bucket, key string,
+	body io.Reader,
+	storageClass StorageClass,
+	metadata map[string]string,
+) error {
+	root := store.root
+	if storageClass == StorageClass_Cold {
+		root = store.coldRoot
+	}
+	path, err := objectPath(root, bucket, key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("couldn't create directory for %q: %w", path, err)
+	}
+
+	// Write to a temporary file first, so that concurrent readers never see a partially written artifact
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return fmt.Errorf("couldn't create temporary file for %q: %w", path, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, body); err != nil {
+		tmp.Close()
+		return fmt.Errorf("couldn't write %q: %w", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("couldn't write %q: %w", path, err)
+	}
+	// The metadata goes first, so that the object never appears with the metadata of the previous one
+	if err := writeMetadata(path, metadata); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("couldn't move the uploaded file to %q: %w", path, err)
+	}
+	return nil
+}
+
+func (store *FileArtifactStore) GetObject(_ context.Context, bucket, key string) (io.ReadCloser, error) {
+	for _, root := range []string{store.root, store.coldRoot} {
+		path, err := objectPath(root, bucket, key)
+		if err != nil {
+			return nil, err
+		}
+		file, err := os.Open(path)
+		if err == nil {
+			return file, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("object %q in bucket %q %w", key, bucket, ErrNotFound)
+}
+
+func (store *FileArtifactStore) HeadObject(_ context.Context, bucket, key string) (*ObjectInfo, error) {
+	for _, root := range []string{store.root, store.coldRoot} {
+		path, err := objectPath(root, bucket, key)
+		if err != nil {
+			return nil, err
+		}
+		info, err := os.Stat(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		metadata, err := readMetadata(path)
+		if err != nil {
+			return nil, err
+		}
+		return &ObjectInfo{Key: key, Size: info.Size(), LastModified: info.ModTime(), Metadata: metadata}, nil
+	}
+	return nil, fmt.Errorf("object %q in bucket %q %w", key, bucket, ErrNotFound)
+}
+
+func (store *FileArtifactStore) DeleteObject(_ context.Context, bucket, key string) error {
+	for _, root := range []string{store.root, store.coldRoot} {
+		path, err := objectPath(root, bucket, key)
+		if err != nil {
+			return err
+		}
+		for _, file := range []string{path, metadataPath(path)} {
+			if err := os.Remove(file); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (store *FileArtifactStore) ListObjects(_ context.Context, bucket, prefix string) ([]ObjectInfo, error) {
+	roots := []string{store.root}
+	if store.coldRoot != store.root {
+		roots = append(roots, store.coldRoot)
+	}
+	var objects []ObjectInfo
+	for _, root := range roots {
+		base, err := objectPath(root, bucket, "_")
+		if err != nil {
+			return nil, err
+		}
+		base = filepath.Dir(base)
+		err = filepath.WalkDir(base, func(path string, entry fs.DirEntry, err error) error {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			if err != nil || entry.IsDir() {
+				return err
+			}
+			relative, err := filepath.Rel(base, path)
+			if err != nil {
+				return err
+			}
+			key := filepath.ToSlash(relative)
+			// Temporary files of uploads in progress are not objects yet, and metadata files are not objects at all
+			if !strings.HasPrefix(key, prefix) || strings.HasPrefix(entry.Name(), ".upload-") ||
+				strings.HasPrefix(entry.Name(), ".metadata-") {
+				return nil
+			}
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			objects = append(objects, ObjectInfo{Key: key, Size: info.Size(), LastModified: info.ModTime()})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return objects, nil
+}
+
+func metadataPath(path string) string {
+	return filepath.Join(filepath.Dir(path), ".metadata-"+filepath.Base(path)+".json")
+}
+
+// writeMetadata replaces the metadata file of the object at path, or removes it if there is no metadata
+func writeMetadata(path string, metadata map[string]string) error {
+	if len(metadata) == 0 {
+		if err := os.Remove(metadataPath(path)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return fmt.Errorf("couldn't create temporary file for the metadata of %q: %w", path, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("couldn't write the metadata of %q: %w", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("couldn't write the metadata of %q: %w", path, err)
+	}
+	if err := os.Rename(tmp.Name(), metadataPath(path)); err != nil {
+		return fmt.Errorf("couldn't move the metadata file of %q: %w", path, err)
+	}
+	return nil
+}
+
+func readMetadata(path string) (map[string]string, error) {
+	data, err := os.ReadFile(metadataPath(path))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var metadata map[string]string
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return nil, fmt.Errorf("couldn't parse the metadata of %q: %w", path, err)
+	}
+	return metadata, nil
+}
+
+func objectPath(root, bucket, key string) (string, error) {
+	root = filepath.Clean(root)
+	base := filepath.Join(root, bucket)
+	if base != root && !strings.HasPrefix(base, root+string(filepath.Separator)) {
+		return "", fmt.Errorf("bucket %q escapes artifacts directory %q", bucket, root)
+	}
+	path := filepath.Join(base, filepath.FromSlash(key))
+	if !strings.HasPrefix(path, base+string(filepath.Separator)) {
+		return "", fmt.Errorf("object key %q escapes bucket %q", key, bucket)
+	}
+	return path, nil
+}
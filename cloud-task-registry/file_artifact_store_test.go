@@ -0,0 +1,78 @@
+package cloud_task_registry
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileArtifactStore_MustKeepS3KeyLayoutAndPutColdArtifactsIntoColdRoot(t *testing.T) {
+	// given
+	ctx := context.Background()
+	tmpDir := t.TempDir()
+	root, coldRoot := filepath.Join(tmpDir, "artifacts"), filepath.Join(tmpDir, "cold")
+	options, err := ArtifactOptionsFromURL("file://" + root + "?cold=" + coldRoot)
+	require.NoError(t, err)
+	registry, err := New("", append(options,
+		WithTaskStore(NewMemoryTaskStore()), WithMessageQueue(NewMemoryMessageQueue()))...)
+	require.NoError(t, err)
+	localFile := filepath.Join(tmpDir, "mesh.7z")
+	require.NoError(t, os.WriteFile(localFile, []byte("mesh"), 0o644))
+	taskRun := &TaskRun{TaskID: "task", UUID: "run-1"}
+	// when
+	outputKey, outputSHA256, err := registry.UploadFileForStage(ctx, localFile, "bucket", taskRun, "cfd", 3)
+	require.NoError(t, err)
+	extraKey, _, err := registry.UploadExtraFileForStage(ctx, localFile, "bucket", taskRun, "cfd", 3)
+	require.NoError(t, err)
+	downloaded := filepath.Join(tmpDir, "downloaded")
+	require.NoError(t, registry.DownloadInputFile(ctx, &Stage{S3Bucket: "bucket", Input: outputKey, InputSHA256: outputSHA256}, downloaded))
+	// then
+	assert.Equal(t, "task-registry/task/run-1/3_cfd/mesh.7z", outputKey)
+	assert.FileExists(t, filepath.Join(root, "bucket", outputKey))
+	assert.FileExists(t, filepath.Join(coldRoot, "bucket", extraKey))
+	content, err := os.ReadFile(downloaded)
+	require.NoError(t, err)
+	assert.Equal(t, "mesh", string(content))
+}
+
+func TestFileArtifactStore_MustRejectKeysEscapingBucket(t *testing.T) {
+	// given
+	store, err := NewFileArtifactStore(t.TempDir(), "")
+	require.NoError(t, err)
+	// when
+	_, err = store.GetObject(t.Context(), "bucket", "../other-bucket/secret")
+	// then
+	assert.ErrorContains(t, err, "escapes bucket")
+}
+
+func TestDownloadInputFile_MustFailOnChecksumMismatchAndRemoveCorruptedFile(t *testing.T) {
+	// given
+	ctx := context.Background()
+	root := t.TempDir()
+	store, err := NewFileArtifactStore(root, "")
+	require.NoError(t, err)
+	registry, err := New("", WithArtifactStore(store),
+		WithTaskStore(NewMemoryTaskStore()), WithMessageQueue(NewMemoryMessageQueue()))
+	require.NoError(t, err)
+	localFile := filepath.Join(t.TempDir(), "mesh.7z")
+	require.NoError(t, os.WriteFile(localFile, []byte("mesh"), 0o644))
+	key, digest, err := registry.UploadFileForStage(ctx, localFile, "bucket", &TaskRun{TaskID: "task", UUID: "run-1"}, "cfd", 1)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(root, "bucket", key), []byte("mash"), 0o644))
+	downloaded := filepath.Join(t.TempDir(), "downloaded")
+	// when
+	errStageDigest := registry.DownloadInputFile(ctx, &Stage{S3Bucket: "bucket", Input: key, InputSHA256: digest}, downloaded)
+	errMetadataDigest := registry.DownloadInputFile(ctx, &Stage{S3Bucket: "bucket", Input: key}, downloaded)
+	// then
+	expectedDigest, err := FileSHA256(localFile)
+	require.NoError(t, err)
+	assert.Equal(t, expectedDigest, digest)
+	assert.ErrorIs(t, errStageDigest, ErrChecksumMismatch)
+	assert.ErrorContains(t, errStageDigest, "instead of "+digest)
+	assert.ErrorIs(t, errMetadataDigest, ErrChecksumMismatch)
+	assert.NoFileExists(t, downloaded)
+}
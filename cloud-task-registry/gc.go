@@ -0,0 +1,135 @@
+package cloud_task_registry
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"math"
+	"slices"
+	"time"
+)
+
+// RetentionPolicy selects the task runs that CollectGarbage deletes, zero fields don't filter anything
+type RetentionPolicy struct {
+	TaskID string
+	// Statuses default to the final ones, so that runs in progress are deleted only if asked explicitly
+	Statuses      []TaskRunStatus
+	CreatedBefore *time.Time
+	// KeepBest is the number of runs per task to keep among the selected ones, ranked by Objective.
+	// Runs without a valid value of the objective are the worst.
+	KeepBest int
+	// Objective defaults to the first objective of the task
+	Objective string
+	Maximize  bool
+	// Archive keeps a JSON record of the run, its stages and results in cold storage before deleting it,
+	// see ArchivePath
+	Archive bool
+	DryRun  bool
+}
+
+// CollectGarbage deletes the task runs selected by the policy together with their stages, all the S3 objects
+// under the run prefix and their reply queues. The objects are deleted first, so that a run that fails
+// to be deleted can be collected again. It also deletes the reply queues that the runners killed before closing
+// them have left behind, see closeStaleReplyQueues. The report is returned even on error, with the runs deleted
+// so far.
+func (registry *CloudTaskRegistry) CollectGarbage(ctx context.Context, policy RetentionPolicy) (*DeletionReport, error) {
+	filter := TaskRunFilter{
+		TaskID:        policy.TaskID,
+		Statuses:      policy.Statuses,
+		CreatedBefore: policy.CreatedBefore,
+		Limit:         deletionPageSize,
+	}
+	if len(filter.Statuses) == 0 {
+		filter.Statuses = finalTaskRunStatuses
+	}
+	report := &DeletionReport{}
+	taskRuns, err := registry.ListAllTaskRuns(ctx, filter)
+	if err != nil {
+		return report, fmt.Errorf("failed to list task runs, %w", err)
+	}
+
+	deleter := newTaskRunDeleter(registry, policy.Archive, policy.DryRun)
+	var kept []TaskRun
+	if policy.KeepBest > 0 {
+		if taskRuns, kept, err = deleter.dropBest(ctx, taskRuns, policy); err != nil {
+			return report, err
+		}
+		report.Kept = len(kept)
+	}
+	if err := deleter.deleteTaskRuns(ctx, taskRuns, report); err != nil {
+		return report, err
+	}
+
+	report.StaleQueues, err = registry.closeStaleReplyQueues(ctx, policy, kept, time.Now())
+	return report, err
+}
+
+// dropBest splits the runs to delete from the best policy.KeepBest runs of each task, which are kept
+func (deleter *taskRunDeleter) dropBest(
+	ctx context.Context,
+	taskRuns []TaskRun,
+	policy RetentionPolicy,
+) ([]TaskRun, []TaskRun, error) {
+	byTask := make(map[string][]TaskRun)
+	var taskIds []string
+	for _, taskRun := range taskRuns {
+		if _, ok := byTask[taskRun.TaskID]; !ok {
+			taskIds = append(taskIds, taskRun.TaskID)
+		}
+		byTask[taskRun.TaskID] = append(byTask[taskRun.TaskID], taskRun)
+	}
+
+	var deleted, kept []TaskRun
+	for _, taskId := range taskIds {
+		objective := policy.Objective
+		if objective == "" {
+			task, err := deleter.getTask(ctx, taskId)
+			if err != nil {
+				return nil, nil, err
+			}
+			if task == nil || len(task.Objectives) == 0 {
+				return nil, nil, fmt.Errorf("task %s has no registered objectives to keep the best runs by", taskId)
+			}
+			objective = task.Objectives[0]
+		}
+
+		runs := byTask[taskId]
+		slices.SortStableFunc(runs, func(a, b TaskRun) int {
+			return compareRuns(a, b, objective, policy.Maximize)
+		})
+		n := min(policy.KeepBest, len(runs))
+		kept = append(kept, runs[:n]...)
+		deleted = append(deleted, runs[n:]...)
+	}
+	return deleted, kept, nil
+}
+
+// compareRuns orders task runs from the best to the worst by the objective
+func compareRuns(a, b TaskRun, objective string, maximize bool) int {
+	aValue, aOk := objectiveValue(a, objective)
+	bValue, bOk := objectiveValue(b, objective)
+	switch {
+	case !aOk || !bOk:
+		// Runs with the value go first
+		return cmp.Compare(boolRank(bOk), boolRank(aOk))
+	case maximize:
+		return cmp.Compare(bValue, aValue)
+	default:
+		return cmp.Compare(aValue, bValue)
+	}
+}
+
+func objectiveValue(taskRun TaskRun, objective string) (float64, bool) {
+	result, ok := taskRun.Results[objective]
+	if !ok || !result.IsValid() || math.IsNaN(result.Value) {
+		return 0, false
+	}
+	return result.Value, true
+}
+
+func boolRank(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
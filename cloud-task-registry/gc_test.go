@@ -0,0 +1,131 @@
+package cloud_task_registry
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollectGarbage_MustReportOnDryRunAndKeepBestRuns(t *testing.T) {
+	// given
+	ctx := context.Background()
+	registry := NewInMemory()
+	require.NoError(t, registry.CreateTask(ctx, Task{ID: "task", S3Bucket: "bucket", Objectives: []string{"drag"}}))
+	outputPath := filepath.Join(t.TempDir(), "output.txt")
+	require.NoError(t, os.WriteFile(outputPath, []byte("0123456789"), 0o644))
+	created := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	drags := map[string]ResultValue{
+		"run-1": {Value: 3, Status: ResultStatus_OK},
+		"run-2": {Value: 1, Status: ResultStatus_OK},
+		"run-3": {Status: ResultStatus_Failed},
+		"run-4": {Value: 2, Status: ResultStatus_OK},
+	}
+	for _, uuid := range []string{"run-1", "run-2", "run-3", "run-4"} {
+		taskRun := TaskRun{TaskID: "task", UUID: uuid, Status: TaskRunStatus_Finished, CreationTime: &created,
+			Results: map[string]ResultValue{"drag": drags[uuid]}}
+		stage := Stage{TaskRunUUID: uuid, NOrd: 1, Name: "cfd", Status: StageStatus_Success, S3Bucket: "bucket"}
+		require.NoError(t, registry.CreateTaskRunWithStages(ctx, taskRun, []Stage{stage}))
+		_, _, err := registry.UploadFileForStage(ctx, outputPath, "bucket", &taskRun, "cfd", 1)
+		require.NoError(t, err)
+	}
+	submitted := TaskRun{TaskID: "task", UUID: "run-5", Status: TaskRunStatus_Submitted, CreationTime: &created}
+	require.NoError(t, registry.InsertTaskRun(ctx, submitted))
+	policy := RetentionPolicy{TaskID: "task", KeepBest: 2, Archive: true, DryRun: true}
+	// when
+	dryRun, errDryRun := registry.CollectGarbage(ctx, policy)
+	listedAfterDryRun, errListDryRun := registry.ListAllTaskRuns(ctx, TaskRunFilter{TaskID: "task"})
+	policy.DryRun = false
+	report, errCollect := registry.CollectGarbage(ctx, policy)
+	remaining, errList := registry.ListAllTaskRuns(ctx, TaskRunFilter{TaskID: "task"})
+	// then
+	require.NoError(t, errDryRun)
+	require.NoError(t, errListDryRun)
+	assert.Len(t, listedAfterDryRun, 5)
+	require.NoError(t, errCollect)
+	assert.Equal(t, dryRun, report)
+	assert.Equal(t, 2, report.Kept)
+	require.Len(t, report.TaskRuns, 2)
+	assert.ElementsMatch(t, []string{"run-1", "run-3"},
+		[]string{report.TaskRuns[0].TaskRun.UUID, report.TaskRuns[1].TaskRun.UUID})
+	assert.Equal(t, 2, report.Objects)
+	assert.Equal(t, int64(20), report.Bytes)
+	require.NoError(t, errList)
+	var remainingUUIDs []string
+	for _, taskRun := range remaining {
+		remainingUUIDs = append(remainingUUIDs, taskRun.UUID)
+	}
+	assert.ElementsMatch(t, []string{"run-2", "run-4", "run-5"}, remainingUUIDs)
+	stages, err := registry.GetAllStages(ctx, "run-1")
+	require.NoError(t, err)
+	assert.Empty(t, stages)
+	objects, err := registry.artifacts.ListObjects(ctx, "bucket", "task-registry/task/run-1/")
+	require.NoError(t, err)
+	assert.Empty(t, objects)
+	archive, err := registry.artifacts.GetObject(ctx, "bucket", ArchivePath("task", "run-3"))
+	require.NoError(t, err)
+	archive.Close()
+}
+
+func TestCollectGarbage_MustReturnReportWhenBestRunsCannotBeRanked(t *testing.T) {
+	// given
+	ctx := context.Background()
+	registry := NewInMemory()
+	require.NoError(t, registry.CreateTask(ctx, Task{ID: "task", S3Bucket: "bucket"}))
+	require.NoError(t, registry.InsertTaskRun(ctx, TaskRun{TaskID: "task", UUID: "run-1", Status: TaskRunStatus_Finished}))
+	// when
+	report, err := registry.CollectGarbage(ctx, RetentionPolicy{TaskID: "task", KeepBest: 1})
+	// then
+	assert.Error(t, err)
+	require.NotNil(t, report)
+	assert.Empty(t, report.TaskRuns)
+	_, err = registry.GetTaskRun(ctx, "run-1")
+	assert.NoError(t, err)
+}
+
+func TestCollectGarbage_MustDeleteReplyQueuesLeftBehindByKilledRunners(t *testing.T) {
+	// given
+	ctx := context.Background()
+	registry := NewInMemory()
+	require.NoError(t, registry.CreateTask(ctx, Task{ID: "task", S3Bucket: "bucket", Objectives: []string{"drag"}}))
+	created := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := time.Now().UTC()
+	for uuid, drag := range map[string]float64{"run-best": 1, "run-worse": 2, "run-best-of-other": 1} {
+		taskRun := TaskRun{TaskID: "task", UUID: uuid, Status: TaskRunStatus_Finished, CreationTime: &created,
+			Results: map[string]ResultValue{"drag": {Value: drag, Status: ResultStatus_OK}}}
+		if uuid == "run-best-of-other" {
+			taskRun.TaskID = "other"
+		}
+		require.NoError(t, registry.InsertTaskRun(ctx, taskRun))
+	}
+	// The run has been created long ago, but its last stage has just finished
+	require.NoError(t, registry.InsertStage(ctx, Stage{
+		TaskRunUUID: "run-best-of-other", NOrd: 1, Name: "cfd", Status: StageStatus_Success, TFinishUTC: &now}))
+	require.NoError(t, registry.InsertTaskRun(ctx,
+		TaskRun{TaskID: "task", UUID: "run-recent", Status: TaskRunStatus_Finished, CreationTime: &now}))
+	for _, uuid := range []string{"run-best", "run-worse", "run-best-of-other", "run-recent", "run-deleted"} {
+		_, err := registry.OpenReplyQueue(ctx, uuid)
+		require.NoError(t, err)
+	}
+	createdBefore := created.Add(time.Hour)
+	policy := RetentionPolicy{CreatedBefore: &createdBefore, KeepBest: 1, Objective: "drag", DryRun: true}
+	// when
+	dryRun, errDryRun := registry.CollectGarbage(ctx, policy)
+	policy.DryRun = false
+	report, err := registry.CollectGarbage(ctx, policy)
+	// then
+	require.NoError(t, errDryRun)
+	require.NoError(t, err)
+	stale := []string{ReplyQueueName("run-best"), ReplyQueueName("run-deleted")}
+	assert.Equal(t, stale, dryRun.StaleQueues)
+	assert.Equal(t, stale, report.StaleQueues)
+	assert.Equal(t, []string{ReplyQueueName("run-worse")}, report.ReplyQueues)
+	remaining, err := registry.queues.ListQueues(ctx, replyQueuePrefix)
+	require.NoError(t, err)
+	assert.Equal(t, []string{ReplyQueueName("run-best-of-other"), ReplyQueueName("run-recent")}, remaining,
+		"the runners of the runs that have just finished may still be waiting for the reply")
+}
@@ -0,0 +1,745 @@
+package cloud_task_registry
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NewInMemory creates a registry that keeps everything in process memory (for tests and local development)
+func NewInMemory() *CloudTaskRegistry {
+	registry, _ := New("",
+		WithTaskStore(NewMemoryTaskStore()),
+		WithArtifactStore(NewMemoryArtifactStore()),
+		WithMessageQueue(NewMemoryMessageQueue()),
+	)
+	return registry
+}
+
+// MemoryTaskStore keeps tasks, task runs and stages in memory, mirroring the semantics of DynamoDBTaskStore
+type MemoryTaskStore struct {
+	mu     sync.Mutex
+	tasks  map[string]Task
+	runs   map[taskRunKey]TaskRun
+	stages map[string]map[int]Stage // run_uuid -> n_ord -> stage
+	events map[string][]TaskEvent   // run_uuid -> events
+}
+
+type taskRunKey struct {
+	taskID  string
+	runUUID string
+}
+
+func NewMemoryTaskStore() *MemoryTaskStore {
+	return &MemoryTaskStore{
+		tasks:  make(map[string]Task),
+		runs:   make(map[taskRunKey]TaskRun),
+		stages: make(map[string]map[int]Stage),
+		events: make(map[string][]TaskEvent),
+	}
+}
+
+func (store *MemoryTaskStore) InsertTask(_ context.Context, task Task) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if _, ok := store.tasks[task.ID]; ok {
+		return fmt.Errorf("failed to insert task '%s': %w", task.ID, ErrConditionFailed)
+	}
+	store.tasks[task.ID] = copyTask(task)
+	return nil
+}
+
+func (store *MemoryTaskStore) GetTask(_ context.Context, taskID string) (*Task, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	task, ok := store.tasks[taskID]
+	if !ok {
+		return nil, fmt.Errorf("task '%s' %w", taskID, ErrNotFound)
+	}
+	task = copyTask(task)
+	return &task, nil
+}
+
+func (store *MemoryTaskStore) ListTasks(_ context.Context) ([]Task, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	var res []Task
+	for _, task := range store.tasks {
+		res = append(res, copyTask(task))
+	}
+	return res, nil
+}
+
+func (store *MemoryTaskStore) DeleteTask(_ context.Context, taskID string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	delete(store.tasks, taskID)
+	return nil
+}
+
+func (store *MemoryTaskStore) InsertTaskRun(_ context.Context, taskRun TaskRun) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.runs[taskRunKey{taskRun.TaskID, taskRun.UUID}] = copyTaskRun(taskRun)
+	return nil
+}
+
+func (store *MemoryTaskStore) GetTaskRun(_ context.Context, taskRunUUID string) (*TaskRun, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var found []TaskRun
+	for key, taskRun := range store.runs {
+		if key.runUUID == taskRunUUID {
+			found = append(found, taskRun)
+		}
+	}
+	if len(found) == 0 {
+		return nil, fmt.Errorf("task run '%s' %w", taskRunUUID, ErrNotFound)
+	}
+	if len(found) > 1 {
+		return nil, fmt.Errorf("task run '%s' is %w", taskRunUUID, ErrNotUnique)
+	}
+
+	taskRun := copyTaskRun(found[0])
+	return &taskRun, nil
+}
+
+func (store *MemoryTaskStore) ListTaskRuns(_ context.Context, filter TaskRunFilter) (*TaskRunPage, error) {
+	var after taskRunKeyCursor
+	if filter.Cursor != "" {
+		if err := decodeCursor(filter.Cursor, &after); err != nil {
+			return nil, err
+		}
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var res []TaskRun
+	for key, taskRun := range store.runs {
+		if filter.Cursor != "" && (key.taskID < after.TaskID || (key.taskID == after.TaskID && key.runUUID <= after.UUID)) {
+			continue
+		}
+		if filter.matches(&taskRun) {
+			res = append(res, copyTaskRun(taskRun))
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].TaskID != res[j].TaskID {
+			return res[i].TaskID < res[j].TaskID
+		}
+		return res[i].UUID < res[j].UUID
+	})
+
+	page := &TaskRunPage{TaskRuns: res}
+	if filter.Limit > 0 && len(res) > filter.Limit {
+		page.TaskRuns = res[:filter.Limit]
+		last := page.TaskRuns[filter.Limit-1]
+		cursor, err := encodeCursor(taskRunKeyCursor{TaskID: last.TaskID, UUID: last.UUID})
+		if err != nil {
+			return nil, err
+		}
+		page.Cursor = cursor
+	}
+	return page, nil
+}
+
+func (store *MemoryTaskStore) UpdateTaskRunStatus(_ context.Context, taskRun *TaskRun, newStatus TaskRunStatus) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	key := taskRunKey{taskRun.TaskID, taskRun.UUID}
+	stored, ok := store.runs[key]
+	if !ok || stored.Status == TaskRunStatus_Cancelled {
+		return fmt.Errorf("failed to update task run status: %w", ErrConditionFailed)
+	}
+	stored.Status = newStatus
+	store.runs[key] = stored
+	return nil
+}
+
+func (store *MemoryTaskStore) PutTaskRunResults(
+	_ context.Context,
+	taskRun *TaskRun,
+	results map[string]ResultValue,
+) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	key := taskRunKey{taskRun.TaskID, taskRun.UUID}
+	stored, ok := store.runs[key]
+	if !ok {
+		return fmt.Errorf("failed to update task run results: %w", ErrConditionFailed)
+	}
+	stored.Results = maps.Clone(results)
+	store.runs[key] = stored
+	return nil
+}
+
+func (store *MemoryTaskStore) MergeTaskRunResults(
+	_ context.Context,
+	taskRun *TaskRun,
+	stageName string,
+	results map[string]ResultValue,
+) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	key := taskRunKey{taskRun.TaskID, taskRun.UUID}
+	stored, ok := store.runs[key]
+	if !ok {
+		return fmt.Errorf("failed to merge task run results: %w", ErrConditionFailed)
+	}
+	if conflicts := findResultConflicts(&stored, stageName, results); len(conflicts) > 0 {
+		return &ResultConflictError{TaskRunUUID: taskRun.UUID, Stage: stageName, Conflicts: conflicts}
+	}
+	if stored.Results == nil {
+		stored.Results = make(map[string]ResultValue)
+	}
+	for resultKey, result := range results {
+		stored.Results[resultKey] = result
+	}
+	store.runs[key] = stored
+	return nil
+}
+
+func (store *MemoryTaskStore) InsertTaskRunWithStages(_ context.Context, taskRun TaskRun, stages []Stage) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if _, ok := store.runs[taskRunKey{taskRun.TaskID, taskRun.UUID}]; ok {
+		return fmt.Errorf("task run '%s' exists already: %w", taskRun.UUID, ErrConditionFailed)
+	}
+	for _, stage := range stages {
+		if _, ok := store.stages[stage.TaskRunUUID][stage.NOrd]; ok {
+			return fmt.Errorf("stage %d of task run '%s' exists already: %w", stage.NOrd, stage.TaskRunUUID,
+				ErrConditionFailed)
+		}
+	}
+	store.runs[taskRunKey{taskRun.TaskID, taskRun.UUID}] = copyTaskRun(taskRun)
+	for _, stage := range stages {
+		if store.stages[stage.TaskRunUUID] == nil {
+			store.stages[stage.TaskRunUUID] = make(map[int]Stage)
+		}
+		store.stages[stage.TaskRunUUID][stage.NOrd] = copyStage(stage)
+	}
+	return nil
+}
+
+func (store *MemoryTaskStore) InsertStage(_ context.Context, stage Stage) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if store.stages[stage.TaskRunUUID] == nil {
+		store.stages[stage.TaskRunUUID] = make(map[int]Stage)
+	}
+	store.stages[stage.TaskRunUUID][stage.NOrd] = copyStage(stage)
+	return nil
+}
+
+func (store *MemoryTaskStore) GetStage(_ context.Context, taskRunUUID string, nOrd int) (*Stage, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	stage, ok := store.stages[taskRunUUID][nOrd]
+	if !ok {
+		return nil, nil
+	}
+	stage = copyStage(stage)
+	return &stage, nil
+}
+
+func (store *MemoryTaskStore) GetStageByName(_ context.Context, taskRunUUID, stageName string) (*Stage, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var found []Stage
+	for _, stage := range store.stages[taskRunUUID] {
+		if stage.Name == stageName {
+			found = append(found, stage)
+		}
+	}
+	if len(found) == 0 {
+		return nil, fmt.Errorf("stage '%s' %w in task %s", stageName, ErrNotFound, taskRunUUID)
+	}
+	if len(found) > 1 {
+		return nil, fmt.Errorf("stage '%s' is %w in task %s", stageName, ErrNotUnique, taskRunUUID)
+	}
+
+	stage := copyStage(found[0])
+	return &stage, nil
+}
+
+func (store *MemoryTaskStore) GetAllStages(_ context.Context, taskRunUUID string) ([]Stage, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var stages []Stage
+	for _, nOrd := range slices.Sorted(maps.Keys(store.stages[taskRunUUID])) {
+		stages = append(stages, copyStage(store.stages[taskRunUUID][nOrd]))
+	}
+	return stages, nil
+}
+
+func (store *MemoryTaskStore) DeleteTaskRun(_ context.Context, taskRun *TaskRun) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	delete(store.stages, taskRun.UUID)
+	delete(store.events, taskRun.UUID)
+	delete(store.runs, taskRunKey{taskRun.TaskID, taskRun.UUID})
+	return nil
+}
+
+func (store *MemoryTaskStore) UpdateStageStatus(_ context.Context, stage *Stage, newStatus string) error {
+	return store.updateStageStatus(stage, newStatus, nil, nil)
+}
+
+func (store *MemoryTaskStore) UpdateStageStatusWithLease(
+	_ context.Context,
+	stage *Stage,
+	newStatus string,
+	tHeartbeatUTC, tLeaseExpiryUTC time.Time,
+) error {
+	heartbeat, expiry := tHeartbeatUTC.Truncate(time.Second), tLeaseExpiryUTC.Truncate(time.Second)
+	return store.updateStageStatus(stage, newStatus, &heartbeat, &expiry)
+}
+
+func (store *MemoryTaskStore) updateStageStatus(
+	stage *Stage,
+	newStatus string,
+	tHeartbeatUTC, tLeaseExpiryUTC *time.Time,
+) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	stored, ok := store.stages[stage.TaskRunUUID][stage.NOrd]
+	if !ok {
+		return fmt.Errorf("failed to update stage status: %w", ErrConditionFailed)
+	}
+	if stored.Status != stage.Status {
+		return newStageTransitionError(stage, newStatus, stored.Status)
+	}
+	stored.Status = newStatus
+	stored.THeartbeatUTC = tHeartbeatUTC
+	stored.TLeaseExpiryUTC = tLeaseExpiryUTC
+	store.stages[stage.TaskRunUUID][stage.NOrd] = stored
+	return nil
+}
+
+func (store *MemoryTaskStore) UpdateStageInput(_ context.Context, stage *Stage, path, sha256 string) error {
+	return store.updateStage(stage, "input", func(s *Stage) { s.Input, s.InputSHA256 = path, sha256 })
+}
+
+func (store *MemoryTaskStore) UpdateStageOutput(_ context.Context, stage *Stage, path, sha256 string) error {
+	return store.updateStage(stage, "output", func(s *Stage) { s.Output, s.OutputSHA256 = path, sha256 })
+}
+
+func (store *MemoryTaskStore) UpdateStageOutputs(_ context.Context, stage *Stage, outputs, sha256s map[string]string) error {
+	return store.updateStage(stage, "outputs", func(s *Stage) {
+		s.Outputs, s.OutputsSHA256 = maps.Clone(outputs), maps.Clone(sha256s)
+	})
+}
+
+func (store *MemoryTaskStore) UpdateStageComment(_ context.Context, stage *Stage, comment string) error {
+	return store.updateStage(stage, "comment", func(s *Stage) { s.Comments = comment })
+}
+
+func (store *MemoryTaskStore) UpdateStageStartTime(_ context.Context, stage *Stage, tStartUTC time.Time) error {
+	// DynamoDB keeps times in RFC3339, i.e. with seconds precision
+	t := tStartUTC.Truncate(time.Second)
+	return store.updateStage(stage, "t_start_utc", func(s *Stage) { s.TStartUTC = &t })
+}
+
+func (store *MemoryTaskStore) UpdateStageFinishTime(_ context.Context, stage *Stage, tFinishUTC time.Time) error {
+	t := tFinishUTC.Truncate(time.Second)
+	return store.updateStage(stage, "t_finish_utc", func(s *Stage) { s.TFinishUTC = &t })
+}
+
+func (store *MemoryTaskStore) UpdateStageLease(
+	_ context.Context,
+	stage *Stage,
+	tHeartbeatUTC, tLeaseExpiryUTC time.Time,
+) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	stored, ok := store.stages[stage.TaskRunUUID][stage.NOrd]
+	if !ok || stored.Status != StageStatus_InProgress || !sameTime(stored.TLeaseExpiryUTC, stage.TLeaseExpiryUTC) {
+		return fmt.Errorf("failed to update stage lease: %w", ErrConditionFailed)
+	}
+	heartbeat, expiry := tHeartbeatUTC.Truncate(time.Second), tLeaseExpiryUTC.Truncate(time.Second)
+	stored.THeartbeatUTC, stored.TLeaseExpiryUTC = &heartbeat, &expiry
+	store.stages[stage.TaskRunUUID][stage.NOrd] = stored
+	return nil
+}
+
+func (store *MemoryTaskStore) AppendStageAttempt(_ context.Context, stage *Stage, attempt StageAttempt) error {
+	return store.updateStage(stage, "attempts", func(s *Stage) {
+		s.Attempts = append(s.Attempts, copyStageAttempt(attempt))
+	})
+}
+
+func (store *MemoryTaskStore) UpdateStageAttempt(_ context.Context, stage *Stage, attempt StageAttempt) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	stored, ok := store.stages[stage.TaskRunUUID][stage.NOrd]
+	if !ok || attempt.N < 1 || attempt.N > len(stored.Attempts) {
+		return fmt.Errorf("failed to update stage attempt %d: %w", attempt.N, ErrConditionFailed)
+	}
+	stored.Attempts = slices.Clone(stored.Attempts)
+	stored.Attempts[attempt.N-1] = copyStageAttempt(attempt)
+	store.stages[stage.TaskRunUUID][stage.NOrd] = stored
+	return nil
+}
+
+func (store *MemoryTaskStore) AppendEvent(_ context.Context, event TaskEvent) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.events[event.TaskRunUUID] = append(store.events[event.TaskRunUUID], event)
+	return nil
+}
+
+func (store *MemoryTaskStore) GetRunEvents(_ context.Context, taskRunUUID string) ([]TaskEvent, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	events := slices.Clone(store.events[taskRunUUID])
+	slices.SortStableFunc(events, func(a, b TaskEvent) int { return strings.Compare(a.ID, b.ID) })
+	return events, nil
+}
+
+func (store *MemoryTaskStore) updateStage(stage *Stage, attribute string, update func(*Stage)) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	stored, ok := store.stages[stage.TaskRunUUID][stage.NOrd]
+	if !ok {
+		return fmt.Errorf("failed to update stage %s: %w", attribute, ErrConditionFailed)
+	}
+	update(&stored)
+	store.stages[stage.TaskRunUUID][stage.NOrd] = stored
+	return nil
+}
+
+func copyTask(task Task) Task {
+	task.Objectives = slices.Clone(task.Objectives)
+	task.Parameters = slices.Clone(task.Parameters)
+	for i, parameter := range task.Parameters {
+		task.Parameters[i].Lower = copyFloat(parameter.Lower)
+		task.Parameters[i].Upper = copyFloat(parameter.Upper)
+	}
+	task.Pipeline = slices.Clone(task.Pipeline)
+	for i, stage := range task.Pipeline {
+		task.Pipeline[i].Next = slices.Clone(stage.Next)
+	}
+	task.CreationTime = copyTime(task.CreationTime)
+	return task
+}
+
+func copyTaskRun(taskRun TaskRun) TaskRun {
+	taskRun.Parameters = maps.Clone(taskRun.Parameters)
+	taskRun.Results = maps.Clone(taskRun.Results)
+	taskRun.CreationTime = copyTime(taskRun.CreationTime)
+	return taskRun
+}
+
+func copyStage(stage Stage) Stage {
+	stage.TStartUTC = copyTime(stage.TStartUTC)
+	stage.TFinishUTC = copyTime(stage.TFinishUTC)
+	stage.Next = slices.Clone(stage.Next)
+	stage.Outputs = maps.Clone(stage.Outputs)
+	stage.OutputsSHA256 = maps.Clone(stage.OutputsSHA256)
+	stage.OutputNames = slices.Clone(stage.OutputNames)
+	stage.InputNames = slices.Clone(stage.InputNames)
+	stage.THeartbeatUTC = copyTime(stage.THeartbeatUTC)
+	stage.TLeaseExpiryUTC = copyTime(stage.TLeaseExpiryUTC)
+	stage.Attempts = slices.Clone(stage.Attempts)
+	for i, attempt := range stage.Attempts {
+		stage.Attempts[i] = copyStageAttempt(attempt)
+	}
+	return stage
+}
+
+func copyStageAttempt(attempt StageAttempt) StageAttempt {
+	attempt.TStartUTC = copyTime(attempt.TStartUTC)
+	attempt.TFinishUTC = copyTime(attempt.TFinishUTC)
+	if attempt.ExitCode != nil {
+		exitCode := *attempt.ExitCode
+		attempt.ExitCode = &exitCode
+	}
+	attempt.Artifacts = slices.Clone(attempt.Artifacts)
+	return attempt
+}
+
+func copyTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	c := *t
+	return &c
+}
+
+func sameTime(a, b *time.Time) bool {
+	return (a == nil && b == nil) || (a != nil && b != nil && a.Equal(*b))
+}
+
+func copyFloat(f *float64) *float64 {
+	if f == nil {
+		return nil
+	}
+	c := *f
+	return &c
+}
+
+// MemoryArtifactStore keeps artifacts in memory
+type MemoryArtifactStore struct {
+	mu      sync.Mutex
+	objects map[string]memoryObject // "bucket/key" -> object
+}
+
+type memoryObject struct {
+	data         []byte
+	storageClass StorageClass
+	metadata     map[string]string
+	modified     time.Time
+}
+
+func NewMemoryArtifactStore() *MemoryArtifactStore {
+	return &MemoryArtifactStore{objects: make(map[string]memoryObject)}
+}
+
+func (store *MemoryArtifactStore) PutObject(
+	_ context.Context,
+	bucket, key string,
+	body io.Reader,
+	storageClass StorageClass,
+	metadata map[string]string,
+) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.objects[bucket+"/"+key] = memoryObject{
+		data:         data,
+		storageClass: storageClass,
+		metadata:     maps.Clone(metadata),
+		modified:     time.Now(),
+	}
+	return nil
+}
+
+func (store *MemoryArtifactStore) GetObject(_ context.Context, bucket, key string) (io.ReadCloser, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	object, ok := store.objects[bucket+"/"+key]
+	if !ok {
+		return nil, fmt.Errorf("object %q in bucket %q %w", key, bucket, ErrNotFound)
+	}
+	return io.NopCloser(bytes.NewReader(object.data)), nil
+}
+
+func (store *MemoryArtifactStore) HeadObject(_ context.Context, bucket, key string) (*ObjectInfo, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	object, ok := store.objects[bucket+"/"+key]
+	if !ok {
+		return nil, fmt.Errorf("object %q in bucket %q %w", key, bucket, ErrNotFound)
+	}
+	return &ObjectInfo{
+		Key:          key,
+		Size:         int64(len(object.data)),
+		LastModified: object.modified,
+		Metadata:     maps.Clone(object.metadata),
+	}, nil
+}
+
+func (store *MemoryArtifactStore) DeleteObject(_ context.Context, bucket, key string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	delete(store.objects, bucket+"/"+key)
+	return nil
+}
+
+func (store *MemoryArtifactStore) ListObjects(_ context.Context, bucket, prefix string) ([]ObjectInfo, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var objects []ObjectInfo
+	for path, object := range store.objects {
+		if key, ok := strings.CutPrefix(path, bucket+"/"); ok && strings.HasPrefix(key, prefix) {
+			objects = append(objects, ObjectInfo{Key: key, Size: int64(len(object.data)), LastModified: object.modified})
+		}
+	}
+	return objects, nil
+}
+
+// MemoryMessageQueue is an in-memory queue with SQS-like semantics: a received message becomes invisible for
+// VisibilityTimeout and is delivered again unless deleted during that time
+type MemoryMessageQueue struct {
+	VisibilityTimeout time.Duration
+
+	mu       sync.Mutex
+	queues   map[string][]*memoryMessage
+	deleted  map[string]bool // queues are created on the first message unless they have been deleted
+	notify   chan struct{}   // closed and replaced on every send
+	receipts int
+}
+
+type memoryMessage struct {
+	body           string
+	receiptHandle  string
+	invisibleUntil time.Time
+}
+
+func NewMemoryMessageQueue() *MemoryMessageQueue {
+	return &MemoryMessageQueue{
+		VisibilityTimeout: 30 * time.Second, // SQS default
+		queues:            make(map[string][]*memoryMessage),
+		deleted:           make(map[string]bool),
+		notify:            make(chan struct{}),
+	}
+}
+
+func (q *MemoryMessageQueue) SendMessage(_ context.Context, queueName, body string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.deleted[queueName] {
+		return fmt.Errorf("queue %q %w", queueName, ErrNotFound)
+	}
+	q.queues[queueName] = append(q.queues[queueName], &memoryMessage{body: body})
+	close(q.notify)
+	q.notify = make(chan struct{})
+	return nil
+}
+
+func (q *MemoryMessageQueue) ReceiveMessage(
+	ctx context.Context,
+	queueName string,
+	waitTime time.Duration,
+) (*QueueMessage, error) {
+	deadline := time.Now().Add(waitTime)
+	for {
+		q.mu.Lock()
+		now := time.Now()
+		wakeUp := deadline
+		for _, message := range q.queues[queueName] {
+			if !message.invisibleUntil.After(now) {
+				q.receipts++
+				message.receiptHandle = fmt.Sprintf("%s-%d", queueName, q.receipts)
+				message.invisibleUntil = now.Add(q.VisibilityTimeout)
+				q.mu.Unlock()
+				return &QueueMessage{Body: message.body, ReceiptHandle: message.receiptHandle}, nil
+			}
+			if message.invisibleUntil.Before(wakeUp) {
+				wakeUp = message.invisibleUntil
+			}
+		}
+		notify := q.notify
+		q.mu.Unlock()
+
+		if !now.Before(deadline) {
+			return nil, nil
+		}
+
+		timer := time.NewTimer(wakeUp.Sub(now))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, fmt.Errorf("failed to receive messages, %w", ctx.Err())
+		case <-notify:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+func (q *MemoryMessageQueue) DeleteMessage(_ context.Context, queueName, receiptHandle string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	i := q.findByReceiptHandle(queueName, receiptHandle)
+	if i < 0 {
+		return fmt.Errorf("message with receipt handle %q %w in queue %q", receiptHandle, ErrNotFound, queueName)
+	}
+	q.queues[queueName] = slices.Delete(q.queues[queueName], i, i+1)
+	return nil
+}
+
+func (q *MemoryMessageQueue) ChangeMessageVisibility(
+	_ context.Context,
+	queueName, receiptHandle string,
+	timeout time.Duration,
+) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	i := q.findByReceiptHandle(queueName, receiptHandle)
+	if i < 0 {
+		return fmt.Errorf("failed to change message visibility: receipt handle %q %w in queue %q",
+			receiptHandle, ErrNotFound, queueName)
+	}
+	q.queues[queueName][i].invisibleUntil = time.Now().Add(timeout)
+	if timeout == 0 {
+		close(q.notify)
+		q.notify = make(chan struct{})
+	}
+	return nil
+}
+
+// CreateQueue does nothing, the queues are created on the first message
+func (q *MemoryMessageQueue) CreateQueue(_ context.Context, queueName string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delete(q.deleted, queueName)
+	if _, ok := q.queues[queueName]; !ok {
+		q.queues[queueName] = nil
+	}
+	return nil
+}
+
+func (q *MemoryMessageQueue) DeleteQueue(_ context.Context, queueName string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delete(q.queues, queueName)
+	q.deleted[queueName] = true
+	return nil
+}
+
+func (q *MemoryMessageQueue) ListQueues(_ context.Context, prefix string) ([]string, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var names []string
+	for queueName := range q.queues {
+		if strings.HasPrefix(queueName, prefix) {
+			names = append(names, queueName)
+		}
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+func (q *MemoryMessageQueue) findByReceiptHandle(queueName, receiptHandle string) int {
+	return slices.IndexFunc(q.queues[queueName], func(m *memoryMessage) bool {
+		return receiptHandle != "" && m.receiptHandle == receiptHandle
+	})
+}
@@ -0,0 +1,168 @@
+package cloud_task_registry
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpdateTaskRunStatus_MustNotChangeCancelledTaskRun(t *testing.T) {
+	// given
+	ctx := context.Background()
+	registry := NewInMemory()
+	taskRun := TaskRun{TaskID: "task", UUID: "run-1", Status: TaskRunStatus_Submitted}
+	require.NoError(t, registry.InsertTaskRun(ctx, taskRun))
+	require.NoError(t, registry.UpdateTaskRunStatus(ctx, &taskRun, TaskRunStatus_Cancelled))
+	// when
+	err := registry.UpdateTaskRunStatus(ctx, &taskRun, TaskRunStatus_Finished)
+	// then
+	assert.ErrorIs(t, err, ErrConditionFailed)
+	cancelled, err := registry.IsCancelled(ctx, taskRun.UUID)
+	require.NoError(t, err)
+	assert.True(t, cancelled)
+}
+
+func TestUpdateStage_MustFailForAbsentStage(t *testing.T) {
+	// given
+	ctx := context.Background()
+	registry := NewInMemory()
+	stage := Stage{TaskRunUUID: "run-1", NOrd: 1, Name: "cfd", Status: StageInitialStatus}
+	// when
+	err := registry.UpdateStageStatus(ctx, &stage, StageStatus_InProgress)
+	// then
+	assert.ErrorIs(t, err, ErrConditionFailed)
+}
+
+func TestUpdateStageStatus_MustLetOnlyOneOfDuplicateDeliveriesStartStage(t *testing.T) {
+	// given
+	ctx := context.Background()
+	registry := NewInMemory()
+	require.NoError(t, registry.InsertStage(ctx, Stage{TaskRunUUID: "run-1", NOrd: 1, Name: "cfd", Status: StageInitialStatus}))
+	first, err := registry.GetStage(ctx, "run-1", 1)
+	require.NoError(t, err)
+	duplicate, err := registry.GetStage(ctx, "run-1", 1)
+	require.NoError(t, err)
+	// when
+	errFirst := registry.UpdateStageStatus(ctx, first, StageStatus_InProgress)
+	errDuplicate := registry.UpdateStageStatus(ctx, duplicate, StageStatus_InProgress)
+	errFinal := registry.UpdateStageStatus(ctx, &Stage{TaskRunUUID: "run-1", NOrd: 1, Status: StageStatus_Success},
+		StageStatus_InProgress)
+	// then
+	require.NoError(t, errFirst)
+	assert.Equal(t, StageStatus_InProgress, first.Status)
+	var transitionErr *StageTransitionError
+	require.ErrorAs(t, errDuplicate, &transitionErr)
+	assert.ErrorIs(t, errDuplicate, ErrTransitionConflict)
+	assert.Equal(t, StageStatus_InProgress, transitionErr.Actual)
+	assert.Equal(t, StageStatus_Pending, duplicate.Status)
+	assert.ErrorIs(t, errFinal, ErrTransitionConflict)
+	require.NoError(t, registry.UpdateStageStatus(ctx, first, StageStatus_Success))
+}
+
+func TestGetTaskRunAndGetStageByName_MustReportNotFoundAndNotUnique(t *testing.T) {
+	// given
+	ctx := context.Background()
+	registry := NewInMemory()
+	require.NoError(t, registry.InsertTaskRun(ctx, TaskRun{TaskID: "task-a", UUID: "run-1"}))
+	require.NoError(t, registry.InsertTaskRun(ctx, TaskRun{TaskID: "task-b", UUID: "run-1"}))
+	require.NoError(t, registry.InsertStage(ctx, Stage{TaskRunUUID: "run-1", NOrd: 1, Name: "cfd"}))
+	require.NoError(t, registry.InsertStage(ctx, Stage{TaskRunUUID: "run-1", NOrd: 2, Name: "cfd"}))
+	// when
+	_, errNotFoundRun := registry.GetTaskRun(ctx, "run-2")
+	_, errNotUniqueRun := registry.GetTaskRun(ctx, "run-1")
+	_, errNotFoundStage := registry.GetStageByName(ctx, "run-1", "mesh")
+	_, errNotUniqueStage := registry.GetStageByName(ctx, "run-1", "cfd")
+	// then
+	assert.ErrorIs(t, errNotFoundRun, ErrNotFound)
+	assert.ErrorIs(t, errNotUniqueRun, ErrNotUnique)
+	assert.ErrorIs(t, errNotFoundStage, ErrNotFound)
+	assert.ErrorIs(t, errNotUniqueStage, ErrNotUnique)
+	assert.EqualError(t, errNotFoundStage, "stage 'mesh' not found in task run-1")
+}
+
+func TestMemoryMessageQueue_MustWakeUpLongPollingReceiverOnSend(t *testing.T) {
+	// given
+	q := NewMemoryMessageQueue()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_ = q.SendMessage(context.Background(), "cfd", "run-1")
+	}()
+	// when
+	started := time.Now()
+	message, err := q.ReceiveMessage(context.Background(), "cfd", 5*time.Second)
+	// then
+	require.NoError(t, err)
+	require.NotNil(t, message)
+	assert.Equal(t, "run-1", message.Body)
+	assert.Less(t, time.Since(started), time.Second)
+}
+
+func TestMemoryMessageQueue_MustRedeliverMessageAfterVisibilityTimeoutUnlessDeleted(t *testing.T) {
+	// given
+	ctx := context.Background()
+	q := NewMemoryMessageQueue()
+	q.VisibilityTimeout = 100 * time.Millisecond
+	require.NoError(t, q.SendMessage(ctx, "cfd", "run-1"))
+	first, err := q.ReceiveMessage(ctx, "cfd", 0)
+	require.NoError(t, err)
+	require.NotNil(t, first)
+	// when
+	hidden, err := q.ReceiveMessage(ctx, "cfd", 0)
+	require.NoError(t, err)
+	redelivered, err := q.ReceiveMessage(ctx, "cfd", time.Second)
+	require.NoError(t, err)
+	require.NotNil(t, redelivered)
+	require.NoError(t, q.DeleteMessage(ctx, "cfd", redelivered.ReceiptHandle))
+	afterDelete, err := q.ReceiveMessage(ctx, "cfd", 200*time.Millisecond)
+	require.NoError(t, err)
+	// then
+	assert.Nil(t, hidden)
+	assert.Equal(t, "run-1", redelivered.Body)
+	assert.NotEqual(t, first.ReceiptHandle, redelivered.ReceiptHandle)
+	assert.Nil(t, afterDelete)
+}
+
+func TestMemoryMessageQueue_MustStopLongPollingOnContextCancellation(t *testing.T) {
+	// given
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	q := NewMemoryMessageQueue()
+	// when
+	message, err := q.ReceiveMessage(ctx, "cfd", 5*time.Second)
+	// then
+	assert.Nil(t, message)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestListTaskRuns_MustPageThroughFilteredTaskRuns(t *testing.T) {
+	// given
+	ctx := context.Background()
+	registry := NewInMemory()
+	creationTime := time.Date(2025, 8, 16, 0, 0, 0, 0, time.UTC)
+	require.NoError(t, registry.InsertTaskRun(ctx, TaskRun{TaskID: "doe", UUID: "run-1", Status: TaskRunStatus_Failed}))
+	require.NoError(t, registry.InsertTaskRun(ctx,
+		TaskRun{TaskID: "doe", UUID: "run-2", CreationTime: &creationTime, Status: TaskRunStatus_Finished}))
+	require.NoError(t, registry.InsertTaskRun(ctx,
+		TaskRun{TaskID: "doe", UUID: "run-3", CreationTime: &creationTime, Status: TaskRunStatus_Finished}))
+	require.NoError(t, registry.InsertTaskRun(ctx, TaskRun{TaskID: "other", UUID: "run-4", Status: TaskRunStatus_Finished}))
+	// when
+	firstPage, errFirst := registry.ListTaskRuns(ctx, TaskRunFilter{Statuses: []TaskRunStatus{TaskRunStatus_Finished}, Limit: 2})
+	secondPage, errSecond := registry.ListTaskRuns(ctx,
+		TaskRunFilter{Statuses: []TaskRunStatus{TaskRunStatus_Finished}, Limit: 2, Cursor: firstPage.Cursor})
+	created, errCreated := registry.ListTaskRuns(ctx, TaskRunFilter{CreatedAfter: &creationTime})
+	// then
+	require.NoError(t, errFirst)
+	require.NoError(t, errSecond)
+	require.NoError(t, errCreated)
+	require.Len(t, firstPage.TaskRuns, 2)
+	assert.Equal(t, "run-2", firstPage.TaskRuns[0].UUID)
+	assert.Equal(t, "run-3", firstPage.TaskRuns[1].UUID)
+	assert.NotEmpty(t, firstPage.Cursor)
+	require.Len(t, secondPage.TaskRuns, 1)
+	assert.Equal(t, "run-4", secondPage.TaskRuns[0].UUID)
+	assert.Empty(t, secondPage.Cursor)
+	assert.Len(t, created.TaskRuns, 2)
+}
@@ -2,34 +2,142 @@ package cloud_task_registry
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log"
+	"time"
+
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
-	"log"
 )
 
-func checkTableExists(d *dynamodb.Client, name string) bool {
-	tables, err := d.ListTables(context.TODO(), &dynamodb.ListTablesInput{})
+// MetaTable keeps the registry schema version, so that only the new migrations are applied on startup
+const MetaTable = "registry_meta"
+
+const schemaVersionKey = "schema_version"
+
+const migrationPollingInterval = 2 * time.Second
+
+// dynamoDBMigration is a step of the registry schema evolution. Steps must be idempotent, since a step may be
+// interrupted after it has made its changes but before the schema version is bumped.
+type dynamoDBMigration struct {
+	description string
+	apply       func(ctx context.Context, svc *dynamodb.Client) error
+}
+
+// dynamoDBMigrations are applied in order, the schema version is the number of the applied steps.
+// Never change or reorder the existing steps, append new ones instead.
+var dynamoDBMigrations = []dynamoDBMigration{
+	{"create " + TasksTable + " table", createTasksTable},
+	{"create " + StagesTable + " table", createStagesTable},
+	{"create " + RegisteredTasksTable + " table", createRegisteredTasksTable},
+	{"add StatusCreationTimeIndex to " + TasksTable + " table", createStatusCreationTimeIndex},
+	{"add TaskCreationTimeIndex to " + TasksTable + " table", createTaskCreationTimeIndex},
+	{"create " + EventsTable + " table", createEventsTable},
+}
+
+// Migrate brings the DynamoDB tables to the latest schema version, waiting for new tables and indexes
+// to become ACTIVE
+func (store *DynamoDBTaskStore) Migrate(ctx context.Context) error {
+	return migrate(ctx, store.client, dynamoDBMigrations)
+}
+
+func migrate(ctx context.Context, svc *dynamodb.Client, migrations []dynamoDBMigration) error {
+	if err := createMetaTable(ctx, svc); err != nil {
+		return fmt.Errorf("failed to create %q table: %w", MetaTable, err)
+	}
+	version, err := getSchemaVersion(ctx, svc)
 	if err != nil {
-		log.Fatal("ListTables failed", err)
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("registry schema version %d is newer than the latest known one (%d), "+
+			"please update this binary", version, len(migrations))
 	}
-	for _, n := range tables.TableNames {
-		if n == name {
-			return true
+	if version == len(migrations) {
+		log.Println("Registry schema is up to date, version", version)
+		return nil
+	}
+	for ; version < len(migrations); version++ {
+		migration := migrations[version]
+		log.Printf("Applying registry migration %d: %s", version+1, migration.description)
+		if err := migration.apply(ctx, svc); err != nil {
+			return fmt.Errorf("registry migration %d (%s) failed: %w", version+1, migration.description, err)
+		}
+		if err := setSchemaVersion(ctx, svc, version, version+1); err != nil {
+			return err
 		}
 	}
-	return false
+	log.Println("Registry schema migrated to version", version)
+	return nil
 }
 
-func createTasksTable(svc *dynamodb.Client) error {
-	tableExists := checkTableExists(svc, TasksTable)
+func getSchemaVersion(ctx context.Context, svc *dynamodb.Client) (int, error) {
+	result, err := svc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(MetaTable),
+		Key: map[string]types.AttributeValue{
+			"key": &types.AttributeValueMemberS{Value: schemaVersionKey},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to get registry schema version: %w", err)
+	}
+	if len(result.Item) == 0 {
+		return 0, nil
+	}
+	var meta struct {
+		Version int `dynamodbav:"version"`
+	}
+	if err := attributevalue.UnmarshalMap(result.Item, &meta); err != nil {
+		return 0, fmt.Errorf("failed to unmarshal registry schema version: %w", err)
+	}
+	return meta.Version, nil
+}
 
-	if tableExists {
-		log.Println(TasksTable, "table already exists")
-		return nil
+// setSchemaVersion fails if another process has migrated the schema in the meantime
+func setSchemaVersion(ctx context.Context, svc *dynamodb.Client, oldVersion, newVersion int) error {
+	_, err := svc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(MetaTable),
+		Key: map[string]types.AttributeValue{
+			"key": &types.AttributeValueMemberS{Value: schemaVersionKey},
+		},
+		UpdateExpression:    aws.String("SET version = :newVersion"),
+		ConditionExpression: aws.String("attribute_not_exists(version) OR version = :oldVersion"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":newVersion": &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", newVersion)},
+			":oldVersion": &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", oldVersion)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set registry schema version %d: %w", newVersion, conditionFailed(err))
 	}
+	return nil
+}
 
+func createMetaTable(ctx context.Context, svc *dynamodb.Client) error {
+	input := &dynamodb.CreateTableInput{
+		TableName: aws.String(MetaTable),
+		KeySchema: []types.KeySchemaElement{
+			{
+				AttributeName: aws.String("key"),
+				KeyType:       types.KeyTypeHash, // Partition key
+			},
+		},
+		AttributeDefinitions: []types.AttributeDefinition{
+			{
+				AttributeName: aws.String("key"),
+				AttributeType: types.ScalarAttributeTypeS,
+			},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	}
+	return createTableIfNotExists(ctx, svc, input)
+}
+
+func createTasksTable(ctx context.Context, svc *dynamodb.Client) error {
 	input := &dynamodb.CreateTableInput{
 		TableName: aws.String(TasksTable),
 		KeySchema: []types.KeySchemaElement{
@@ -69,21 +177,10 @@ func createTasksTable(svc *dynamodb.Client) error {
 		BillingMode: types.BillingModePayPerRequest,
 	}
 
-	_, err := svc.CreateTable(context.TODO(), input)
-	if err == nil {
-		log.Println(TasksTable, "table created")
-	}
-	return err
+	return createTableIfNotExists(ctx, svc, input)
 }
 
-func createStagesTable(svc *dynamodb.Client) error {
-	tableExists := checkTableExists(svc, StagesTable)
-
-	if tableExists {
-		log.Println(StagesTable, "table already exists")
-		return nil
-	}
-
+func createStagesTable(ctx context.Context, svc *dynamodb.Client) error {
 	input := &dynamodb.CreateTableInput{
 		TableName: aws.String(StagesTable),
 		KeySchema: []types.KeySchemaElement{
@@ -135,21 +232,215 @@ func createStagesTable(svc *dynamodb.Client) error {
 		//},
 	}
 
-	_, err := svc.CreateTable(context.TODO(), input)
-	if err == nil {
-		log.Println(StagesTable, "table created")
+	return createTableIfNotExists(ctx, svc, input)
+}
+
+func createRegisteredTasksTable(ctx context.Context, svc *dynamodb.Client) error {
+	input := &dynamodb.CreateTableInput{
+		TableName: aws.String(RegisteredTasksTable),
+		KeySchema: []types.KeySchemaElement{
+			{
+				AttributeName: aws.String("task_id"),
+				KeyType:       types.KeyTypeHash, // Partition key
+			},
+		},
+		AttributeDefinitions: []types.AttributeDefinition{
+			{
+				AttributeName: aws.String("task_id"),
+				AttributeType: types.ScalarAttributeTypeS,
+			},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	}
+	return createTableIfNotExists(ctx, svc, input)
+}
+
+// createEventsTable keeps the event log of task runs, the sort key orders the events by time (see newEventID)
+func createEventsTable(ctx context.Context, svc *dynamodb.Client) error {
+	input := &dynamodb.CreateTableInput{
+		TableName: aws.String(EventsTable),
+		KeySchema: []types.KeySchemaElement{
+			{
+				AttributeName: aws.String("run_uuid"),
+				KeyType:       types.KeyTypeHash, // Partition key
+			},
+			{
+				AttributeName: aws.String("event_id"),
+				KeyType:       types.KeyTypeRange, // Sort key
+			},
+		},
+		AttributeDefinitions: []types.AttributeDefinition{
+			{
+				AttributeName: aws.String("run_uuid"),
+				AttributeType: types.ScalarAttributeTypeS,
+			},
+			{
+				AttributeName: aws.String("event_id"),
+				AttributeType: types.ScalarAttributeTypeS,
+			},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	}
+	return createTableIfNotExists(ctx, svc, input)
+}
+
+// createTableIfNotExists creates the table unless it exists and waits until it is ACTIVE
+// createStatusCreationTimeIndex lets task runs of all tasks be listed by status and creation time without a Scan
+func createStatusCreationTimeIndex(ctx context.Context, svc *dynamodb.Client) error {
+	return createIndexIfNotExists(ctx, svc, TasksTable, types.GlobalSecondaryIndex{
+		IndexName: aws.String("StatusCreationTimeIndex"),
+		KeySchema: []types.KeySchemaElement{
+			{
+				AttributeName: aws.String("status"),
+				KeyType:       types.KeyTypeHash, // Partition key
+			},
+			{
+				AttributeName: aws.String("creation_time"),
+				KeyType:       types.KeyTypeRange, // Sort key
+			},
+		},
+		Projection: &types.Projection{
+			ProjectionType: types.ProjectionTypeAll,
+		},
+	}, []types.AttributeDefinition{
+		{
+			AttributeName: aws.String("status"),
+			AttributeType: types.ScalarAttributeTypeS,
+		},
+		{
+			AttributeName: aws.String("creation_time"),
+			AttributeType: types.ScalarAttributeTypeS, // RFC3339Nano
+		},
+	})
+}
+
+// createTaskCreationTimeIndex lets task runs of a task be listed by creation time
+func createTaskCreationTimeIndex(ctx context.Context, svc *dynamodb.Client) error {
+	return createIndexIfNotExists(ctx, svc, TasksTable, types.GlobalSecondaryIndex{
+		IndexName: aws.String("TaskCreationTimeIndex"),
+		KeySchema: []types.KeySchemaElement{
+			{
+				AttributeName: aws.String("task_id"),
+				KeyType:       types.KeyTypeHash, // Partition key
+			},
+			{
+				AttributeName: aws.String("creation_time"),
+				KeyType:       types.KeyTypeRange, // Sort key
+			},
+		},
+		Projection: &types.Projection{
+			ProjectionType: types.ProjectionTypeAll,
+		},
+	}, []types.AttributeDefinition{
+		{
+			AttributeName: aws.String("task_id"),
+			AttributeType: types.ScalarAttributeTypeS,
+		},
+		{
+			AttributeName: aws.String("creation_time"),
+			AttributeType: types.ScalarAttributeTypeS, // RFC3339Nano
+		},
+	})
+}
+
+func createTableIfNotExists(ctx context.Context, svc *dynamodb.Client, input *dynamodb.CreateTableInput) error {
+	tableName := aws.ToString(input.TableName)
+	_, err := svc.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: input.TableName})
+	var notFound *types.ResourceNotFoundException
+	switch {
+	case err == nil:
+		log.Println(tableName, "table already exists")
+	case errors.As(err, &notFound):
+		_, err = svc.CreateTable(ctx, input)
+		var inUse *types.ResourceInUseException
+		if errors.As(err, &inUse) {
+			log.Println(tableName, "table is being created by someone else")
+		} else if err != nil {
+			return err
+		} else {
+			log.Println(tableName, "table created")
+		}
+	default:
+		return fmt.Errorf("failed to describe %q table: %w", tableName, err)
 	}
-	return err
+	return waitForTableActive(ctx, svc, tableName)
 }
 
-func migrate(svc *dynamodb.Client) error {
-	if err := createTasksTable(svc); err != nil {
-		errTasks := fmt.Errorf("failed to create %q table: %w", TasksTable, err)
-		return errTasks
+// createIndexIfNotExists adds the global secondary index to an existing table and waits until it is backfilled.
+// attributes must define the key attributes of the index.
+func createIndexIfNotExists(
+	ctx context.Context,
+	svc *dynamodb.Client,
+	tableName string,
+	index types.GlobalSecondaryIndex,
+	attributes []types.AttributeDefinition,
+) error {
+	indexName := aws.ToString(index.IndexName)
+	// The table can't be updated while another index is being created
+	if err := waitForTableActive(ctx, svc, tableName); err != nil {
+		return err
 	}
-	if err := createStagesTable(svc); err != nil {
-		errStages := fmt.Errorf("failed to create %q table: %w", StagesTable, err)
-		return errStages
+	output, err := svc.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(tableName)})
+	if err != nil {
+		return fmt.Errorf("failed to describe %q table: %w", tableName, err)
 	}
-	return nil
+	for _, existing := range output.Table.GlobalSecondaryIndexes {
+		if aws.ToString(existing.IndexName) == indexName {
+			log.Println(indexName, "index of", tableName, "table already exists")
+			return nil
+		}
+	}
+
+	_, err = svc.UpdateTable(ctx, &dynamodb.UpdateTableInput{
+		TableName:            aws.String(tableName),
+		AttributeDefinitions: attributes,
+		GlobalSecondaryIndexUpdates: []types.GlobalSecondaryIndexUpdate{
+			{
+				Create: &types.CreateGlobalSecondaryIndexAction{
+					IndexName:  index.IndexName,
+					KeySchema:  index.KeySchema,
+					Projection: index.Projection,
+				},
+			},
+		},
+	})
+	var inUse *types.ResourceInUseException
+	if errors.As(err, &inUse) {
+		log.Println(indexName, "index of", tableName, "table is being created by someone else")
+	} else if err != nil {
+		return fmt.Errorf("failed to create %s index of %q table: %w", indexName, tableName, err)
+	} else {
+		log.Println(indexName, "index of", tableName, "table created, waiting for backfilling")
+	}
+	return waitForTableActive(ctx, svc, tableName)
+}
+
+// waitForTableActive waits until the table and all its global secondary indexes are ACTIVE
+func waitForTableActive(ctx context.Context, svc *dynamodb.Client, tableName string) error {
+	for {
+		output, err := svc.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(tableName)})
+		if err != nil {
+			return fmt.Errorf("failed to describe %q table: %w", tableName, err)
+		}
+		if isTableActive(output.Table) {
+			return nil
+		}
+		log.Println("Waiting for", tableName, "table and its indexes to become active...")
+		if SleepInterruptibly(ctx, migrationPollingInterval) {
+			return fmt.Errorf("%q table is not active yet: %w", tableName, ctx.Err())
+		}
+	}
+}
+
+func isTableActive(table *types.TableDescription) bool {
+	// Some DynamoDB-compatible services (e.g. YDB) may omit the status, which means the table is ready
+	if table == nil || (table.TableStatus != "" && table.TableStatus != types.TableStatusActive) {
+		return false
+	}
+	for _, index := range table.GlobalSecondaryIndexes {
+		if index.IndexStatus != "" && index.IndexStatus != types.IndexStatusActive {
+			return false
+		}
+	}
+	return true
 }
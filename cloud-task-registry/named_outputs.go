@@ -0,0 +1,96 @@
+package cloud_task_registry
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+var outputNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// CheckOutputName checks that the name of a named output can be a part of an S3 path and of a qualified input name
+// ("stage.name")
+func CheckOutputName(name string) error {
+	if !outputNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid output name %q, expected letters, digits, '_' and '-' only", name)
+	}
+	return nil
+}
+
+// SplitInputName splits a qualified input name "stage.name" into the stage and the output name.
+// The stage is empty if the name is not qualified.
+func SplitInputName(inputName string) (string, string) {
+	if i := strings.LastIndex(inputName, "."); i >= 0 {
+		return inputName[:i], inputName[i+1:]
+	}
+	return "", inputName
+}
+
+// UploadNamedOutput uploads the file as the named output of the stage and returns its S3 path and SHA-256 digest
+// to put into Stage.Outputs and Stage.OutputsSHA256 (see UpdateStageOutputs)
+func (registry *CloudTaskRegistry) UploadNamedOutput(
+	ctx context.Context,
+	filePath string,
+	s3Bucket string,
+	taskRun *TaskRun,
+	stageName string,
+	stageNOrd int,
+	outputName string,
+) (string, string, error) {
+	if err := CheckOutputName(outputName); err != nil {
+		return "", "", err
+	}
+	return registry.uploadFileForStage(
+		ctx, filePath, s3Bucket, taskRun, stageName, stageNOrd, outputName, StorageClass_Standard)
+}
+
+// DownloadNamedInput downloads the named output of a previous stage, i.e. of a stage that has this one among
+// its next stages. The input name is "stage.name", or just "name" if only one of the previous stages has it.
+func (registry *CloudTaskRegistry) DownloadNamedInput(ctx context.Context, stage *Stage, inputName, destination string) error {
+	previous, outputName, err := registry.findNamedInput(ctx, stage, inputName)
+	if err != nil {
+		return err
+	}
+	s3Path := previous.Outputs[outputName]
+	err = registry.downloadFile(ctx, previous.S3Bucket, s3Path, destination, previous.OutputsSHA256[outputName])
+	if err != nil {
+		return fmt.Errorf("failed to download input %q (%q from s3 bucket %q) for stage %q of task %s, %w",
+			inputName, s3Path, previous.S3Bucket, stage.Name, stage.TaskRunUUID, err)
+	}
+	return nil
+}
+
+// findNamedInput returns the previous stage that has uploaded the output for the input name, and the output name
+func (registry *CloudTaskRegistry) findNamedInput(ctx context.Context, stage *Stage, inputName string) (*Stage, string, error) {
+	stages, err := registry.tasks.GetAllStages(ctx, stage.TaskRunUUID)
+	if err != nil {
+		return nil, "", err
+	}
+	stageName, outputName := SplitInputName(inputName)
+	var found []Stage
+	for _, previous := range stages {
+		if !slices.Contains(previous.Next, stage.Name) || (stageName != "" && previous.Name != stageName) {
+			continue
+		}
+		if _, ok := previous.Outputs[outputName]; ok {
+			found = append(found, previous)
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return nil, "", fmt.Errorf("input %q of stage %q: no previous stage has uploaded such an output, %w",
+			inputName, stage.Name, ErrNotFound)
+	case 1:
+		return &found[0], outputName, nil
+	default:
+		names := make([]string, len(found))
+		for i, previous := range found {
+			names[i] = previous.Name
+		}
+		return nil, "", fmt.Errorf("input %q of stage %q is uploaded by stages %v, use <stage>.%s, %w",
+			inputName, stage.Name, names, outputName, ErrNotUnique)
+	}
+}
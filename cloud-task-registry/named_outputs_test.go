@@ -0,0 +1,65 @@
+package cloud_task_registry
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownloadNamedInput_MustFindOutputOfPreviousStageByName(t *testing.T) {
+	// given
+	ctx := context.Background()
+	store, err := NewSQLiteStore(filepath.Join(t.TempDir(), "registry.db"))
+	require.NoError(t, err)
+	defer store.Close()
+	registry, err := New("", WithTaskStore(store), WithMessageQueue(store), WithArtifactStore(NewMemoryArtifactStore()))
+	require.NoError(t, err)
+	taskRun := TaskRun{TaskID: "task", UUID: "run-1", Status: TaskRunStatus_Submitted}
+	stages := []Stage{
+		{TaskRunUUID: "run-1", NOrd: 1, Name: "cfd", S3Bucket: "bucket", Next: []string{"post"},
+			OutputNames: []string{"summary", "log"}},
+		{TaskRunUUID: "run-1", NOrd: 2, Name: "mesh", S3Bucket: "bucket", Next: []string{"post"},
+			OutputNames: []string{"log"}},
+		{TaskRunUUID: "run-1", NOrd: 3, Name: "post", S3Bucket: "bucket", InputNames: []string{"summary", "mesh.log"}},
+	}
+	require.NoError(t, registry.CreateTaskRunWithStages(ctx, taskRun, stages))
+	tmpDir := t.TempDir()
+	for i, content := range []string{"cfd", "mesh"} {
+		stage := &stages[i]
+		outputs, sha256s := make(map[string]string), make(map[string]string)
+		for _, name := range stage.OutputNames {
+			filePath := filepath.Join(tmpDir, content+"-"+name+".txt")
+			require.NoError(t, os.WriteFile(filePath, []byte(content+" "+name), 0o644))
+			outputs[name], sha256s[name], err = registry.UploadNamedOutput(
+				ctx, filePath, stage.S3Bucket, &taskRun, stage.Name, stage.NOrd, name)
+			require.NoError(t, err)
+		}
+		require.NoError(t, registry.UpdateStageOutputs(ctx, stage, outputs, sha256s))
+	}
+	post, err := registry.GetStageByName(ctx, "run-1", "post")
+	require.NoError(t, err)
+	destination := filepath.Join(tmpDir, "input")
+	// when
+	errSummary := registry.DownloadNamedInput(ctx, post, "summary", destination)
+	summary, _ := os.ReadFile(destination)
+	errQualified := registry.DownloadNamedInput(ctx, post, "mesh.log", destination)
+	log, _ := os.ReadFile(destination)
+	errAmbiguous := registry.DownloadNamedInput(ctx, post, "log", destination)
+	errMissing := registry.DownloadNamedInput(ctx, post, "mesh.summary", destination)
+	// then
+	require.NoError(t, errSummary)
+	assert.Equal(t, "cfd summary", string(summary))
+	require.NoError(t, errQualified)
+	assert.Equal(t, "mesh log", string(log))
+	assert.ErrorIs(t, errAmbiguous, ErrNotUnique)
+	assert.ErrorIs(t, errMissing, ErrNotFound)
+	assert.Equal(t, []string{"summary", "mesh.log"}, post.InputNames)
+	cfd, err := registry.GetStageByName(ctx, "run-1", "cfd")
+	require.NoError(t, err)
+	assert.Equal(t, "task-registry/task/run-1/1_cfd/log/cfd-log.txt", cfd.Outputs["log"])
+	assert.Len(t, cfd.OutputsSHA256, 2)
+}
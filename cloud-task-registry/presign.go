@@ -0,0 +1,204 @@
+package cloud_task_registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// MaxPresignExpiry is the longest validity of presigned URLs that S3 allows
+const MaxPresignExpiry = 7 * 24 * time.Hour
+
+// Kinds of the run artifacts in ArtifactManifest
+const (
+	ArtifactKind_Definition = "definition"
+	ArtifactKind_Config     = "config"
+	ArtifactKind_Output     = "output"
+	ArtifactKind_Extra      = "extra"
+)
+
+// ArtifactManifest lists the presigned URLs of the artifacts of a task run
+type ArtifactManifest struct {
+	TaskID      string              `json:"task_id"`
+	TaskRunUUID string              `json:"run_uuid"`
+	Expires     time.Time           `json:"expires"`
+	Artifacts   []PresignedArtifact `json:"artifacts"`
+}
+
+type PresignedArtifact struct {
+	Kind     string `json:"kind"`
+	Stage    string `json:"stage,omitempty"` // empty for the task definition
+	Name     string `json:"name,omitempty"`  // of a named output
+	Bucket   string `json:"bucket"`
+	Key      string `json:"key"`
+	FileName string `json:"file_name,omitempty"` // the URL downloads a blob as, see MetadataFileName
+	URL      string `json:"url"`
+}
+
+// PresignTaskRunArtifacts returns URLs valid for expiry to download the task definition of the run, the configs and
+// outputs (named ones included) of its stages, and the extra artifacts uploaded by the stages, in the order
+// of the stages. The artifact store must implement URLPresigner.
+func (registry *CloudTaskRegistry) PresignTaskRunArtifacts(
+	ctx context.Context,
+	taskRunUUID string,
+	expiry time.Duration,
+) (*ArtifactManifest, error) {
+	presigner, ok := registry.artifacts.(URLPresigner)
+	if !ok {
+		return nil, errors.New("the artifact store doesn't support presigned URLs")
+	}
+	if expiry <= 0 || expiry > MaxPresignExpiry {
+		return nil, fmt.Errorf("expiry of presigned URLs must be positive and at most %v, got %v", MaxPresignExpiry, expiry)
+	}
+	taskRun, err := registry.tasks.GetTaskRun(ctx, taskRunUUID)
+	if err != nil {
+		return nil, err
+	}
+	stages, err := registry.tasks.GetAllStages(ctx, taskRunUUID)
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(stages, func(a, b Stage) int { return a.NOrd - b.NOrd })
+
+	manifest := &ArtifactManifest{
+		TaskID:      taskRun.TaskID,
+		TaskRunUUID: taskRun.UUID,
+		Expires:     time.Now().UTC().Add(expiry).Truncate(time.Second),
+	}
+	presign := func(kind, stage, name, bucket, key string) error {
+		fileName, err := registry.blobFileName(ctx, bucket, key)
+		if err != nil {
+			return err
+		}
+		url, err := presigner.PresignGetObject(ctx, bucket, key, fileName, expiry)
+		if err != nil {
+			return fmt.Errorf("failed to presign %q in S3 bucket %q, %w", key, bucket, err)
+		}
+		manifest.Artifacts = append(manifest.Artifacts, PresignedArtifact{
+			Kind: kind, Stage: stage, Name: name, Bucket: bucket, Key: key, FileName: fileName, URL: url,
+		})
+		return nil
+	}
+
+	if taskRun.TaskDefinition != "" {
+		bucket, err := registry.definitionBucket(ctx, taskRun, stages)
+		if err != nil {
+			return nil, err
+		}
+		if err := presign(ArtifactKind_Definition, "", "", bucket, taskRun.TaskDefinition); err != nil {
+			return nil, err
+		}
+	}
+	for _, stage := range stages {
+		if stage.Config != "" {
+			if err := presign(ArtifactKind_Config, stage.Name, "", stage.S3Bucket, stage.Config); err != nil {
+				return nil, err
+			}
+		}
+		if stage.Output != "" {
+			if err := presign(ArtifactKind_Output, stage.Name, "", stage.S3Bucket, stage.Output); err != nil {
+				return nil, err
+			}
+		}
+		for _, name := range slices.Sorted(maps.Keys(stage.Outputs)) {
+			if err := presign(ArtifactKind_Output, stage.Name, name, stage.S3Bucket, stage.Outputs[name]); err != nil {
+				return nil, err
+			}
+		}
+		for _, key := range extraArtifactPaths(&stage) {
+			if err := presign(ArtifactKind_Extra, stage.Name, "", stage.S3Bucket, key); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return manifest, nil
+}
+
+// blobFileName returns the name of the file uploaded as the blob, or "" if the key is not a blob or the name is
+// unknown (e.g. the blob has been uploaded before the names were kept) or invalid
+func (registry *CloudTaskRegistry) blobFileName(ctx context.Context, bucket, key string) (string, error) {
+	if !IsBlobPath(key) {
+		return "", nil
+	}
+	object, err := registry.artifacts.HeadObject(ctx, bucket, key)
+	if errors.Is(err, ErrNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to check %q in S3 bucket %q, %w", key, bucket, err)
+	}
+	fileName, err := url.PathUnescape(object.Metadata[MetadataFileName])
+	if err != nil {
+		// The URL still works, the file is just downloaded under the digest
+		log.Printf("Ignored the file name %q of %q in S3 bucket %q (non-critical error), %v",
+			object.Metadata[MetadataFileName], key, bucket, err)
+		return "", nil
+	}
+	return fileName, nil
+}
+
+// definitionBucket is the bucket of the task, or of the first stage for the runs created before tasks got registered
+func (registry *CloudTaskRegistry) definitionBucket(ctx context.Context, taskRun *TaskRun, stages []Stage) (string, error) {
+	task, err := registry.tasks.GetTask(ctx, taskRun.TaskID)
+	if err == nil {
+		return task.S3Bucket, nil
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return "", err
+	}
+	if len(stages) == 0 {
+		return "", fmt.Errorf("bucket of the definition of task %s %w", taskRun.TaskID, ErrNotFound)
+	}
+	return stages[0].S3Bucket, nil
+}
+
+// extraArtifactPaths returns the S3 paths of the extra artifacts of the stage, i.e. the artifacts but the outputs
+// of its latest attempt that has uploaded any. The stages run by older connectors have no attempts, their extra
+// artifacts are taken from the stage comment.
+func extraArtifactPaths(stage *Stage) []string {
+	if len(stage.Attempts) == 0 {
+		return commentArtifactPaths(stage.Comments)
+	}
+	outputs := append(slices.Collect(maps.Values(stage.Outputs)), stage.Output)
+	for i := len(stage.Attempts) - 1; i >= 0; i-- {
+		artifacts := stage.Attempts[i].Artifacts
+		if len(artifacts) == 0 {
+			continue
+		}
+		var paths []string
+		for _, path := range artifacts {
+			if !slices.Contains(outputs, path) {
+				paths = append(paths, path)
+			}
+		}
+		return paths
+	}
+	return nil
+}
+
+// commentArtifactPaths returns the S3 paths of the uploaded extra artifacts from the stage comment, which lists them
+// first in brackets, e.g. "Uploaded 2 extra artifacts: [task-registry/a task-registry/b]"
+// (see uploadExtraArtifactsAndUpdateStageComment of cloud-connector)
+func commentArtifactPaths(comments string) []string {
+	_, list, ok := strings.Cut(comments, "[")
+	if !ok {
+		return nil
+	}
+	list, _, ok = strings.Cut(list, "]")
+	if !ok {
+		return nil
+	}
+	var paths []string
+	for _, path := range strings.Fields(list) {
+		if strings.HasPrefix(path, s3CommonPrefix+"/") {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
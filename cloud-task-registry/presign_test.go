@@ -0,0 +1,78 @@
+package cloud_task_registry
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPresignTaskRunArtifacts_MustListDefinitionConfigsOutputsAndExtras(t *testing.T) {
+	// given
+	ctx := context.Background()
+	registry, err := New("", WithArtifactStore(&fakePresigner{NewMemoryArtifactStore()}),
+		WithTaskStore(NewMemoryTaskStore()), WithMessageQueue(NewMemoryMessageQueue()))
+	require.NoError(t, err)
+	definitionPath := filepath.Join(t.TempDir(), "wing 1.in")
+	require.NoError(t, os.WriteFile(definitionPath, []byte("span=10"), 0o644))
+	definition, _, err := registry.UploadBlob(ctx, definitionPath, "bucket")
+	require.NoError(t, err)
+	require.NoError(t, registry.CreateTask(ctx, Task{ID: "task", S3Bucket: "bucket", Definition: definition}))
+	taskRun := TaskRun{TaskID: "task", UUID: "run-1", Status: TaskRunStatus_Finished, TaskDefinition: definition}
+	stages := []Stage{
+		{TaskRunUUID: "run-1", NOrd: 2, Name: "post", S3Bucket: "results", Input: "task-registry/task/run-1/1_cfd/out.7z",
+			Comments: "Extra artifacts upload failed! Uploaded 1 ([task-registry/task/run-1/2_post/plot.png]) " +
+				"out of 2 ([plot.png log.txt] files, error uploading file \"log.txt\""},
+		{TaskRunUUID: "run-1", NOrd: 1, Name: "cfd", S3Bucket: "bucket", Config: "task-registry/blobs/c",
+			Output:   "task-registry/task/run-1/1_cfd/out.7z",
+			Comments: "Uploaded 1 extra artifacts: [task-registry/task/run-1/1_cfd/comment.txt]",
+			Attempts: []StageAttempt{
+				{N: 1, Status: StageStatus_Success,
+					Artifacts: []string{"task-registry/task/run-1/1_cfd/log.txt", "task-registry/task/run-1/1_cfd/out.7z"}},
+				{N: 2, Status: StageStatus_Error},
+			}},
+	}
+	require.NoError(t, registry.CreateTaskRunWithStages(ctx, taskRun, stages))
+	// when
+	manifest, err := registry.PresignTaskRunArtifacts(ctx, "run-1", time.Hour)
+	_, errExpiry := registry.PresignTaskRunArtifacts(ctx, "run-1", 8*24*time.Hour)
+	// then
+	require.NoError(t, err)
+	assert.Equal(t, "task", manifest.TaskID)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), manifest.Expires, time.Minute)
+	assert.Equal(t, []PresignedArtifact{
+		{Kind: ArtifactKind_Definition, Bucket: "bucket", Key: definition, FileName: "wing 1.in",
+			URL: "https://bucket/" + definition + "?expires=3600&filename=wing 1.in"},
+		{Kind: ArtifactKind_Config, Stage: "cfd", Bucket: "bucket", Key: "task-registry/blobs/c",
+			URL: "https://bucket/task-registry/blobs/c?expires=3600"},
+		{Kind: ArtifactKind_Output, Stage: "cfd", Bucket: "bucket", Key: "task-registry/task/run-1/1_cfd/out.7z",
+			URL: "https://bucket/task-registry/task/run-1/1_cfd/out.7z?expires=3600"},
+		{Kind: ArtifactKind_Extra, Stage: "cfd", Bucket: "bucket", Key: "task-registry/task/run-1/1_cfd/log.txt",
+			URL: "https://bucket/task-registry/task/run-1/1_cfd/log.txt?expires=3600"},
+		{Kind: ArtifactKind_Extra, Stage: "post", Bucket: "results", Key: "task-registry/task/run-1/2_post/plot.png",
+			URL: "https://results/task-registry/task/run-1/2_post/plot.png?expires=3600"},
+	}, manifest.Artifacts)
+	assert.Error(t, errExpiry)
+}
+
+// fakePresigner makes up URLs that tell the object and the expiry
+type fakePresigner struct {
+	*MemoryArtifactStore
+}
+
+func (f *fakePresigner) PresignGetObject(
+	_ context.Context,
+	bucket, key, fileName string,
+	expiry time.Duration,
+) (string, error) {
+	url := fmt.Sprintf("https://%s/%s?expires=%d", bucket, key, int(expiry.Seconds()))
+	if fileName != "" {
+		url += "&filename=" + fileName
+	}
+	return url, nil
+}
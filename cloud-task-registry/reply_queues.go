@@ -0,0 +1,273 @@
+package cloud_task_registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"slices"
+	"strings"
+	"time"
+)
+
+// replyQueuePrefix is followed by the task run UUID, which keeps the name within the SQS limit of 80 characters
+const replyQueuePrefix = finishedTasksQ + "-"
+
+// deadLetterRetryTimeout keeps a dead letter that couldn't be forwarded out of sight of the other dispatchers
+// for a while, e.g. when the reply queue is unavailable
+const deadLetterRetryTimeout = 5 * time.Minute
+
+// unparsedLetterTimeout keeps a dead letter that can't be parsed out of sight of the dispatchers for the longest
+// visibility timeout allowed by SQS, until it expires with the retention period of the queue
+const unparsedLetterTimeout = 12 * time.Hour
+
+// staleReplyQueueAge is how long a final run must have been quiet before its reply queue is deemed left behind
+const staleReplyQueueAge = 24 * time.Hour
+
+// ReplyQueueName is the queue where the task run is reported as finished to its runner
+func ReplyQueueName(taskRunUUID string) string {
+	return replyQueuePrefix + taskRunUUID
+}
+
+// OpenReplyQueue creates the reply queue of the task run and returns its name to be set to TaskMessage.ReplyTo.
+// The runner must close the queue with CloseReplyQueue once the task run is finished.
+func (registry *CloudTaskRegistry) OpenReplyQueue(ctx context.Context, taskRunUUID string) (string, error) {
+	queueName := ReplyQueueName(taskRunUUID)
+	if err := registry.queues.CreateQueue(ctx, queueName); err != nil {
+		return "", fmt.Errorf("failed to open reply queue of task run %s, %w", taskRunUUID, err)
+	}
+	return queueName, nil
+}
+
+// CloseReplyQueue deletes the reply queue of the task run, it doesn't fail if the queue has been deleted already
+func (registry *CloudTaskRegistry) CloseReplyQueue(ctx context.Context, taskRunUUID string) error {
+	if err := registry.queues.DeleteQueue(ctx, ReplyQueueName(taskRunUUID)); err != nil {
+		return fmt.Errorf("failed to close reply queue of task run %s, %w", taskRunUUID, err)
+	}
+	return nil
+}
+
+// closeStaleReplyQueues deletes the reply queues that the runners killed before closing them have left behind.
+// Those are the queues of the runs that the retention policy has selected but kept as the best ones, once the runs
+// are final and have been quiet for staleReplyQueueAge, and unless the policy is limited to a task, the queues
+// of the runs deleted already. On a dry run it only returns the queues that would be deleted.
+func (registry *CloudTaskRegistry) closeStaleReplyQueues(
+	ctx context.Context,
+	policy RetentionPolicy,
+	kept []TaskRun,
+	now time.Time,
+) ([]string, error) {
+	queueNames, err := registry.queues.ListQueues(ctx, replyQueuePrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list reply queues, %w", err)
+	}
+	var stale []string
+	for _, queueName := range queueNames {
+		taskRunUUID := strings.TrimPrefix(queueName, replyQueuePrefix)
+		keptAt := slices.IndexFunc(kept, func(taskRun TaskRun) bool { return taskRun.UUID == taskRunUUID })
+		if keptAt >= 0 {
+			quiet, err := registry.quietSince(ctx, kept[keptAt], now.Add(-staleReplyQueueAge))
+			if err != nil {
+				return stale, err
+			}
+			if !quiet {
+				continue
+			}
+		} else {
+			// The task of a deleted run is unknown, and the runs the policy hasn't selected are left alone
+			_, err := registry.tasks.GetTaskRun(ctx, taskRunUUID)
+			if err != nil && !errors.Is(err, ErrNotFound) {
+				return stale, fmt.Errorf("failed to get task run %s, %w", taskRunUUID, err)
+			}
+			if err == nil || policy.TaskID != "" {
+				continue
+			}
+		}
+		if !policy.DryRun {
+			if err := registry.CloseReplyQueue(ctx, taskRunUUID); err != nil {
+				return stale, err
+			}
+			log.Printf("Deleted the stale reply queue %s", queueName)
+		}
+		stale = append(stale, queueName)
+	}
+	return stale, nil
+}
+
+// quietSince tells whether the task run is final and none of its stages has been active since the given time,
+// so that its runner must have received the reply already
+func (registry *CloudTaskRegistry) quietSince(ctx context.Context, taskRun TaskRun, since time.Time) (bool, error) {
+	if !slices.Contains(finalTaskRunStatuses, taskRun.Status) ||
+		(taskRun.CreationTime != nil && taskRun.CreationTime.After(since)) {
+		return false, nil
+	}
+	stages, err := registry.tasks.GetAllStages(ctx, taskRun.UUID)
+	if err != nil {
+		return false, fmt.Errorf("failed to get stages of task run %s, %w", taskRun.UUID, err)
+	}
+	for _, stage := range stages {
+		for _, t := range []*time.Time{stage.TStartUTC, stage.TFinishUTC, stage.THeartbeatUTC} {
+			if t != nil && t.After(since) {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
+// WaitForReply blocks until the expected task run is reported to its reply queue or ctx is done, in which case
+// ctx.Err() is returned. The task run has failed if the reply is DeadLettered, see DispatchDeadLetters.
+func (registry *CloudTaskRegistry) WaitForReply(
+	ctx context.Context,
+	replyQueue string,
+	taskId string,
+	expectedTaskRunUUID string,
+) (*TaskMessage, error) {
+	log.Println("Waiting for the pipeline to finish...")
+	for {
+		// Receive messages with long polling
+		message, err := registry.queues.ReceiveMessage(ctx, replyQueue, longPollingInterval*time.Second)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to receive messages, %w", err)
+		}
+
+		if message == nil {
+			registry.printStatusReport(ctx, taskId, expectedTaskRunUUID)
+			continue
+		}
+
+		reply, err := ParseTaskMessage(message.Body)
+		if err == nil && reply.TaskRunUUID != expectedTaskRunUUID {
+			err = fmt.Errorf("the reply is about task run %s", reply.TaskRunUUID)
+		}
+		// Nobody else reads the reply queue, a message left there would be received again and again
+		if errDelete := registry.queues.DeleteMessage(ctx, replyQueue, message.ReceiptHandle); errDelete != nil {
+			log.Printf("failed to remove message from the queue (non-critical error), %v", errDelete)
+		}
+		if err != nil {
+			log.Printf("Dropped unexpected message %q from the reply queue %s, %v\n", message.Body, replyQueue, err)
+			continue
+		}
+
+		if reply.DeadLettered {
+			log.Println("TaskRun", reply.TaskRunUUID, "failed!", describeTaskMessage(reply))
+		} else {
+			log.Println("TaskRun", reply.TaskRunUUID, "finished!", describeTaskMessage(reply))
+		}
+		return reply, nil
+	}
+}
+
+// DispatchDeadLetters forwards the task runs landing in the dead-letter queue to the reply queues of their runners
+// until ctx is done, and then returns ctx.Err(). Every runner may dispatch the dead letters of the others, so that
+// none of them has to look through the queue for its own task run. Legacy messages without a reply queue are left
+// to the runners waiting with WaitForDLQ while their task runs are not final, and dropped afterwards. The messages
+// that can't be parsed are parked for unparsedLetterTimeout, they may be sent by a newer version.
+func (registry *CloudTaskRegistry) DispatchDeadLetters(ctx context.Context, dlqName string) error {
+	for {
+		// Receive messages with long polling
+		message, err := registry.queues.ReceiveMessage(ctx, dlqName, longPollingInterval*time.Second)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			return fmt.Errorf("failed to receive messages, %w", err)
+		}
+
+		if message == nil {
+			continue
+		}
+
+		failed, err := ParseTaskMessage(message.Body)
+		if err != nil {
+			log.Printf("Parked unexpected message %q in the dead-letter queue %s for %v, %v\n",
+				message.Body, dlqName, unparsedLetterTimeout, err)
+			err = registry.queues.ChangeMessageVisibility(ctx, dlqName, message.ReceiptHandle, unparsedLetterTimeout)
+			if err != nil {
+				log.Printf("Failed to change message visibility timeout (non-critical error), %v\n", err)
+			}
+			continue
+		}
+
+		if failed.ReplyTo == "" {
+			awaited, err := registry.isAwaitedOnSharedQueues(ctx, failed.TaskRunUUID)
+			if err != nil {
+				log.Printf("Failed to check task run %s from the dead-letter queue %s (will retry), %v\n",
+					failed.TaskRunUUID, dlqName, err)
+				err = registry.queues.ChangeMessageVisibility(ctx, dlqName, message.ReceiptHandle, deadLetterRetryTimeout)
+				if err != nil {
+					log.Printf("Failed to change message visibility timeout (non-critical error), %v\n", err)
+				}
+				continue
+			}
+			if awaited {
+				if err := registry.makeMessageMaximallyVisible(ctx, dlqName, message.ReceiptHandle); err != nil {
+					log.Printf("Failed to set message visibility timeout to 0 due to an error: %v\n", err)
+				}
+				if SleepInterruptibly(ctx, time.Duration(rand.Intn(3000))*time.Millisecond) {
+					return ctx.Err()
+				}
+				continue
+			}
+			log.Printf("Dropped task run %s from the dead-letter queue %s, nobody waits for it anymore\n",
+				failed.TaskRunUUID, dlqName)
+			if err := registry.queues.DeleteMessage(ctx, dlqName, message.ReceiptHandle); err != nil {
+				log.Printf("failed to remove message from the queue (non-critical error), %v", err)
+			}
+			continue
+		}
+
+		err = registry.forwardDeadLetter(ctx, dlqName, failed)
+		if errors.Is(err, ErrNotFound) {
+			// The runner is gone together with its reply queue, nobody is waiting for the task run anymore
+			log.Printf("Dropped task run %s from the dead-letter queue %s, %v\n", failed.TaskRunUUID, dlqName, err)
+			registry.recordEvent(ctx, failed.TaskRunUUID, failed.TargetStage, EventType_DLQ,
+				"landed in "+dlqName+", dropped as "+failed.ReplyTo+" is gone")
+		} else if err != nil {
+			log.Printf("Failed to forward task run %s from the dead-letter queue %s (will retry), %v\n",
+				failed.TaskRunUUID, dlqName, err)
+			err = registry.queues.ChangeMessageVisibility(ctx, dlqName, message.ReceiptHandle, deadLetterRetryTimeout)
+			if err != nil {
+				log.Printf("Failed to change message visibility timeout (non-critical error), %v\n", err)
+			}
+			continue
+		}
+		if err := registry.queues.DeleteMessage(ctx, dlqName, message.ReceiptHandle); err != nil {
+			log.Printf("failed to remove message from the queue (non-critical error), %v", err)
+		}
+	}
+}
+
+// isAwaitedOnSharedQueues tells whether a runner may still wait for the legacy dead letter of the task run with
+// WaitForDLQ, i.e. the run exists and is not final yet, as the runner marks it failed once it receives the letter
+func (registry *CloudTaskRegistry) isAwaitedOnSharedQueues(ctx context.Context, taskRunUUID string) (bool, error) {
+	taskRun, err := registry.tasks.GetTaskRun(ctx, taskRunUUID)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to get task run %s, %w", taskRunUUID, err)
+	}
+	return !slices.Contains(finalTaskRunStatuses, taskRun.Status), nil
+}
+
+// forwardDeadLetter sends the message to its reply queue as is, so that the runner can tell which stage has failed
+func (registry *CloudTaskRegistry) forwardDeadLetter(ctx context.Context, dlqName string, failed *TaskMessage) error {
+	failed.DeadLettered = true
+	body, err := failed.encode()
+	if err != nil {
+		return err
+	}
+	if err := registry.queues.SendMessage(ctx, failed.ReplyTo, body); err != nil {
+		return fmt.Errorf("error sending message to SQS queue %q, %w", failed.ReplyTo, err)
+	}
+	log.Println("Forwarded task run", failed.TaskRunUUID, "from the dead-letter queue", dlqName, "to", failed.ReplyTo,
+		describeTaskMessage(failed))
+	registry.recordEvent(ctx, failed.TaskRunUUID, failed.TargetStage, EventType_DLQ,
+		"landed in "+dlqName+", forwarded to "+failed.ReplyTo)
+	return nil
+}
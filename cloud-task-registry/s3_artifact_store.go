@@ -0,0 +1,152 @@
+package cloud_task_registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// S3ArtifactStore keeps artifacts in S3-compatible object storage (Yandex Object Storage by default)
+type S3ArtifactStore struct {
+	client   *s3.Client
+	transfer *s3Transfer
+}
+
+func NewS3ArtifactStore(serviceConfig ServiceConfig) (*S3ArtifactStore, error) {
+	configForS3, err := loadAwsConfig(serviceConfig)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load SDK config for S3, %w", err)
+	}
+	client := s3.NewFromConfig(configForS3, func(o *s3.Options) {
+		o.UsePathStyle = serviceConfig.PathStyle
+	})
+	return &S3ArtifactStore{client: client, transfer: newS3Transfer(client, serviceConfig.Transfer)}, nil
+}
+
+func (store *S3ArtifactStore) PutObject(
+	ctx context.Context,
+	bucket, key string,
+	body io.Reader,
+	storageClass StorageClass,
+	metadata map[string]string,
+) error {
+	_, err := store.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:       aws.String(bucket),
+		Key:          aws.String(key),
+		Body:         body,
+		StorageClass: toS3StorageClass(storageClass),
+		Metadata:     metadata,
+	})
+	return err
+}
+
+func (store *S3ArtifactStore) GetObject(ctx context.Context, bucket, key string) (io.ReadCloser, error) {
+	object, err := store.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return object.Body, nil
+}
+
+func (store *S3ArtifactStore) HeadObject(ctx context.Context, bucket, key string) (*ObjectInfo, error) {
+	head, err := store.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	var notFound *s3types.NotFound
+	if errors.As(err, &notFound) {
+		return nil, fmt.Errorf("object %q in bucket %q %w", key, bucket, ErrNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectInfo{
+		Key:          key,
+		Size:         head.ContentLength,
+		LastModified: aws.ToTime(head.LastModified),
+		Metadata:     head.Metadata,
+	}, nil
+}
+
+func (store *S3ArtifactStore) DeleteObject(ctx context.Context, bucket, key string) error {
+	_, err := store.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+func (store *S3ArtifactStore) UploadFile(
+	ctx context.Context,
+	bucket, key, filePath string,
+	storageClass StorageClass,
+	metadata map[string]string,
+) error {
+	return store.transfer.UploadFile(ctx, bucket, key, filePath, storageClass, metadata)
+}
+
+func (store *S3ArtifactStore) DownloadFile(ctx context.Context, bucket, key, destination string) error {
+	return store.transfer.DownloadFile(ctx, bucket, key, destination)
+}
+
+func (store *S3ArtifactStore) PresignGetObject(
+	ctx context.Context,
+	bucket, key, fileName string,
+	expiry time.Duration,
+) (string, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	if fileName != "" {
+		input.ResponseContentDisposition = aws.String(
+			mime.FormatMediaType("attachment", map[string]string{"filename": fileName}))
+	}
+	request, err := s3.NewPresignClient(store.client).PresignGetObject(ctx, input, s3.WithPresignExpires(expiry))
+	if err != nil {
+		return "", err
+	}
+	return request.URL, nil
+}
+
+func (store *S3ArtifactStore) ListObjects(ctx context.Context, bucket, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	paginator := s3.NewListObjectsV2Paginator(store.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range page.Contents {
+			objects = append(objects, ObjectInfo{
+				Key:          aws.ToString(object.Key),
+				Size:         object.Size,
+				LastModified: aws.ToTime(object.LastModified),
+			})
+		}
+	}
+	return objects, nil
+}
+
+func toS3StorageClass(storageClass StorageClass) s3types.StorageClass {
+	switch storageClass {
+	case StorageClass_Cold:
+		// Cold storage is 2x cheaper than the standard one
+		return s3types.StorageClassStandardIa
+	default:
+		return s3types.StorageClassStandard
+	}
+}
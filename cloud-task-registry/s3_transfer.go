@@ -0,0 +1,372 @@
+package cloud_task_registry
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Defaults of TransferConfig
+const (
+	defaultPartSizeMB          = 64
+	defaultTransferConcurrency = 4
+	defaultPartRetries         = 3
+)
+
+const (
+	minPartSizeMB = 5     // S3 limit for all the parts but the last one
+	maxParts      = 10000 // S3 limit
+)
+
+// s3TransferAPI is the part of the S3 client that transfers use
+type s3TransferAPI interface {
+	s3.ListPartsAPIClient
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput,
+		optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error)
+	UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error)
+	CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput,
+		optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error)
+	ListMultipartUploads(ctx context.Context, params *s3.ListMultipartUploadsInput,
+		optFns ...func(*s3.Options)) (*s3.ListMultipartUploadsOutput, error)
+}
+
+// s3Transfer uploads files larger than a part with multipart uploads and downloads them with ranged GETs,
+// transferring the parts in parallel and retrying the failed ones
+type s3Transfer struct {
+	client      s3TransferAPI
+	partSize    int64
+	concurrency int
+	retries     int
+	retryDelay  time.Duration // grows linearly with the attempt
+}
+
+func newS3Transfer(client s3TransferAPI, config TransferConfig) *s3Transfer {
+	partSizeMB := config.PartSizeMB
+	if partSizeMB == 0 {
+		partSizeMB = defaultPartSizeMB
+	}
+	transfer := &s3Transfer{
+		client:      client,
+		partSize:    int64(max(partSizeMB, minPartSizeMB)) << 20,
+		concurrency: config.Concurrency,
+		retries:     config.PartRetries,
+		retryDelay:  time.Second,
+	}
+	if transfer.concurrency == 0 {
+		transfer.concurrency = defaultTransferConcurrency
+	}
+	if transfer.retries == 0 {
+		transfer.retries = defaultPartRetries
+	}
+	return transfer
+}
+
+type filePart struct {
+	number int32 // 1-based, as in S3
+	offset int64
+	size   int64
+}
+
+// planParts splits the file into parts, growing them if there would be too many
+func (transfer *s3Transfer) planParts(size int64) []filePart {
+	partSize := max(transfer.partSize, (size+maxParts-1)/maxParts)
+	var parts []filePart
+	for offset := int64(0); offset < size; offset += partSize {
+		parts = append(parts, filePart{number: int32(len(parts) + 1), offset: offset, size: min(partSize, size-offset)})
+	}
+	return parts
+}
+
+// UploadFile uploads the file in parts unless it fits into one. If the upload fails, the uploaded parts are kept,
+// so that the next upload of the same file to the same key resumes it. Abandoned uploads are to be removed
+// by a bucket lifecycle rule. NB: a resumed upload keeps the metadata it was started with.
+func (transfer *s3Transfer) UploadFile(
+	ctx context.Context,
+	bucket, key, filePath string,
+	storageClass StorageClass,
+	metadata map[string]string,
+) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	parts := transfer.planParts(info.Size())
+	if len(parts) <= 1 {
+		_, err = transfer.client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:       aws.String(bucket),
+			Key:          aws.String(key),
+			Body:         file,
+			StorageClass: toS3StorageClass(storageClass),
+			Metadata:     metadata,
+		})
+		if err != nil {
+			return err
+		}
+		logThroughput("Uploaded", key, info.Size(), 1, time.Since(start))
+		return nil
+	}
+
+	uploadId, uploaded, err := transfer.startOrResumeUpload(ctx, bucket, key, storageClass, metadata)
+	if err != nil {
+		return err
+	}
+	completed := make([]s3types.CompletedPart, len(parts))
+	resumed := make([]bool, len(parts))
+	err = runParallel(ctx, len(parts), transfer.concurrency, func(ctx context.Context, i int) error {
+		part := parts[i]
+		section := io.NewSectionReader(file, part.offset, part.size)
+		if previous, ok := uploaded[part.number]; ok && previous.Size == part.size {
+			etag, err := partETag(section)
+			if err != nil {
+				return err
+			}
+			if etag == strings.Trim(aws.ToString(previous.ETag), `"`) {
+				completed[i] = s3types.CompletedPart{PartNumber: part.number, ETag: previous.ETag}
+				resumed[i] = true
+				return nil
+			}
+		}
+		what := fmt.Sprintf("upload of part %d of %q", part.number, key)
+		return transfer.withRetries(ctx, what, func() error {
+			output, err := transfer.client.UploadPart(ctx, &s3.UploadPartInput{
+				Bucket:        aws.String(bucket),
+				Key:           aws.String(key),
+				UploadId:      aws.String(uploadId),
+				PartNumber:    part.number,
+				Body:          io.NewSectionReader(file, part.offset, part.size),
+				ContentLength: part.size,
+			})
+			if err != nil {
+				return err
+			}
+			completed[i] = s3types.CompletedPart{PartNumber: part.number, ETag: output.ETag}
+			return nil
+		})
+	})
+	if err != nil {
+		log.Printf("Upload of %q failed, the next upload of the file will resume it", key)
+		return err
+	}
+
+	_, err = transfer.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(bucket),
+		Key:             aws.String(key),
+		UploadId:        aws.String(uploadId),
+		MultipartUpload: &s3types.CompletedMultipartUpload{Parts: completed},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to complete upload of %q, %w", key, err)
+	}
+	if n := len(slices.DeleteFunc(resumed, func(r bool) bool { return !r })); n > 0 {
+		log.Printf("Resumed upload of %q, %d of %d parts were uploaded before", key, n, len(parts))
+		transfer.checkMetadata(ctx, bucket, key, metadata)
+	}
+	logThroughput("Uploaded", key, info.Size(), len(parts), time.Since(start))
+	return nil
+}
+
+// checkMetadata warns if the uploaded object has metadata other than expected, which happens when a resumed
+// upload was started for a different file. The registry keeps the digests in the stages anyway.
+func (transfer *s3Transfer) checkMetadata(ctx context.Context, bucket, key string, metadata map[string]string) {
+	head, err := transfer.client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if err != nil {
+		log.Printf("Couldn't check metadata of %q: %v", key, err)
+		return
+	}
+	if !maps.Equal(head.Metadata, metadata) {
+		log.Printf("Warning: %q has metadata %v of the upload it resumed instead of %v", key, head.Metadata, metadata)
+	}
+}
+
+// startOrResumeUpload returns the ID of the latest unfinished upload to the key with its parts, or starts a new one
+func (transfer *s3Transfer) startOrResumeUpload(
+	ctx context.Context,
+	bucket, key string,
+	storageClass StorageClass,
+	metadata map[string]string,
+) (string, map[int32]s3types.Part, error) {
+	uploads, err := transfer.client.ListMultipartUploads(ctx, &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(key),
+	})
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to list unfinished uploads of %q, %w", key, err)
+	}
+	var latest *s3types.MultipartUpload
+	for i, upload := range uploads.Uploads {
+		if aws.ToString(upload.Key) != key ||
+			(upload.StorageClass != "" && upload.StorageClass != toS3StorageClass(storageClass)) {
+			continue
+		}
+		if latest == nil || aws.ToTime(upload.Initiated).After(aws.ToTime(latest.Initiated)) {
+			latest = &uploads.Uploads[i]
+		}
+	}
+
+	if latest != nil {
+		uploaded := make(map[int32]s3types.Part)
+		paginator := s3.NewListPartsPaginator(transfer.client, &s3.ListPartsInput{
+			Bucket:   aws.String(bucket),
+			Key:      aws.String(key),
+			UploadId: latest.UploadId,
+		})
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				return "", nil, fmt.Errorf("failed to list uploaded parts of %q, %w", key, err)
+			}
+			for _, part := range page.Parts {
+				uploaded[part.PartNumber] = part
+			}
+		}
+		return aws.ToString(latest.UploadId), uploaded, nil
+	}
+
+	upload, err := transfer.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:       aws.String(bucket),
+		Key:          aws.String(key),
+		StorageClass: toS3StorageClass(storageClass),
+		Metadata:     metadata,
+	})
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to start upload of %q, %w", key, err)
+	}
+	return aws.ToString(upload.UploadId), nil, nil
+}
+
+// partETag is the ETag that S3 gives to an uploaded part: the MD5 digest of its content
+func partETag(part io.Reader) (string, error) {
+	hash := md5.New()
+	if _, err := io.Copy(hash, part); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// DownloadFile downloads the object with parallel ranged GETs unless it fits into one part
+func (transfer *s3Transfer) DownloadFile(ctx context.Context, bucket, key, destination string) error {
+	head, err := transfer.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return err
+	}
+	file, err := os.Create(destination)
+	if err != nil {
+		return fmt.Errorf("failed to create/overwrite destination file %q, %w", destination, err)
+	}
+	defer file.Close()
+
+	start := time.Now()
+	parts := transfer.planParts(head.ContentLength)
+	if err := file.Truncate(head.ContentLength); err != nil {
+		return err
+	}
+	err = runParallel(ctx, len(parts), transfer.concurrency, func(ctx context.Context, i int) error {
+		part := parts[i]
+		what := fmt.Sprintf("download of part %d of %q", part.number, key)
+		return transfer.withRetries(ctx, what, func() error {
+			// IfMatch makes sure that all the parts come from the same version of the object
+			object, err := transfer.client.GetObject(ctx, &s3.GetObjectInput{
+				Bucket:  aws.String(bucket),
+				Key:     aws.String(key),
+				Range:   aws.String(fmt.Sprintf("bytes=%d-%d", part.offset, part.offset+part.size-1)),
+				IfMatch: head.ETag,
+			})
+			if err != nil {
+				return err
+			}
+			defer object.Body.Close()
+			n, err := io.Copy(io.NewOffsetWriter(file, part.offset), object.Body)
+			if err != nil {
+				return err
+			}
+			if n != part.size {
+				return fmt.Errorf("got %d bytes instead of %d", n, part.size)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	logThroughput("Downloaded", key, head.ContentLength, len(parts), time.Since(start))
+	return nil
+}
+
+func (transfer *s3Transfer) withRetries(ctx context.Context, what string, do func() error) error {
+	err := do()
+	for attempt := 1; attempt <= transfer.retries && err != nil && ctx.Err() == nil; attempt++ {
+		log.Printf("Retrying %s (%d of %d) after error: %v", what, attempt, transfer.retries, err)
+		if SleepInterruptibly(ctx, time.Duration(attempt)*transfer.retryDelay) {
+			return ctx.Err()
+		}
+		err = do()
+	}
+	if err != nil {
+		return fmt.Errorf("%s failed, %w", what, err)
+	}
+	return nil
+}
+
+// runParallel calls do for 0..n-1 with up to concurrency calls at a time. The first error cancels the rest.
+func runParallel(ctx context.Context, n, concurrency int, do func(ctx context.Context, i int) error) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for range min(concurrency, n) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				if err := do(ctx, i); err != nil {
+					cancel(err)
+				}
+			}
+		}()
+	}
+feed:
+	for i := range n {
+		select {
+		case indexes <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(indexes)
+	wg.Wait()
+	return context.Cause(ctx)
+}
+
+// logThroughput logs the transfer speed, so that the part size and concurrency can be tuned for an executor
+func logThroughput(verb, key string, size int64, parts int, elapsed time.Duration) {
+	mibPerSecond := float64(size) / (1 << 20) / max(elapsed.Seconds(), 1e-3)
+	log.Printf("%s %q: %d bytes in %d part(s) in %v, %.1f MiB/s",
+		verb, key, size, parts, elapsed.Round(time.Millisecond), mibPerSecond)
+}
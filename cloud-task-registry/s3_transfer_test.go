@@ -0,0 +1,210 @@
+package cloud_task_registry
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestS3Transfer_MustResumeFailedUploadAndDownloadInRanges(t *testing.T) {
+	// given
+	ctx := context.Background()
+	client := newFakeS3()
+	transfer := newS3Transfer(client, TransferConfig{PartSizeMB: 5, Concurrency: 3, PartRetries: 1})
+	transfer.retryDelay = 0
+	content := make([]byte, 17<<20) // 4 parts
+	rand.New(rand.NewSource(1)).Read(content)
+	filePath := filepath.Join(t.TempDir(), "case.tar.gz")
+	require.NoError(t, os.WriteFile(filePath, content, 0o644))
+	destination := filepath.Join(t.TempDir(), "downloaded.tar.gz")
+	// when
+	client.failures[3] = 2 // more than the retries
+	errFailed := transfer.UploadFile(ctx, "bucket", "key", filePath, StorageClass_Standard, nil)
+	client.failures[3] = 1
+	errResumed := transfer.UploadFile(ctx, "bucket", "key", filePath, StorageClass_Standard, nil)
+	errDownload := transfer.DownloadFile(ctx, "bucket", "key", destination)
+	// then
+	assert.Error(t, errFailed)
+	require.NoError(t, errResumed)
+	assert.Equal(t, map[int32]int{1: 1, 2: 1, 3: 1, 4: 1}, client.successes, "uploaded parts must not be uploaded again")
+	assert.Equal(t, content, client.objects["bucket/key"])
+	assert.Empty(t, client.uploads)
+	require.NoError(t, errDownload)
+	downloaded, err := os.ReadFile(destination)
+	require.NoError(t, err)
+	assert.Equal(t, content, downloaded)
+	assert.Equal(t, 4, client.rangedGets)
+}
+
+// fakeS3 keeps objects and multipart uploads in memory
+type fakeS3 struct {
+	mu         sync.Mutex
+	objects    map[string][]byte      // "bucket/key" -> content
+	uploads    map[string]*fakeUpload // upload ID -> upload
+	uploadIds  int
+	failures   map[int32]int // part number -> number of part uploads to fail
+	successes  map[int32]int // part number -> number of successful part uploads
+	rangedGets int
+}
+
+type fakeUpload struct {
+	bucket, key string
+	initiated   time.Time
+	parts       map[int32][]byte
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{
+		objects:   make(map[string][]byte),
+		uploads:   make(map[string]*fakeUpload),
+		failures:  make(map[int32]int),
+		successes: make(map[int32]int),
+	}
+}
+
+func fakeETag(data []byte) *string {
+	digest := md5.Sum(data)
+	return aws.String(`"` + hex.EncodeToString(digest[:]) + `"`)
+}
+
+func (f *fakeS3) PutObject(_ context.Context, params *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	data, err := io.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[aws.ToString(params.Bucket)+"/"+aws.ToString(params.Key)] = data
+	return &s3.PutObjectOutput{ETag: fakeETag(data)}, nil
+}
+
+func (f *fakeS3) HeadObject(_ context.Context, params *s3.HeadObjectInput, _ ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	data, ok := f.objects[aws.ToString(params.Bucket)+"/"+aws.ToString(params.Key)]
+	if !ok {
+		return nil, errors.New("no such key")
+	}
+	return &s3.HeadObjectOutput{ContentLength: int64(len(data)), ETag: fakeETag(data)}, nil
+}
+
+func (f *fakeS3) GetObject(_ context.Context, params *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	data, ok := f.objects[aws.ToString(params.Bucket)+"/"+aws.ToString(params.Key)]
+	if !ok {
+		return nil, errors.New("no such key")
+	}
+	if params.IfMatch != nil && aws.ToString(params.IfMatch) != aws.ToString(fakeETag(data)) {
+		return nil, errors.New("precondition failed")
+	}
+	if params.Range != nil {
+		var first, last int
+		if _, err := fmt.Sscanf(aws.ToString(params.Range), "bytes=%d-%d", &first, &last); err != nil {
+			return nil, err
+		}
+		data = data[first : last+1]
+		f.rangedGets++
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(data)), ContentLength: int64(len(data))}, nil
+}
+
+func (f *fakeS3) CreateMultipartUpload(
+	_ context.Context,
+	params *s3.CreateMultipartUploadInput,
+	_ ...func(*s3.Options),
+) (*s3.CreateMultipartUploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.uploadIds++
+	uploadId := fmt.Sprintf("upload-%d", f.uploadIds)
+	f.uploads[uploadId] = &fakeUpload{bucket: aws.ToString(params.Bucket), key: aws.ToString(params.Key),
+		initiated: time.Now(), parts: make(map[int32][]byte)}
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String(uploadId)}, nil
+}
+
+func (f *fakeS3) UploadPart(ctx context.Context, params *s3.UploadPartInput, _ ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	data, err := io.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failures[params.PartNumber] > 0 {
+		f.failures[params.PartNumber]--
+		return nil, errors.New("connection reset by peer")
+	}
+	f.uploads[aws.ToString(params.UploadId)].parts[params.PartNumber] = data
+	f.successes[params.PartNumber]++
+	return &s3.UploadPartOutput{ETag: fakeETag(data)}, nil
+}
+
+func (f *fakeS3) CompleteMultipartUpload(
+	_ context.Context,
+	params *s3.CompleteMultipartUploadInput,
+	_ ...func(*s3.Options),
+) (*s3.CompleteMultipartUploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	upload := f.uploads[aws.ToString(params.UploadId)]
+	var data []byte
+	for _, part := range params.MultipartUpload.Parts {
+		if aws.ToString(part.ETag) != aws.ToString(fakeETag(upload.parts[part.PartNumber])) {
+			return nil, fmt.Errorf("invalid part %d", part.PartNumber)
+		}
+		data = append(data, upload.parts[part.PartNumber]...)
+	}
+	f.objects[upload.bucket+"/"+upload.key] = data
+	delete(f.uploads, aws.ToString(params.UploadId))
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+
+func (f *fakeS3) ListMultipartUploads(
+	_ context.Context,
+	params *s3.ListMultipartUploadsInput,
+	_ ...func(*s3.Options),
+) (*s3.ListMultipartUploadsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	output := &s3.ListMultipartUploadsOutput{}
+	for uploadId, upload := range f.uploads {
+		if upload.bucket == aws.ToString(params.Bucket) && upload.key == aws.ToString(params.Prefix) {
+			output.Uploads = append(output.Uploads, s3types.MultipartUpload{
+				Key: aws.String(upload.key), UploadId: aws.String(uploadId), Initiated: aws.Time(upload.initiated)})
+		}
+	}
+	return output, nil
+}
+
+func (f *fakeS3) ListParts(_ context.Context, params *s3.ListPartsInput, _ ...func(*s3.Options)) (*s3.ListPartsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	upload := f.uploads[aws.ToString(params.UploadId)]
+	output := &s3.ListPartsOutput{}
+	for _, number := range slices.Sorted(maps.Keys(upload.parts)) {
+		data := upload.parts[number]
+		output.Parts = append(output.Parts, s3types.Part{PartNumber: number, Size: int64(len(data)), ETag: fakeETag(data)})
+	}
+	return output, nil
+}
@@ -0,0 +1,974 @@
+package cloud_task_registry
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const sqlitePollingInterval = 500 * time.Millisecond
+
+// sqliteMigrations are applied in order, the schema version (PRAGMA user_version) is the number of the applied steps.
+// Never change or reorder the existing steps, append new ones instead.
+var sqliteMigrations = []string{
+	// 1: initial schema
+	`
+CREATE TABLE IF NOT EXISTS task_runs (
+	task_id         TEXT NOT NULL,
+	run_uuid        TEXT NOT NULL,
+	parameters      TEXT NOT NULL DEFAULT '{}',
+	results         TEXT,
+	task_definition TEXT NOT NULL DEFAULT '',
+	creation_time   TEXT,
+	status          TEXT NOT NULL,
+	PRIMARY KEY (task_id, run_uuid)
+);
+CREATE INDEX IF NOT EXISTS TaskRunUUIDIndex ON task_runs (run_uuid);
+
+CREATE TABLE IF NOT EXISTS task_stages (
+	run_uuid     TEXT NOT NULL,
+	n_ord        INTEGER NOT NULL,
+	name         TEXT NOT NULL,
+	status       TEXT NOT NULL,
+	config       TEXT NOT NULL DEFAULT '',
+	input        TEXT NOT NULL DEFAULT '',
+	output       TEXT NOT NULL DEFAULT '',
+	t_start_utc  TEXT,
+	t_finish_utc TEXT,
+	executor     TEXT NOT NULL DEFAULT '',
+	s3_bucket    TEXT NOT NULL DEFAULT '',
+	comments     TEXT NOT NULL DEFAULT '',
+	next         TEXT NOT NULL DEFAULT '[]',
+	PRIMARY KEY (run_uuid, n_ord)
+);
+CREATE INDEX IF NOT EXISTS StageNameIndex ON task_stages (run_uuid, name);
+
+CREATE TABLE IF NOT EXISTS queue_messages (
+	id              INTEGER PRIMARY KEY AUTOINCREMENT,
+	queue_name      TEXT NOT NULL,
+	body            TEXT NOT NULL,
+	receipt_handle  TEXT,
+	invisible_until INTEGER NOT NULL DEFAULT 0, -- unix milliseconds
+	receive_count   INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS QueueNameIndex ON queue_messages (queue_name, invisible_until);
+`,
+	// 2: tasks
+	`
+CREATE TABLE IF NOT EXISTS tasks (
+	task_id           TEXT PRIMARY KEY,
+	definition        TEXT NOT NULL DEFAULT '',
+	definition_sha256 TEXT NOT NULL DEFAULT '',
+	s3_bucket         TEXT NOT NULL DEFAULT '',
+	objectives        TEXT NOT NULL DEFAULT '[]',
+	parameters        TEXT NOT NULL DEFAULT '[]',
+	pipeline          TEXT NOT NULL DEFAULT '[]',
+	creation_time     TEXT
+);
+`,
+	// 3: indexes for listing task runs by status and creation time
+	`
+CREATE INDEX IF NOT EXISTS StatusCreationTimeIndex ON task_runs (status, creation_time);
+CREATE INDEX IF NOT EXISTS TaskCreationTimeIndex ON task_runs (task_id, creation_time);
+`,
+	// 4: SHA-256 digests of the stage artifacts
+	`
+ALTER TABLE task_stages ADD COLUMN config_sha256 TEXT NOT NULL DEFAULT '';
+ALTER TABLE task_stages ADD COLUMN input_sha256 TEXT NOT NULL DEFAULT '';
+ALTER TABLE task_stages ADD COLUMN output_sha256 TEXT NOT NULL DEFAULT '';
+`,
+	// 5: named outputs and inputs of the stages
+	`
+ALTER TABLE task_stages ADD COLUMN outputs TEXT NOT NULL DEFAULT '{}';
+ALTER TABLE task_stages ADD COLUMN outputs_sha256 TEXT NOT NULL DEFAULT '{}';
+ALTER TABLE task_stages ADD COLUMN output_names TEXT NOT NULL DEFAULT '[]';
+ALTER TABLE task_stages ADD COLUMN input_names TEXT NOT NULL DEFAULT '[]';
+`,
+	// 6: heartbeats and leases of the stages in progress
+	`
+ALTER TABLE task_stages ADD COLUMN t_heartbeat_utc TEXT;
+ALTER TABLE task_stages ADD COLUMN t_lease_expiry_utc TEXT;
+`,
+	// 7: attempts of the stages
+	`
+ALTER TABLE task_stages ADD COLUMN attempts TEXT NOT NULL DEFAULT '[]';
+ALTER TABLE task_stages ADD COLUMN max_attempts INTEGER NOT NULL DEFAULT 0;
+`,
+	// 8: event log of the task runs
+	`
+CREATE TABLE IF NOT EXISTS task_events (
+	run_uuid TEXT NOT NULL,
+	event_id TEXT NOT NULL,
+	time_utc TEXT NOT NULL,
+	stage    TEXT NOT NULL DEFAULT '',
+	type     TEXT NOT NULL,
+	actor    TEXT NOT NULL DEFAULT '',
+	details  TEXT NOT NULL DEFAULT '',
+	PRIMARY KEY (run_uuid, event_id)
+);
+`,
+}
+
+// stageColumns are the columns of task_stages in the order of stageValues
+const stageColumns = `run_uuid, n_ord, name, status, config, input, output, t_start_utc, t_finish_utc,
+	executor, s3_bucket, comments, config_sha256, input_sha256, output_sha256,
+	next, outputs, outputs_sha256, output_names, input_names, t_heartbeat_utc, t_lease_expiry_utc,
+	attempts, max_attempts`
+
+// SQLiteStore keeps tasks, task runs, stages and queues in a single SQLite file, so that a pipeline can run on one
+// machine without any cloud services. It implements both TaskStore and MessageQueue.
+// Received messages become invisible for VisibilityTimeout and are delivered again unless deleted.
+type SQLiteStore struct {
+	VisibilityTimeout time.Duration
+
+	db *sql.DB
+}
+
+func NewSQLiteStore(path string) (*SQLiteStore, error) {
+	// Immediate transactions, so that concurrent migrations wait for each other instead of failing
+	dsn := "file:" + path + "?_pragma=busy_timeout(10000)&_pragma=journal_mode(WAL)&_txlock=immediate"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open SQLite database %q: %w", path, err)
+	}
+	store := &SQLiteStore{
+		VisibilityTimeout: 30 * time.Second, // SQS default
+		db:                db,
+	}
+	// The database is local, so there is no point in skipping the migrations
+	if err := store.Migrate(context.Background()); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate SQLite schema in %q: %w", path, err)
+	}
+	return store, nil
+}
+
+// Migrate brings the SQLite schema to the latest version
+func (store *SQLiteStore) Migrate(ctx context.Context) error {
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var version int
+	if err := tx.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version); err != nil {
+		return fmt.Errorf("failed to get schema version: %w", err)
+	}
+	if version > len(sqliteMigrations) {
+		return fmt.Errorf("schema version %d is newer than the latest known one (%d), please update this binary",
+			version, len(sqliteMigrations))
+	}
+	if version == len(sqliteMigrations) {
+		return nil
+	}
+	for ; version < len(sqliteMigrations); version++ {
+		if _, err := tx.ExecContext(ctx, sqliteMigrations[version]); err != nil {
+			return fmt.Errorf("migration %d failed: %w", version+1, err)
+		}
+	}
+	// PRAGMA doesn't support parameters
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("PRAGMA user_version = %d", version)); err != nil {
+		return fmt.Errorf("failed to set schema version: %w", err)
+	}
+	return tx.Commit()
+}
+
+func (store *SQLiteStore) Close() error {
+	return store.db.Close()
+}
+
+func (store *SQLiteStore) InsertTask(ctx context.Context, task Task) error {
+	objectives, err := json.Marshal(task.Objectives)
+	if err != nil {
+		return err
+	}
+	parameters, err := json.Marshal(task.Parameters)
+	if err != nil {
+		return err
+	}
+	pipeline, err := json.Marshal(task.Pipeline)
+	if err != nil {
+		return err
+	}
+	result, err := store.db.ExecContext(ctx,
+		`INSERT INTO tasks
+			(task_id, definition, definition_sha256, s3_bucket, objectives, parameters, pipeline, creation_time)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (task_id) DO NOTHING`,
+		task.ID, task.Definition, task.DefinitionSHA256, task.S3Bucket, string(objectives), string(parameters),
+		string(pipeline), formatNullableTime(task.CreationTime))
+	if err = checkRowUpdated(result, err); err != nil {
+		return fmt.Errorf("failed to insert task '%s': %w", task.ID, err)
+	}
+	return nil
+}
+
+func (store *SQLiteStore) GetTask(ctx context.Context, taskID string) (*Task, error) {
+	tasks, err := store.queryTasks(ctx, "WHERE task_id = ?", taskID)
+	if err != nil {
+		return nil, err
+	}
+	if len(tasks) == 0 {
+		return nil, fmt.Errorf("task '%s' %w", taskID, ErrNotFound)
+	}
+	return &tasks[0], nil
+}
+
+func (store *SQLiteStore) ListTasks(ctx context.Context) ([]Task, error) {
+	return store.queryTasks(ctx, "ORDER BY task_id")
+}
+
+func (store *SQLiteStore) DeleteTask(ctx context.Context, taskID string) error {
+	_, err := store.db.ExecContext(ctx, "DELETE FROM tasks WHERE task_id = ?", taskID)
+	if err != nil {
+		return fmt.Errorf("failed to delete task '%s': %w", taskID, err)
+	}
+	return nil
+}
+
+func (store *SQLiteStore) InsertTaskRun(ctx context.Context, taskRun TaskRun) error {
+	parameters, err := json.Marshal(taskRun.Parameters)
+	if err != nil {
+		return err
+	}
+	results, err := marshalNullableJSON(taskRun.Results)
+	if err != nil {
+		return err
+	}
+	_, err = store.db.ExecContext(ctx,
+		`INSERT OR REPLACE INTO task_runs
+			(task_id, run_uuid, parameters, results, task_definition, creation_time, status)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		taskRun.TaskID, taskRun.UUID, string(parameters), results, taskRun.TaskDefinition,
+		formatNullableTime(taskRun.CreationTime), string(taskRun.Status))
+	return err
+}
+
+func (store *SQLiteStore) InsertTaskRunWithStages(ctx context.Context, taskRun TaskRun, stages []Stage) error {
+	parameters, err := json.Marshal(taskRun.Parameters)
+	if err != nil {
+		return err
+	}
+	results, err := marshalNullableJSON(taskRun.Results)
+	if err != nil {
+		return err
+	}
+
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx,
+		`INSERT INTO task_runs
+			(task_id, run_uuid, parameters, results, task_definition, creation_time, status)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (task_id, run_uuid) DO NOTHING`,
+		taskRun.TaskID, taskRun.UUID, string(parameters), results, taskRun.TaskDefinition,
+		formatNullableTime(taskRun.CreationTime), string(taskRun.Status))
+	if err = checkRowUpdated(result, err); err != nil {
+		return fmt.Errorf("failed to insert task run '%s': %w", taskRun.UUID, err)
+	}
+	for _, stage := range stages {
+		values, err := stageValues(stage)
+		if err != nil {
+			return err
+		}
+		result, err := tx.ExecContext(ctx,
+			`INSERT INTO task_stages (`+stageColumns+`) VALUES (`+stagePlaceholders+`)
+				ON CONFLICT (run_uuid, n_ord) DO NOTHING`,
+			values...)
+		if err = checkRowUpdated(result, err); err != nil {
+			return fmt.Errorf("failed to insert stage %d of task run '%s': %w", stage.NOrd, stage.TaskRunUUID, err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (store *SQLiteStore) GetTaskRun(ctx context.Context, taskRunUUID string) (*TaskRun, error) {
+	taskRuns, err := store.queryTaskRuns(ctx, "WHERE run_uuid = ?", taskRunUUID)
+	if err != nil {
+		return nil, err
+	}
+	if len(taskRuns) == 0 {
+		return nil, fmt.Errorf("task run '%s' %w", taskRunUUID, ErrNotFound)
+	}
+	if len(taskRuns) > 1 {
+		return nil, fmt.Errorf("task run '%s' is %w", taskRunUUID, ErrNotUnique)
+	}
+	return &taskRuns[0], nil
+}
+
+func (store *SQLiteStore) ListTaskRuns(ctx context.Context, filter TaskRunFilter) (*TaskRunPage, error) {
+	var conditions []string
+	var args []any
+	if filter.TaskID != "" {
+		conditions = append(conditions, "task_id = ?")
+		args = append(args, filter.TaskID)
+	}
+	if len(filter.Statuses) > 0 {
+		conditions = append(conditions, "status IN (?"+strings.Repeat(", ?", len(filter.Statuses)-1)+")")
+		for _, status := range filter.Statuses {
+			args = append(args, string(status))
+		}
+	}
+	if filter.CreatedAfter != nil {
+		conditions = append(conditions, "creation_time >= ?")
+		args = append(args, filter.CreatedAfter.UTC().Format(time.RFC3339))
+	}
+	if filter.CreatedBefore != nil {
+		conditions = append(conditions, "creation_time < ?")
+		args = append(args, filter.CreatedBefore.UTC().Format(time.RFC3339))
+	}
+	if filter.Cursor != "" {
+		var after taskRunKeyCursor
+		if err := decodeCursor(filter.Cursor, &after); err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, "(task_id, run_uuid) > (?, ?)")
+		args = append(args, after.TaskID, after.UUID)
+	}
+	clause := "ORDER BY task_id, run_uuid"
+	if len(conditions) > 0 {
+		clause = "WHERE " + strings.Join(conditions, " AND ") + " " + clause
+	}
+	if filter.Limit > 0 {
+		// One more task run tells whether there is a next page
+		clause += " LIMIT ?"
+		args = append(args, filter.Limit+1)
+	}
+
+	taskRuns, err := store.queryTaskRuns(ctx, clause, args...)
+	if err != nil {
+		return nil, err
+	}
+	page := &TaskRunPage{TaskRuns: taskRuns}
+	if filter.Limit > 0 && len(taskRuns) > filter.Limit {
+		page.TaskRuns = taskRuns[:filter.Limit]
+		last := page.TaskRuns[filter.Limit-1]
+		if page.Cursor, err = encodeCursor(taskRunKeyCursor{TaskID: last.TaskID, UUID: last.UUID}); err != nil {
+			return nil, err
+		}
+	}
+	return page, nil
+}
+
+func (store *SQLiteStore) UpdateTaskRunStatus(ctx context.Context, taskRun *TaskRun, newStatus TaskRunStatus) error {
+	result, err := store.db.ExecContext(ctx,
+		"UPDATE task_runs SET status = ? WHERE task_id = ? AND run_uuid = ? AND status <> ?",
+		string(newStatus), taskRun.TaskID, taskRun.UUID, string(TaskRunStatus_Cancelled))
+	if err = checkRowUpdated(result, err); err != nil {
+		return fmt.Errorf("failed to update task run status: %w", err)
+	}
+	return nil
+}
+
+func (store *SQLiteStore) PutTaskRunResults(
+	ctx context.Context,
+	taskRun *TaskRun,
+	results map[string]ResultValue,
+) error {
+	resultsJSON, err := json.Marshal(results)
+	if err != nil {
+		return err
+	}
+	result, err := store.db.ExecContext(ctx,
+		"UPDATE task_runs SET results = ? WHERE task_id = ? AND run_uuid = ?",
+		string(resultsJSON), taskRun.TaskID, taskRun.UUID)
+	if err = checkRowUpdated(result, err); err != nil {
+		return fmt.Errorf("failed to update task run results: %w", err)
+	}
+	return nil
+}
+
+func (store *SQLiteStore) MergeTaskRunResults(
+	ctx context.Context,
+	taskRun *TaskRun,
+	stageName string,
+	results map[string]ResultValue,
+) error {
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var storedResults sql.NullString
+	err = tx.QueryRowContext(ctx,
+		"SELECT results FROM task_runs WHERE task_id = ? AND run_uuid = ?",
+		taskRun.TaskID, taskRun.UUID).Scan(&storedResults)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("failed to merge task run results: %w", ErrConditionFailed)
+	}
+	if err != nil {
+		return err
+	}
+	stored := TaskRun{Results: make(map[string]ResultValue)}
+	if err := unmarshalNullableJSON(storedResults, &stored.Results); err != nil {
+		return fmt.Errorf("failed to unmarshal results of task run %s: %w", taskRun.UUID, err)
+	}
+	if conflicts := findResultConflicts(&stored, stageName, results); len(conflicts) > 0 {
+		return &ResultConflictError{TaskRunUUID: taskRun.UUID, Stage: stageName, Conflicts: conflicts}
+	}
+	for key, result := range results {
+		stored.Results[key] = result
+	}
+
+	resultsJSON, err := json.Marshal(stored.Results)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx,
+		"UPDATE task_runs SET results = ? WHERE task_id = ? AND run_uuid = ?",
+		string(resultsJSON), taskRun.TaskID, taskRun.UUID)
+	if err != nil {
+		return fmt.Errorf("failed to merge task run results: %w", err)
+	}
+	return tx.Commit()
+}
+
+func (store *SQLiteStore) InsertStage(ctx context.Context, stage Stage) error {
+	values, err := stageValues(stage)
+	if err != nil {
+		return err
+	}
+	_, err = store.db.ExecContext(ctx,
+		`INSERT OR REPLACE INTO task_stages (`+stageColumns+`) VALUES (`+stagePlaceholders+`)`, values...)
+	return err
+}
+
+var stagePlaceholders = strings.Repeat("?, ", strings.Count(stageColumns, ",")) + "?"
+
+// stageValues returns the values of stageColumns, the slices and maps are kept as JSON
+func stageValues(stage Stage) ([]any, error) {
+	values := []any{stage.TaskRunUUID, stage.NOrd, stage.Name, stage.Status, stage.Config, stage.Input, stage.Output,
+		formatNullableTime(stage.TStartUTC), formatNullableTime(stage.TFinishUTC), stage.Executor, stage.S3Bucket,
+		stage.Comments, stage.ConfigSHA256, stage.InputSHA256, stage.OutputSHA256}
+	for _, field := range []any{stage.Next, stage.Outputs, stage.OutputsSHA256, stage.OutputNames, stage.InputNames} {
+		data, err := json.Marshal(field)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, string(data))
+	}
+	// Not null, so that AppendStageAttempt can append to it
+	attempts, err := json.Marshal(append([]StageAttempt{}, stage.Attempts...))
+	if err != nil {
+		return nil, err
+	}
+	return append(values, formatNullableTime(stage.THeartbeatUTC), formatNullableTime(stage.TLeaseExpiryUTC),
+		string(attempts), stage.MaxAttempts), nil
+}
+
+func (store *SQLiteStore) GetStage(ctx context.Context, taskRunUUID string, nOrd int) (*Stage, error) {
+	stages, err := store.queryStages(ctx, "WHERE run_uuid = ? AND n_ord = ?", taskRunUUID, nOrd)
+	if err != nil {
+		return nil, err
+	}
+	if len(stages) == 0 {
+		return nil, nil
+	}
+	return &stages[0], nil
+}
+
+func (store *SQLiteStore) GetStageByName(ctx context.Context, taskRunUUID, stageName string) (*Stage, error) {
+	stages, err := store.queryStages(ctx, "WHERE run_uuid = ? AND name = ?", taskRunUUID, stageName)
+	if err != nil {
+		return nil, err
+	}
+	if len(stages) == 0 {
+		return nil, fmt.Errorf("stage '%s' %w in task %s", stageName, ErrNotFound, taskRunUUID)
+	}
+	if len(stages) > 1 {
+		return nil, fmt.Errorf("stage '%s' is %w in task %s", stageName, ErrNotUnique, taskRunUUID)
+	}
+	return &stages[0], nil
+}
+
+func (store *SQLiteStore) DeleteTaskRun(ctx context.Context, taskRun *TaskRun) error {
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM task_stages WHERE run_uuid = ?", taskRun.UUID); err != nil {
+		return fmt.Errorf("failed to delete stages of task run '%s': %w", taskRun.UUID, err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM task_events WHERE run_uuid = ?", taskRun.UUID); err != nil {
+		return fmt.Errorf("failed to delete events of task run '%s': %w", taskRun.UUID, err)
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM task_runs WHERE task_id = ? AND run_uuid = ?", taskRun.TaskID, taskRun.UUID)
+	if err != nil {
+		return fmt.Errorf("failed to delete task run '%s': %w", taskRun.UUID, err)
+	}
+	return tx.Commit()
+}
+
+func (store *SQLiteStore) GetAllStages(ctx context.Context, taskRunUUID string) ([]Stage, error) {
+	stages, err := store.queryStages(ctx, "WHERE run_uuid = ? ORDER BY n_ord", taskRunUUID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query stages: %w", err)
+	}
+	return stages, nil
+}
+
+func (store *SQLiteStore) UpdateStageStatus(ctx context.Context, stage *Stage, newStatus string) error {
+	return store.updateStageStatus(ctx, stage, newStatus, nil, nil)
+}
+
+func (store *SQLiteStore) UpdateStageStatusWithLease(
+	ctx context.Context,
+	stage *Stage,
+	newStatus string,
+	tHeartbeatUTC, tLeaseExpiryUTC time.Time,
+) error {
+	return store.updateStageStatus(ctx, stage, newStatus, &tHeartbeatUTC, &tLeaseExpiryUTC)
+}
+
+func (store *SQLiteStore) updateStageStatus(
+	ctx context.Context,
+	stage *Stage,
+	newStatus string,
+	tHeartbeatUTC, tLeaseExpiryUTC *time.Time,
+) error {
+	result, err := store.db.ExecContext(ctx,
+		`UPDATE task_stages SET status = ?, t_heartbeat_utc = ?, t_lease_expiry_utc = ?
+			WHERE run_uuid = ? AND n_ord = ? AND status = ?`,
+		newStatus, formatNullableTime(tHeartbeatUTC), formatNullableTime(tLeaseExpiryUTC),
+		stage.TaskRunUUID, stage.NOrd, stage.Status)
+	if err = checkRowUpdated(result, err); errors.Is(err, ErrConditionFailed) {
+		stored, errGet := store.GetStage(ctx, stage.TaskRunUUID, stage.NOrd)
+		if errGet == nil && stored != nil {
+			return newStageTransitionError(stage, newStatus, stored.Status)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update stage status: %w", err)
+	}
+	return nil
+}
+
+func (store *SQLiteStore) UpdateStageInput(ctx context.Context, stage *Stage, path, sha256 string) error {
+	return store.updateStageArtifact(ctx, stage, "input", path, sha256)
+}
+
+func (store *SQLiteStore) UpdateStageOutput(ctx context.Context, stage *Stage, path, sha256 string) error {
+	return store.updateStageArtifact(ctx, stage, "output", path, sha256)
+}
+
+func (store *SQLiteStore) UpdateStageComment(ctx context.Context, stage *Stage, comment string) error {
+	return store.updateStage(ctx, stage, "comments", comment)
+}
+
+func (store *SQLiteStore) UpdateStageStartTime(ctx context.Context, stage *Stage, tStartUTC time.Time) error {
+	return store.updateStage(ctx, stage, "t_start_utc", tStartUTC.Format(time.RFC3339))
+}
+
+func (store *SQLiteStore) UpdateStageFinishTime(ctx context.Context, stage *Stage, tFinishUTC time.Time) error {
+	return store.updateStage(ctx, stage, "t_finish_utc", tFinishUTC.Format(time.RFC3339))
+}
+
+func (store *SQLiteStore) UpdateStageLease(
+	ctx context.Context,
+	stage *Stage,
+	tHeartbeatUTC, tLeaseExpiryUTC time.Time,
+) error {
+	result, err := store.db.ExecContext(ctx,
+		`UPDATE task_stages SET t_heartbeat_utc = ?, t_lease_expiry_utc = ?
+			WHERE run_uuid = ? AND n_ord = ? AND status = ? AND t_lease_expiry_utc IS ?`,
+		tHeartbeatUTC.Format(time.RFC3339), tLeaseExpiryUTC.Format(time.RFC3339),
+		stage.TaskRunUUID, stage.NOrd, StageStatus_InProgress, formatNullableTime(stage.TLeaseExpiryUTC))
+	if err = checkRowUpdated(result, err); err != nil {
+		return fmt.Errorf("failed to update stage lease: %w", err)
+	}
+	return nil
+}
+
+func (store *SQLiteStore) AppendStageAttempt(ctx context.Context, stage *Stage, attempt StageAttempt) error {
+	data, err := json.Marshal(attempt)
+	if err != nil {
+		return err
+	}
+	result, err := store.db.ExecContext(ctx,
+		"UPDATE task_stages SET attempts = json_insert(attempts, '$[#]', json(?)) WHERE run_uuid = ? AND n_ord = ?",
+		string(data), stage.TaskRunUUID, stage.NOrd)
+	if err = checkRowUpdated(result, err); err != nil {
+		return fmt.Errorf("failed to append stage attempt: %w", err)
+	}
+	return nil
+}
+
+func (store *SQLiteStore) UpdateStageAttempt(ctx context.Context, stage *Stage, attempt StageAttempt) error {
+	data, err := json.Marshal(attempt)
+	if err != nil {
+		return err
+	}
+	result, err := store.db.ExecContext(ctx,
+		`UPDATE task_stages SET attempts = json_replace(attempts, ?, json(?))
+			WHERE run_uuid = ? AND n_ord = ? AND json_array_length(attempts) >= ?`,
+		fmt.Sprintf("$[%d]", attempt.N-1), string(data), stage.TaskRunUUID, stage.NOrd, attempt.N)
+	if err = checkRowUpdated(result, err); err != nil {
+		return fmt.Errorf("failed to update stage attempt %d: %w", attempt.N, err)
+	}
+	return nil
+}
+
+func (store *SQLiteStore) AppendEvent(ctx context.Context, event TaskEvent) error {
+	_, err := store.db.ExecContext(ctx,
+		`INSERT INTO task_events (run_uuid, event_id, time_utc, stage, type, actor, details)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		event.TaskRunUUID, event.ID, event.TimeUTC.Format(time.RFC3339Nano), event.Stage, event.Type, event.Actor,
+		event.Details)
+	if err != nil {
+		return fmt.Errorf("failed to append event of task run %s: %w", event.TaskRunUUID, err)
+	}
+	return nil
+}
+
+func (store *SQLiteStore) GetRunEvents(ctx context.Context, taskRunUUID string) ([]TaskEvent, error) {
+	rows, err := store.db.QueryContext(ctx,
+		`SELECT run_uuid, event_id, time_utc, stage, type, actor, details
+			FROM task_events WHERE run_uuid = ? ORDER BY event_id`, taskRunUUID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query events: %w", err)
+	}
+	defer rows.Close()
+
+	var events []TaskEvent
+	for rows.Next() {
+		var event TaskEvent
+		var timeUTC string
+		err := rows.Scan(&event.TaskRunUUID, &event.ID, &timeUTC, &event.Stage, &event.Type, &event.Actor,
+			&event.Details)
+		if err != nil {
+			return nil, err
+		}
+		if event.TimeUTC, err = time.Parse(time.RFC3339Nano, timeUTC); err != nil {
+			return nil, fmt.Errorf("failed to parse time %q: %w", timeUTC, err)
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// updateStage NB: column is never user input, it's one of the task_stages columns listed above
+func (store *SQLiteStore) updateStage(ctx context.Context, stage *Stage, column string, value any) error {
+	result, err := store.db.ExecContext(ctx,
+		"UPDATE task_stages SET "+column+" = ? WHERE run_uuid = ? AND n_ord = ?",
+		value, stage.TaskRunUUID, stage.NOrd)
+	if err = checkRowUpdated(result, err); err != nil {
+		return fmt.Errorf("failed to update stage %s: %w", column, err)
+	}
+	return nil
+}
+
+func (store *SQLiteStore) UpdateStageOutputs(ctx context.Context, stage *Stage, outputs, sha256s map[string]string) error {
+	outputsJSON, err := json.Marshal(outputs)
+	if err != nil {
+		return err
+	}
+	sha256sJSON, err := json.Marshal(sha256s)
+	if err != nil {
+		return err
+	}
+	result, err := store.db.ExecContext(ctx,
+		"UPDATE task_stages SET outputs = ?, outputs_sha256 = ? WHERE run_uuid = ? AND n_ord = ?",
+		string(outputsJSON), string(sha256sJSON), stage.TaskRunUUID, stage.NOrd)
+	if err = checkRowUpdated(result, err); err != nil {
+		return fmt.Errorf("failed to update stage outputs: %w", err)
+	}
+	return nil
+}
+
+// updateStageArtifact sets the path of the stage artifact (e.g. "input") together with its digest
+func (store *SQLiteStore) updateStageArtifact(ctx context.Context, stage *Stage, artifact, path, sha256 string) error {
+	result, err := store.db.ExecContext(ctx,
+		"UPDATE task_stages SET "+artifact+" = ?, "+artifact+"_sha256 = ? WHERE run_uuid = ? AND n_ord = ?",
+		path, sha256, stage.TaskRunUUID, stage.NOrd)
+	if err = checkRowUpdated(result, err); err != nil {
+		return fmt.Errorf("failed to update stage %s: %w", artifact, err)
+	}
+	return nil
+}
+
+func (store *SQLiteStore) queryTasks(ctx context.Context, clause string, args ...any) ([]Task, error) {
+	rows, err := store.db.QueryContext(ctx,
+		`SELECT task_id, definition, definition_sha256, s3_bucket, objectives, parameters, pipeline, creation_time
+			FROM tasks `+clause, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tasks []Task
+	for rows.Next() {
+		var task Task
+		var objectives, parameters, pipeline string
+		var creationTime sql.NullString
+		err := rows.Scan(&task.ID, &task.Definition, &task.DefinitionSHA256, &task.S3Bucket,
+			&objectives, &parameters, &pipeline, &creationTime)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(objectives), &task.Objectives); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal objectives of task %s: %w", task.ID, err)
+		}
+		if err := json.Unmarshal([]byte(parameters), &task.Parameters); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal parameters of task %s: %w", task.ID, err)
+		}
+		if err := json.Unmarshal([]byte(pipeline), &task.Pipeline); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal pipeline of task %s: %w", task.ID, err)
+		}
+		if task.CreationTime, err = parseNullableTime(creationTime); err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, rows.Err()
+}
+
+func (store *SQLiteStore) queryTaskRuns(ctx context.Context, clause string, args ...any) ([]TaskRun, error) {
+	rows, err := store.db.QueryContext(ctx,
+		`SELECT task_id, run_uuid, parameters, results, task_definition, creation_time, status
+			FROM task_runs `+clause, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var taskRuns []TaskRun
+	for rows.Next() {
+		var taskRun TaskRun
+		var parameters string
+		var results, creationTime sql.NullString
+		err := rows.Scan(&taskRun.TaskID, &taskRun.UUID, &parameters, &results, &taskRun.TaskDefinition,
+			&creationTime, &taskRun.Status)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(parameters), &taskRun.Parameters); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal parameters of task run %s: %w", taskRun.UUID, err)
+		}
+		if err := unmarshalNullableJSON(results, &taskRun.Results); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal results of task run %s: %w", taskRun.UUID, err)
+		}
+		if taskRun.CreationTime, err = parseNullableTime(creationTime); err != nil {
+			return nil, err
+		}
+		taskRuns = append(taskRuns, taskRun)
+	}
+	return taskRuns, rows.Err()
+}
+
+func (store *SQLiteStore) queryStages(ctx context.Context, clause string, args ...any) ([]Stage, error) {
+	rows, err := store.db.QueryContext(ctx, `SELECT `+stageColumns+` FROM task_stages `+clause, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var stages []Stage
+	for rows.Next() {
+		var stage Stage
+		var tStart, tFinish, tHeartbeat, tLeaseExpiry sql.NullString
+		var next, outputs, outputsSHA256, outputNames, inputNames, attempts string
+		err := rows.Scan(&stage.TaskRunUUID, &stage.NOrd, &stage.Name, &stage.Status, &stage.Config,
+			&stage.Input, &stage.Output, &tStart, &tFinish, &stage.Executor, &stage.S3Bucket, &stage.Comments,
+			&stage.ConfigSHA256, &stage.InputSHA256, &stage.OutputSHA256,
+			&next, &outputs, &outputsSHA256, &outputNames, &inputNames, &tHeartbeat, &tLeaseExpiry,
+			&attempts, &stage.MaxAttempts)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(next), &stage.Next); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal next stages of stage %s: %w", stage.Name, err)
+		}
+		if err := json.Unmarshal([]byte(outputs), &stage.Outputs); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal outputs of stage %s: %w", stage.Name, err)
+		}
+		if err := json.Unmarshal([]byte(outputsSHA256), &stage.OutputsSHA256); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal output digests of stage %s: %w", stage.Name, err)
+		}
+		if err := json.Unmarshal([]byte(outputNames), &stage.OutputNames); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal output names of stage %s: %w", stage.Name, err)
+		}
+		if err := json.Unmarshal([]byte(inputNames), &stage.InputNames); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal input names of stage %s: %w", stage.Name, err)
+		}
+		if err := json.Unmarshal([]byte(attempts), &stage.Attempts); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal attempts of stage %s: %w", stage.Name, err)
+		}
+		if stage.TStartUTC, err = parseNullableTime(tStart); err != nil {
+			return nil, err
+		}
+		if stage.TFinishUTC, err = parseNullableTime(tFinish); err != nil {
+			return nil, err
+		}
+		if stage.THeartbeatUTC, err = parseNullableTime(tHeartbeat); err != nil {
+			return nil, err
+		}
+		if stage.TLeaseExpiryUTC, err = parseNullableTime(tLeaseExpiry); err != nil {
+			return nil, err
+		}
+		stages = append(stages, stage)
+	}
+	return stages, rows.Err()
+}
+
+func (store *SQLiteStore) SendMessage(ctx context.Context, queueName, body string) error {
+	_, err := store.db.ExecContext(ctx,
+		"INSERT INTO queue_messages (queue_name, body) VALUES (?, ?)", queueName, body)
+	return err
+}
+
+func (store *SQLiteStore) ReceiveMessage(
+	ctx context.Context,
+	queueName string,
+	waitTime time.Duration,
+) (*QueueMessage, error) {
+	deadline := time.Now().Add(waitTime)
+	for {
+		now := time.Now()
+		var message QueueMessage
+		err := store.db.QueryRowContext(ctx,
+			`UPDATE queue_messages
+				SET receipt_handle = id || '-' || (receive_count + 1),
+					invisible_until = ?,
+					receive_count = receive_count + 1
+				WHERE id = (
+					SELECT id FROM queue_messages
+					WHERE queue_name = ? AND invisible_until <= ?
+					ORDER BY id LIMIT 1
+				)
+				RETURNING body, receipt_handle`,
+			now.Add(store.VisibilityTimeout).UnixMilli(), queueName, now.UnixMilli(),
+		).Scan(&message.Body, &message.ReceiptHandle)
+		if err == nil {
+			return &message, nil
+		}
+		if err != sql.ErrNoRows {
+			return nil, fmt.Errorf("failed to receive messages, %w", err)
+		}
+
+		remaining := deadline.Sub(now)
+		if remaining <= 0 {
+			return nil, nil
+		}
+		if SleepInterruptibly(ctx, min(remaining, sqlitePollingInterval)) {
+			return nil, fmt.Errorf("failed to receive messages, %w", ctx.Err())
+		}
+	}
+}
+
+func (store *SQLiteStore) DeleteMessage(ctx context.Context, queueName, receiptHandle string) error {
+	result, err := store.db.ExecContext(ctx,
+		"DELETE FROM queue_messages WHERE queue_name = ? AND receipt_handle = ?", queueName, receiptHandle)
+	if err = checkRowUpdated(result, err); err != nil {
+		return fmt.Errorf("failed to delete message from queue %q: %w", queueName, err)
+	}
+	return nil
+}
+
+func (store *SQLiteStore) ChangeMessageVisibility(
+	ctx context.Context,
+	queueName, receiptHandle string,
+	timeout time.Duration,
+) error {
+	result, err := store.db.ExecContext(ctx,
+		"UPDATE queue_messages SET invisible_until = ? WHERE queue_name = ? AND receipt_handle = ?",
+		time.Now().Add(timeout).UnixMilli(), queueName, receiptHandle)
+	if err = checkRowUpdated(result, err); err != nil {
+		return fmt.Errorf("failed to change message visibility: %w", err)
+	}
+	return nil
+}
+
+// CreateQueue does nothing, a queue is just the messages with its name
+func (store *SQLiteStore) CreateQueue(_ context.Context, _ string) error {
+	return nil
+}
+
+func (store *SQLiteStore) DeleteQueue(ctx context.Context, queueName string) error {
+	_, err := store.db.ExecContext(ctx, "DELETE FROM queue_messages WHERE queue_name = ?", queueName)
+	if err != nil {
+		return fmt.Errorf("failed to delete queue %q: %w", queueName, err)
+	}
+	return nil
+}
+
+// ListQueues returns the queues with pending messages only, since a queue is just the messages with its name
+func (store *SQLiteStore) ListQueues(ctx context.Context, prefix string) ([]string, error) {
+	rows, err := store.db.QueryContext(ctx,
+		"SELECT DISTINCT queue_name FROM queue_messages WHERE substr(queue_name, 1, length(?)) = ? ORDER BY queue_name",
+		prefix, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list queues %q: %w", prefix, err)
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// checkRowUpdated mimics DynamoDB condition checks: an update that matched no rows is ErrConditionFailed
+func checkRowUpdated(result sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrConditionFailed
+	}
+	return nil
+}
+
+func marshalNullableJSON[V any](m map[string]V) (sql.NullString, error) {
+	if m == nil {
+		return sql.NullString{}, nil
+	}
+	data, err := json.Marshal(m)
+	return sql.NullString{String: string(data), Valid: err == nil}, err
+}
+
+func unmarshalNullableJSON(data sql.NullString, v any) error {
+	if !data.Valid {
+		return nil
+	}
+	return json.Unmarshal([]byte(data.String), v)
+}
+
+func formatNullableTime(t *time.Time) sql.NullString {
+	if t == nil {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: t.Format(time.RFC3339), Valid: true}
+}
+
+func parseNullableTime(s sql.NullString) (*time.Time, error) {
+	if !s.Valid {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, s.String)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse time %q: %w", s.String, err)
+	}
+	return &t, nil
+}
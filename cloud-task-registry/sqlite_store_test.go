@@ -0,0 +1,255 @@
+package cloud_task_registry
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSQLiteStore_MustRoundTripTaskRunsAndStagesWithDynamoDBSemantics(t *testing.T) {
+	// given
+	ctx := context.Background()
+	store, err := NewSQLiteStore(filepath.Join(t.TempDir(), "registry.db"))
+	require.NoError(t, err)
+	defer store.Close()
+	registry, err := New("", WithTaskStore(store), WithMessageQueue(store), WithArtifactStore(NewMemoryArtifactStore()))
+	require.NoError(t, err)
+	creationTime := time.Date(2025, 8, 16, 23, 55, 24, 0, time.UTC)
+	taskRun := TaskRun{
+		TaskID: "task", UUID: "run-1", Parameters: map[string]string{"beta": "0.3"},
+		CreationTime: &creationTime, Status: TaskRunStatus_Submitted,
+	}
+	stage := Stage{TaskRunUUID: "run-1", NOrd: 1, Name: "cfd", Status: StageInitialStatus, Next: []string{"cfd-reader"}}
+	require.NoError(t, registry.InsertTaskRun(ctx, taskRun))
+	require.NoError(t, registry.InsertStage(ctx, stage))
+	// when
+	require.NoError(t, registry.PutTaskRunResults(ctx, &taskRun,
+		map[string]ResultValue{"lift_to_drag": {Value: 7.7, Status: ResultStatus_OK}}))
+	require.NoError(t, registry.UpdateStageStatus(ctx, &stage, StageStatus_InProgress))
+	require.NoError(t, registry.UpdateTaskRunStatus(ctx, &taskRun, TaskRunStatus_Cancelled))
+	errCancelled := registry.UpdateTaskRunStatus(ctx, &taskRun, TaskRunStatus_Finished)
+	errAbsentStage := registry.UpdateStageStatus(ctx, &Stage{TaskRunUUID: "run-1", NOrd: 2}, StageStatus_Success)
+	_, errNotFound := registry.GetStageByName(ctx, "run-1", "mesh")
+	// then
+	assert.ErrorIs(t, errCancelled, ErrConditionFailed)
+	assert.ErrorIs(t, errAbsentStage, ErrConditionFailed)
+	assert.ErrorIs(t, errNotFound, ErrNotFound)
+	storedTaskRun, err := registry.GetTaskRun(ctx, "run-1")
+	require.NoError(t, err)
+	assert.Equal(t, TaskRunStatus_Cancelled, storedTaskRun.Status)
+	assert.Equal(t, map[string]ResultValue{"lift_to_drag": {Value: 7.7, Status: ResultStatus_OK}}, storedTaskRun.Results)
+	assert.Equal(t, creationTime, *storedTaskRun.CreationTime)
+	storedStage, err := registry.GetStageByName(ctx, "run-1", "cfd")
+	require.NoError(t, err)
+	assert.Equal(t, StageStatus_InProgress, storedStage.Status)
+	assert.Equal(t, []string{"cfd-reader"}, storedStage.Next)
+}
+
+func TestSQLiteStore_MustHideReceivedMessageUntilVisibilityTimeoutExpires(t *testing.T) {
+	// given
+	ctx := context.Background()
+	store, err := NewSQLiteStore(filepath.Join(t.TempDir(), "registry.db"))
+	require.NoError(t, err)
+	defer store.Close()
+	store.VisibilityTimeout = 200 * time.Millisecond
+	require.NoError(t, store.SendMessage(ctx, "cfd", "run-1"))
+	first, err := store.ReceiveMessage(ctx, "cfd", 0)
+	require.NoError(t, err)
+	require.NotNil(t, first)
+	// when
+	hidden, err := store.ReceiveMessage(ctx, "cfd", 0)
+	require.NoError(t, err)
+	redelivered, err := store.ReceiveMessage(ctx, "cfd", 2*time.Second)
+	require.NoError(t, err)
+	require.NotNil(t, redelivered)
+	errStaleHandle := store.DeleteMessage(ctx, "cfd", first.ReceiptHandle)
+	require.NoError(t, store.DeleteMessage(ctx, "cfd", redelivered.ReceiptHandle))
+	// then
+	assert.Nil(t, hidden)
+	assert.Equal(t, "run-1", redelivered.Body)
+	assert.ErrorIs(t, errStaleHandle, ErrConditionFailed)
+}
+
+func TestSQLiteStore_MustApplyMigrationsOnlyOnce(t *testing.T) {
+	// given
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "registry.db")
+	store, err := NewSQLiteStore(path)
+	require.NoError(t, err)
+	require.NoError(t, store.InsertTaskRun(ctx, TaskRun{TaskID: "task", UUID: "run-1", Status: TaskRunStatus_Submitted}))
+	require.NoError(t, store.Close())
+	// when
+	reopened, err := NewSQLiteStore(path)
+	require.NoError(t, err)
+	defer reopened.Close()
+	errMigrateAgain := reopened.Migrate(ctx)
+	// then
+	require.NoError(t, errMigrateAgain)
+	var version int
+	require.NoError(t, reopened.db.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version))
+	assert.Equal(t, len(sqliteMigrations), version)
+	_, err = reopened.GetTaskRun(ctx, "run-1")
+	assert.NoError(t, err)
+}
+
+func TestSQLiteStore_MustRoundTripTasksAndRejectDuplicates(t *testing.T) {
+	// given
+	ctx := context.Background()
+	store, err := NewSQLiteStore(filepath.Join(t.TempDir(), "registry.db"))
+	require.NoError(t, err)
+	defer store.Close()
+	lower, upper := 0.0, 0.5
+	creationTime := time.Date(2025, 8, 16, 23, 55, 24, 0, time.UTC)
+	task := Task{
+		ID: "task", Definition: "task-registry/task/optimization.in", DefinitionSHA256: "abc", S3Bucket: "bucket",
+		Objectives:   []string{"lift", "drag"},
+		Parameters:   []ParameterSpec{{Name: "beta", Lower: &lower, Upper: &upper}, {Name: "gamma"}},
+		Pipeline:     []PipelineStage{{Name: "cfd", Next: []string{"cfd-reader"}}, {Name: "cfd-reader"}},
+		CreationTime: &creationTime,
+	}
+	require.NoError(t, store.InsertTask(ctx, task))
+	// when
+	errDuplicate := store.InsertTask(ctx, Task{ID: "task"})
+	stored, err := store.GetTask(ctx, "task")
+	require.NoError(t, err)
+	tasks, err := store.ListTasks(ctx)
+	require.NoError(t, err)
+	_, errNotFound := store.GetTask(ctx, "other")
+	// then
+	assert.ErrorIs(t, errDuplicate, ErrConditionFailed)
+	assert.Equal(t, task, *stored)
+	assert.Equal(t, []Task{task}, tasks)
+	assert.ErrorIs(t, errNotFound, ErrNotFound)
+}
+
+func TestCreateTaskRunWithStages_MustRollBackAndDeleteConfigsOnConflict(t *testing.T) {
+	// given
+	ctx := context.Background()
+	store, err := NewSQLiteStore(filepath.Join(t.TempDir(), "registry.db"))
+	require.NoError(t, err)
+	defer store.Close()
+	artifacts := NewMemoryArtifactStore()
+	registry, err := New("", WithTaskStore(store), WithMessageQueue(store), WithArtifactStore(artifacts))
+	require.NoError(t, err)
+	require.NoError(t, registry.InsertStage(ctx, Stage{TaskRunUUID: "run-1", NOrd: 2, Name: "leftover"}))
+	require.NoError(t, artifacts.PutObject(ctx, "bucket", "task-registry/task/run-1/1_cfd/cfd.cfg",
+		strings.NewReader("config"), StorageClass_Standard, nil))
+	taskRun := TaskRun{TaskID: "task", UUID: "run-1", Status: TaskRunStatus_Submitted}
+	stages := []Stage{
+		{TaskRunUUID: "run-1", NOrd: 1, Name: "cfd", Config: "task-registry/task/run-1/1_cfd/cfd.cfg", S3Bucket: "bucket"},
+		{TaskRunUUID: "run-1", NOrd: 2, Name: "cfd-reader"},
+	}
+	// when
+	errConflict := registry.CreateTaskRunWithStages(ctx, taskRun, stages)
+	errCreate := registry.CreateTaskRunWithStages(ctx, TaskRun{TaskID: "task", UUID: "run-2"},
+		[]Stage{{TaskRunUUID: "run-2", NOrd: 1, Name: "cfd"}, {TaskRunUUID: "run-2", NOrd: 2, Name: "cfd-reader"}})
+	// then
+	assert.ErrorIs(t, errConflict, ErrConditionFailed)
+	_, err = registry.GetTaskRun(ctx, "run-1")
+	assert.ErrorIs(t, err, ErrNotFound)
+	storedStage, err := registry.GetStage(ctx, "run-1", 1)
+	require.NoError(t, err)
+	assert.Nil(t, storedStage)
+	_, err = artifacts.GetObject(ctx, "bucket", "task-registry/task/run-1/1_cfd/cfd.cfg")
+	assert.Error(t, err)
+	require.NoError(t, errCreate)
+	createdStages, err := registry.GetAllStages(ctx, "run-2")
+	require.NoError(t, err)
+	assert.Len(t, createdStages, 2)
+}
+
+func TestSQLiteStore_MustMergeResultsOfStagesAndRejectConflictingOnes(t *testing.T) {
+	// given
+	ctx := context.Background()
+	store, err := NewSQLiteStore(filepath.Join(t.TempDir(), "registry.db"))
+	require.NoError(t, err)
+	defer store.Close()
+	registry, err := New("", WithTaskStore(store), WithMessageQueue(store), WithArtifactStore(NewMemoryArtifactStore()))
+	require.NoError(t, err)
+	taskRun := TaskRun{TaskID: "task", UUID: "run-1", Status: TaskRunStatus_Submitted}
+	require.NoError(t, registry.InsertTaskRun(ctx, taskRun))
+	// when
+	require.NoError(t, registry.MergeTaskRunResults(ctx, &taskRun, "mass-estimation",
+		map[string]ResultValue{"mass": {Value: 42, Unit: "kg", Status: ResultStatus_OK}}))
+	require.NoError(t, registry.MergeTaskRunResults(ctx, &taskRun, "cfd",
+		map[string]ResultValue{"lift_to_drag": {Value: 7.7, Status: ResultStatus_OK}}))
+	errRerun := registry.MergeTaskRunResults(ctx, &taskRun, "cfd",
+		map[string]ResultValue{"lift_to_drag": {Value: math.NaN(), Status: ResultStatus_Failed}})
+	errConflict := registry.MergeTaskRunResults(ctx, &taskRun, "cfd",
+		map[string]ResultValue{"mass": {Value: 41, Status: ResultStatus_OK}, "drag": {Value: 1, Status: ResultStatus_OK}})
+	errAbsent := registry.MergeTaskRunResults(ctx, &TaskRun{TaskID: "task", UUID: "run-2"}, "cfd",
+		map[string]ResultValue{"mass": {Value: 1, Status: ResultStatus_OK}})
+	// then
+	require.NoError(t, errRerun)
+	var conflictErr *ResultConflictError
+	require.ErrorAs(t, errConflict, &conflictErr)
+	assert.Equal(t, map[string]string{"mass": "mass-estimation"}, conflictErr.Conflicts)
+	assert.ErrorIs(t, errConflict, ErrResultConflict)
+	assert.ErrorIs(t, errAbsent, ErrConditionFailed)
+	storedTaskRun, err := registry.GetTaskRun(ctx, "run-1")
+	require.NoError(t, err)
+	assert.Equal(t, ResultValue{Value: 42, Unit: "kg", Status: ResultStatus_OK, Stage: "mass-estimation"},
+		storedTaskRun.Results["mass"])
+	assert.Equal(t, ResultStatus_Failed, storedTaskRun.Results["lift_to_drag"].Status)
+	assert.True(t, math.IsNaN(storedTaskRun.Results["lift_to_drag"].Value))
+	assert.Equal(t, "cfd", storedTaskRun.Results["lift_to_drag"].Stage)
+}
+
+func TestSQLiteStore_MustPageThroughTaskRunsFilteredByStatusAndCreationTime(t *testing.T) {
+	// given
+	ctx := context.Background()
+	store, err := NewSQLiteStore(filepath.Join(t.TempDir(), "registry.db"))
+	require.NoError(t, err)
+	defer store.Close()
+	registry, err := New("", WithTaskStore(store), WithMessageQueue(store), WithArtifactStore(NewMemoryArtifactStore()))
+	require.NoError(t, err)
+	start := time.Date(2025, 8, 16, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		creationTime := start.Add(time.Duration(i) * time.Hour)
+		status := TaskRunStatus_Finished
+		if i%3 == 0 {
+			status = TaskRunStatus_Failed
+		}
+		require.NoError(t, registry.InsertTaskRun(ctx, TaskRun{
+			TaskID: "doe", UUID: fmt.Sprintf("run-%d", i), CreationTime: &creationTime, Status: status,
+		}))
+	}
+	require.NoError(t, registry.InsertTaskRun(ctx, TaskRun{TaskID: "other", UUID: "run-x", Status: TaskRunStatus_Finished}))
+	createdAfter, createdBefore := start.Add(time.Hour), start.Add(8*time.Hour)
+	filter := TaskRunFilter{
+		TaskID:        "doe",
+		Statuses:      []TaskRunStatus{TaskRunStatus_Finished},
+		CreatedAfter:  &createdAfter,
+		CreatedBefore: &createdBefore,
+		Limit:         2,
+	}
+	// when
+	var pages [][]string
+	for {
+		page, err := registry.ListTaskRuns(ctx, filter)
+		require.NoError(t, err)
+		var uuids []string
+		for _, taskRun := range page.TaskRuns {
+			uuids = append(uuids, taskRun.UUID)
+		}
+		pages = append(pages, uuids)
+		if page.Cursor == "" {
+			break
+		}
+		filter.Cursor = page.Cursor
+	}
+	all, errAll := registry.ListAllTaskRuns(ctx, TaskRunFilter{Limit: 4})
+	_, errCursor := registry.ListTaskRuns(ctx, TaskRunFilter{Cursor: "not a cursor"})
+	// then
+	assert.Equal(t, [][]string{{"run-1", "run-2"}, {"run-4", "run-5"}, {"run-7"}}, pages)
+	require.NoError(t, errAll)
+	assert.Len(t, all, 11)
+	assert.Error(t, errCursor)
+}
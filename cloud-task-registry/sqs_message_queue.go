@@ -0,0 +1,163 @@
+package cloud_task_registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// SQSMessageQueue passes messages via SQS-compatible queues (Yandex Message Queue by default)
+type SQSMessageQueue struct {
+	client *sqs.Client
+}
+
+func NewSQSMessageQueue(serviceConfig ServiceConfig) (*SQSMessageQueue, error) {
+	configForSQS, err := loadAwsConfig(serviceConfig)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load SDK config for SQS, %w", err)
+	}
+	return &SQSMessageQueue{client: sqs.NewFromConfig(configForSQS)}, nil
+}
+
+func (q *SQSMessageQueue) SendMessage(ctx context.Context, queueName, body string) error {
+	queueUrl, err := q.getQueueUrl(ctx, queueName)
+	if err != nil {
+		return queueNotFound(queueName, err)
+	}
+	_, err = q.client.SendMessage(ctx, &sqs.SendMessageInput{
+		QueueUrl:    aws.String(queueUrl),
+		MessageBody: aws.String(body),
+	})
+	// The queue may have been deleted after its URL was cached by the service
+	return queueNotFound(queueName, err)
+}
+
+func (q *SQSMessageQueue) ReceiveMessage(
+	ctx context.Context,
+	queueName string,
+	waitTime time.Duration,
+) (*QueueMessage, error) {
+	queueUrl, err := q.getQueueUrl(ctx, queueName)
+	if err != nil {
+		return nil, err
+	}
+	output, err := q.client.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+		QueueUrl:            aws.String(queueUrl),
+		MaxNumberOfMessages: 1,
+		WaitTimeSeconds:     int32(waitTime.Seconds()),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to receive messages, %w", err)
+	}
+	if len(output.Messages) == 0 {
+		return nil, nil
+	}
+	return &QueueMessage{
+		Body:          aws.ToString(output.Messages[0].Body),
+		ReceiptHandle: aws.ToString(output.Messages[0].ReceiptHandle),
+	}, nil
+}
+
+func (q *SQSMessageQueue) DeleteMessage(ctx context.Context, queueName, receiptHandle string) error {
+	queueUrl, err := q.getQueueUrl(ctx, queueName)
+	if err != nil {
+		return err
+	}
+	_, err = q.client.DeleteMessage(ctx, &sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(queueUrl),
+		ReceiptHandle: aws.String(receiptHandle),
+	})
+	return err
+}
+
+func (q *SQSMessageQueue) ChangeMessageVisibility(
+	ctx context.Context,
+	queueName, receiptHandle string,
+	timeout time.Duration,
+) error {
+	queueUrl, err := q.getQueueUrl(ctx, queueName)
+	if err != nil {
+		return err
+	}
+
+	input := &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(queueUrl),
+		ReceiptHandle:     aws.String(receiptHandle),
+		VisibilityTimeout: int32(timeout.Seconds()),
+	}
+
+	_, err = q.client.ChangeMessageVisibility(ctx, input)
+	if err != nil {
+		return fmt.Errorf("failed to change message visibility: %w", err)
+	}
+	return nil
+}
+
+// CreateQueue creates a standard queue with the default attributes, it succeeds if the queue exists already
+func (q *SQSMessageQueue) CreateQueue(ctx context.Context, queueName string) error {
+	_, err := q.client.CreateQueue(ctx, &sqs.CreateQueueInput{
+		QueueName: aws.String(queueName),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create SQS queue %q, %w", queueName, err)
+	}
+	return nil
+}
+
+func (q *SQSMessageQueue) DeleteQueue(ctx context.Context, queueName string) error {
+	queueUrl, err := q.getQueueUrl(ctx, queueName)
+	var doesNotExist *types.QueueDoesNotExist
+	if errors.As(err, &doesNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = q.client.DeleteQueue(ctx, &sqs.DeleteQueueInput{
+		QueueUrl: aws.String(queueUrl),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete SQS queue %q, %w", queueName, err)
+	}
+	return nil
+}
+
+func (q *SQSMessageQueue) ListQueues(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+	paginator := sqs.NewListQueuesPaginator(q.client, &sqs.ListQueuesInput{QueueNamePrefix: aws.String(prefix)})
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list SQS queues %q, %w", prefix, err)
+		}
+		for _, queueUrl := range output.QueueUrls {
+			names = append(names, path.Base(queueUrl))
+		}
+	}
+	return names, nil
+}
+
+func (q *SQSMessageQueue) getQueueUrl(ctx context.Context, queueName string) (string, error) {
+	result, err := q.client.GetQueueUrl(ctx, &sqs.GetQueueUrlInput{
+		QueueName: aws.String(queueName),
+	})
+	if err != nil {
+		return "", fmt.Errorf("error getting SQS queue URL for name %q, %w", queueName, err)
+	}
+	return *result.QueueUrl, nil
+}
+
+// queueNotFound tells an absent queue by ErrNotFound
+func queueNotFound(queueName string, err error) error {
+	var doesNotExist *types.QueueDoesNotExist
+	if errors.As(err, &doesNotExist) {
+		return fmt.Errorf("SQS queue %q %w, %w", queueName, ErrNotFound, err)
+	}
+	return err
+}
@@ -0,0 +1,50 @@
+package cloud_task_registry
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// AttemptsExhausted tells whether the stage must not be started again, as it has been attempted MaxAttempts times
+func AttemptsExhausted(stage *Stage) bool {
+	return stage.MaxAttempts > 0 && len(stage.Attempts) >= stage.MaxAttempts
+}
+
+// StartStageAttempt records a new attempt of the stage by the executor (an instance of the connector)
+// and appends it to stage.Attempts on success
+func (registry *CloudTaskRegistry) StartStageAttempt(ctx context.Context, stage *Stage, executor string) (StageAttempt, error) {
+	// DynamoDB keeps times in RFC3339, i.e. with seconds precision
+	tStart := time.Now().UTC().Truncate(time.Second)
+	attempt := StageAttempt{
+		N:         len(stage.Attempts) + 1,
+		Status:    StageStatus_InProgress,
+		TStartUTC: &tStart,
+		Executor:  executor,
+	}
+	if err := registry.tasks.AppendStageAttempt(ctx, stage, attempt); err != nil {
+		return StageAttempt{}, err
+	}
+	stage.Attempts = append(stage.Attempts, attempt)
+	return attempt, nil
+}
+
+// FinishStageAttempt records the outcome of the attempt with the given status, and sets it to stage.Attempts
+// on success. The attempt must have been started by StartStageAttempt.
+func (registry *CloudTaskRegistry) FinishStageAttempt(
+	ctx context.Context,
+	stage *Stage,
+	attempt StageAttempt,
+	status string,
+) error {
+	if attempt.N < 1 || attempt.N > len(stage.Attempts) {
+		return fmt.Errorf("attempt %d of stage %s of task run %s %w", attempt.N, stage.Name, stage.TaskRunUUID, ErrNotFound)
+	}
+	tFinish := time.Now().UTC().Truncate(time.Second)
+	attempt.Status, attempt.TFinishUTC = status, &tFinish
+	if err := registry.tasks.UpdateStageAttempt(ctx, stage, attempt); err != nil {
+		return err
+	}
+	stage.Attempts[attempt.N-1] = attempt
+	return nil
+}
@@ -0,0 +1,56 @@
+package cloud_task_registry
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStageAttempts_MustKeepHistoryOfAttemptsUntilExhausted(t *testing.T) {
+	sqliteStore, err := NewSQLiteStore(filepath.Join(t.TempDir(), "registry.db"))
+	require.NoError(t, err)
+	defer sqliteStore.Close()
+	stores := map[string]TaskStore{"memory": NewMemoryTaskStore(), "sqlite": sqliteStore}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			// given
+			ctx := context.Background()
+			registry, err := New("", WithTaskStore(store), WithMessageQueue(NewMemoryMessageQueue()),
+				WithArtifactStore(NewMemoryArtifactStore()))
+			require.NoError(t, err)
+			require.NoError(t, registry.InsertStage(ctx,
+				Stage{TaskRunUUID: "run-1", NOrd: 1, Name: "cfd", Status: StageInitialStatus, MaxAttempts: 2}))
+			stage, err := registry.GetStage(ctx, "run-1", 1)
+			require.NoError(t, err)
+			exitCode := 137
+			// when
+			first, errFirst := registry.StartStageAttempt(ctx, stage, "connector-a")
+			first.ExitCode, first.Error = &exitCode, "subprocess failed with error, exit-code 137"
+			errFinishFirst := registry.FinishStageAttempt(ctx, stage, first, StageStatus_Error)
+			exhaustedAfterFirst := AttemptsExhausted(stage)
+			second, errSecond := registry.StartStageAttempt(ctx, stage, "connector-b")
+			second.Artifacts = []string{"task-registry/task/run-1/1_cfd/out.7z"}
+			errFinishSecond := registry.FinishStageAttempt(ctx, stage, second, StageStatus_Success)
+			errAbsent := store.UpdateStageAttempt(ctx, stage, StageAttempt{N: 3})
+			// then
+			require.NoError(t, errFirst)
+			require.NoError(t, errFinishFirst)
+			require.NoError(t, errSecond)
+			require.NoError(t, errFinishSecond)
+			assert.ErrorIs(t, errAbsent, ErrConditionFailed)
+			assert.False(t, exhaustedAfterFirst)
+			stored, err := registry.GetStage(ctx, "run-1", 1)
+			require.NoError(t, err)
+			assert.Equal(t, stage.Attempts, stored.Attempts)
+			require.Len(t, stored.Attempts, 2)
+			assert.Equal(t, 137, *stored.Attempts[0].ExitCode)
+			assert.Equal(t, StageStatus_Error, stored.Attempts[0].Status)
+			assert.Equal(t, "connector-b", stored.Attempts[1].Executor)
+			assert.NotNil(t, stored.Attempts[1].TFinishUTC)
+			assert.True(t, AttemptsExhausted(stored))
+		})
+	}
+}
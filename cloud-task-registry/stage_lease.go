@@ -0,0 +1,66 @@
+package cloud_task_registry
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// DefaultStageLease is how long a stage in progress is deemed alive after the last heartbeat of its connector
+const DefaultStageLease = 3 * time.Minute
+
+// IsStageLeaseExpired tells whether the stage is InProgress but its connector hasn't renewed the lease in time,
+// i.e. the executor is presumably dead. Stages started without a lease (by older connectors) never expire.
+func IsStageLeaseExpired(stage *Stage, now time.Time) bool {
+	return stage.Status == StageStatus_InProgress && stage.TLeaseExpiryUTC != nil && now.After(*stage.TLeaseExpiryUTC)
+}
+
+// RenewStageLease records a heartbeat of the stage and extends its lease by the given duration, and sets them
+// to stage on success. It fails with ErrConditionFailed if the stage is not InProgress anymore or its lease has been
+// renewed by someone else meanwhile, i.e. another connector has taken the stage over.
+func (registry *CloudTaskRegistry) RenewStageLease(ctx context.Context, stage *Stage, lease time.Duration) error {
+	// The stores keep times with seconds precision, the lease is compared with the stored one on the next renewal
+	heartbeat := time.Now().UTC().Truncate(time.Second)
+	expiry := heartbeat.Add(lease)
+	if err := registry.tasks.UpdateStageLease(ctx, stage, heartbeat, expiry); err != nil {
+		return err
+	}
+	stage.THeartbeatUTC, stage.TLeaseExpiryUTC = &heartbeat, &expiry
+	return nil
+}
+
+// StartStageWithLease moves the stage to InProgress and takes its lease for the given duration in a single
+// compare-and-set, so that no duplicate delivery can see the stage InProgress with the expired lease of a previous
+// attempt and take it over in between. It fails like UpdateStageStatus if the status has changed meanwhile.
+func (registry *CloudTaskRegistry) StartStageWithLease(ctx context.Context, stage *Stage, lease time.Duration) error {
+	if !CanTransitionStage(stage.Status, StageStatus_InProgress) {
+		return newStageTransitionError(stage, StageStatus_InProgress, "")
+	}
+	heartbeat := time.Now().UTC().Truncate(time.Second)
+	expiry := heartbeat.Add(lease)
+	err := registry.tasks.UpdateStageStatusWithLease(ctx, stage, StageStatus_InProgress, heartbeat, expiry)
+	if err != nil {
+		return err
+	}
+	registry.recordEvent(ctx, stage.TaskRunUUID, stage.Name, EventType_StageStatus,
+		stage.Status+" -> "+StageStatus_InProgress)
+	stage.Status = StageStatus_InProgress
+	stage.THeartbeatUTC, stage.TLeaseExpiryUTC = &heartbeat, &expiry
+	return nil
+}
+
+// TakeOverStage takes the lease of a stage whose executor is presumably dead (see IsStageLeaseExpired),
+// so that a redelivery of the task run can run the stage again. It fails with ErrTransitionConflict if the lease
+// hasn't expired, or if another connector has renewed or taken the lease meanwhile.
+func (registry *CloudTaskRegistry) TakeOverStage(ctx context.Context, stage *Stage, lease time.Duration) error {
+	if !IsStageLeaseExpired(stage, time.Now()) {
+		return fmt.Errorf("stage %d of task run %s is %s and its lease hasn't expired, %w",
+			stage.NOrd, stage.TaskRunUUID, stage.Status, ErrTransitionConflict)
+	}
+	if err := registry.RenewStageLease(ctx, stage, lease); err != nil {
+		return fmt.Errorf("failed to take over stage %d of task run %s, %w: %w",
+			stage.NOrd, stage.TaskRunUUID, ErrTransitionConflict, err)
+	}
+	registry.recordEvent(ctx, stage.TaskRunUUID, stage.Name, EventType_Handover, "taken over, the lease had expired")
+	return nil
+}
@@ -0,0 +1,94 @@
+package cloud_task_registry
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTakeOverStage_MustTakeOnlyExpiredLeaseAndFenceOffPreviousOwner(t *testing.T) {
+	sqliteStore, err := NewSQLiteStore(filepath.Join(t.TempDir(), "registry.db"))
+	require.NoError(t, err)
+	defer sqliteStore.Close()
+	stores := map[string]TaskStore{"memory": NewMemoryTaskStore(), "sqlite": sqliteStore}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			// given
+			ctx := context.Background()
+			registry, err := New("", WithTaskStore(store), WithMessageQueue(NewMemoryMessageQueue()),
+				WithArtifactStore(NewMemoryArtifactStore()))
+			require.NoError(t, err)
+			require.NoError(t, registry.InsertStage(ctx, Stage{TaskRunUUID: "run-1", NOrd: 1, Name: "cfd", Status: StageInitialStatus}))
+			dead, err := registry.GetStage(ctx, "run-1", 1)
+			require.NoError(t, err)
+			require.NoError(t, registry.UpdateStageStatus(ctx, dead, StageStatus_InProgress))
+			require.NoError(t, registry.RenewStageLease(ctx, dead, -time.Minute))
+			redelivered, err := registry.GetStage(ctx, "run-1", 1)
+			require.NoError(t, err)
+			duplicate, err := registry.GetStage(ctx, "run-1", 1)
+			require.NoError(t, err)
+			// when
+			expired := IsStageLeaseExpired(redelivered, time.Now())
+			errTakeOver := registry.TakeOverStage(ctx, redelivered, time.Minute)
+			errDuplicate := registry.TakeOverStage(ctx, duplicate, time.Minute)
+			errDeadRenewal := registry.RenewStageLease(ctx, dead, time.Minute)
+			errRenewal := registry.RenewStageLease(ctx, redelivered, time.Minute)
+			// then
+			assert.True(t, expired)
+			require.NoError(t, errTakeOver)
+			assert.ErrorIs(t, errDuplicate, ErrTransitionConflict)
+			assert.ErrorIs(t, errDeadRenewal, ErrConditionFailed)
+			require.NoError(t, errRenewal)
+			stored, err := registry.GetStage(ctx, "run-1", 1)
+			require.NoError(t, err)
+			assert.Equal(t, redelivered.TLeaseExpiryUTC, stored.TLeaseExpiryUTC)
+			assert.False(t, IsStageLeaseExpired(stored, time.Now()))
+			require.NoError(t, registry.UpdateStageStatus(ctx, redelivered, StageStatus_Success))
+			assert.ErrorIs(t, registry.RenewStageLease(ctx, redelivered, time.Minute), ErrConditionFailed)
+		})
+	}
+}
+
+func TestStartStageWithLease_MustLeaveNoExpiredLeaseToTakeOverWhenRetryingStage(t *testing.T) {
+	sqliteStore, err := NewSQLiteStore(filepath.Join(t.TempDir(), "registry.db"))
+	require.NoError(t, err)
+	defer sqliteStore.Close()
+	stores := map[string]TaskStore{"memory": NewMemoryTaskStore(), "sqlite": sqliteStore}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			// given
+			ctx := context.Background()
+			registry, err := New("", WithTaskStore(store), WithMessageQueue(NewMemoryMessageQueue()),
+				WithArtifactStore(NewMemoryArtifactStore()))
+			require.NoError(t, err)
+			require.NoError(t, registry.InsertStage(ctx, Stage{TaskRunUUID: "run-1", NOrd: 1, Name: "cfd", Status: StageInitialStatus}))
+			failed, err := registry.GetStage(ctx, "run-1", 1)
+			require.NoError(t, err)
+			require.NoError(t, registry.StartStageWithLease(ctx, failed, -time.Minute))
+			require.NoError(t, registry.UpdateStageStatus(ctx, failed, StageStatus_Error))
+			retry, err := registry.GetStage(ctx, "run-1", 1)
+			require.NoError(t, err)
+			duplicate, err := registry.GetStage(ctx, "run-1", 1)
+			require.NoError(t, err)
+			// when
+			errRetry := registry.StartStageWithLease(ctx, retry, time.Minute)
+			errDuplicate := registry.StartStageWithLease(ctx, duplicate, time.Minute)
+			lateDuplicate, err := registry.GetStage(ctx, "run-1", 1)
+			require.NoError(t, err)
+			errLateDuplicate := registry.TakeOverStage(ctx, lateDuplicate, time.Minute)
+			errRenewal := registry.RenewStageLease(ctx, retry, time.Minute)
+			// then
+			assert.Nil(t, failed.TLeaseExpiryUTC)
+			require.NoError(t, errRetry)
+			assert.ErrorIs(t, errDuplicate, ErrTransitionConflict)
+			assert.False(t, IsStageLeaseExpired(lateDuplicate, time.Now()))
+			assert.ErrorIs(t, errLateDuplicate, ErrTransitionConflict)
+			require.NoError(t, errRenewal)
+			assert.Equal(t, StageStatus_InProgress, retry.Status)
+		})
+	}
+}
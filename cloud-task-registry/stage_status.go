@@ -0,0 +1,53 @@
+package cloud_task_registry
+
+import (
+	"fmt"
+	"slices"
+)
+
+// stageTransitions lists the statuses a stage may move to from each status.
+// Success and Cancelled are final, so there is no way out of them.
+var stageTransitions = map[string][]string{
+	StageStatus_Pending:    {StageStatus_InProgress, StageStatus_Error, StageStatus_Cancelled},
+	StageStatus_InProgress: {StageStatus_Success, StageStatus_Error, StageStatus_Cancelled},
+	// A failed stage is started again when SQS redelivers the task run
+	StageStatus_Error: {StageStatus_InProgress, StageStatus_Cancelled},
+}
+
+// CanTransitionStage tells whether a stage with status "from" may be moved to status "to"
+func CanTransitionStage(from, to string) bool {
+	return slices.Contains(stageTransitions[from], to)
+}
+
+// StageTransitionError is returned when a stage status can't be changed, either because the transition is not
+// allowed or because the stored status is not the expected one anymore (e.g. another connector has taken the stage
+// after a duplicate SQS delivery). It matches both ErrTransitionConflict and ErrConditionFailed with errors.Is.
+type StageTransitionError struct {
+	TaskRunUUID string
+	NOrd        int
+	From        string // status the stage was expected to have
+	To          string
+	Actual      string // stored status, if known
+}
+
+func (e *StageTransitionError) Error() string {
+	if e.Actual != "" && e.Actual != e.From {
+		return fmt.Sprintf("stage %d of task run %s can't be moved from %s to %s: it is %s already",
+			e.NOrd, e.TaskRunUUID, e.From, e.To, e.Actual)
+	}
+	return fmt.Sprintf("stage %d of task run %s can't be moved from %s to %s", e.NOrd, e.TaskRunUUID, e.From, e.To)
+}
+
+func (e *StageTransitionError) Is(target error) bool {
+	return target == ErrTransitionConflict || target == ErrConditionFailed
+}
+
+func newStageTransitionError(stage *Stage, newStatus, actualStatus string) *StageTransitionError {
+	return &StageTransitionError{
+		TaskRunUUID: stage.TaskRunUUID,
+		NOrd:        stage.NOrd,
+		From:        stage.Status,
+		To:          newStatus,
+		Actual:      actualStatus,
+	}
+}
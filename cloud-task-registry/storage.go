@@ -0,0 +1,177 @@
+package cloud_task_registry
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned (wrapped) when the requested task, task run, stage or artifact doesn't exist
+	ErrNotFound = errors.New("not found")
+	// ErrNotUnique is returned (wrapped) when a lookup by a secondary index matched more than one item
+	ErrNotUnique = errors.New("not unique")
+	// ErrConditionFailed is returned (wrapped) when a conditional update was rejected, e.g. the item doesn't exist
+	// or the task run is already cancelled
+	ErrConditionFailed = errors.New("condition failed")
+	// ErrTransitionConflict is matched by StageTransitionError, i.e. when a stage status update lost a race
+	// or is not allowed by the stage state machine
+	ErrTransitionConflict = errors.New("stage status transition conflict")
+	// ErrResultConflict is matched by ResultConflictError, i.e. when two stages publish the same result
+	ErrResultConflict = errors.New("result conflict")
+	// ErrChecksumMismatch is returned (wrapped) when a downloaded file doesn't match the SHA-256 digest
+	// it was uploaded with
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+)
+
+// TaskStore persists tasks, task runs and their stages (DynamoDB tables "tasks", "task_runs" and "task_stages" by default)
+type TaskStore interface {
+	// InsertTask fails with ErrConditionFailed if the task already exists
+	InsertTask(ctx context.Context, task Task) error
+	GetTask(ctx context.Context, taskID string) (*Task, error)
+	ListTasks(ctx context.Context) ([]Task, error)
+	// DeleteTask deletes only the task, not its runs. It doesn't fail if there is no such task.
+	DeleteTask(ctx context.Context, taskID string) error
+
+	InsertTaskRun(ctx context.Context, taskRun TaskRun) error
+	GetTaskRun(ctx context.Context, taskRunUUID string) (*TaskRun, error)
+	// ListTaskRuns returns a page of the task runs matching the filter, a page may have fewer than filter.Limit
+	// task runs (even none) while there are more pages. Task runs without creation time may be omitted
+	// unless the filter has neither time range nor statuses.
+	ListTaskRuns(ctx context.Context, filter TaskRunFilter) (*TaskRunPage, error)
+	// UpdateTaskRunStatus NB: The status must not be updated if the task run is already cancelled
+	UpdateTaskRunStatus(ctx context.Context, taskRun *TaskRun, newStatus TaskRunStatus) error
+	// PutTaskRunResults replaces all results of the task run
+	PutTaskRunResults(ctx context.Context, taskRun *TaskRun, results map[string]ResultValue) error
+	// MergeTaskRunResults sets the given results of the task run on behalf of the stage, keeping the other ones.
+	// The results come with ResultValue.Stage set to stageName.
+	// It fails with ResultConflictError if any of the results is set by another stage already.
+	MergeTaskRunResults(ctx context.Context, taskRun *TaskRun, stageName string, results map[string]ResultValue) error
+
+	// InsertTaskRunWithStages writes the task run and all its stages, or nothing at all.
+	// It fails with ErrConditionFailed if the task run or any of the stages exists already.
+	InsertTaskRunWithStages(ctx context.Context, taskRun TaskRun, stages []Stage) error
+
+	InsertStage(ctx context.Context, stage Stage) error
+	// GetStage returns nil (and no error) if there is no such stage
+	GetStage(ctx context.Context, taskRunUUID string, nOrd int) (*Stage, error)
+	GetStageByName(ctx context.Context, taskRunUUID, stageName string) (*Stage, error)
+	GetAllStages(ctx context.Context, taskRunUUID string) ([]Stage, error)
+	// DeleteTaskRun deletes the stages and events of the task run and then the task run itself, so that
+	// an interrupted deletion can be repeated. It doesn't fail if there is no such task run.
+	DeleteTaskRun(ctx context.Context, taskRun *TaskRun) error
+	// UpdateStageStatus is a compare-and-set: it succeeds only if the stored status is still stage.Status,
+	// and returns StageTransitionError otherwise (or ErrConditionFailed if there is no such stage).
+	// It clears the lease of the stage, since the lease belongs to the status it was taken in.
+	UpdateStageStatus(ctx context.Context, stage *Stage, newStatus string) error
+	// UpdateStageStatusWithLease is UpdateStageStatus that sets the new lease in the same write
+	UpdateStageStatusWithLease(ctx context.Context, stage *Stage, newStatus string,
+		tHeartbeatUTC, tLeaseExpiryUTC time.Time) error
+	UpdateStageInput(ctx context.Context, stage *Stage, path, sha256 string) error
+	UpdateStageOutput(ctx context.Context, stage *Stage, path, sha256 string) error
+	// UpdateStageOutputs replaces the named outputs of the stage with their digests
+	UpdateStageOutputs(ctx context.Context, stage *Stage, outputs, sha256s map[string]string) error
+	UpdateStageComment(ctx context.Context, stage *Stage, comment string) error
+	UpdateStageStartTime(ctx context.Context, stage *Stage, tStartUTC time.Time) error
+	UpdateStageFinishTime(ctx context.Context, stage *Stage, tFinishUTC time.Time) error
+	// UpdateStageLease is a compare-and-set: it succeeds only if the stored status is InProgress and the stored lease
+	// expiry is still stage.TLeaseExpiryUTC (none if nil), and fails with ErrConditionFailed otherwise
+	UpdateStageLease(ctx context.Context, stage *Stage, tHeartbeatUTC, tLeaseExpiryUTC time.Time) error
+	// AppendStageAttempt adds the attempt after the stored attempts of the stage
+	AppendStageAttempt(ctx context.Context, stage *Stage, attempt StageAttempt) error
+	// UpdateStageAttempt replaces the stored attempt with the same number (StageAttempt.N)
+	UpdateStageAttempt(ctx context.Context, stage *Stage, attempt StageAttempt) error
+
+	// AppendEvent adds the event to the log of its task run, events are never changed afterwards
+	AppendEvent(ctx context.Context, event TaskEvent) error
+	// GetRunEvents returns the events of the task run ordered by TaskEvent.ID, i.e. by time
+	GetRunEvents(ctx context.Context, taskRunUUID string) ([]TaskEvent, error)
+}
+
+// ArtifactStore keeps files (task definitions, stage configs, inputs and outputs) by bucket and key (S3 by default)
+type ArtifactStore interface {
+	// PutObject stores the metadata (may be nil) along with the object, see MetadataSHA256
+	PutObject(
+		ctx context.Context,
+		bucket, key string,
+		body io.Reader,
+		storageClass StorageClass,
+		metadata map[string]string,
+	) error
+	GetObject(ctx context.Context, bucket, key string) (io.ReadCloser, error)
+	// HeadObject returns the size and metadata of the object, or ErrNotFound
+	HeadObject(ctx context.Context, bucket, key string) (*ObjectInfo, error)
+	// DeleteObject doesn't fail if there is no such object
+	DeleteObject(ctx context.Context, bucket, key string) error
+	// ListObjects returns all objects with the key prefix, in no particular order
+	ListObjects(ctx context.Context, bucket, prefix string) ([]ObjectInfo, error)
+}
+
+// FileTransferrer is implemented by the artifact stores that transfer large files better than PutObject
+// and GetObject do, e.g. in parallel parts. The registry uses it for file uploads and downloads when available.
+type FileTransferrer interface {
+	UploadFile(
+		ctx context.Context,
+		bucket, key, filePath string,
+		storageClass StorageClass,
+		metadata map[string]string,
+	) error
+	DownloadFile(ctx context.Context, bucket, key, destination string) error
+}
+
+// URLPresigner is implemented by the artifact stores that can give access to an object without credentials
+type URLPresigner interface {
+	// PresignGetObject returns a URL to download the object that is valid for expiry. The object is downloaded
+	// as fileName unless it's empty.
+	PresignGetObject(ctx context.Context, bucket, key, fileName string, expiry time.Duration) (string, error)
+}
+
+type ObjectInfo struct {
+	Key          string
+	Size         int64 // bytes
+	LastModified time.Time
+	Metadata     map[string]string // set by HeadObject only
+}
+
+// MetadataSHA256 is the object metadata key of the hex-encoded SHA-256 digest of the object content
+const MetadataSHA256 = "sha256"
+
+// MetadataFileName is the object metadata key of the URL-escaped name of the file uploaded as a blob, whose key
+// is the digest only. The files with the same content share the blob and its name.
+const MetadataFileName = "file-name"
+
+// MessageQueue passes task messages (see TaskMessage) between the pipeline stages and the runners (SQS by default)
+type MessageQueue interface {
+	// SendMessage fails with ErrNotFound if the queue has been deleted. The stores that keep the messages only
+	// (no queues) never do.
+	SendMessage(ctx context.Context, queueName, body string) error
+	// ReceiveMessage waits up to waitTime for a message and returns nil (and no error) if there was none
+	ReceiveMessage(ctx context.Context, queueName string, waitTime time.Duration) (*QueueMessage, error)
+	DeleteMessage(ctx context.Context, queueName, receiptHandle string) error
+	ChangeMessageVisibility(ctx context.Context, queueName, receiptHandle string, timeout time.Duration) error
+	// CreateQueue creates the queue unless it exists, the stage queues are created beforehand though (see OpenReplyQueue)
+	CreateQueue(ctx context.Context, queueName string) error
+	// DeleteQueue deletes the queue with its messages, it doesn't fail if there is no such queue
+	DeleteQueue(ctx context.Context, queueName string) error
+	// ListQueues returns the names of the queues starting with the prefix
+	ListQueues(ctx context.Context, prefix string) ([]string, error)
+}
+
+// Migrator is implemented by the stores that have a schema to create or upgrade before use.
+// Migrate must be idempotent, New calls it unless WithoutMigrations is given.
+type Migrator interface {
+	Migrate(ctx context.Context) error
+}
+
+type QueueMessage struct {
+	Body          string
+	ReceiptHandle string
+}
+
+type StorageClass string
+
+const (
+	StorageClass_Standard StorageClass = "Standard"
+	StorageClass_Cold     StorageClass = "Cold"
+)
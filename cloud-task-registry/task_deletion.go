@@ -0,0 +1,366 @@
+package cloud_task_registry
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+)
+
+// deletionPageSize is the number of task runs read from the registry at a time when deleting them
+const deletionPageSize = 1000
+
+// defaultDeadLetterQueue is the dead-letter queue of the stage queues unless set with WithDeadLetterQueue
+const defaultDeadLetterQueue = "DLQ"
+
+// queuePurgeWaitTime is how long a queue is polled for more messages when purging it
+var queuePurgeWaitTime = time.Second
+
+// queuePurgeHoldTimeout keeps the messages that are not purged invisible until the queue is scanned
+const queuePurgeHoldTimeout = 5 * time.Minute
+
+// queuePurgeMaxMessages bounds the scan of a queue, so that it ends long before the held messages are visible again
+const queuePurgeMaxMessages = 1000
+
+// DeletionReport tells what has been deleted (or would be deleted on a dry run)
+type DeletionReport struct {
+	TaskRuns []DeletedTaskRun
+	Kept     int      // runs selected by the retention policy but kept as the best ones
+	Objects  int      // S3 objects of the task runs and, when a task is deleted, of the task itself
+	Bytes    int64    // total size of Objects
+	Queues   []string // shared queues purged of the pending messages of the task runs
+	Messages int      // pending messages purged from Queues, always 0 on a dry run
+	// ReplyQueues are the reply queues of the task runs, deleted along with them
+	ReplyQueues []string
+	// StaleQueues are the reply queues left behind by the runners of other runs, deleted by CollectGarbage
+	StaleQueues []string
+}
+
+type DeletedTaskRun struct {
+	TaskRun TaskRun
+	Stages  int
+	Objects int
+	Bytes   int64
+	Archive string // path of the archive record, empty if the run isn't archived
+}
+
+// archivedTaskRun is the archive record of a deleted task run
+type archivedTaskRun struct {
+	TaskRun TaskRun `json:"task_run"`
+	Stages  []Stage `json:"stages"`
+}
+
+// ArchivePath is the S3 path of the archive record of the task run, it's out of the run prefix deleted with the run
+func ArchivePath(taskId, taskRunId string) string {
+	return strings.Join([]string{s3CommonPrefix, taskId, "archive", taskRunId + ".json"}, "/")
+}
+
+// DeleteTaskRun deletes the task run, its stages, all the S3 objects under the run prefix and its reply queue.
+// Unless the run is final, its pending messages are purged from the finished tasks queue and the dead-letter queue.
+// The stage queues are not scanned, as that would disturb the other runs: the connectors drop the messages about
+// the deleted runs on receipt. On a dry run it only reports what would be deleted.
+func (registry *CloudTaskRegistry) DeleteTaskRun(
+	ctx context.Context,
+	taskRunUUID string,
+	dryRun bool,
+) (*DeletionReport, error) {
+	taskRun, err := registry.tasks.GetTaskRun(ctx, taskRunUUID)
+	if err != nil {
+		return nil, err
+	}
+	report := &DeletionReport{}
+	err = newTaskRunDeleter(registry, false, dryRun).deleteTaskRuns(ctx, []TaskRun{*taskRun}, report)
+	return report, err
+}
+
+// DeleteTask deletes all runs of the task as DeleteTaskRun does, then the rest of the S3 objects of the task
+// (e.g. archived runs) and the task itself. The blobs it refers to are left to CollectBlobs.
+// On a dry run it only reports what would be deleted.
+func (registry *CloudTaskRegistry) DeleteTask(ctx context.Context, taskID string, dryRun bool) (*DeletionReport, error) {
+	deleter := newTaskRunDeleter(registry, false, dryRun)
+	task, err := deleter.getTask(ctx, taskID)
+	if err != nil {
+		return nil, err
+	}
+	taskRuns, err := registry.ListAllTaskRuns(ctx, TaskRunFilter{TaskID: taskID, Limit: deletionPageSize})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list task runs, %w", err)
+	}
+	// Runs created before tasks got registered have no task
+	if task == nil && len(taskRuns) == 0 {
+		return nil, fmt.Errorf("task '%s' %w", taskID, ErrNotFound)
+	}
+
+	report := &DeletionReport{}
+	if err := deleter.deleteTaskRuns(ctx, taskRuns, report); err != nil {
+		return report, err
+	}
+
+	// On a dry run the objects of the runs are still there and must not be counted twice
+	runUUIDs := make(map[string]bool, len(taskRuns))
+	for _, taskRun := range taskRuns {
+		runUUIDs[taskRun.UUID] = true
+	}
+	taskPrefix := strings.Join([]string{s3CommonPrefix, taskID}, "/") + "/"
+	buckets, err := deleter.buckets(ctx, taskID, nil)
+	if err != nil {
+		return report, err
+	}
+	for _, bucket := range buckets {
+		objects, err := registry.artifacts.ListObjects(ctx, bucket, taskPrefix)
+		if err != nil {
+			return report, fmt.Errorf("failed to list %q in S3 bucket %q, %w", taskPrefix, bucket, err)
+		}
+		for _, object := range objects {
+			runUUID, _, _ := strings.Cut(strings.TrimPrefix(object.Key, taskPrefix), "/")
+			if runUUIDs[runUUID] || IsBlobPath(object.Key) {
+				continue
+			}
+			if !dryRun {
+				if err := registry.artifacts.DeleteObject(ctx, bucket, object.Key); err != nil {
+					return report, fmt.Errorf("failed to delete %q from S3 bucket %q, %w", object.Key, bucket, err)
+				}
+			}
+			report.Objects++
+			report.Bytes += object.Size
+		}
+	}
+	if dryRun {
+		return report, nil
+	}
+	if err := registry.tasks.DeleteTask(ctx, taskID); err != nil {
+		return report, err
+	}
+	log.Printf("Deleted task %s", taskID)
+	return report, nil
+}
+
+type taskRunDeleter struct {
+	registry *CloudTaskRegistry
+	archive  bool
+	dryRun   bool
+	tasks    map[string]*Task // nil for the runs of unregistered tasks
+}
+
+func newTaskRunDeleter(registry *CloudTaskRegistry, archive, dryRun bool) *taskRunDeleter {
+	return &taskRunDeleter{registry: registry, archive: archive, dryRun: dryRun, tasks: make(map[string]*Task)}
+}
+
+// plannedTaskRun is a task run to delete with everything found to delete along with it
+type plannedTaskRun struct {
+	report  DeletedTaskRun
+	stages  []Stage
+	buckets []string
+	objects map[string][]ObjectInfo // bucket -> objects under the run prefix
+}
+
+func (deleter *taskRunDeleter) getTask(ctx context.Context, taskId string) (*Task, error) {
+	if task, ok := deleter.tasks[taskId]; ok {
+		return task, nil
+	}
+	task, err := deleter.registry.tasks.GetTask(ctx, taskId)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, fmt.Errorf("failed to get task %s, %w", taskId, err)
+	}
+	deleter.tasks[taskId] = task
+	return task, nil
+}
+
+// deleteTaskRuns finds everything to delete along with the task runs first, so that nothing is deleted if a run
+// can't be planned, and purges the pending messages of the runs before they are gone. The deleted runs are added
+// to the report as they are deleted.
+func (deleter *taskRunDeleter) deleteTaskRuns(ctx context.Context, taskRuns []TaskRun, report *DeletionReport) error {
+	planned := make([]*plannedTaskRun, 0, len(taskRuns))
+	var pending []string
+	for _, taskRun := range taskRuns {
+		plan, err := deleter.plan(ctx, taskRun)
+		if err != nil {
+			return fmt.Errorf("failed to plan deletion of task run %s, %w", taskRun.UUID, err)
+		}
+		planned = append(planned, plan)
+		report.ReplyQueues = append(report.ReplyQueues, ReplyQueueName(taskRun.UUID))
+		// The runners of the final runs have received their messages already
+		if !slices.Contains(finalTaskRunStatuses, taskRun.Status) {
+			pending = append(pending, taskRun.UUID)
+		}
+	}
+
+	var purgeErr error
+	if len(pending) > 0 {
+		report.Queues = []string{finishedTasksQ, deleter.registry.dlqName}
+		if !deleter.dryRun {
+			// A failure to purge a queue doesn't stop the deletion, the messages about deleted runs are dropped anyway
+			report.Messages, purgeErr = deleter.registry.purgeMessages(ctx, report.Queues, pending)
+		}
+	}
+	for _, plan := range planned {
+		if !deleter.dryRun {
+			if err := deleter.delete(ctx, plan); err != nil {
+				return errors.Join(purgeErr, fmt.Errorf("failed to delete task run %s, %w", plan.report.TaskRun.UUID, err))
+			}
+		}
+		report.add(plan.report)
+	}
+	return purgeErr
+}
+
+func (report *DeletionReport) add(taskRun DeletedTaskRun) {
+	report.TaskRuns = append(report.TaskRuns, taskRun)
+	report.Objects += taskRun.Objects
+	report.Bytes += taskRun.Bytes
+}
+
+func (deleter *taskRunDeleter) plan(ctx context.Context, taskRun TaskRun) (*plannedTaskRun, error) {
+	stages, err := deleter.registry.tasks.GetAllStages(ctx, taskRun.UUID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stages, %w", err)
+	}
+	buckets, err := deleter.buckets(ctx, taskRun.TaskID, stages)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &plannedTaskRun{
+		report:  DeletedTaskRun{TaskRun: taskRun, Stages: len(stages)},
+		stages:  stages,
+		buckets: buckets,
+		objects: make(map[string][]ObjectInfo),
+	}
+	prefix := strings.Join([]string{s3CommonPrefix, taskRun.TaskID, taskRun.UUID}, "/") + "/"
+	for _, bucket := range buckets {
+		plan.objects[bucket], err = deleter.registry.artifacts.ListObjects(ctx, bucket, prefix)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %q in S3 bucket %q, %w", prefix, bucket, err)
+		}
+		for _, object := range plan.objects[bucket] {
+			plan.report.Objects++
+			plan.report.Bytes += object.Size
+		}
+	}
+	if deleter.archive {
+		if len(buckets) == 0 {
+			return nil, errors.New("no S3 bucket to archive the task run to")
+		}
+		plan.report.Archive = ArchivePath(taskRun.TaskID, taskRun.UUID)
+	}
+	return plan, nil
+}
+
+// delete deletes the S3 objects before the task run, so that a run that fails to be deleted can be deleted again
+func (deleter *taskRunDeleter) delete(ctx context.Context, plan *plannedTaskRun) error {
+	taskRun := plan.report.TaskRun
+	if plan.report.Archive != "" {
+		record, err := json.Marshal(archivedTaskRun{TaskRun: taskRun, Stages: plan.stages})
+		if err != nil {
+			return err
+		}
+		digest := sha256.Sum256(record)
+		err = deleter.registry.artifacts.PutObject(ctx, plan.buckets[0], plan.report.Archive,
+			bytes.NewReader(record), StorageClass_Cold, digestMetadata(hex.EncodeToString(digest[:])))
+		if err != nil {
+			return fmt.Errorf("failed to archive to %q in S3 bucket %q, %w", plan.report.Archive, plan.buckets[0], err)
+		}
+	}
+	for _, bucket := range plan.buckets {
+		for _, object := range plan.objects[bucket] {
+			if err := deleter.registry.artifacts.DeleteObject(ctx, bucket, object.Key); err != nil {
+				return fmt.Errorf("failed to delete %q from S3 bucket %q, %w", object.Key, bucket, err)
+			}
+		}
+	}
+	if err := deleter.registry.tasks.DeleteTaskRun(ctx, &taskRun); err != nil {
+		return err
+	}
+	// The runner deletes its reply queue itself, unless it has crashed or been killed
+	if err := deleter.registry.CloseReplyQueue(ctx, taskRun.UUID); err != nil {
+		log.Printf("Failed to delete the reply queue of task run %s (non-critical error), %v", taskRun.UUID, err)
+	}
+	log.Printf("Deleted task run %s of task %s: %d stages, %d S3 objects, %d bytes",
+		taskRun.UUID, taskRun.TaskID, plan.report.Stages, plan.report.Objects, plan.report.Bytes)
+	return nil
+}
+
+// buckets returns the distinct S3 buckets of the task and the stages, the task bucket first
+func (deleter *taskRunDeleter) buckets(ctx context.Context, taskId string, stages []Stage) ([]string, error) {
+	task, err := deleter.getTask(ctx, taskId)
+	if err != nil {
+		return nil, err
+	}
+	var buckets []string
+	if task != nil && task.S3Bucket != "" {
+		buckets = append(buckets, task.S3Bucket)
+	}
+	// Stages of a run usually share the task bucket, but nothing prevents them from using their own ones
+	for _, stage := range stages {
+		if stage.S3Bucket != "" && !slices.Contains(buckets, stage.S3Bucket) {
+			buckets = append(buckets, stage.S3Bucket)
+		}
+	}
+	return buckets, nil
+}
+
+// purgeMessages deletes the pending messages about the task runs from the queues. Messages that are being processed
+// right now are invisible and can't be purged.
+func (registry *CloudTaskRegistry) purgeMessages(
+	ctx context.Context,
+	queueNames []string,
+	taskRunUUIDs []string,
+) (int, error) {
+	purged := 0
+	var errs []error
+	for _, queueName := range queueNames {
+		n, err := registry.purgeQueue(ctx, queueName, taskRunUUIDs)
+		purged += n
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to purge queue %q, %w", queueName, err))
+		}
+	}
+	return purged, errors.Join(errs...)
+}
+
+// purgeQueue receives up to queuePurgeMaxMessages visible messages of the queue, deleting the ones about the task
+// runs. The other messages are held invisible until the queue is scanned and then made visible again.
+func (registry *CloudTaskRegistry) purgeQueue(ctx context.Context, queueName string, taskRunUUIDs []string) (int, error) {
+	var held []string
+	defer func() {
+		for _, receiptHandle := range held {
+			if err := registry.makeMessageMaximallyVisible(ctx, queueName, receiptHandle); err != nil {
+				log.Printf("Failed to release a message of queue %s (non-critical error), %v", queueName, err)
+			}
+		}
+	}()
+
+	purged := 0
+	for range queuePurgeMaxMessages {
+		message, err := registry.queues.ReceiveMessage(ctx, queueName, queuePurgeWaitTime)
+		if err != nil {
+			return purged, err
+		}
+		if message == nil {
+			return purged, nil
+		}
+		taskRunUUID := taskRunUUIDOf(message.Body)
+		if !slices.Contains(taskRunUUIDs, taskRunUUID) {
+			held = append(held, message.ReceiptHandle)
+			err = registry.queues.ChangeMessageVisibility(ctx, queueName, message.ReceiptHandle, queuePurgeHoldTimeout)
+			if err != nil {
+				return purged, err
+			}
+			continue
+		}
+		if err := registry.queues.DeleteMessage(ctx, queueName, message.ReceiptHandle); err != nil {
+			return purged, err
+		}
+		purged++
+		log.Printf("Purged task run %s from queue %s", taskRunUUID, queueName)
+	}
+	log.Printf("Stopped purging queue %s after %d messages, the rest is left", queueName, queuePurgeMaxMessages)
+	return purged, nil
+}
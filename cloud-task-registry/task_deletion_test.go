@@ -0,0 +1,103 @@
+package cloud_task_registry
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeleteTask_MustDeleteRunsObjectsAndPendingMessagesButNotTouchStageQueues(t *testing.T) {
+	// given
+	ctx := context.Background()
+	registry := NewInMemory()
+	withoutQueuePurgeWait(t)
+	filePath := filepath.Join(t.TempDir(), "optimization.in")
+	require.NoError(t, os.WriteFile(filePath, []byte("0123456789"), 0o644))
+	definition, digest, err := registry.UploadTaskDefinition(ctx, filePath, "bucket", "task")
+	require.NoError(t, err)
+	require.NoError(t, registry.CreateTask(ctx, Task{ID: "task", S3Bucket: "bucket", Definition: definition,
+		DefinitionSHA256: digest, Pipeline: []PipelineStage{{Name: "cfd"}}}))
+	for _, uuid := range []string{"run-1", "run-2"} {
+		taskRun := TaskRun{TaskID: "task", UUID: uuid, Status: TaskRunStatus_Submitted}
+		stage := Stage{TaskRunUUID: uuid, NOrd: 1, Name: "cfd", Status: StageInitialStatus, S3Bucket: "bucket"}
+		require.NoError(t, registry.CreateTaskRunWithStages(ctx, taskRun, []Stage{stage}))
+		_, _, err := registry.UploadFileForStage(ctx, filePath, "bucket", &taskRun, "cfd", 1)
+		require.NoError(t, err)
+	}
+	other := TaskRun{TaskID: "other", UUID: "run-3", Status: TaskRunStatus_Submitted}
+	require.NoError(t, registry.InsertTaskRun(ctx, other))
+	require.NoError(t, registry.PassTaskToStage(ctx, &Stage{TaskRunUUID: "run-1", Name: "cfd"},
+		NewTaskMessage(&TaskRun{TaskID: "task", UUID: "run-1"}, "", "")))
+	require.NoError(t, registry.PassTaskToStage(ctx, &Stage{TaskRunUUID: "run-3", Name: "cfd"},
+		NewTaskMessage(&other, "", "")))
+	replyQueue, err := registry.OpenReplyQueue(ctx, "run-2")
+	require.NoError(t, err)
+	require.NoError(t, registry.queues.SendMessage(ctx, replyQueue, "reply"))
+	// Sent to the runners waiting on the shared queues
+	require.NoError(t, registry.PassTaskToStage(ctx, &Stage{TaskRunUUID: "run-2", Name: finishedTasksQ},
+		NewTaskMessage(&TaskRun{TaskID: "task", UUID: "run-2"}, "", "")))
+	require.NoError(t, registry.PassTaskToStage(ctx, &Stage{TaskRunUUID: "run-3", Name: finishedTasksQ},
+		NewTaskMessage(&other, "", "")))
+	require.NoError(t, registry.PassTaskToStage(ctx, &Stage{TaskRunUUID: "run-1", Name: "DLQ"},
+		NewTaskMessage(&TaskRun{TaskID: "task", UUID: "run-1"}, "", "")))
+	// when
+	dryRun, errDryRun := registry.DeleteTask(ctx, "task", true)
+	_, errGetAfterDryRun := registry.GetTaskRun(ctx, "run-1")
+	report, errDelete := registry.DeleteTask(ctx, "task", false)
+	// then
+	require.NoError(t, errDryRun)
+	require.NoError(t, errGetAfterDryRun)
+	assert.Len(t, dryRun.TaskRuns, 2)
+	assert.Equal(t, 2, dryRun.Objects)
+	assert.Equal(t, int64(20), dryRun.Bytes)
+	assert.Equal(t, []string{finishedTasksQ, "DLQ"}, dryRun.Queues)
+	assert.Zero(t, dryRun.Messages)
+	assert.Equal(t, []string{ReplyQueueName("run-1"), ReplyQueueName("run-2")}, dryRun.ReplyQueues)
+	require.NoError(t, errDelete)
+	assert.Equal(t, 2, report.Objects)
+	assert.Equal(t, 2, report.Messages)
+	assert.Equal(t, dryRun.ReplyQueues, report.ReplyQueues)
+	_, err = registry.GetTask(ctx, "task")
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = registry.GetTaskRun(ctx, "run-2")
+	assert.ErrorIs(t, err, ErrNotFound)
+	stages, err := registry.GetAllStages(ctx, "run-1")
+	require.NoError(t, err)
+	assert.Empty(t, stages)
+	objects, err := registry.artifacts.ListObjects(ctx, "bucket", "task-registry/task/")
+	require.NoError(t, err)
+	assert.Empty(t, objects)
+	_, err = registry.artifacts.HeadObject(ctx, "bucket", definition)
+	assert.NoError(t, err, "the definition blob must be left to CollectBlobs")
+	reply, err := registry.queues.ReceiveMessage(ctx, replyQueue, 0)
+	require.NoError(t, err)
+	assert.Nil(t, reply)
+	var pending []string
+	for range 2 {
+		message, err := registry.queues.ReceiveMessage(ctx, "cfd", 0)
+		require.NoError(t, err)
+		require.NotNil(t, message)
+		pending = append(pending, taskRunUUIDOf(message.Body))
+	}
+	assert.Equal(t, []string{"run-1", "run-3"}, pending, "the stage queues are shared with the other runs")
+	finished, err := registry.queues.ReceiveMessage(ctx, finishedTasksQ, 0)
+	require.NoError(t, err)
+	require.NotNil(t, finished)
+	assert.Equal(t, "run-3", taskRunUUIDOf(finished.Body))
+	dead, err := registry.queues.ReceiveMessage(ctx, "DLQ", 0)
+	require.NoError(t, err)
+	assert.Nil(t, dead)
+	_, err = registry.GetTaskRun(ctx, "run-3")
+	assert.NoError(t, err)
+}
+
+// withoutQueuePurgeWait makes purging the in-memory queues return as soon as they are scanned
+func withoutQueuePurgeWait(t *testing.T) {
+	waitTime := queuePurgeWaitTime
+	queuePurgeWaitTime = 0
+	t.Cleanup(func() { queuePurgeWaitTime = waitTime })
+}
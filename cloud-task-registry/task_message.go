@@ -0,0 +1,109 @@
+package cloud_task_registry
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// TaskMessageVersion is the version of the TaskMessage envelope sent by this registry
+const TaskMessageVersion = 1
+
+// TaskMessage is the body of the messages of the stage queues and the finished-tasks queue. Older registries sent
+// the bare task run UUID instead, see ParseTaskMessage.
+type TaskMessage struct {
+	Version     int        `json:"version"`
+	TaskRunUUID string     `json:"run_uuid"`
+	TaskID      string     `json:"task_id,omitempty"`
+	TargetStage string     `json:"target_stage,omitempty"` // empty when the task run is finished
+	SourceStage string     `json:"source_stage,omitempty"` // empty when sent by the runner
+	Attempt     int        `json:"attempt,omitempty"`      // the attempt of the target stage the message is meant to start
+	EnqueuedUTC *time.Time `json:"enqueued_utc,omitempty"`
+	TraceID     string     `json:"trace_id,omitempty"` // the same for all the messages about the task run
+	// ReplyTo is the queue of the runner waiting for the task run (see OpenReplyQueue), the task run is finished
+	// to the shared finished-tasks queue if it's empty
+	ReplyTo      string `json:"reply_to,omitempty"`
+	DeadLettered bool   `json:"dead_lettered,omitempty"` // the message has been forwarded from the DLQ
+}
+
+// NewTaskMessage makes a message about the task run sent by the source stage ("" for the runner) to be passed to
+// PassTaskToStage or FinishTaskRun. An empty trace ID starts a new trace.
+func NewTaskMessage(taskRun *TaskRun, sourceStage, traceID string) TaskMessage {
+	if traceID == "" {
+		traceID = newTraceID()
+	}
+	return TaskMessage{
+		Version:     TaskMessageVersion,
+		TaskRunUUID: taskRun.UUID,
+		TaskID:      taskRun.TaskID,
+		SourceStage: sourceStage,
+		TraceID:     traceID,
+	}
+}
+
+// PassOn makes the message the source stage sends after handling this one, keeping its trace and reply queue
+func (message *TaskMessage) PassOn(taskRun *TaskRun, sourceStage string) TaskMessage {
+	next := NewTaskMessage(taskRun, sourceStage, message.TraceID)
+	next.ReplyTo = message.ReplyTo
+	return next
+}
+
+// ParseTaskMessage reads the envelope from the message body. A legacy body of a bare task run UUID makes a message
+// of version 0 with TaskRunUUID only, any other body that is not an envelope is an error.
+func ParseTaskMessage(body string) (*TaskMessage, error) {
+	body = strings.TrimSpace(body)
+	if !strings.HasPrefix(body, "{") {
+		if _, err := uuid.Parse(body); err != nil {
+			return nil, fmt.Errorf("task message %q is neither an envelope nor a task run UUID, %w", body, err)
+		}
+		return &TaskMessage{TaskRunUUID: body}, nil
+	}
+	var message TaskMessage
+	if err := json.Unmarshal([]byte(body), &message); err != nil {
+		return nil, fmt.Errorf("failed to parse task message %q, %w", body, err)
+	}
+	if message.Version > TaskMessageVersion {
+		return nil, fmt.Errorf("task message version %d is newer than the supported version %d",
+			message.Version, TaskMessageVersion)
+	}
+	if message.TaskRunUUID == "" {
+		return nil, fmt.Errorf("task message %q has no task run UUID", body)
+	}
+	return &message, nil
+}
+
+// QueueWaitTime tells how long the message has been in the queue, it is zero for legacy messages
+func (message *TaskMessage) QueueWaitTime(now time.Time) time.Duration {
+	if message.EnqueuedUTC == nil {
+		return 0
+	}
+	return now.Sub(*message.EnqueuedUTC)
+}
+
+func (message *TaskMessage) encode() (string, error) {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode task message of task run %s, %w", message.TaskRunUUID, err)
+	}
+	return string(body), nil
+}
+
+// taskRunUUIDOf returns the task run UUID of the message body, or "" if the body is not a task message
+func taskRunUUIDOf(body string) string {
+	message, err := ParseTaskMessage(body)
+	if err != nil {
+		return ""
+	}
+	return message.TaskRunUUID
+}
+
+func newTraceID() string {
+	var id [16]byte
+	_, _ = rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
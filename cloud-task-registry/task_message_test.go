@@ -0,0 +1,51 @@
+package cloud_task_registry
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTaskMessage_MustReadEnvelopeSentByPassTaskToStage(t *testing.T) {
+	// given
+	ctx := context.Background()
+	registry := NewInMemory()
+	taskRun := TaskRun{TaskID: "task", UUID: "run-1"}
+	stage := &Stage{TaskRunUUID: "run-1", Name: "cfd", Attempts: []StageAttempt{{N: 1}}}
+	require.NoError(t, registry.PassTaskToStage(ctx, stage, NewTaskMessage(&taskRun, "mesh", "trace-1")))
+	received, err := registry.queues.ReceiveMessage(ctx, "cfd", time.Second)
+	require.NoError(t, err)
+	require.NotNil(t, received)
+	// when
+	message, err := ParseTaskMessage(received.Body)
+	// then
+	require.NoError(t, err)
+	assert.Equal(t, TaskMessageVersion, message.Version)
+	assert.Equal(t, "run-1", message.TaskRunUUID)
+	assert.Equal(t, "task", message.TaskID)
+	assert.Equal(t, "cfd", message.TargetStage)
+	assert.Equal(t, "mesh", message.SourceStage)
+	assert.Equal(t, 2, message.Attempt)
+	assert.Equal(t, "trace-1", message.TraceID)
+	require.NotNil(t, message.EnqueuedUTC)
+	assert.GreaterOrEqual(t, message.QueueWaitTime(time.Now()), time.Duration(0))
+}
+
+func TestParseTaskMessage_MustAcceptLegacyBodyAndRejectNewerVersions(t *testing.T) {
+	// when
+	legacy, errLegacy := ParseTaskMessage("0190d0e4-7c1f-7b2a-9a53-3f0e7f2c1a11\n")
+	_, errNewer := ParseTaskMessage(`{"version": 2, "run_uuid": "run-1"}`)
+	_, errNoUUID := ParseTaskMessage(`{"version": 1}`)
+	_, errGarbage := ParseTaskMessage("hello")
+	// then
+	require.NoError(t, errLegacy)
+	assert.Equal(t, &TaskMessage{TaskRunUUID: "0190d0e4-7c1f-7b2a-9a53-3f0e7f2c1a11"}, legacy)
+	assert.Zero(t, legacy.QueueWaitTime(time.Now()))
+	assert.Error(t, errNewer)
+	assert.Error(t, errNoUUID)
+	assert.Error(t, errGarbage)
+	assert.NotEmpty(t, NewTaskMessage(&TaskRun{UUID: "run-1"}, "", "").TraceID)
+}
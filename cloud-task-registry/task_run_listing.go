@@ -0,0 +1,82 @@
+package cloud_task_registry
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// TaskRunFilter selects task runs for ListTaskRuns, zero fields don't filter anything
+type TaskRunFilter struct {
+	TaskID        string
+	Statuses      []TaskRunStatus
+	CreatedAfter  *time.Time // inclusive
+	CreatedBefore *time.Time // exclusive
+	// Limit is the maximum number of task runs in a page, 0 means all the task runs in one page
+	Limit int
+	// Cursor is TaskRunPage.Cursor of the previous page, empty for the first page
+	Cursor string
+}
+
+// TaskRunPage is a page of task runs. Cursor is empty on the last page.
+type TaskRunPage struct {
+	TaskRuns []TaskRun
+	Cursor   string
+}
+
+// allTaskRunStatuses is used to list task runs of all statuses by the status index
+var allTaskRunStatuses = []TaskRunStatus{
+	TaskRunStatus_Submitted, TaskRunStatus_Finished, TaskRunStatus_Failed, TaskRunStatus_Cancelled,
+}
+
+func (filter *TaskRunFilter) hasTimeRange() bool {
+	return filter.CreatedAfter != nil || filter.CreatedBefore != nil
+}
+
+// matches checks everything but the cursor. Task runs without creation time don't match any time range.
+func (filter *TaskRunFilter) matches(taskRun *TaskRun) bool {
+	if filter.TaskID != "" && taskRun.TaskID != filter.TaskID {
+		return false
+	}
+	if len(filter.Statuses) > 0 && !slices.Contains(filter.Statuses, taskRun.Status) {
+		return false
+	}
+	if filter.hasTimeRange() && taskRun.CreationTime == nil {
+		return false
+	}
+	if filter.CreatedAfter != nil && taskRun.CreationTime.Before(*filter.CreatedAfter) {
+		return false
+	}
+	if filter.CreatedBefore != nil && !taskRun.CreationTime.Before(*filter.CreatedBefore) {
+		return false
+	}
+	return true
+}
+
+// encodeCursor makes an opaque cursor of the store-specific position
+func encodeCursor(position any) (string, error) {
+	data, err := json.Marshal(position)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeCursor(cursor string, position any) error {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return fmt.Errorf("invalid task run cursor: %w", err)
+	}
+	if err := json.Unmarshal(data, position); err != nil {
+		return fmt.Errorf("invalid task run cursor: %w", err)
+	}
+	return nil
+}
+
+// taskRunKeyCursor is the position of the memory and SQLite stores, which list task runs by task ID and UUID
+type taskRunKeyCursor struct {
+	TaskID string `json:"task_id"`
+	UUID   string `json:"run_uuid"`
+}
@@ -0,0 +1,264 @@
+package cloud_task_registry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+type ResultStatus string
+
+const (
+	ResultStatus_OK      ResultStatus = "ok"
+	ResultStatus_Missing ResultStatus = "missing" // the stage didn't evaluate the objective
+	ResultStatus_Failed  ResultStatus = "failed"  // the evaluation was attempted but failed
+	ResultStatus_Penalty ResultStatus = "penalty" // the value is a penalty for an infeasible design, not an evaluation
+)
+
+// ResultValue is a single result (objective value) of a task run. Unlike a bare float, it tells a failed evaluation
+// from a legitimate NaN. It's written by stages in the text form parsed by ParseResultValue.
+type ResultValue struct {
+	Value  float64
+	Unit   string
+	Status ResultStatus
+	Stage  string // stage that has published the result, empty if unknown
+}
+
+// ParseResultValue parses "[status] [number] [unit]", e.g. "42", "42 kg", "NaN", "failed" or "penalty 1e6 N".
+// The number is required for ok (default) and penalty results and must be absent for missing and failed ones.
+func ParseResultValue(s string) (ResultValue, error) {
+	fields := strings.Fields(s)
+	result := ResultValue{Value: math.NaN(), Status: ResultStatus_OK}
+	if len(fields) > 0 {
+		switch status := ResultStatus(strings.ToLower(fields[0])); status {
+		case ResultStatus_OK, ResultStatus_Missing, ResultStatus_Failed, ResultStatus_Penalty:
+			result.Status = status
+			fields = fields[1:]
+		}
+	}
+	if result.Status == ResultStatus_OK || result.Status == ResultStatus_Penalty {
+		if len(fields) == 0 {
+			return ResultValue{}, fmt.Errorf("result %q has no value", s)
+		}
+		value, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			return ResultValue{}, fmt.Errorf("result %q has invalid value: %w", s, err)
+		}
+		result.Value = value
+		fields = fields[1:]
+	}
+	if len(fields) > 1 {
+		return ResultValue{}, fmt.Errorf("result %q has unexpected %q after the unit", s, strings.Join(fields[1:], " "))
+	}
+	if len(fields) == 1 {
+		result.Unit = fields[0]
+	}
+	return result, nil
+}
+
+// ParseResults parses the results read from a stage output. Values that can't be parsed are kept as failed results,
+// so that a single malformed value doesn't lose the others.
+func ParseResults(values map[string]string) (map[string]ResultValue, error) {
+	results := make(map[string]ResultValue, len(values))
+	var errs []error
+	for key, s := range values {
+		result, err := ParseResultValue(s)
+		if err != nil {
+			errs = append(errs, err)
+			result = ResultValue{Value: math.NaN(), Status: ResultStatus_Failed}
+		}
+		results[key] = result
+	}
+	return results, errors.Join(errs...)
+}
+
+// String returns the result in the form parsed by ParseResultValue
+func (v ResultValue) String() string {
+	var s string
+	switch v.Status {
+	case ResultStatus_Missing, ResultStatus_Failed:
+		return string(v.Status)
+	case ResultStatus_Penalty:
+		s = string(v.Status) + " " + formatResultNumber(v.Value)
+	default:
+		s = formatResultNumber(v.Value)
+	}
+	if v.Unit != "" {
+		s += " " + v.Unit
+	}
+	return s
+}
+
+// Format returns the number to give to an optimizer or to export: the value of ok and penalty results
+// and missingValue for missing and failed ones
+func (v ResultValue) Format(missingValue string) string {
+	if !v.IsValid() {
+		return missingValue
+	}
+	return formatResultNumber(v.Value)
+}
+
+// IsValid tells whether the result has a value, which is true for ok and penalty results
+func (v ResultValue) IsValid() bool {
+	return v.Status != ResultStatus_Missing && v.Status != ResultStatus_Failed
+}
+
+func formatResultNumber(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// resultFromLegacyString reads a result stored as a bare string before results got typed
+func resultFromLegacyString(s string) ResultValue {
+	result, err := ParseResultValue(s)
+	if err != nil {
+		return ResultValue{Value: math.NaN(), Status: ResultStatus_Failed}
+	}
+	return result
+}
+
+// resultJSON is the stored form of ResultValue. JSON and DynamoDB numbers can't be NaN or infinite,
+// so such values are stored as strings.
+type resultJSON struct {
+	Value  json.RawMessage `json:"value"`
+	Unit   string          `json:"unit,omitempty"`
+	Status ResultStatus    `json:"status"`
+	Stage  string          `json:"stage,omitempty"`
+}
+
+func (v ResultValue) MarshalJSON() ([]byte, error) {
+	value := formatResultNumber(v.Value)
+	if math.IsNaN(v.Value) || math.IsInf(v.Value, 0) {
+		value = strconv.Quote(value)
+	}
+	return json.Marshal(resultJSON{Value: json.RawMessage(value), Unit: v.Unit, Status: v.Status, Stage: v.Stage})
+}
+
+func (v *ResultValue) UnmarshalJSON(data []byte) error {
+	var legacy string
+	if err := json.Unmarshal(data, &legacy); err == nil {
+		*v = resultFromLegacyString(legacy)
+		return nil
+	}
+	var stored resultJSON
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return err
+	}
+	if stored.Status == "" {
+		// a merged result stored before results got typed: a bare string with its source stage
+		if err := json.Unmarshal(stored.Value, &legacy); err != nil {
+			return fmt.Errorf("invalid result value %s: %w", stored.Value, err)
+		}
+		*v = resultFromLegacyString(legacy)
+		v.Stage = stored.Stage
+		return nil
+	}
+	value := strings.Trim(string(stored.Value), `"`)
+	if value == "" || value == "null" {
+		value = "NaN"
+	}
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return fmt.Errorf("invalid result value %s: %w", stored.Value, err)
+	}
+	*v = ResultValue{Value: parsed, Unit: stored.Unit, Status: stored.Status, Stage: stored.Stage}
+	return nil
+}
+
+func (v ResultValue) MarshalDynamoDBAttributeValue() (types.AttributeValue, error) {
+	var value types.AttributeValue = &types.AttributeValueMemberN{Value: formatResultNumber(v.Value)}
+	if math.IsNaN(v.Value) || math.IsInf(v.Value, 0) {
+		value = &types.AttributeValueMemberS{Value: formatResultNumber(v.Value)}
+	}
+	item := map[string]types.AttributeValue{
+		"value":  value,
+		"status": &types.AttributeValueMemberS{Value: string(v.Status)},
+	}
+	if v.Unit != "" {
+		item["unit"] = &types.AttributeValueMemberS{Value: v.Unit}
+	}
+	if v.Stage != "" {
+		item["stage"] = &types.AttributeValueMemberS{Value: v.Stage}
+	}
+	return &types.AttributeValueMemberM{Value: item}, nil
+}
+
+func (v *ResultValue) UnmarshalDynamoDBAttributeValue(av types.AttributeValue) error {
+	switch av := av.(type) {
+	case *types.AttributeValueMemberS:
+		*v = resultFromLegacyString(av.Value)
+		return nil
+	case *types.AttributeValueMemberM:
+		result := ResultValue{Value: math.NaN()}
+		var value string
+		switch stored := av.Value["value"].(type) {
+		case *types.AttributeValueMemberN:
+			value = stored.Value
+		case *types.AttributeValueMemberS:
+			value = stored.Value
+		}
+		if value != "" {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return fmt.Errorf("invalid result value %q: %w", value, err)
+			}
+			result.Value = parsed
+		}
+		if status, ok := av.Value["status"].(*types.AttributeValueMemberS); ok {
+			result.Status = ResultStatus(status.Value)
+		}
+		if unit, ok := av.Value["unit"].(*types.AttributeValueMemberS); ok {
+			result.Unit = unit.Value
+		}
+		if stage, ok := av.Value["stage"].(*types.AttributeValueMemberS); ok {
+			result.Stage = stage.Value
+		}
+		*v = result
+		return nil
+	default:
+		return fmt.Errorf("unexpected result attribute type %T", av)
+	}
+}
+
+// ResultConflictError is returned when a stage merges results that are published by another stage already.
+// It matches both ErrResultConflict and ErrConditionFailed with errors.Is.
+type ResultConflictError struct {
+	TaskRunUUID string
+	Stage       string
+	Conflicts   map[string]string // result key -> stage that has published it, "" if the results were put as a whole
+}
+
+func (e *ResultConflictError) Error() string {
+	conflicts := make([]string, 0, len(e.Conflicts))
+	for _, key := range slices.Sorted(maps.Keys(e.Conflicts)) {
+		if e.Conflicts[key] == "" {
+			conflicts = append(conflicts, key)
+		} else {
+			conflicts = append(conflicts, fmt.Sprintf("%s (by stage %s)", key, e.Conflicts[key]))
+		}
+	}
+	return fmt.Sprintf("stage %s can't publish results of task run %s that are published already: %s",
+		e.Stage, e.TaskRunUUID, strings.Join(conflicts, ", "))
+}
+
+func (e *ResultConflictError) Is(target error) bool {
+	return target == ErrResultConflict || target == ErrConditionFailed
+}
+
+// findResultConflicts returns the results that the stage can't merge into the stored task run,
+// with the stages that have published them
+func findResultConflicts(stored *TaskRun, stageName string, results map[string]ResultValue) map[string]string {
+	conflicts := make(map[string]string)
+	for key := range results {
+		if storedResult, ok := stored.Results[key]; ok && storedResult.Stage != stageName {
+			conflicts[key] = storedResult.Stage
+		}
+	}
+	return conflicts
+}
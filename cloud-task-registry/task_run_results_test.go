@@ -0,0 +1,81 @@
+package cloud_task_registry
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseResultValue_MustTellFailedEvaluationFromNaN(t *testing.T) {
+	// given
+	inputs := []string{"42", "42 kg", "NaN", "failed", "missing", "penalty 1e6 N", "42 kg extra", "kg", "penalty"}
+	// when
+	results := make([]ResultValue, len(inputs))
+	errs := make([]error, len(inputs))
+	for i, input := range inputs {
+		results[i], errs[i] = ParseResultValue(input)
+	}
+	// then
+	require.NoError(t, errs[0])
+	assert.Equal(t, ResultValue{Value: 42, Status: ResultStatus_OK}, results[0])
+	assert.Equal(t, "42", results[0].String())
+	require.NoError(t, errs[1])
+	assert.Equal(t, ResultValue{Value: 42, Unit: "kg", Status: ResultStatus_OK}, results[1])
+	assert.Equal(t, "42 kg", results[1].String())
+	require.NoError(t, errs[2])
+	assert.Equal(t, ResultStatus_OK, results[2].Status)
+	assert.Equal(t, "NaN", results[2].Format("-1"))
+	require.NoError(t, errs[3])
+	assert.Equal(t, ResultStatus_Failed, results[3].Status)
+	assert.Equal(t, "-1", results[3].Format("-1"))
+	require.NoError(t, errs[4])
+	assert.Equal(t, "missing", results[4].String())
+	require.NoError(t, errs[5])
+	assert.Equal(t, ResultValue{Value: 1e6, Unit: "N", Status: ResultStatus_Penalty}, results[5])
+	assert.Equal(t, "1e+06", results[5].Format("-1"))
+	assert.Error(t, errs[6])
+	assert.Error(t, errs[7])
+	assert.Error(t, errs[8])
+}
+
+func TestResultValue_MustRoundTripAndReadLegacyStrings(t *testing.T) {
+	// given
+	results := map[string]ResultValue{
+		"mass": {Value: 42, Unit: "kg", Status: ResultStatus_OK, Stage: "mass-estimation"},
+		"drag": {Value: math.Inf(1), Status: ResultStatus_Penalty},
+	}
+	legacyJSON := `{"mass": "42", "drag": "NaN", "lift": "oops", "cost": {"value": "7", "stage": "costing"}}`
+	legacyItem := map[string]types.AttributeValue{
+		"mass": &types.AttributeValueMemberS{Value: "42"},
+	}
+	// when
+	data, errMarshalJSON := json.Marshal(results)
+	var fromJSON map[string]ResultValue
+	errUnmarshalJSON := json.Unmarshal(data, &fromJSON)
+	item, errMarshalItem := attributevalue.MarshalMap(results)
+	var fromItem map[string]ResultValue
+	errUnmarshalItem := attributevalue.UnmarshalMap(item, &fromItem)
+	var fromLegacyJSON, fromLegacyItem map[string]ResultValue
+	errLegacyJSON := json.Unmarshal([]byte(legacyJSON), &fromLegacyJSON)
+	errLegacyItem := attributevalue.UnmarshalMap(legacyItem, &fromLegacyItem)
+	// then
+	require.NoError(t, errMarshalJSON)
+	require.NoError(t, errUnmarshalJSON)
+	assert.Equal(t, results, fromJSON)
+	require.NoError(t, errMarshalItem)
+	require.NoError(t, errUnmarshalItem)
+	assert.Equal(t, results, fromItem)
+	require.NoError(t, errLegacyJSON)
+	assert.Equal(t, ResultValue{Value: 42, Status: ResultStatus_OK}, fromLegacyJSON["mass"])
+	assert.Equal(t, ResultStatus_OK, fromLegacyJSON["drag"].Status)
+	assert.True(t, math.IsNaN(fromLegacyJSON["drag"].Value))
+	assert.Equal(t, ResultStatus_Failed, fromLegacyJSON["lift"].Status)
+	assert.Equal(t, ResultValue{Value: 7, Status: ResultStatus_OK, Stage: "costing"}, fromLegacyJSON["cost"])
+	require.NoError(t, errLegacyItem)
+	assert.Equal(t, ResultValue{Value: 42, Status: ResultStatus_OK}, fromLegacyItem["mass"])
+}
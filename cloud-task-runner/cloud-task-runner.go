@@ -2,6 +2,8 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
@@ -17,11 +19,18 @@ import (
 
 const pidsFile = "cloud-task-runner.pids"
 
+// cancellationTimeout bounds marking the task run as cancelled on SIGINT/SIGTERM
+const cancellationTimeout = 30 * time.Second
+
 func main() {
 	dynamoDocApiEndpoint :=
 		flag.String("dynamo-docapi-endpoint", "", "DynamoDB Document API endpoint URL for task registry")
+	registryURL :=
+		flag.String("registry", "", "Task registry backend, e.g. 'sqlite:///path/to/registry.db' (DynamoDB, S3 and SQS by default)")
 	s3Bucket :=
 		flag.String("s3-bucket", "", "S3 bucket name to use for task registry")
+	artifactStoreURL :=
+		flag.String("artifact-store", "", "Artifact storage, e.g. 'file:///mnt/shared/artifacts' (S3 by default)")
 	stagesConfigPath :=
 		flag.String("stages-config-file", "stages.yaml", "YAML file with pipeline stages configuration")
 	taskId :=
@@ -36,13 +45,34 @@ func main() {
 		flag.String("dlq-name", "DLQ", "Name of the Dead Letter Queue to monitor for failed tasks")
 	objectivesArg :=
 		flag.String("objectives", "", "Comma-separated list of required objectives names (e.g. 'obj1,obj2')")
+	parameterBoundsArg :=
+		flag.String("parameter-bounds", "", "Comma-separated bounds of the optimization parameters to register with the task (e.g. 'x=0:1,y=-5:')")
 	missingObjectiveValue :=
 		flag.String("missing-obj-value", "NaN", "Value to put as objectives if they are not present in task results (e.g., due to task failure)")
+	migrateOnly :=
+		flag.Bool("migrate-only", false, "Apply task registry schema migrations and exit")
+	skipMigrate :=
+		flag.Bool("skip-migrate", false, "Don't check the task registry schema on startup (use after --migrate-only)")
+	sharedFinishedQueue :=
+		flag.Bool("shared-finished-queue", false, "Wait on the shared finished-tasks queue and the DLQ instead of a reply queue of the task run (for connectors older than reply queues)")
+	printTimeline :=
+		flag.Bool("print-timeline", false, "Print the event log of the task run (status changes, handovers, uploads) after the report")
+	registryConfigFlags := cloud_task_registry.RegisterConfigFlags(flag.CommandLine)
 
 	flag.Parse()
 
-	checkRequiredFlags(dynamoDocApiEndpoint, s3Bucket, stagesConfigPath, taskId, taskDefinitionPath, runParametersFilePath, outputFile, objectivesArg)
+	if *migrateOnly {
+		connectToRegistry(*dynamoDocApiEndpoint, *registryURL, *artifactStoreURL, registryConfigFlags, false)
+		log.Println("Task registry schema is up to date")
+		os.Exit(0)
+	}
+
+	checkRequiredFlags(s3Bucket, stagesConfigPath, taskId, taskDefinitionPath, runParametersFilePath, outputFile, objectivesArg)
 	objectives := parseObjectivesArg(*objectivesArg)
+	parameterBounds, err := parseParameterBounds(*parameterBoundsArg)
+	if err != nil {
+		log.Fatalf("Error parsing --parameter-bounds: %v", err)
+	}
 
 	dumpProcessId()
 
@@ -61,10 +91,8 @@ func main() {
 		log.Fatalf("Cannot stat task definition file: %v", err)
 	}
 
-	registry, err := cloud_task_registry.New(*dynamoDocApiEndpoint)
-	if err != nil {
-		log.Fatalf("Error connection to the Cloud Task Registry, %v", err)
-	}
+	ctx := context.Background()
+	registry := connectToRegistry(*dynamoDocApiEndpoint, *registryURL, *artifactStoreURL, registryConfigFlags, *skipMigrate)
 
 	//fetchedStage, err := registry.GetStage("019090c8-68d9-7823-8f5d-0e6649c759ea", 4)
 	//if err != nil {
@@ -80,9 +108,17 @@ func main() {
 	//
 	//os.Exit(0)
 
-	s3Path, err := registry.UploadFileForTask(*taskDefinitionPath, *s3Bucket, *taskId, newRunUUID.String())
+	stagesYAML, err := readStagesYAML(*stagesConfigPath)
 	if err != nil {
-		log.Fatalf("Error uploading task defition file to S3, %v", err)
+		log.Fatalf("Error reading stages config file: %v", err)
+	}
+	declaredTask := describeTask(*taskId, *s3Bucket, objectives, taskParameters, parameterBounds, stagesYAML)
+	task, err := registerOrVerifyTask(ctx, registry, declaredTask, *taskDefinitionPath)
+	if err != nil {
+		log.Fatalf("Error registering the task: %v", err)
+	}
+	if err := checkParametersWithinBounds(task, taskParameters); err != nil {
+		log.Fatalf("Invalid parameters for task %s: %v", task.ID, err)
 	}
 
 	taskCreationTime := convertUuidTime(newRunUUID.Time())
@@ -91,66 +127,59 @@ func main() {
 		UUID:           newRunUUID.String(),
 		Parameters:     taskParameters,
 		Results:        nil,
-		TaskDefinition: s3Path,
+		TaskDefinition: task.Definition,
 		CreationTime:   &taskCreationTime,
 		Status:         cloud_task_registry.TaskRunStatus_Submitted,
 	}
 
-	stages, err := createStages(registry, &taskRun, *stagesConfigPath, *s3Bucket)
+	stages, err := createStages(ctx, registry, &taskRun, *stagesConfigPath, *s3Bucket)
 	if err != nil {
 		log.Fatalf("Error reading stages config file: %v", err)
 	}
 
-	if err := registry.InsertTaskRun(taskRun); err != nil {
-		log.Fatalf("failed to insert task run: %v", err)
+	if err := registry.CreateTaskRunWithStages(ctx, taskRun, stages); err != nil {
+		log.Fatalf("failed to insert task run with stages: %v", err)
 	}
-	log.Println("Successfully inserted task run with id", newRunUUID.String(), "for task", *taskId)
-
-	for _, stage := range stages {
-		if err := registry.InsertStage(stage); err == nil {
-			log.Println("Successfully inserted stage", stage.NOrd, "(", stage.Name, ")")
-		} else {
-			log.Fatalf("failed to insert stage: %v", err)
+	log.Println("Successfully inserted task run with id", newRunUUID.String(), "for task", *taskId,
+		"and", len(stages), "stages")
+
+	// The message starts the trace of the task run, the connectors pass its trace ID and reply queue on
+	message := cloud_task_registry.NewTaskMessage(&taskRun, "", "")
+	closeReplyQueue := func() {}
+	if !*sharedFinishedQueue {
+		message.ReplyTo, err = registry.OpenReplyQueue(ctx, taskRun.UUID)
+		if err != nil {
+			_ = registry.UpdateTaskRunStatus(ctx, &taskRun, cloud_task_registry.TaskRunStatus_Failed)
+			log.Fatalf("failed starting the pipeline: %v", err)
+		}
+		closeReplyQueue = func() {
+			if err := registry.CloseReplyQueue(ctx, taskRun.UUID); err != nil {
+				log.Println("Failed deleting the reply queue (non-critical error)", err)
+			}
 		}
 	}
-
-	err = registry.PassTaskToStage(&stages[0])
+	err = registry.PassTaskToStage(ctx, &stages[0], message)
 	if err != nil {
-		_ = registry.UpdateTaskRunStatus(&taskRun, cloud_task_registry.TaskRunStatus_Failed)
+		closeReplyQueue()
+		_ = registry.UpdateTaskRunStatus(ctx, &taskRun, cloud_task_registry.TaskRunStatus_Failed)
 		log.Fatalf("failed starting the pipeline: %v", err)
 	}
-	log.Println("Submitted task run", newRunUUID.String(), "for task", *taskId)
+	log.Println("Submitted task run", newRunUUID.String(), "for task", *taskId, "with trace ID", message.TraceID)
 
-	wasCancelled := make(chan bool, 3)
-	setupCancellationHandler(registry, &taskRun, wasCancelled)
+	waitCtx, cancelWaiting := context.WithCancel(ctx)
+	setupCancellationHandler(registry, &taskRun, cancelWaiting)
 
 	// Start waiting for both normal queue and DLQ
 	finishedTaskRunIDChan := make(chan string, 1)
 	dlqTaskRunIDChan := make(chan string, 1)
 	waitErrChan := make(chan error, 2)
 
-	go func() {
-		id, err := registry.WaitForPipelineFinish(*taskId, newRunUUID.String(), wasCancelled)
-		if err != nil {
-			waitErrChan <- err
-		} else {
-			finishedTaskRunIDChan <- id
-		}
-	}()
-
-	go func() {
-		id, err := registry.WaitForDLQ(*dlqName, newRunUUID.String(), wasCancelled)
-		if err != nil {
-			waitErrChan <- err
-		} else {
-			dlqTaskRunIDChan <- id
-		}
-	}()
-
-	cancelled := <-wasCancelled
-	if cancelled {
-		log.Printf("%s (run %s): Task execution cancelled!\n", taskRun.TaskID, taskRun.UUID)
-		os.Exit(-1)
+	if *sharedFinishedQueue {
+		waitOnSharedQueues(waitCtx, registry, *taskId, *dlqName, taskRun.UUID,
+			finishedTaskRunIDChan, dlqTaskRunIDChan, waitErrChan)
+	} else {
+		waitOnReplyQueue(waitCtx, registry, *taskId, *dlqName, message.ReplyTo, taskRun.UUID,
+			finishedTaskRunIDChan, dlqTaskRunIDChan, waitErrChan)
 	}
 
 	var finishedTaskRunID string
@@ -158,6 +187,11 @@ func main() {
 
 	select {
 	case err := <-waitErrChan:
+		closeReplyQueue()
+		if errors.Is(err, context.Canceled) {
+			log.Printf("%s (run %s): Task execution cancelled!\n", taskRun.TaskID, taskRun.UUID)
+			os.Exit(-1)
+		}
 		log.Fatalf("failed while waiting for the pipeline to finish: %v", err)
 	case finishedTaskRunID = <-finishedTaskRunIDChan:
 		if finishedTaskRunID != taskRun.UUID {
@@ -173,21 +207,33 @@ func main() {
 		}
 	}
 
-	finishedTask, err := registry.GetTaskRun(taskRun.UUID)
+	// Stop the other waiter
+	cancelWaiting()
+	closeReplyQueue()
+
+	finishedTask, err := registry.GetTaskRun(ctx, taskRun.UUID)
 	if err != nil {
 		log.Fatalf("failed getting task run information from DB: %v", err)
 	}
 
-	finishedStages, err := registry.GetAllStages(taskRun.UUID)
+	finishedStages, err := registry.GetAllStages(ctx, taskRun.UUID)
 	if err != nil {
 		log.Fatalf("failed getting stages information from DB: %v", err)
 	}
 
 	printTaskReportWithAllStages(finishedTask, finishedStages)
+	if *printTimeline {
+		events, err := registry.GetRunEvents(ctx, taskRun.UUID)
+		if err != nil {
+			log.Println("Failed getting events of task run", taskRun.UUID, "(non-critical error)", err)
+		} else {
+			printTaskRunTimeline(events)
+		}
+	}
 
 	if dlqTriggered {
 		// Mark as failed and write -1 for missing objectives
-		if err := registry.UpdateTaskRunStatus(&taskRun, cloud_task_registry.TaskRunStatus_Failed); err != nil {
+		if err := registry.UpdateTaskRunStatus(ctx, &taskRun, cloud_task_registry.TaskRunStatus_Failed); err != nil {
 			log.Println("Failed setting status", cloud_task_registry.TaskRunStatus_Failed,
 				"to task run", taskRun.UUID, "of task", taskRun.TaskID, "(non-critical error)", err)
 		}
@@ -204,7 +250,7 @@ func main() {
 				log.Fatalf("failed printing results into the output file: %v", err)
 			}
 			fmt.Println("Written output to", *outputFile)
-			err = registry.UpdateTaskRunStatus(&taskRun, cloud_task_registry.TaskRunStatus_Finished)
+			err = registry.UpdateTaskRunStatus(ctx, &taskRun, cloud_task_registry.TaskRunStatus_Finished)
 			if err != nil {
 				log.Println("Failed setting status", cloud_task_registry.TaskRunStatus_Finished,
 					"to task run", taskRun.UUID, "of task", taskRun.TaskID, "(non-critical error)", err)
@@ -214,7 +260,7 @@ func main() {
 			// Unlikely situation: pipeline finished with erroneous stage(s) but via finished-tasks queue implying success
 			// TODO iterate over the result and put NaNs to the missing ones (?)
 			if anyStageHasStatus(finishedStages, cloud_task_registry.StageStatus_Error) {
-				err = registry.UpdateTaskRunStatus(&taskRun, cloud_task_registry.TaskRunStatus_Failed)
+				err = registry.UpdateTaskRunStatus(ctx, &taskRun, cloud_task_registry.TaskRunStatus_Failed)
 				if err != nil {
 					log.Println("Failed setting status", cloud_task_registry.TaskRunStatus_Failed,
 						"to task run", taskRun.UUID, "of task", taskRun.TaskID, "(non-critical error)", err)
@@ -225,6 +271,35 @@ func main() {
 	}
 }
 
+func connectToRegistry(
+	dynamoDocApiEndpoint, registryURL, artifactStoreURL string,
+	registryConfigFlags *cloud_task_registry.ConfigFlags,
+	skipMigrate bool,
+) *cloud_task_registry.CloudTaskRegistry {
+	registryOptions, err := cloud_task_registry.OptionsFromURL(registryURL)
+	if err != nil {
+		log.Fatalf("Error configuring the Cloud Task Registry, %v", err)
+	}
+	artifactOptions, err := cloud_task_registry.ArtifactOptionsFromURL(artifactStoreURL)
+	if err != nil {
+		log.Fatalf("Error configuring the Cloud Task Registry artifact store, %v", err)
+	}
+	registryOptions = append(registryOptions, artifactOptions...)
+	registryConfig, err := registryConfigFlags.Load()
+	if err != nil {
+		log.Fatalf("Error loading the Cloud Task Registry configuration, %v", err)
+	}
+	registryOptions = append(registryOptions, cloud_task_registry.WithConfig(registryConfig))
+	if skipMigrate {
+		registryOptions = append(registryOptions, cloud_task_registry.WithoutMigrations())
+	}
+	registry, err := cloud_task_registry.New(dynamoDocApiEndpoint, registryOptions...)
+	if err != nil {
+		log.Fatalf("Error connection to the Cloud Task Registry, %v", err)
+	}
+	return registry
+}
+
 func dumpProcessId() {
 	pid := os.Getpid()
 	f, err := os.OpenFile(pidsFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
@@ -250,7 +325,6 @@ func dumpProcessId() {
 }
 
 func checkRequiredFlags(
-	dynamoDocApiEndpoint *string,
 	s3Bucket *string,
 	stagesConfigPath *string,
 	taskId *string,
@@ -259,9 +333,6 @@ func checkRequiredFlags(
 	outputFile *string,
 	objectivesList *string,
 ) {
-	if *dynamoDocApiEndpoint == "" {
-		log.Fatal("Please provide --dynamo-docapi-endpoint")
-	}
 	if *s3Bucket == "" {
 		log.Fatal("Please provide --s3-bucket")
 	}
@@ -290,7 +361,13 @@ func convertUuidTime(t uuid.Time) time.Time {
 	return time.Unix(sec, nsec).UTC()
 }
 
-func printResultsToFile(filename string, objectives []string, results map[string]string, missingObjValue string) error {
+// printResultsToFile writes "value objective" lines, where missing and failed results get missingObjValue
+func printResultsToFile(
+	filename string,
+	objectives []string,
+	results map[string]cloud_task_registry.ResultValue,
+	missingObjValue string,
+) error {
 	file, err := os.Create(filename)
 	if err != nil {
 		return fmt.Errorf("failed to create file %q: %w", filename, err)
@@ -298,12 +375,12 @@ func printResultsToFile(filename string, objectives []string, results map[string
 	defer file.Close()
 
 	for _, obj := range objectives {
-		if value, ok := results[obj]; !ok {
+		if result, ok := results[obj]; !ok {
 			fmt.Printf("%s %s\n", missingObjValue, obj)
 			_, err = fmt.Fprintf(file, "%s %s\n", missingObjValue, obj)
 		} else {
-			fmt.Printf("%s %s\n", value, obj)
-			_, err = fmt.Fprintf(file, "%s %s\n", value, obj)
+			fmt.Printf("%s %s (%s)\n", result.Format(missingObjValue), obj, result)
+			_, err = fmt.Fprintf(file, "%s %s\n", result.Format(missingObjValue), obj)
 		}
 		if err != nil {
 			return fmt.Errorf("failed to write to file %q: %w", filename, err)
@@ -313,21 +390,80 @@ func printResultsToFile(filename string, objectives []string, results map[string
 	return nil
 }
 
+// waitOnSharedQueues waits for the task run on the finished-tasks queue and the DLQ shared by all the runners
+func waitOnSharedQueues(
+	ctx context.Context,
+	registry *cloud_task_registry.CloudTaskRegistry,
+	taskId, dlqName, taskRunUUID string,
+	finished, deadLettered chan<- string,
+	waitErr chan<- error,
+) {
+	go func() {
+		id, err := registry.WaitForPipelineFinish(ctx, taskId, taskRunUUID)
+		if err != nil {
+			waitErr <- err
+		} else {
+			finished <- id
+		}
+	}()
+
+	go func() {
+		id, err := registry.WaitForDLQ(ctx, dlqName, taskRunUUID)
+		if err != nil {
+			waitErr <- err
+		} else {
+			deadLettered <- id
+		}
+	}()
+}
+
+// waitOnReplyQueue waits for the task run on its own reply queue, while dispatching the dead letters of all
+// the runners to their reply queues
+func waitOnReplyQueue(
+	ctx context.Context,
+	registry *cloud_task_registry.CloudTaskRegistry,
+	taskId, dlqName, replyQueue, taskRunUUID string,
+	finished, deadLettered chan<- string,
+	waitErr chan<- error,
+) {
+	go func() {
+		reply, err := registry.WaitForReply(ctx, replyQueue, taskId, taskRunUUID)
+		switch {
+		case err != nil:
+			waitErr <- err
+		case reply.DeadLettered:
+			deadLettered <- reply.TaskRunUUID
+		default:
+			finished <- reply.TaskRunUUID
+		}
+	}()
+
+	go func() {
+		waitErr <- registry.DispatchDeadLetters(ctx, dlqName)
+	}()
+}
+
+// setupCancellationHandler marks the task run as cancelled on SIGINT/SIGTERM and then stops waiting
+// for the pipeline. If marking fails, the runner keeps waiting, so that the signal can be sent again.
 func setupCancellationHandler(
 	registry *cloud_task_registry.CloudTaskRegistry,
 	taskRun *cloud_task_registry.TaskRun,
-	wasCancelled chan bool,
+	cancelWaiting context.CancelFunc,
 ) {
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
 	go func() {
-		<-sigs
-		log.Println("Got interrupt, cancelling the task...")
-		err := registry.UpdateTaskRunStatus(taskRun, cloud_task_registry.TaskRunStatus_Cancelled)
-		if err != nil {
-			log.Println("Failed to cancel task:", err)
-		} else {
-			wasCancelled <- true
+		for range sigs {
+			log.Println("Got interrupt, cancelling the task...")
+			ctx, cancel := context.WithTimeout(context.Background(), cancellationTimeout)
+			err := registry.UpdateTaskRunStatus(ctx, taskRun, cloud_task_registry.TaskRunStatus_Cancelled)
+			cancel()
+			if err != nil {
+				log.Println("Failed to cancel task:", err)
+				continue
+			}
+			cancelWaiting()
+			return
 		}
 	}()
 }
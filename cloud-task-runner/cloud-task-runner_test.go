@@ -8,6 +8,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	cloud_task_registry "github.com/wndrws/cloud-optimization-suite/cloud-task-registry"
 )
 
 func TestPrintResultsToFile_MustRespectUserDefinedObjectivesOrder_MustPutNaNsForAbsentObjectives(t *testing.T) {
@@ -16,7 +17,7 @@ func TestPrintResultsToFile_MustRespectUserDefinedObjectivesOrder_MustPutNaNsFor
 		tmpDir := t.TempDir()
 		testFile := tmpDir + "/test" + strconv.Itoa(i)
 		objectives := []string{"a", "c", "b"}
-		results := map[string]string{"b": "123.7", "c": "456"}
+		results := mustParseResults(t, map[string]string{"b": "123.7", "c": "456"})
 		// when
 		err := printResultsToFile(testFile, objectives, results, "NaN")
 		if err != nil {
@@ -35,8 +36,8 @@ func TestPrintResultsToFile_MustPutSpecifiedValueForAbsentObjectivesIfProvided(t
 	// given
 	tmpDir := t.TempDir()
 	testFile := tmpDir + "/test"
-	objectives := []string{"a", "c", "b"}
-	results := map[string]string{"b": "123.7", "c": "NaN"}
+	objectives := []string{"a", "c", "b", "d"}
+	results := mustParseResults(t, map[string]string{"b": "123.7", "c": "NaN", "d": "failed"})
 	// when
 	err := printResultsToFile(testFile, objectives, results, "-9999")
 	if err != nil {
@@ -47,7 +48,16 @@ func TestPrintResultsToFile_MustPutSpecifiedValueForAbsentObjectivesIfProvided(t
 	if err != nil {
 		t.Errorf("Error reading test file: %v", err)
 	}
-	assert.Equal(t, []string{"-9999 a", "NaN c", "123.7 b"}, actual)
+	assert.Equal(t, []string{"-9999 a", "NaN c", "123.7 b", "-9999 d"}, actual)
+}
+
+func mustParseResults(t *testing.T, values map[string]string) map[string]cloud_task_registry.ResultValue {
+	t.Helper()
+	results, err := cloud_task_registry.ParseResults(values)
+	if err != nil {
+		t.Fatalf("Error parsing results: %v", err)
+	}
+	return results
 }
 
 func readTestFile(filePath string) ([]string, error) {
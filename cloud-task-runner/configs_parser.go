@@ -2,10 +2,13 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"github.com/wndrws/cloud-optimization-suite/cloud-task-registry"
 	"gopkg.in/yaml.v3"
+	"log"
 	"os"
+	"slices"
 	"strings"
 )
 
@@ -14,48 +17,64 @@ type StageYAML struct {
 	Config   string   `yaml:"config"`
 	Executor string   `yaml:"executor"`
 	Next     []string `yaml:"next"`
+	Outputs  []string `yaml:"outputs"` // names of the outputs the stage uploads besides the default one
+	Inputs   []string `yaml:"inputs"`  // named outputs of the previous stages, "stage.name" or just "name"
+	// MaxAttempts limits how many times the stage is run on redeliveries of the task run, no limit by default
+	MaxAttempts int `yaml:"max_attempts"`
 }
 
 func createStages(
+	ctx context.Context,
 	registry *cloud_task_registry.CloudTaskRegistry,
 	taskRun *cloud_task_registry.TaskRun,
 	stagesYamlPath string,
 	s3Bucket string,
 ) ([]cloud_task_registry.Stage, error) {
-	data, err := os.ReadFile(stagesYamlPath)
+	stagesYAML, err := readStagesYAML(stagesYamlPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read file: %w", err)
+		return nil, err
+	}
+	if err = checkNamedInputs(stagesYAML); err != nil {
+		return nil, err
 	}
 
-	var stagesYAML []StageYAML
-	if err = yaml.Unmarshal(data, &stagesYAML); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal YAML: %w", err)
+	for _, stageYAML := range stagesYAML {
+		if stageYAML.MaxAttempts < 0 {
+			return nil, fmt.Errorf("stage %q: max_attempts must not be negative, got %d", stageYAML.Name, stageYAML.MaxAttempts)
+		}
 	}
 
 	stages := make([]cloud_task_registry.Stage, len(stagesYAML))
 	notFoundNextStages := make(map[string]string)
 	for i, stageYAML := range stagesYAML {
 		stageNOrd := i + 1
-		var s3Path = ""
+		var s3Path, digest = "", ""
 		if stageYAML.Config != "" {
 			_, err = os.Stat(stageYAML.Config)
 			if err != nil {
+				deleteUploadedConfigs(ctx, registry, stages[:i])
 				return nil, fmt.Errorf("cannot stat stage %v config file: %v", stageYAML, err)
 			}
-			s3Path, err = registry.UploadFileForStage(stageYAML.Config, s3Bucket, taskRun, stageYAML.Name, stageNOrd)
+			// The same configs are used by many runs, so they are kept once in the blob area
+			s3Path, digest, err = registry.UploadBlob(ctx, stageYAML.Config, s3Bucket)
 			if err != nil {
+				deleteUploadedConfigs(ctx, registry, stages[:i])
 				return nil, fmt.Errorf("error uploading stage config file to S3, %v", err)
 			}
 		}
 		stages[i] = cloud_task_registry.Stage{
-			TaskRunUUID: taskRun.UUID,
-			NOrd:        stageNOrd,
-			Name:        stageYAML.Name,
-			Status:      cloud_task_registry.StageInitialStatus,
-			Config:      s3Path,
-			Executor:    stageYAML.Executor,
-			S3Bucket:    s3Bucket,
-			Next:        stageYAML.Next,
+			TaskRunUUID:  taskRun.UUID,
+			NOrd:         stageNOrd,
+			Name:         stageYAML.Name,
+			Status:       cloud_task_registry.StageInitialStatus,
+			Config:       s3Path,
+			ConfigSHA256: digest,
+			Executor:     stageYAML.Executor,
+			S3Bucket:     s3Bucket,
+			Next:         stageYAML.Next,
+			OutputNames:  stageYAML.Outputs,
+			InputNames:   stageYAML.Inputs,
+			MaxAttempts:  stageYAML.MaxAttempts,
 		}
 		for _, nextStage := range stageYAML.Next {
 			notFoundNextStages[nextStage] = nextStage
@@ -64,12 +83,70 @@ func createStages(
 	}
 
 	if len(notFoundNextStages) > 0 {
+		deleteUploadedConfigs(ctx, registry, stages)
 		return nil, fmt.Errorf("some stage(s) reference next stage(s) that were not found: %v", notFoundNextStages)
 	}
 
 	return stages, nil
 }
 
+// checkNamedInputs checks that every named input of a stage is declared as an output by exactly one of
+// the previous stages (the ones that have it as next), or by the stage the input name is qualified with
+func checkNamedInputs(stagesYAML []StageYAML) error {
+	for _, stageYAML := range stagesYAML {
+		for _, name := range stageYAML.Outputs {
+			if err := cloud_task_registry.CheckOutputName(name); err != nil {
+				return fmt.Errorf("stage %q: %w", stageYAML.Name, err)
+			}
+		}
+	}
+	for _, stageYAML := range stagesYAML {
+		for _, inputName := range stageYAML.Inputs {
+			stageName, outputName := cloud_task_registry.SplitInputName(inputName)
+			var declaredBy []string
+			for _, previous := range stagesYAML {
+				if slices.Contains(previous.Next, stageYAML.Name) && slices.Contains(previous.Outputs, outputName) &&
+					(stageName == "" || previous.Name == stageName) {
+					declaredBy = append(declaredBy, previous.Name)
+				}
+			}
+			switch {
+			case len(declaredBy) == 0:
+				return fmt.Errorf("input %q of stage %q is not declared in outputs of any previous stage",
+					inputName, stageYAML.Name)
+			case len(declaredBy) > 1:
+				return fmt.Errorf("input %q of stage %q is declared in outputs of stages %v, use <stage>.%s",
+					inputName, stageYAML.Name, declaredBy, outputName)
+			}
+		}
+	}
+	return nil
+}
+
+// deleteUploadedConfigs cleans up the config files of a task run that is not going to be created
+func deleteUploadedConfigs(
+	ctx context.Context,
+	registry *cloud_task_registry.CloudTaskRegistry,
+	stages []cloud_task_registry.Stage,
+) {
+	if err := registry.DeleteStageConfigs(ctx, stages); err != nil {
+		log.Printf("Failed to clean up uploaded stage config files: %v", err)
+	}
+}
+
+func readStagesYAML(stagesYamlPath string) ([]StageYAML, error) {
+	data, err := os.ReadFile(stagesYamlPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+
+	var stagesYAML []StageYAML
+	if err = yaml.Unmarshal(data, &stagesYAML); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal YAML: %w", err)
+	}
+	return stagesYAML, nil
+}
+
 func readKeyValueFile(filePath string) (map[string]string, error) {
 	file, err := os.Open(filePath)
 	if err != nil {
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckNamedInputs_MustRequireQualifiedNameForInputDeclaredByManyStages(t *testing.T) {
+	// given
+	stages := func(inputs ...string) []StageYAML {
+		return []StageYAML{
+			{Name: "cfd", Next: []string{"post"}, Outputs: []string{"summary", "log"}},
+			{Name: "mesh", Next: []string{"post"}, Outputs: []string{"log"}},
+			{Name: "post", Inputs: inputs},
+		}
+	}
+	// when
+	errValid := checkNamedInputs(stages("summary", "mesh.log"))
+	errAmbiguous := checkNamedInputs(stages("log"))
+	errUndeclared := checkNamedInputs(stages("mesh.summary"))
+	errInvalidName := checkNamedInputs([]StageYAML{{Name: "cfd", Outputs: []string{"a/b"}}})
+	// then
+	assert.NoError(t, errValid)
+	assert.ErrorContains(t, errAmbiguous, "use <stage>.log")
+	assert.Error(t, errUndeclared)
+	assert.Error(t, errInvalidName)
+}
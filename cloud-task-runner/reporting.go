@@ -3,6 +3,8 @@ package main
 import (
 	"fmt"
 	"github.com/wndrws/cloud-optimization-suite/cloud-task-registry"
+	"maps"
+	"slices"
 	"time"
 )
 
@@ -19,6 +21,8 @@ func printTaskReportWithAllStages(task *cloud_task_registry.TaskRun, stages []cl
 		fmt.Printf("All stages finished successfully!\n")
 	case anyStageHasStatus(stages, cloud_task_registry.StageStatus_Error):
 		fmt.Printf("Error on some stage(s)!\n")
+	case anyStageHasStaleHeartbeat(stages):
+		fmt.Printf("Some stage has status InProgress, but its executor has stopped sending heartbeats! It is presumably dead.\n")
 	case anyStageHasStatus(stages, cloud_task_registry.StageStatus_InProgress):
 		fmt.Printf("Some stage has status InProgress! This is probably an error!\n")
 	case anyStageHasStatus(stages, cloud_task_registry.StageStatus_Pending):
@@ -36,6 +40,9 @@ func printTaskReportWithAllStages(task *cloud_task_registry.TaskRun, stages []cl
 		fmt.Printf("    Config: %s\n", stage.Config)
 		fmt.Printf("    Input: %s\n", stage.Input)
 		fmt.Printf("    Output: %s\n", stage.Output)
+		for _, name := range slices.Sorted(maps.Keys(stage.Outputs)) {
+			fmt.Printf("    Output %s: %s\n", name, stage.Outputs[name])
+		}
 		fmt.Printf("    S3Bucket: %s\n", stage.S3Bucket)
 		fmt.Printf("    Next: %s\n", stage.Next)
 		if stage.TStartUTC != nil {
@@ -44,18 +51,59 @@ func printTaskReportWithAllStages(task *cloud_task_registry.TaskRun, stages []cl
 		if stage.TFinishUTC != nil {
 			fmt.Printf("    Finish Time: %s\n", stage.TFinishUTC.Format(time.DateTime))
 		}
+		if stage.THeartbeatUTC != nil && stage.Status == cloud_task_registry.StageStatus_InProgress {
+			stale := ""
+			if cloud_task_registry.IsStageLeaseExpired(&stage, time.Now()) {
+				stale = fmt.Sprintf(" (STALE, the lease expired at %s)", stage.TLeaseExpiryUTC.Format(time.DateTime))
+			}
+			fmt.Printf("    Last Heartbeat: %s%s\n", stage.THeartbeatUTC.Format(time.DateTime), stale)
+		}
 		if stage.Executor != "" {
 			fmt.Printf("    Executor: %s\n", stage.Executor)
 		}
 		if stage.Comments != "" {
 			fmt.Printf("    Comments: %s\n", stage.Comments)
 		}
+		printStageAttempts(stage)
 		fmt.Println()
 	}
 
 	printStagesTimeSummary(task, stages)
 }
 
+func printStageAttempts(stage cloud_task_registry.Stage) {
+	if len(stage.Attempts) == 0 {
+		return
+	}
+	maxAttempts := "no limit"
+	if stage.MaxAttempts > 0 {
+		maxAttempts = fmt.Sprintf("max %d", stage.MaxAttempts)
+	}
+	fmt.Printf("    Attempts (%s):\n", maxAttempts)
+	for _, attempt := range stage.Attempts {
+		fmt.Printf("      - #%d %s", attempt.N, attempt.Status)
+		if attempt.TStartUTC != nil {
+			fmt.Printf(", started %s", attempt.TStartUTC.Format(time.DateTime))
+		}
+		if attempt.TFinishUTC != nil {
+			fmt.Printf(", finished %s", attempt.TFinishUTC.Format(time.DateTime))
+		}
+		if attempt.Executor != "" {
+			fmt.Printf(" on %s", attempt.Executor)
+		}
+		if attempt.ExitCode != nil {
+			fmt.Printf(", exit code %d", *attempt.ExitCode)
+		}
+		fmt.Println()
+		if attempt.Error != "" {
+			fmt.Printf("        Error: %s\n", attempt.Error)
+		}
+		for _, artifact := range attempt.Artifacts {
+			fmt.Printf("        Artifact: %s\n", artifact)
+		}
+	}
+}
+
 // Function to calculate time spent on each stage and print a summary
 func printStagesTimeSummary(task *cloud_task_registry.TaskRun, stages []cloud_task_registry.Stage) {
 	fmt.Printf("Stages processing times:\n")
@@ -100,6 +148,29 @@ func printStagesTimeSummary(task *cloud_task_registry.TaskRun, stages []cloud_ta
 	}
 }
 
+// printTaskRunTimeline prints the event log of the task run (--print-timeline), one event per line
+func printTaskRunTimeline(events []cloud_task_registry.TaskEvent) {
+	fmt.Printf("Timeline:\n")
+	if len(events) == 0 {
+		fmt.Println("    N/A")
+		return
+	}
+	for _, event := range events {
+		subject := "task run"
+		if event.Stage != "" {
+			subject = "stage " + event.Stage
+		}
+		fmt.Printf("    %s  %-15s  %s", event.TimeUTC.Format("2006-01-02 15:04:05.000"), event.Type, subject)
+		if event.Details != "" {
+			fmt.Printf(": %s", event.Details)
+		}
+		if event.Actor != "" {
+			fmt.Printf(" (by %s)", event.Actor)
+		}
+		fmt.Println()
+	}
+}
+
 func allStagesHaveStatus(stages []cloud_task_registry.Stage, status string) bool {
 	for _, stage := range stages {
 		if stage.Status != status {
@@ -117,3 +188,13 @@ func anyStageHasStatus(stages []cloud_task_registry.Stage, status string) bool {
 	}
 	return false
 }
+
+func anyStageHasStaleHeartbeat(stages []cloud_task_registry.Stage) bool {
+	now := time.Now()
+	for _, stage := range stages {
+		if cloud_task_registry.IsStageLeaseExpired(&stage, now) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	cloud_task_registry "github.com/wndrws/cloud-optimization-suite/cloud-task-registry"
+)
+
+// describeTask builds the task as declared by the runner arguments, the definition is filled in on registration
+func describeTask(
+	taskId string,
+	s3Bucket string,
+	objectives []string,
+	runParameters map[string]string,
+	parameterBounds map[string]cloud_task_registry.ParameterSpec,
+	stagesYAML []StageYAML,
+) cloud_task_registry.Task {
+	parameterNames := make([]string, 0, len(runParameters))
+	for name := range runParameters {
+		parameterNames = append(parameterNames, name)
+	}
+	slices.Sort(parameterNames)
+	parameters := make([]cloud_task_registry.ParameterSpec, len(parameterNames))
+	for i, name := range parameterNames {
+		parameters[i] = cloud_task_registry.ParameterSpec{Name: name}
+		if bounds, ok := parameterBounds[name]; ok {
+			parameters[i].Lower, parameters[i].Upper = bounds.Lower, bounds.Upper
+		}
+	}
+
+	pipeline := make([]cloud_task_registry.PipelineStage, len(stagesYAML))
+	for i, stageYAML := range stagesYAML {
+		pipeline[i] = cloud_task_registry.PipelineStage{
+			Name:     stageYAML.Name,
+			Executor: stageYAML.Executor,
+			Next:     stageYAML.Next,
+		}
+	}
+
+	return cloud_task_registry.Task{
+		ID:         taskId,
+		S3Bucket:   s3Bucket,
+		Objectives: objectives,
+		Parameters: parameters,
+		Pipeline:   pipeline,
+	}
+}
+
+// registerOrVerifyTask registers the task on its first run, uploading the task definition file once.
+// On the next runs it checks that the runner arguments still describe the same task,
+// so that runs of different tasks don't get mixed up under the same task ID.
+func registerOrVerifyTask(
+	ctx context.Context,
+	registry *cloud_task_registry.CloudTaskRegistry,
+	declared cloud_task_registry.Task,
+	taskDefinitionPath string,
+) (*cloud_task_registry.Task, error) {
+	registered, err := registry.GetTask(ctx, declared.ID)
+	if errors.Is(err, cloud_task_registry.ErrNotFound) {
+		declared.Definition, declared.DefinitionSHA256, err =
+			registry.UploadTaskDefinition(ctx, taskDefinitionPath, declared.S3Bucket, declared.ID)
+		if err != nil {
+			return nil, fmt.Errorf("error uploading task definition file to S3, %w", err)
+		}
+		creationTime := time.Now().UTC()
+		declared.CreationTime = &creationTime
+		err = registry.CreateTask(ctx, declared)
+		if err == nil {
+			log.Println("Registered task", declared.ID)
+			return &declared, nil
+		}
+		if !errors.Is(err, cloud_task_registry.ErrConditionFailed) {
+			return nil, fmt.Errorf("failed to register task %s: %w", declared.ID, err)
+		}
+		// Another runner has registered the task in the meantime
+		registered, err = registry.GetTask(ctx, declared.ID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get task %s: %w", declared.ID, err)
+	}
+
+	declared.DefinitionSHA256, err = cloud_task_registry.FileSHA256(taskDefinitionPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read task definition file: %w", err)
+	}
+	if err := verifyTask(registered, declared); err != nil {
+		return nil, fmt.Errorf("task %s is registered with different settings (use another --task-id): %w",
+			declared.ID, err)
+	}
+	log.Println("Verified task", registered.ID, "registered at", registered.CreationTime)
+	return registered, nil
+}
+
+func verifyTask(registered *cloud_task_registry.Task, declared cloud_task_registry.Task) error {
+	var mismatches []string
+	if registered.DefinitionSHA256 != declared.DefinitionSHA256 {
+		mismatches = append(mismatches, fmt.Sprintf("task definition file differs from the registered one %s",
+			registered.Definition))
+	}
+	if !sameElements(registered.Objectives, declared.Objectives) {
+		mismatches = append(mismatches, fmt.Sprintf("objectives are %v instead of %v",
+			declared.Objectives, registered.Objectives))
+	}
+
+	registeredParameters := make(map[string]cloud_task_registry.ParameterSpec)
+	for _, parameter := range registered.Parameters {
+		registeredParameters[parameter.Name] = parameter
+	}
+	declaredNames := make([]string, len(declared.Parameters))
+	registeredNames := make([]string, len(registered.Parameters))
+	for i, parameter := range registered.Parameters {
+		registeredNames[i] = parameter.Name
+	}
+	for i, parameter := range declared.Parameters {
+		declaredNames[i] = parameter.Name
+		// Bounds are checked only when given, so that they don't have to be repeated on every run
+		if parameter.Lower == nil && parameter.Upper == nil {
+			continue
+		}
+		if registeredParameter, ok := registeredParameters[parameter.Name]; ok {
+			if !sameBound(parameter.Lower, registeredParameter.Lower) || !sameBound(parameter.Upper, registeredParameter.Upper) {
+				mismatches = append(mismatches, fmt.Sprintf("bounds of parameter %s are %s instead of %s",
+					parameter.Name, formatBounds(parameter), formatBounds(registeredParameter)))
+			}
+		}
+	}
+	if !sameElements(registeredNames, declaredNames) {
+		mismatches = append(mismatches, fmt.Sprintf("parameters are %v instead of %v", declaredNames, registeredNames))
+	}
+
+	if !samePipeline(registered.Pipeline, declared.Pipeline) {
+		mismatches = append(mismatches, fmt.Sprintf("pipeline is %s instead of %s",
+			formatPipeline(declared.Pipeline), formatPipeline(registered.Pipeline)))
+	}
+
+	if len(mismatches) > 0 {
+		return errors.New(strings.Join(mismatches, "; "))
+	}
+	return nil
+}
+
+// checkParametersWithinBounds checks the run parameters against the bounds of the registered task
+func checkParametersWithinBounds(task *cloud_task_registry.Task, runParameters map[string]string) error {
+	for _, parameter := range task.Parameters {
+		if parameter.Lower == nil && parameter.Upper == nil {
+			continue
+		}
+		value, err := strconv.ParseFloat(runParameters[parameter.Name], 64)
+		if err != nil {
+			return fmt.Errorf("parameter %s=%q is not a number: %w", parameter.Name, runParameters[parameter.Name], err)
+		}
+		if (parameter.Lower != nil && value < *parameter.Lower) || (parameter.Upper != nil && value > *parameter.Upper) {
+			return fmt.Errorf("parameter %s=%v is out of bounds %s", parameter.Name, value, formatBounds(parameter))
+		}
+	}
+	return nil
+}
+
+// parseParameterBounds parses bounds like "x=0:1,y=-5:5", either bound may be omitted, e.g. "z=0:"
+func parseParameterBounds(arg string) (map[string]cloud_task_registry.ParameterSpec, error) {
+	bounds := make(map[string]cloud_task_registry.ParameterSpec)
+	for _, item := range splitAndTrim(arg, ",") {
+		if item == "" {
+			continue
+		}
+		name, interval, found := strings.Cut(item, "=")
+		lowerStr, upperStr, isInterval := strings.Cut(interval, ":")
+		if !found || !isInterval || trim(name) == "" {
+			return nil, fmt.Errorf("invalid parameter bounds %q, expected name=lower:upper", item)
+		}
+		parameter := cloud_task_registry.ParameterSpec{Name: trim(name)}
+		var err error
+		if parameter.Lower, err = parseBound(lowerStr); err != nil {
+			return nil, fmt.Errorf("invalid lower bound in %q: %w", item, err)
+		}
+		if parameter.Upper, err = parseBound(upperStr); err != nil {
+			return nil, fmt.Errorf("invalid upper bound in %q: %w", item, err)
+		}
+		bounds[parameter.Name] = parameter
+	}
+	return bounds, nil
+}
+
+func parseBound(s string) (*float64, error) {
+	if trim(s) == "" {
+		return nil, nil
+	}
+	value, err := strconv.ParseFloat(trim(s), 64)
+	if err != nil {
+		return nil, err
+	}
+	return &value, nil
+}
+
+func sameBound(a, b *float64) bool {
+	return (a == nil && b == nil) || (a != nil && b != nil && *a == *b)
+}
+
+func formatBounds(parameter cloud_task_registry.ParameterSpec) string {
+	format := func(bound *float64) string {
+		if bound == nil {
+			return ""
+		}
+		return strconv.FormatFloat(*bound, 'g', -1, 64)
+	}
+	return fmt.Sprintf("[%s:%s]", format(parameter.Lower), format(parameter.Upper))
+}
+
+func sameElements(a, b []string) bool {
+	a, b = slices.Clone(a), slices.Clone(b)
+	slices.Sort(a)
+	slices.Sort(b)
+	return slices.Equal(a, b)
+}
+
+// samePipeline compares stages and their order, executors are informational and may change between runs
+func samePipeline(a, b []cloud_task_registry.PipelineStage) bool {
+	return slices.EqualFunc(a, b, func(x, y cloud_task_registry.PipelineStage) bool {
+		return x.Name == y.Name && slices.Equal(x.Next, y.Next)
+	})
+}
+
+func formatPipeline(pipeline []cloud_task_registry.PipelineStage) string {
+	stages := make([]string, len(pipeline))
+	for i, stage := range pipeline {
+		stages[i] = fmt.Sprintf("%s->%v", stage.Name, stage.Next)
+	}
+	return strings.Join(stages, ", ")
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	cloud_task_registry "github.com/wndrws/cloud-optimization-suite/cloud-task-registry"
+)
+
+func TestRegisterOrVerifyTask_MustRegisterTaskOnceAndRejectDifferentSettings(t *testing.T) {
+	// given
+	ctx := context.Background()
+	registry := cloud_task_registry.NewInMemory()
+	definitionPath := filepath.Join(t.TempDir(), "optimization.in")
+	require.NoError(t, os.WriteFile(definitionPath, []byte("blade optimization"), 0o644))
+	bounds, err := parseParameterBounds("beta=0:0.5")
+	require.NoError(t, err)
+	stagesYAML := []StageYAML{{Name: "cfd", Next: []string{"cfd-reader"}}, {Name: "cfd-reader"}}
+	parameters := map[string]string{"beta": "0.3", "gamma": "1"}
+	declared := describeTask("task", "bucket", []string{"lift", "drag"}, parameters, bounds, stagesYAML)
+	// when
+	registered, errRegister := registerOrVerifyTask(ctx, registry, declared, definitionPath)
+	verified, errVerify := registerOrVerifyTask(ctx, registry,
+		describeTask("task", "bucket", []string{"drag", "lift"}, parameters, nil, stagesYAML), definitionPath)
+	_, errObjectives := registerOrVerifyTask(ctx, registry,
+		describeTask("task", "bucket", []string{"lift"}, parameters, nil, stagesYAML), definitionPath)
+	require.NoError(t, os.WriteFile(definitionPath, []byte("another optimization"), 0o644))
+	_, errDefinition := registerOrVerifyTask(ctx, registry, declared, definitionPath)
+	// then
+	require.NoError(t, errRegister)
+	require.NoError(t, errVerify)
+	assert.Equal(t, registered.Definition, verified.Definition)
+	assert.NotEmpty(t, registered.Definition)
+	assert.ErrorContains(t, errObjectives, "objectives")
+	assert.ErrorContains(t, errDefinition, "task definition file differs")
+	assert.NoError(t, checkParametersWithinBounds(verified, parameters))
+	assert.Error(t, checkParametersWithinBounds(verified, map[string]string{"beta": "0.7", "gamma": "1"}))
+}
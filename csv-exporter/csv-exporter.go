@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/csv"
 	"flag"
 	"fmt"
@@ -13,30 +14,51 @@ import (
 	reg "github.com/wndrws/cloud-optimization-suite/cloud-task-registry"
 )
 
+// pageSize is the number of task runs read from the registry at a time
+const pageSize = 1000
+
 func main() {
 	var (
 		dynamoEndpoint = flag.String("dynamo-docapi-endpoint", "", "DynamoDB endpoint (Yandex Cloud Document API URL)")
-		taskID         = flag.String("task-id", "", "Filter by TaskID (optional). If empty, export ALL task runs via Scan")
+		registryURL    = flag.String("registry", "", "Task registry backend, e.g. 'sqlite:///path/to/registry.db' (DynamoDB by default)")
+		taskID         = flag.String("task-id", "", "Filter by TaskID (optional). If empty, export ALL task runs")
 		statusesCSV    = flag.String("status", "", "Comma-separated statuses to include (Submitted,Finished,Failed,Cancelled)")
+		since          = flag.String("since", "", "Include task runs created at or after this RFC3339 time (optional)")
+		until          = flag.String("until", "", "Include task runs created before this RFC3339 time (optional)")
 		output         = flag.String("output", "export.csv", "Output CSV path")
+		missingValue   = flag.String("missing-obj-value", "", "Value to put for missing and failed results (empty by default)")
+		resultStatus   = flag.Bool("result-status", false, "Add obj_<name>_status columns telling failed and penalty results from ok ones")
 	)
+	configFlags := reg.RegisterConfigFlags(flag.CommandLine)
 	flag.Parse()
 
-	if *dynamoEndpoint == "" {
-		log.Fatal("--dynamo-endpoint is required (e.g., https://docapi.serverless.yandexcloud.net/...)")
+	cfg, err := configFlags.Load()
+	if err != nil {
+		log.Fatalf("registry config: %v", err)
 	}
-
-	r, err := reg.New(*dynamoEndpoint)
+	opts, err := reg.OptionsFromURL(*registryURL)
+	if err != nil {
+		log.Fatalf("registry init: %v", err)
+	}
+	opts = append(opts, reg.WithConfig(cfg))
+	r, err := reg.New(*dynamoEndpoint, opts...)
 	if err != nil {
 		log.Fatalf("registry init: %v", err)
 	}
 
-	var statuses []reg.TaskRunStatus
+	filter := reg.TaskRunFilter{TaskID: *taskID, Limit: pageSize}
 	for _, s := range split(*statusesCSV) {
-		statuses = append(statuses, reg.TaskRunStatus(s))
+		filter.Statuses = append(filter.Statuses, reg.TaskRunStatus(s))
+	}
+	if filter.CreatedAfter, err = parseTime(*since); err != nil {
+		log.Fatalf("--since: %v", err)
+	}
+	if filter.CreatedBefore, err = parseTime(*until); err != nil {
+		log.Fatalf("--until: %v", err)
 	}
 
-	runs, err := r.ListTaskRuns(*taskID, statuses)
+	// The header needs all parameter and objective names, so all the pages are collected first
+	runs, err := r.ListAllTaskRuns(context.Background(), filter)
 	if err != nil {
 		log.Fatalf("list task runs: %v", err)
 	}
@@ -58,13 +80,29 @@ func main() {
 	pCols := prefixedSorted(paramKeys, "param_")
 	oCols := prefixedSorted(objKeys, "obj_")
 	header := append(append(metaCols, pCols...), oCols...)
+	if *resultStatus {
+		for _, c := range oCols {
+			header = append(header, c+"_status")
+		}
+	}
 
-	if err := writeCSV(*output, header, runs, pCols, oCols); err != nil {
+	if err := writeCSV(*output, header, runs, pCols, oCols, *missingValue, *resultStatus); err != nil {
 		log.Fatalf("write csv: %v", err)
 	}
 	fmt.Printf("Wrote %d rows to %s\n", len(runs), *output)
 }
 
+func parseTime(s string) (*time.Time, error) {
+	if s == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
 func split(s string) []string {
 	var out []string
 	for _, p := range strings.Split(s, ",") {
@@ -85,7 +123,14 @@ func prefixedSorted(m map[string]struct{}, prefix string) []string {
 	return keys
 }
 
-func writeCSV(path string, header []string, runs []reg.TaskRun, pCols, oCols []string) error {
+func writeCSV(
+	path string,
+	header []string,
+	runs []reg.TaskRun,
+	pCols, oCols []string,
+	missingValue string,
+	resultStatus bool,
+) error {
 	f, err := os.Create(path)
 	if err != nil {
 		return err
@@ -124,6 +169,11 @@ func writeCSV(path string, header []string, runs []reg.TaskRun, pCols, oCols []s
 		for range oCols { // fill later
 			row = append(row, "")
 		}
+		if resultStatus {
+			for range oCols { // fill later
+				row = append(row, "")
+			}
+		}
 
 		// Fill parameters
 		for i, key := range pKeys {
@@ -132,7 +182,15 @@ func writeCSV(path string, header []string, runs []reg.TaskRun, pCols, oCols []s
 		// Fill objectives/results
 		base := 4 + len(pCols)
 		for i, key := range oKeys {
-			row[base+i] = tr.Results[key]
+			result, ok := tr.Results[key]
+			if !ok {
+				continue
+			}
+			// Formatted the same way as the runner output file
+			row[base+i] = result.Format(missingValue)
+			if resultStatus {
+				row[base+len(oCols)+i] = string(result.Status)
+			}
 		}
 
 		if err := w.Write(row); err != nil {
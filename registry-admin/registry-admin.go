@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	reg "github.com/wndrws/cloud-optimization-suite/cloud-task-registry"
+)
+
+const usage = `Usage: registry-admin <command> [flags]
+
+Commands:
+  gc             Delete or archive old task runs with their stages and S3 objects
+  delete-run     Delete a task run with its stages, S3 objects and reply queue, and purge its messages from the shared queues
+  delete-task    Delete a task with all its runs
+  gc-blobs       Delete the shared config and task definition files that nothing refers to anymore
+  presign        Print time-limited download URLs of the artifacts of a task run
+
+Run 'registry-admin <command> -h' for the command flags.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	switch os.Args[1] {
+	case "gc":
+		gc(os.Args[2:])
+	case "delete-run":
+		deleteRun(os.Args[2:])
+	case "delete-task":
+		deleteTask(os.Args[2:])
+	case "gc-blobs":
+		gcBlobs(os.Args[2:])
+	case "presign":
+		presign(os.Args[2:])
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+}
+
+// registryFlags are the flags every command needs to connect to the registry
+type registryFlags struct {
+	dynamoEndpoint *string
+	registryURL    *string
+	artifactStore  *string
+	dlqName        *string
+	config         *reg.ConfigFlags
+}
+
+func addRegistryFlags(fs *flag.FlagSet) *registryFlags {
+	return &registryFlags{
+		dynamoEndpoint: fs.String("dynamo-docapi-endpoint", "", "DynamoDB endpoint (Yandex Cloud Document API URL)"),
+		registryURL:    fs.String("registry", "", "Task registry backend, e.g. 'sqlite:///path/to/registry.db' (DynamoDB by default)"),
+		artifactStore:  fs.String("artifact-store", "", "Artifact storage, e.g. 'file:///mnt/shared/artifacts' (S3 by default)"),
+		dlqName:        fs.String("dlq-name", "DLQ", "Name of the Dead Letter Queue purged of the messages of the deleted task runs"),
+		config:         reg.RegisterConfigFlags(fs),
+	}
+}
+
+func (f *registryFlags) connect() *reg.CloudTaskRegistry {
+	cfg, err := f.config.Load()
+	if err != nil {
+		log.Fatalf("registry config: %v", err)
+	}
+	opts, err := reg.OptionsFromURL(*f.registryURL)
+	if err != nil {
+		log.Fatalf("registry init: %v", err)
+	}
+	artifactOpts, err := reg.ArtifactOptionsFromURL(*f.artifactStore)
+	if err != nil {
+		log.Fatalf("artifact store init: %v", err)
+	}
+	opts = append(append(opts, artifactOpts...), reg.WithConfig(cfg), reg.WithDeadLetterQueue(*f.dlqName))
+	r, err := reg.New(*f.dynamoEndpoint, opts...)
+	if err != nil {
+		log.Fatalf("registry init: %v", err)
+	}
+	return r
+}
+
+func gc(args []string) {
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	var (
+		taskID      = fs.String("task-id", "", "Collect runs of this task only (all tasks by default)")
+		statusesCSV = fs.String("status", "", "Comma-separated statuses to collect (Finished,Failed,Cancelled by default)")
+		olderThan   = fs.Duration("older-than", 0, "Collect runs created more than this long ago, e.g. 720h")
+		keepBest    = fs.Int("keep-best", 0, "Keep this many best runs of each task among the collected ones")
+		objective   = fs.String("objective", "", "Objective to rank runs by for --keep-best (the first objective of the task by default)")
+		maximize    = fs.Bool("maximize", false, "Rank runs by the greatest objective value for --keep-best (the least by default)")
+		archive     = fs.Bool("archive", false, "Keep a record of each run, its stages and results in cold storage before deleting it")
+		dryRun      = fs.Bool("dry-run", false, "Only report what would be deleted")
+	)
+	registryFlags := addRegistryFlags(fs)
+	_ = fs.Parse(args)
+
+	if *taskID == "" && *olderThan == 0 && *keepBest == 0 {
+		log.Fatal("refusing to collect all task runs, set --task-id, --older-than or --keep-best")
+	}
+	policy := reg.RetentionPolicy{
+		TaskID:    strings.TrimSpace(*taskID),
+		KeepBest:  *keepBest,
+		Objective: *objective,
+		Maximize:  *maximize,
+		Archive:   *archive,
+		DryRun:    *dryRun,
+	}
+	for _, s := range split(*statusesCSV) {
+		status := reg.TaskRunStatus(s)
+		if !slices.Contains(reg.TaskRunStatuses, status) {
+			log.Fatalf("unknown task run status %q in --status, expected one of %v", s, reg.TaskRunStatuses)
+		}
+		policy.Statuses = append(policy.Statuses, status)
+	}
+	if *olderThan > 0 {
+		createdBefore := time.Now().UTC().Add(-*olderThan)
+		policy.CreatedBefore = &createdBefore
+	}
+
+	r := registryFlags.connect()
+	report, err := r.CollectGarbage(context.Background(), policy)
+	if report != nil {
+		printReport(report, *dryRun)
+	}
+	if err != nil {
+		log.Fatalf("gc: %v", err)
+	}
+}
+
+func deleteRun(args []string) {
+	fs := flag.NewFlagSet("delete-run", flag.ExitOnError)
+	runUUID := fs.String("run-uuid", "", "UUID of the task run to delete")
+	yes := fs.Bool("yes", false, "Don't ask for confirmation")
+	registryFlags := addRegistryFlags(fs)
+	_ = fs.Parse(args)
+	if *runUUID == "" {
+		log.Fatal("--run-uuid is required")
+	}
+
+	r := registryFlags.connect()
+	confirmAndDelete(*yes, func(dryRun bool) (*reg.DeletionReport, error) {
+		return r.DeleteTaskRun(context.Background(), strings.TrimSpace(*runUUID), dryRun)
+	})
+}
+
+func deleteTask(args []string) {
+	fs := flag.NewFlagSet("delete-task", flag.ExitOnError)
+	taskID := fs.String("task-id", "", "ID of the task to delete with all its runs")
+	yes := fs.Bool("yes", false, "Don't ask for confirmation")
+	registryFlags := addRegistryFlags(fs)
+	_ = fs.Parse(args)
+	if *taskID == "" {
+		log.Fatal("--task-id is required")
+	}
+
+	r := registryFlags.connect()
+	confirmAndDelete(*yes, func(dryRun bool) (*reg.DeletionReport, error) {
+		return r.DeleteTask(context.Background(), strings.TrimSpace(*taskID), dryRun)
+	})
+}
+
+func gcBlobs(args []string) {
+	fs := flag.NewFlagSet("gc-blobs", flag.ExitOnError)
+	minAge := fs.Duration("min-age", 7*24*time.Hour,
+		fmt.Sprintf("Collect blobs uploaded more than this long ago, at least %v", reg.MinBlobAge))
+	dryRun := fs.Bool("dry-run", false, "Only report what would be deleted")
+	registryFlags := addRegistryFlags(fs)
+	_ = fs.Parse(args)
+
+	r := registryFlags.connect()
+	report, err := r.CollectBlobs(context.Background(), *minAge, *dryRun)
+	if report != nil {
+		verb := "Deleted"
+		if *dryRun {
+			verb = "Would delete"
+		}
+		fmt.Printf("%s %d unreferenced blobs, %s freed\n", verb, report.Objects, formatBytes(report.Bytes))
+	}
+	if err != nil {
+		log.Fatalf("gc-blobs: %v", err)
+	}
+}
+
+func presign(args []string) {
+	fs := flag.NewFlagSet("presign", flag.ExitOnError)
+	runUUID := fs.String("run-uuid", "", "UUID of the task run")
+	expiresIn := fs.Duration("expires-in", 24*time.Hour,
+		fmt.Sprintf("How long the URLs are valid, at most %v", reg.MaxPresignExpiry))
+	manifestPath := fs.String("manifest", "", "Also write the URLs to this JSON manifest file")
+	registryFlags := addRegistryFlags(fs)
+	_ = fs.Parse(args)
+	if *runUUID == "" {
+		log.Fatal("--run-uuid is required")
+	}
+
+	r := registryFlags.connect()
+	manifest, err := r.PresignTaskRunArtifacts(context.Background(), strings.TrimSpace(*runUUID), *expiresIn)
+	if err != nil {
+		log.Fatalf("presign: %v", err)
+	}
+	for _, artifact := range manifest.Artifacts {
+		fmt.Printf("%s\t%s\t%s\t%s\n", artifact.Kind, artifact.Stage, artifact.Key, artifact.URL)
+	}
+	fmt.Printf("%d URLs valid until %s\n", len(manifest.Artifacts), manifest.Expires.Format(time.RFC3339))
+	if *manifestPath != "" {
+		data, err := json.MarshalIndent(manifest, "", "  ")
+		if err != nil {
+			log.Fatalf("presign: %v", err)
+		}
+		// Anyone with the URLs can download the artifacts
+		if err := os.WriteFile(*manifestPath, data, 0o600); err != nil {
+			log.Fatalf("presign: %v", err)
+		}
+		fmt.Println("Manifest written to", *manifestPath)
+	}
+}
+
+// confirmAndDelete prints what would be deleted and asks for confirmation before deleting it
+func confirmAndDelete(yes bool, del func(dryRun bool) (*reg.DeletionReport, error)) {
+	summary, err := del(true)
+	if err != nil {
+		log.Fatalf("delete: %v", err)
+	}
+	printReport(summary, true)
+	if !yes && !confirm("Delete? [y/N] ") {
+		fmt.Println("Nothing deleted")
+		return
+	}
+
+	report, err := del(false)
+	if report != nil {
+		printReport(report, false)
+	}
+	if err != nil {
+		log.Fatalf("delete: %v", err)
+	}
+}
+
+func confirm(prompt string) bool {
+	fmt.Print(prompt)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+func printReport(report *reg.DeletionReport, dryRun bool) {
+	verb := "Deleted"
+	if dryRun {
+		verb = "Would delete"
+	}
+	for _, collected := range report.TaskRuns {
+		tr := collected.TaskRun
+		line := fmt.Sprintf("%s\t%s\t%s\t%s\t%d stages\t%d objects\t%s",
+			tr.TaskID, tr.UUID, tr.Status, timePtr(tr.CreationTime), collected.Stages, collected.Objects,
+			formatBytes(collected.Bytes))
+		if collected.Archive != "" {
+			line += "\tarchive " + collected.Archive
+		}
+		fmt.Println(line)
+	}
+	summary := fmt.Sprintf("%s %d task runs, %d S3 objects, %s freed",
+		verb, len(report.TaskRuns), report.Objects, formatBytes(report.Bytes))
+	if report.Kept > 0 {
+		summary += fmt.Sprintf("; kept %d best runs", report.Kept)
+	}
+	fmt.Println(summary)
+	if len(report.Queues) > 0 && dryRun {
+		fmt.Printf("Would purge pending messages of the task runs from queues: %s\n", strings.Join(report.Queues, ", "))
+	} else if len(report.Queues) > 0 {
+		fmt.Printf("Purged %d pending messages of the task runs from queues: %s\n",
+			report.Messages, strings.Join(report.Queues, ", "))
+	}
+	if len(report.ReplyQueues) > 0 {
+		fmt.Printf("%s reply queues: %s\n", verb, strings.Join(report.ReplyQueues, ", "))
+	}
+	if len(report.StaleQueues) > 0 {
+		fmt.Printf("%s stale reply queues of other runs: %s\n", verb, strings.Join(report.StaleQueues, ", "))
+	}
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func split(s string) []string {
+	var out []string
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+func timePtr(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}